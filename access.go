@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessFile is the per-directory rules file. It applies to its directory
+// and everything below that has no rules file of its own, and is never
+// listed or served.
+const accessFile = ".access"
+
+// accessRecheck is how long a directory's rules are trusted before the file
+// is stat'ed again; a listing asks for every subdirectory.
+const accessRecheck = 2 * time.Second
+
+// accessRules is one parsed .access file. Names are token names, user
+// names and certificate CNs; "*" is anyone, including clients of an open
+// server, and "@admin" anyone allowed to write. broken rules let nobody in.
+type accessRules struct {
+	allow  []string
+	deny   []string
+	hide   bool
+	broken bool
+}
+
+type accessEntry struct {
+	rules   *accessRules
+	mod     time.Time
+	size    int64
+	checked time.Time
+}
+
+var accessCache = struct {
+	sync.Mutex
+	m map[string]*accessEntry
+}{m: map[string]*accessEntry{}}
+
+// parseAccess reads allow: and deny: lines of names separated by commas,
+// spaces or "|", and hide: true or false. # starts a comment.
+func parseAccess(b []byte) (*accessRules, error) {
+	rules := &accessRules{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: want key: value", n)
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		names := strings.FieldsFunc(value, func(c rune) bool { return c == ',' || c == '|' || c == ' ' || c == '\t' })
+		switch key {
+		case "allow", "deny":
+			if len(names) == 0 {
+				return nil, fmt.Errorf("line %d: %s: needs at least one name", n, key)
+			}
+			if key == "allow" {
+				rules.allow = append(rules.allow, names...)
+			} else {
+				rules.deny = append(rules.deny, names...)
+			}
+		case "hide":
+			switch strings.ToLower(value) {
+			case "true", "yes":
+				rules.hide = true
+			case "false", "no":
+				rules.hide = false
+			default:
+				return nil, fmt.Errorf("line %d: hide: want true or false", n)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown key %q: want allow, deny or hide", n, key)
+		}
+	}
+	return rules, sc.Err()
+}
+
+// dirRules returns the rules in dir's .access file, nil when it has none.
+// A file that cannot be read or parsed is logged once per version and
+// denies everyone until it is fixed.
+func dirRules(dir string, now time.Time) *accessRules {
+	accessCache.Lock()
+	e := accessCache.m[dir]
+	accessCache.Unlock()
+	if e != nil && now.Sub(e.checked) < accessRecheck {
+		return e.rules
+	}
+	p := filepath.Join(dir, accessFile)
+	ne := &accessEntry{checked: now}
+	fi, err := os.Stat(p)
+	if err == nil {
+		ne.mod, ne.size = fi.ModTime(), fi.Size()
+	}
+	switch {
+	case os.IsNotExist(err):
+	case e != nil && e.rules != nil && e.mod.Equal(ne.mod) && e.size == ne.size:
+		ne.rules = e.rules
+	default:
+		if err == nil && !fi.Mode().IsRegular() {
+			err = fmt.Errorf("not a regular file")
+		}
+		var b []byte
+		if err == nil {
+			b, err = os.ReadFile(p)
+		}
+		if err == nil {
+			ne.rules, err = parseAccess(b)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "warning: %s: %v; denying access\n", p, err)
+			ne.rules = &accessRules{broken: true}
+		}
+	}
+	accessCache.Lock()
+	accessCache.m[dir] = ne
+	accessCache.Unlock()
+	return ne.rules
+}
+
+// rulesFor finds the rules that govern the root-relative path rel: those of
+// rel itself when it is a directory, else of the nearest directory above it
+// that has a .access file.
+func rulesFor(rel string, isDir bool) *accessRules {
+	now := time.Now()
+	d := strings.Trim(rel, "/")
+	if !isDir {
+		d = path.Dir(d)
+	}
+	for {
+		if d == "." {
+			d = ""
+		}
+		if rules := dirRules(filepath.Join(root, filepath.FromSlash(d)), now); rules != nil {
+			return rules
+		}
+		if d == "" {
+			return nil
+		}
+		d = path.Dir(d)
+	}
+}
+
+func (a *accessRules) admits(info *authInfo) bool {
+	if a.broken {
+		return false
+	}
+	match := func(names []string) bool {
+		for _, n := range names {
+			switch {
+			case n == "*":
+				return true
+			case info == nil:
+			case n == "@admin" && info.write, info.name != "" && n == info.name:
+				return true
+			}
+		}
+		return false
+	}
+	if match(a.deny) {
+		return false
+	}
+	return a.allow == nil || match(a.allow)
+}
+
+// accessFor reports whether r may reach rel, and when it may not whether
+// rel is to be hidden from it rather than refused. A nil r is the server
+// itself and may reach everything. A path that leads through a symlink
+// must also be reachable where the link points, or a link would open a
+// directory its own rules keep closed.
+func accessFor(r *http.Request, rel string, isDir bool) (ok, hidden bool) {
+	if r == nil {
+		return true, false
+	}
+	info, _ := r.Context().Value(authInfoKey{}).(*authInfo)
+	ok, hidden = admitted(info, rel, isDir)
+	if ok {
+		if real := realRel(rel); real != "" {
+			ok, hidden = admitted(info, real, isDir)
+		}
+	}
+	return ok, hidden
+}
+
+func admitted(info *authInfo, rel string, isDir bool) (ok, hidden bool) {
+	rules := rulesFor(rel, isDir)
+	if rules == nil || rules.admits(info) {
+		return true, false
+	}
+	return false, rules.hide || rules.broken
+}
+
+// accessible reports whether r may reach rel at all; walks and indexes
+// leave out what it may not.
+func accessible(r *http.Request, rel string, isDir bool) bool {
+	ok, _ := accessFor(r, rel, isDir)
+	return ok
+}
+
+// resolveFor is resolvePath for what r asks for, with the .access rules
+// applied, also to where a symlink on the way points: a hidden path does
+// not exist for a client that does not match, any other it does not match
+// is forbidden.
+func resolveFor(r *http.Request, upath string) (string, error) {
+	full, err := resolvePath(upath)
+	if err != nil || r == nil {
+		return full, err
+	}
+	fi, err := os.Stat(full)
+	ok, hidden := accessFor(r, relPath(full), err == nil && fi.IsDir())
+	switch {
+	case hidden:
+		return "", os.ErrNotExist
+	case !ok:
+		return "", errForbidden
+	}
+	return full, nil
+}
+
+// visibleTo filters library items down to those r may reach.
+func visibleTo(r *http.Request, items []libraryItem) []libraryItem {
+	out := make([]libraryItem, 0, len(items))
+	for _, it := range items {
+		if accessible(r, it.Path, false) {
+			out = append(out, it)
+		}
+	}
+	return out
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var (
+	alice = &authInfo{who: "alice", name: "alice"}
+	bob   = &authInfo{who: "bob", name: "bob"}
+	admin = &authInfo{who: "admin", name: "admin", write: true}
+)
+
+// serveAs is serve for a client that authenticated as info; nil is a
+// client of an open server.
+func serveAs(h http.HandlerFunc, info *authInfo, method, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if info != nil {
+		r = r.WithContext(context.WithValue(r.Context(), authInfoKey{}, info))
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func who(info *authInfo) string {
+	if info == nil {
+		return "anonymous"
+	}
+	return info.who
+}
+
+// setupAccess builds a share with a closed directory, a subdirectory that
+// opens up again, a hidden one, a deny list and a broken rules file.
+func setupAccess(t *testing.T) string {
+	t.Helper()
+	return setupRoot(t, map[string]string{
+		"Public/a.mkv":            "a",
+		"Private/.access":         "# alice only\nallow: alice\n",
+		"Private/secret.mkv":      "secret",
+		"Private/Deep/inner.mkv":  "inner",
+		"Private/Shared/.access":  "allow: *\n",
+		"Private/Shared/open.mkv": "open",
+		"Hidden/.access":          "allow: @admin\nhide: true\n",
+		"Hidden/h.mkv":            "hidden",
+		"Denied/.access":          "deny: bob\n",
+		"Denied/d.mkv":            "denied",
+		"Broken/.access":          "allow alice\n",
+		"Broken/b.mkv":            "broken",
+	})
+}
+
+func TestParseAccess(t *testing.T) {
+	rules, err := parseAccess([]byte("# comment\nALLOW: alice, bob|carol\n\ndeny: *  # nobody\nhide: yes\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rules.allow, []string{"alice", "bob", "carol"}) || !slices.Equal(rules.deny, []string{"*"}) || !rules.hide {
+		t.Errorf("parsed %+v", rules)
+	}
+	for _, bad := range []string{"allow alice", "allow:", "hide: maybe", "owner: alice"} {
+		if _, err := parseAccess([]byte(bad)); err == nil {
+			t.Errorf("parseAccess(%q) accepted", bad)
+		}
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	setupAccess(t)
+	tests := []struct {
+		path string
+		want map[*authInfo]int
+	}{
+		{"/Public/a.mkv", map[*authInfo]int{nil: 200, alice: 200, bob: 200, admin: 200}},
+		{"/Private/secret.mkv", map[*authInfo]int{nil: 403, alice: 200, bob: 403, admin: 403}},
+		{"/Private/", map[*authInfo]int{nil: 403, alice: 200, bob: 403}},
+		// Without a rules file of its own a directory inherits its parent's.
+		{"/Private/Deep/inner.mkv", map[*authInfo]int{nil: 403, alice: 200, bob: 403}},
+		// One of its own replaces them, even under a closed parent.
+		{"/Private/Shared/open.mkv", map[*authInfo]int{nil: 200, alice: 200, bob: 200}},
+		{"/Hidden/h.mkv", map[*authInfo]int{nil: 404, alice: 404, bob: 404, admin: 200}},
+		{"/Hidden/", map[*authInfo]int{nil: 404, alice: 404, admin: 200}},
+		{"/Denied/d.mkv", map[*authInfo]int{nil: 200, alice: 200, bob: 403, admin: 200}},
+		{"/Broken/b.mkv", map[*authInfo]int{nil: 404, alice: 404, admin: 404}},
+		{"/Private/.access", map[*authInfo]int{nil: 404, alice: 404, admin: 404}},
+	}
+	for _, tt := range tests {
+		for info, want := range tt.want {
+			if w := serveAs(indexHandler, info, http.MethodGet, tt.path); w.Code != want {
+				t.Errorf("GET %s as %s = %d, want %d", tt.path, who(info), w.Code, want)
+			}
+		}
+	}
+}
+
+func TestAccessListings(t *testing.T) {
+	setupAccess(t)
+	for info, want := range map[*authInfo][]string{
+		nil:   {"Denied", "Private", "Public"},
+		alice: {"Denied", "Private", "Public"},
+		admin: {"Denied", "Hidden", "Private", "Public"},
+	} {
+		w := serveAs(indexHandler, info, http.MethodGet, "/?format=json")
+		var lst dirListing
+		if err := json.Unmarshal([]byte(body(t, w)), &lst); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range lst.Entries {
+			got = append(got, e.Name)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("/ as %s lists %q, want %q", who(info), got, want)
+		}
+	}
+}
+
+// indexPaths runs a search or library request as info and returns the
+// paths it lists.
+func indexPaths(t *testing.T, h http.HandlerFunc, info *authInfo, target string) []string {
+	t.Helper()
+	w := serveAs(h, info, http.MethodGet, target)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d", target, w.Code)
+	}
+	var res struct {
+		Results []struct{ Path string }
+		Items   []struct{ Path string }
+	}
+	if err := json.Unmarshal([]byte(body(t, w)), &res); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, r := range append(res.Results, res.Items...) {
+		paths = append(paths, r.Path)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func TestAccessIndexes(t *testing.T) {
+	setupAccess(t)
+	tests := []struct {
+		info *authInfo
+		want []string
+	}{
+		{nil, []string{"Denied/d.mkv", "Private/Shared/open.mkv", "Public/a.mkv"}},
+		{alice, []string{"Denied/d.mkv", "Private/Deep/inner.mkv", "Private/Shared/open.mkv", "Private/secret.mkv", "Public/a.mkv"}},
+		{bob, []string{"Private/Shared/open.mkv", "Public/a.mkv"}},
+		{admin, []string{"Denied/d.mkv", "Hidden/h.mkv", "Private/Shared/open.mkv", "Public/a.mkv"}},
+	}
+	for _, tt := range tests {
+		if got := indexPaths(t, searchHandler, tt.info, "/api/search?q=mkv"); !slices.Equal(got, tt.want) {
+			t.Errorf("/api/search as %s finds %q, want %q", who(tt.info), got, tt.want)
+		}
+		if got := indexPaths(t, libraryHandler, tt.info, "/api/library"); !slices.Equal(got, tt.want) {
+			t.Errorf("/api/library as %s lists %q, want %q", who(tt.info), got, tt.want)
+		}
+	}
+}
+
+func TestAccessThroughSymlinks(t *testing.T) {
+	dir := setupAccess(t)
+	if err := os.MkdirAll(filepath.Join(dir, "Drafts"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Drafts", "draft.mkv"), []byte("draft"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"Public/deep":       "../Private/Deep",
+		"Public/secret.mkv": "../Private/secret.mkv",
+		"Public/h.mkv":      "../Hidden/h.mkv",
+		"Public/drafts":     "../Drafts",
+		"Public/draft.mkv":  "../Drafts/draft.mkv",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludes = stringList{"Drafts"}
+
+	tests := []struct {
+		path string
+		want map[*authInfo]int
+	}{
+		{"/Public/deep/inner.mkv", map[*authInfo]int{nil: 403, alice: 200, bob: 403}},
+		{"/Public/deep/", map[*authInfo]int{nil: 403, alice: 200}},
+		{"/Public/secret.mkv", map[*authInfo]int{nil: 403, alice: 200, bob: 403}},
+		{"/Public/h.mkv", map[*authInfo]int{nil: 404, alice: 404, admin: 200}},
+		{"/Public/drafts/draft.mkv", map[*authInfo]int{nil: 404, admin: 404}},
+		{"/Public/draft.mkv", map[*authInfo]int{nil: 404, admin: 404}},
+	}
+	for _, tt := range tests {
+		for info, want := range tt.want {
+			if w := serveAs(indexHandler, info, http.MethodGet, tt.path); w.Code != want {
+				t.Errorf("GET %s as %s = %d, want %d", tt.path, who(info), w.Code, want)
+			}
+		}
+	}
+
+	for info, want := range map[*authInfo][]string{
+		nil:   {"deep", "a.mkv", "secret.mkv"},
+		admin: {"deep", "a.mkv", "h.mkv", "secret.mkv"},
+	} {
+		var lst dirListing
+		if err := json.Unmarshal([]byte(body(t, serveAs(indexHandler, info, http.MethodGet, "/Public/?format=json"))), &lst); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range lst.Entries {
+			got = append(got, e.Name)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("/Public/ as %s lists %q, want %q", who(info), got, want)
+		}
+	}
+
+	if code, got := archiveNames(t, "Public"); code != http.StatusOK || !slices.Equal(got, []string{"Public/a.mkv"}) {
+		t.Errorf("anonymous archive of Public = %d %q, want only Public/a.mkv", code, got)
+	}
+
+	got := indexPaths(t, searchHandler, nil, "/api/search?q=mkv")
+	for _, p := range got {
+		if strings.HasPrefix(p, "Public/") && p != "Public/a.mkv" {
+			t.Errorf("anonymous search finds %s through a link", p)
+		}
+	}
+	got = indexPaths(t, libraryHandler, alice, "/api/library")
+	for _, p := range []string{"Public/deep/inner.mkv", "Public/secret.mkv"} {
+		if !slices.Contains(got, p) {
+			t.Errorf("alice's library is missing %s", p)
+		}
+	}
+	if slices.Contains(got, "Public/h.mkv") || slices.Contains(got, "Public/draft.mkv") || slices.Contains(got, "Public/drafts/draft.mkv") {
+		t.Errorf("alice's library has hidden or excluded files through links: %q", got)
+	}
+}
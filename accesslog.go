@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogFormat is -log-format, clf or json; accessLogPath sends the log
+// to a file instead of stdout and quietLog turns it off.
+var accessLogFormat string
+var accessLogPath string
+var quietLog bool
+
+var accessLog = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stdout}
+
+// redactedParams are query parameters that carry credentials.
+var redactedParams = map[string]bool{"token": true, "access_token": true, "password": true}
+
+type logRecordKey struct{}
+
+// logRecord is filled in further down the chain with what only the inner
+// handlers know.
+type logRecord struct {
+	user string
+}
+
+func checkAccessLog() error {
+	if accessLogFormat != "clf" && accessLogFormat != "json" {
+		return fmt.Errorf("-log-format must be clf or json")
+	}
+	if accessLogPath == "" {
+		return nil
+	}
+	if quietLog {
+		return fmt.Errorf("-quiet turns the access log off; drop it or -access-log")
+	}
+	f, err := os.OpenFile(accessLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("-access-log: %v", err)
+	}
+	accessLog.w = f
+	return nil
+}
+
+// redactQuery replaces the values of credential parameters in a raw query,
+// leaving the rest as the client sent it.
+func redactQuery(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	parts := strings.Split(raw, "&")
+	for i, p := range parts {
+		k, _, _ := strings.Cut(p, "=")
+		if name, err := url.QueryUnescape(k); err == nil && redactedParams[strings.ToLower(name)] {
+			parts[i] = k + "=REDACTED"
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// redactURI is redactQuery for a request URI or Referer.
+func redactURI(uri string) string {
+	if p, q, ok := strings.Cut(uri, "?"); ok {
+		return p + "?" + redactQuery(q)
+	}
+	return uri
+}
+
+type accessLine struct {
+	Time      string  `json:"time"`
+	IP        string  `json:"ip"`
+	User      string  `json:"user,omitempty"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Proto     string  `json:"proto"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration_ms"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+}
+
+// format writes l as Combined Log Format with the duration in seconds
+// appended, as nginx's $request_time, or as one JSON object.
+func (l accessLine) format(t time.Time) []byte {
+	if accessLogFormat == "json" {
+		l.Time = t.Format(time.RFC3339Nano)
+		b, _ := json.Marshal(l)
+		return append(b, '\n')
+	}
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	user := strings.ReplaceAll(dash(l.User), " ", "_")
+	return fmt.Appendf(nil, "%s - %s [%s] %s %d %d %s %s %.3f\n",
+		l.IP, user, t.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(l.Method+" "+l.Path+" "+l.Proto), l.Status, l.Bytes,
+		strconv.Quote(dash(l.Referer)), strconv.Quote(dash(l.UserAgent)), l.Duration/1000)
+}
+
+// withAccessLog writes one line for every request once it is answered.
+// The URI is taken before anything below can rewrite it, with tokens
+// blanked out.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		uri := redactURI(r.RequestURI)
+		rec := &logRecord{}
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), logRecordKey{}, rec)))
+		status := cw.status
+		switch {
+		case status == 0 && r.Header.Get("Upgrade") != "":
+			status = http.StatusSwitchingProtocols
+		case status == 0:
+			status = http.StatusOK
+		}
+		line := accessLine{
+			IP:        clientIP(r).String(),
+			User:      rec.user,
+			Method:    r.Method,
+			Path:      uri,
+			Proto:     r.Proto,
+			Status:    status,
+			Bytes:     cw.n,
+			Duration:  float64(time.Since(start).Microseconds()) / 1000,
+			Referer:   redactURI(r.Referer()),
+			UserAgent: r.UserAgent(),
+		}
+		b := line.format(start)
+		accessLog.Lock()
+		accessLog.w.Write(b)
+		accessLog.Unlock()
+	})
+}
+
+// logUser records who r was let in as for the access log.
+func logUser(r *http.Request, name string) {
+	if rec, _ := r.Context().Value(logRecordKey{}).(*logRecord); rec != nil {
+		rec.user = name
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeDomains switch on certificates from Let's Encrypt for those names.
+// acmeCache is where they are kept, acmeEmail the contact for expiry
+// notices and acmeHTTP an optional plain-HTTP address for HTTP-01
+// challenges and a redirect to HTTPS.
+var acmeDomains stringList
+var acmeCache, acmeEmail, acmeHTTP string
+
+// acmeBackoff is how long a failed certificate order keeps the server from
+// placing another one. Let's Encrypt allows five failed validations per
+// name an hour, and a server restarted in a loop would use them up.
+const acmeBackoff = time.Hour
+
+// acmeFailedKey is the cache entry recording the last failed order.
+const acmeFailedKey = "fileserver-acme-failed"
+
+func acmeEnabled() bool {
+	return len(acmeDomains) > 0
+}
+
+func acmeCacheDir() string {
+	if acmeCache != "" || stateFile == "" {
+		return acmeCache
+	}
+	return filepath.Join(filepath.Dir(stateFile), "fileserver-acme")
+}
+
+// checkACME splits comma-separated -acme-domain values and rejects the
+// flags ACME replaces.
+func checkACME() error {
+	var domains stringList
+	for _, v := range acmeDomains {
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+				domains = append(domains, d)
+			}
+		}
+	}
+	acmeDomains = domains
+	if !acmeEnabled() {
+		if acmeCache != "" || acmeEmail != "" || acmeHTTP != "" {
+			return fmt.Errorf("-acme-cache, -acme-email and -acme-http need -acme-domain")
+		}
+		return nil
+	}
+	for _, d := range acmeDomains {
+		if net.ParseIP(d) != nil || !strings.Contains(d, ".") {
+			return fmt.Errorf("bad -acme-domain %q: Let's Encrypt only issues certificates for public domain names", d)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		return fmt.Errorf("-acme-domain and -cert/-key exclude each other: ACME obtains the certificate itself")
+	}
+	if tlsSelfSigned {
+		return fmt.Errorf("-acme-domain and -tls-self-signed exclude each other")
+	}
+	if httpRedirect != "" {
+		return fmt.Errorf("use -acme-http instead of -http-redirect with -acme-domain: it also answers HTTP-01 challenges")
+	}
+	if acmeCacheDir() == "" {
+		return fmt.Errorf("-acme-domain needs -acme-cache (or -state): without a cache every start orders a new certificate")
+	}
+	return nil
+}
+
+// acmeManager obtains and renews certificates on demand, keeping them in
+// the cache directory so a restart reuses them instead of asking the CA.
+func acmeManager() *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(acmeDomains...),
+		Cache:      autocert.DirCache(acmeCacheDir()),
+		Email:      acmeEmail,
+	}
+}
+
+// startACME hands cfg's certificates over to m. A name without a cached
+// certificate is not ordered again within acmeBackoff of a failed order,
+// which is remembered in the cache and so across restarts.
+func startACME(cfg *tls.Config, m *autocert.Manager) {
+	fmt.Printf("ACME certificates for %s, cached in %s\n", strings.Join(acmeDomains, ", "), acmeCacheDir())
+	cfg.NextProtos = append(cfg.NextProtos, "h2", "http/1.1", acme.ALPNProto)
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+		challenge := len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+		if challenge || m.HostPolicy(hello.Context(), name) != nil {
+			return m.GetCertificate(hello)
+		}
+		ctx := hello.Context()
+		_, err := m.Cache.Get(ctx, name)
+		cached := err == nil
+		if !cached {
+			if b, err := m.Cache.Get(ctx, acmeFailedKey); err == nil {
+				if t, err := time.Parse(time.RFC3339, string(b)); err == nil && time.Since(t) < acmeBackoff {
+					return nil, fmt.Errorf("acme: not ordering a certificate for %s until %s after a failed attempt", name, t.Add(acmeBackoff).Format(time.TimeOnly))
+				}
+			}
+		}
+		c, err := m.GetCertificate(hello)
+		if err != nil && !cached && !errors.Is(err, context.Canceled) {
+			m.Cache.Put(context.Background(), acmeFailedKey, []byte(time.Now().Format(time.RFC3339)))
+		}
+		return c, err
+	}
+	if cfg.ClientAuth != tls.NoClientCert {
+		// The CA validating a TLS-ALPN-01 challenge has no client
+		// certificate to offer.
+		challengeCfg := cfg.Clone()
+		challengeCfg.ClientAuth = tls.NoClientCert
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+				return challengeCfg, nil
+			}
+			return nil, nil
+		}
+	}
+}
+
+// startACMEHTTP serves HTTP-01 challenges on acmeHTTP and redirects
+// everything else to HTTPS.
+func startACMEHTTP(m *autocert.Manager) {
+	if acmeHTTP == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", acmeHTTP)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "acme-http:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Answering ACME HTTP-01 challenges and redirecting to https on http://%s\n", ln.Addr())
+	go newServer(m.HTTPHandler(nil)).Serve(ln)
+}
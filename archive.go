@@ -0,0 +1,366 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// byteCounter counts what goes through it to the client.
+type byteCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// archiveWriter is one archive format being streamed to the client.
+type archiveWriter interface {
+	dir(name string, mod time.Time) error
+	// file copies exactly fi.Size() bytes of f, so the archive stays valid
+	// when the file changes while it is read.
+	file(name string, f *os.File, fi os.FileInfo) error
+	Close() error
+}
+
+// copyEntry copies size bytes of f to w, padding with zeros if the file got
+// shorter since it was stat'ed.
+func copyEntry(w io.Writer, f *os.File, name string, size int64) error {
+	bp := getBuf()
+	defer putBuf(bp)
+	n, err := io.CopyBuffer(w, io.LimitReader(struct{ io.Reader }{f}, size), *bp)
+	if err != nil {
+		if _, ok := err.(*fs.PathError); !ok {
+			return err
+		}
+	}
+	if n < size {
+		fmt.Fprintf(os.Stdout, "warning: %s changed while being archived, padded with zeros\n", name)
+		_, err = io.CopyBuffer(w, io.LimitReader(zeroReader{}, size-n), *bp)
+	}
+	return err
+}
+
+type zipArchive struct{ zw *zip.Writer }
+
+// zipMethod stores media as it is: videos and images are compressed
+// already and deflating them would only cost CPU.
+func zipMethod(name string) uint16 {
+	switch fileKind(name) {
+	case "video", "image":
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+func (a zipArchive) dir(name string, mod time.Time) error {
+	_, err := a.zw.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: mod})
+	return err
+}
+
+func (a zipArchive) file(name string, f *os.File, fi os.FileInfo) error {
+	hdr := &zip.FileHeader{Name: name, Method: zipMethod(name), Modified: fi.ModTime()}
+	hdr.SetMode(fi.Mode())
+	zf, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	return copyEntry(zf, f, name, fi.Size())
+}
+
+func (a zipArchive) Close() error { return a.zw.Close() }
+
+// tarArchive writes a tar stream, gzipped at the fastest level when gz is
+// set: on a LAN the network is rarely slower than deflate.
+type tarArchive struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (a tarArchive) dir(name string, mod time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0o755, ModTime: mod})
+}
+
+func (a tarArchive) file(name string, f *os.File, fi os.FileInfo) error {
+	err := a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: int64(fi.Mode().Perm()), Size: fi.Size(), ModTime: fi.ModTime()})
+	if err != nil {
+		return err
+	}
+	return copyEntry(a.tw, f, name, fi.Size())
+}
+
+func (a tarArchive) Close() error {
+	err := a.tw.Close()
+	if a.gz != nil {
+		if gerr := a.gz.Close(); err == nil {
+			err = gerr
+		}
+	}
+	return err
+}
+
+// addFile adds the regular file at p. One that vanished or cannot be opened
+// is left out with a warning; only a failed write to the client stops the
+// archive.
+func addFile(aw archiveWriter, p, entry string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "warning: %s skipped in archive: %v\n", entry, err)
+		return nil
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	return aw.file(entry, f, fi)
+}
+
+// addTree adds the directory full and everything visible below it that r
+// may reach under the archive directory name.
+func addTree(r *http.Request, aw archiveWriter, full, name string) error {
+	return walkShare(full, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if cerr := r.Context().Err(); cerr != nil {
+			return cerr
+		}
+		rel := relPath(p)
+		if !visible(rel) || !accessible(r, rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		inner, _ := filepath.Rel(full, p)
+		entry := path.Join(name, filepath.ToSlash(inner))
+		if d.IsDir() {
+			return aw.dir(entry, modTime(d))
+		}
+		return addFile(aw, p, entry)
+	})
+}
+
+func modTime(d fs.DirEntry) time.Time {
+	if info, err := d.Info(); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+// archiveDir resolves the directory an archive request is for and the name
+// the archive gets. It returns false when it has answered with an error.
+func archiveDir(w http.ResponseWriter, r *http.Request, prefix string) (string, string, string, bool) {
+	upath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, prefix))
+	full, err := resolveFor(r, upath)
+	if err != nil {
+		writePathError(w, false, err)
+		return "", "", "", false
+	}
+	fi, err := os.Stat(full)
+	if err != nil || !fi.IsDir() {
+		http.Error(w, "not a directory", http.StatusNotFound)
+		return "", "", "", false
+	}
+	name := path.Base(upath)
+	if upath == "/" {
+		name = filepath.Base(root)
+	}
+	return full, upath, name, true
+}
+
+// streamArchive sets the response headers and runs add. The length is not
+// known in advance, so the response is chunked and cannot be resumed.
+func streamArchive(w http.ResponseWriter, r *http.Request, rel, label, ctype, filename string, open func(io.Writer) archiveWriter, add func(archiveWriter) error) {
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", attachment(filename))
+	w.Header().Set("Accept-Ranges", "none")
+	if r.Method == http.MethodHead {
+		return
+	}
+	w, served := countServed(w, rel)
+	defer served()
+	start := time.Now()
+	cw := &byteCounter{w: w}
+	aw := open(cw)
+	err := add(aw)
+	if err == nil {
+		err = aw.Close()
+	}
+	if err != nil {
+		elapsed, _ := throughput(cw.n, start)
+		fmt.Fprintf(os.Stdout, "%s interrupted after %s in %.2fs to %s: %s\n", label, human(cw.n), elapsed, r.RemoteAddr, failureReason(r, err))
+		return
+	}
+	logTransfer(label, cw.n, start, r.RemoteAddr)
+}
+
+func openZip(w io.Writer) archiveWriter { return zipArchive{zip.NewWriter(w)} }
+
+func openTar(w io.Writer) archiveWriter { return tarArchive{tw: tar.NewWriter(w)} }
+
+func openTarGz(w io.Writer) archiveWriter {
+	gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	return tarArchive{tw: tar.NewWriter(gz), gz: gz}
+}
+
+// zipURL links the archive of the directory at upath.
+func zipURL(upath string) string {
+	return "/zip" + dirURL(upath)
+}
+
+// zipHandler serves /zip/<dir>: the directory and everything visible below
+// it as a zip archive, streamed while it is built. archive/zip switches to
+// Zip64 by itself for large entries and archives.
+func zipHandler(w http.ResponseWriter, r *http.Request) {
+	full, upath, name, ok := archiveDir(w, r, "/zip")
+	if !ok {
+		return
+	}
+	streamArchive(w, r, upath+"/", "zip "+upath, "application/zip", name+".zip", openZip, func(aw archiveWriter) error {
+		return addTree(r, aw, full, name)
+	})
+}
+
+// tarHandler serves /tar/<dir>, the same as /zip/ as a tar stream for
+// curl | tar x; ?gz=1 gzips it.
+func tarHandler(w http.ResponseWriter, r *http.Request) {
+	full, upath, name, ok := archiveDir(w, r, "/tar")
+	if !ok {
+		return
+	}
+	ctype, filename, open := "application/x-tar", name+".tar", openTar
+	if r.URL.Query().Get("gz") == "1" {
+		ctype, filename, open = "application/gzip", name+".tar.gz", openTarGz
+	}
+	streamArchive(w, r, upath+"/", "tar "+upath, ctype, filename, open, func(aw archiveWriter) error {
+		return addTree(r, aw, full, name)
+	})
+}
+
+// maxArchivePaths bounds one /api/archive selection.
+const maxArchivePaths = 10000
+
+// uniqueName returns name, or name with " (2)", " (3)"... before the
+// extension when an earlier selected file already took it.
+func uniqueName(name string, taken map[string]bool) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	taken[name] = true
+	return name
+}
+
+// archiveHandler serves POST /api/archive: the selected files and
+// directories in one archive, streamed back in the response. The body is
+// JSON {paths, format} or, so that a plain form can start the download, a
+// form with repeated path fields and format. Every item goes in at the top
+// of the archive under its own name.
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Paths  []string `json:"paths"`
+		Format string   `json:"format"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4<<20)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "body must be JSON {paths, format}", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			jsonError(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		req.Paths, req.Format = r.PostForm["path"], r.PostForm.Get("format")
+	}
+	if len(req.Paths) == 0 || len(req.Paths) > maxArchivePaths {
+		jsonError(w, fmt.Sprintf("paths must list between 1 and %d files", maxArchivePaths), http.StatusBadRequest)
+		return
+	}
+	ctype, filename, open := "application/zip", "selection.zip", openZip
+	switch req.Format {
+	case "", "zip":
+	case "tar":
+		ctype, filename, open = "application/x-tar", "selection.tar", openTar
+	case "tar.gz", "tgz":
+		ctype, filename, open = "application/gzip", "selection.tar.gz", openTarGz
+	default:
+		jsonError(w, "format must be zip, tar or tar.gz", http.StatusBadRequest)
+		return
+	}
+	type selected struct {
+		full, entry string
+		dir         bool
+	}
+	var items []selected
+	taken := map[string]bool{}
+	for _, p := range req.Paths {
+		full, err := resolveFor(r, p)
+		if err != nil {
+			writePathError(w, true, err)
+			return
+		}
+		fi, err := os.Stat(full)
+		if err != nil {
+			writePathError(w, true, err)
+			return
+		}
+		name := filepath.Base(full)
+		if full == root {
+			name = filepath.Base(root)
+		}
+		items = append(items, selected{full: full, entry: uniqueName(name, taken), dir: fi.IsDir()})
+	}
+	// A selection from more than one top-level directory counts towards
+	// the root.
+	rel := ""
+	for i, it := range items {
+		p := relPath(it.full)
+		if it.dir {
+			p += "/"
+		}
+		if i == 0 {
+			rel = p
+		} else if topDir(p) != topDir(rel) {
+			rel = ""
+			break
+		}
+	}
+	streamArchive(w, r, rel, fmt.Sprintf("archive of %d item(s)", len(items)), ctype, filename, open, func(aw archiveWriter) error {
+		for _, it := range items {
+			var err error
+			if it.dir {
+				err = addTree(r, aw, it.full, it.entry)
+			} else {
+				err = addFile(aw, it.full, it.entry)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// audioFormat is one way /audio/ can package a track: the encoder (or
+// "copy"), the muxer and the Content-Type the result is served as.
+type audioFormat struct {
+	encoder  string
+	muxer    string
+	mime     string
+	channels int
+}
+
+var audioFormats = map[string]audioFormat{
+	"mp3":  {encoder: "libmp3lame", muxer: "mp3", mime: "audio/mpeg", channels: 2},
+	"aac":  {encoder: "aac", muxer: "adts", mime: "audio/aac"},
+	"opus": {encoder: "libopus", muxer: "ogg", mime: "audio/ogg"},
+	"flac": {encoder: "flac", muxer: "flac", mime: "audio/flac"},
+}
+
+// copyFormats picks the container for ?codec=copy by source codec. Anything
+// else, or any file ffprobe cannot tell us about, goes into Matroska audio,
+// which holds every codec.
+var copyFormats = map[string]audioFormat{
+	"aac":    {encoder: "copy", muxer: "adts", mime: "audio/aac"},
+	"mp3":    {encoder: "copy", muxer: "mp3", mime: "audio/mpeg"},
+	"ac3":    {encoder: "copy", muxer: "ac3", mime: "audio/ac3"},
+	"eac3":   {encoder: "copy", muxer: "eac3", mime: "audio/eac3"},
+	"flac":   {encoder: "copy", muxer: "flac", mime: "audio/flac"},
+	"opus":   {encoder: "copy", muxer: "ogg", mime: "audio/ogg"},
+	"vorbis": {encoder: "copy", muxer: "ogg", mime: "audio/ogg"},
+}
+
+var copyFallback = audioFormat{encoder: "copy", muxer: "matroska", mime: "audio/x-matroska"}
+
+const defaultAudioBitrate = "192k"
+
+var audioBitrate = regexp.MustCompile(`^[1-9][0-9]{1,2}k$`)
+
+func audioArgs(input string, track int, f audioFormat, bitrate string) []string {
+	args := append(ffmpegBaseArgs(), "-i", input, "-map", fmt.Sprintf("0:a:%d", track), "-c:a", f.encoder)
+	if f.encoder != "copy" && f.encoder != "flac" {
+		args = append(args, "-b:a", bitrate)
+	}
+	if f.channels > 0 {
+		args = append(args, "-ac", strconv.Itoa(f.channels))
+	}
+	return append(args, "-f", f.muxer, "pipe:1")
+}
+
+// audioHandler serves /audio/<path>: one audio track of a video, copied
+// (?codec=copy) or converted (?codec=mp3&bitrate=192k), picked by ?track=N.
+func audioHandler(w http.ResponseWriter, r *http.Request) {
+	if ffmpegPath == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if allowCORS(w, r) {
+		return
+	}
+	upath, err := decodePath(strings.TrimPrefix(r.URL.EscapedPath(), "/audio"))
+	if err != nil {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+	full, err := resolveFor(r, upath)
+	if err != nil {
+		writePathError(w, false, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() || fileKind(fi.Name()) != "video" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	track := 0
+	if v := q.Get("track"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "track must be a non-negative stream index", http.StatusBadRequest)
+			return
+		}
+		track = n
+	}
+	bitrate := defaultAudioBitrate
+	if v := q.Get("bitrate"); v != "" {
+		if !audioBitrate.MatchString(v) {
+			http.Error(w, "bitrate must look like 192k", http.StatusBadRequest)
+			return
+		}
+		bitrate = v
+	}
+	codec := q.Get("codec")
+	if codec == "" {
+		codec = "mp3"
+	}
+	f, ok := audioFormats[codec]
+	if !ok && codec != "copy" {
+		http.Error(w, "codec must be copy, mp3, aac, opus or flac", http.StatusBadRequest)
+		return
+	}
+	// With ffprobe the track number is checked up front and a copied track
+	// gets a container that suits it; without, ffmpeg finds out.
+	var info *mediaInfo
+	if ffprobePath != "" {
+		if mi, err := probeMedia(full, fi); err == nil {
+			info = &mi
+		} else {
+			fmt.Fprintf(os.Stderr, "ffprobe: %s: %v\n", fi.Name(), err)
+		}
+	}
+	if info != nil && track >= len(info.Audio) {
+		http.Error(w, fmt.Sprintf("no audio track %d (file has %d)", track, len(info.Audio)), http.StatusNotFound)
+		return
+	}
+	if codec == "copy" {
+		f = copyFallback
+		if info != nil {
+			if cf, ok := copyFormats[info.Audio[track].Codec]; ok {
+				f = cf
+			}
+		}
+	}
+	w.Header().Set("Content-Type", f.mime)
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	t := &transcode{id: newTranscodeID(), kind: "audio", path: full, client: clientHost(r), owner: transcodeOwner(r), started: time.Now()}
+	streamFFmpeg(w, r, t, audioArgs(full, track, f, bitrate))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// castContainers are the containers the Default Media Receiver plays as
+// plain files, with the Content-Type it expects for them.
+var castContainers = map[string]string{".mp4": "video/mp4", ".m4v": "video/mp4", ".webm": "video/webm"}
+
+var castVideoCodecs = map[string]bool{"h264": true, "vp8": true, "vp9": true}
+var castAudioCodecs = map[string]bool{"aac": true, "mp3": true, "opus": true, "vorbis": true, "flac": true}
+
+type castInfo struct {
+	Path     string   `json:"path"`
+	Castable bool     `json:"castable"`
+	Reasons  []string `json:"reasons,omitempty"`
+	// URL and ContentType are what a sender should load: the file itself
+	// when it is castable, otherwise the best stream ffmpeg can make.
+	URL         string `json:"url,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	RemuxURL    string `json:"remux_url,omitempty"`
+	HLSURL      string `json:"hls_url,omitempty"`
+	Message     string `json:"message,omitempty"`
+}
+
+// allowCORS lets other origins fetch media, which a Chromecast does from
+// the receiver page. It answers preflight requests itself and reports
+// whether it did, in which case the caller is done.
+func allowCORS(w http.ResponseWriter, r *http.Request) bool {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, Content-Type")
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	h.Set("Access-Control-Allow-Headers", "Range, Content-Type")
+	h.Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// castMedia reports whether name is something a receiver loads itself:
+// video, audio or subtitles. Other files get no CORS headers, so a page on
+// another site cannot read the share through a visitor's browser.
+func castMedia(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	if k := fileKind(name); k == "video" || k == "subtitle" {
+		return true
+	}
+	t := mimeTypes[ext]
+	return strings.HasPrefix(t, "audio/") && t != "audio/x-mpegurl" || strings.HasPrefix(t, "video/")
+}
+
+// castCheck decides whether the Default Media Receiver can play a file
+// directly: the container by extension, the codecs from media info when
+// ffprobe is around.
+func castCheck(full string, fi os.FileInfo) (bool, []string) {
+	var reasons []string
+	ext := strings.ToLower(filepath.Ext(fi.Name()))
+	if castContainers[ext] == "" {
+		reasons = append(reasons, "container "+strings.TrimPrefix(ext, ".")+" is not supported by the receiver")
+	}
+	if ffprobePath == "" {
+		return len(reasons) == 0, append(reasons, "codecs not checked: ffprobe not found")
+	}
+	info, err := probeMedia(full, fi)
+	if err != nil {
+		return false, append(reasons, "cannot read media info")
+	}
+	ok := len(reasons) == 0
+	if info.Video != nil && !castVideoCodecs[info.Video.Codec] {
+		ok = false
+		reasons = append(reasons, "video codec "+info.Video.Codec+" is not supported by the receiver")
+	}
+	if a := castAudio(info); a != nil && !castAudioCodecs[a.Codec] {
+		ok = false
+		reasons = append(reasons, "audio codec "+a.Codec+" is not supported by the receiver")
+	}
+	return ok, reasons
+}
+
+// castAudio is the track a receiver would play: the default one, or the
+// first.
+func castAudio(info mediaInfo) *audioStream {
+	for i := range info.Audio {
+		if info.Audio[i].Default {
+			return &info.Audio[i]
+		}
+	}
+	if len(info.Audio) > 0 {
+		return &info.Audio[0]
+	}
+	return nil
+}
+
+// castCodecsOK reports whether only the container is in the way, so that
+// repackaging without re-encoding is enough.
+func castCodecsOK(full string, fi os.FileInfo) bool {
+	if ffprobePath == "" {
+		return false
+	}
+	info, err := probeMedia(full, fi)
+	if err != nil || info.Video == nil || info.Video.Codec != "h264" {
+		return false
+	}
+	a := castAudio(info)
+	return a == nil || a.Codec == "aac" || a.Codec == "mp3"
+}
+
+func castInfoHandler(w http.ResponseWriter, r *http.Request) {
+	upath := path.Clean("/" + r.URL.Query().Get("path"))
+	full, err := resolveFor(r, upath)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() || fileKind(fi.Name()) != "video" {
+		jsonError(w, "not a video", http.StatusNotFound)
+		return
+	}
+	base := baseURL(r)
+	info := castInfo{Path: strings.TrimPrefix(upath, "/")}
+	info.Castable, info.Reasons = castCheck(full, fi)
+	if ffmpegPath != "" {
+		info.HLSURL = withToken(r, base+"/hls"+escapePath(upath)+"/index.m3u8")
+		if !info.Castable && castCodecsOK(full, fi) {
+			info.RemuxURL = withToken(r, base+"/remux"+escapePath(upath))
+		}
+	}
+	switch {
+	case info.Castable:
+		info.URL, info.ContentType = withToken(r, base+escapePath(upath)), castContainers[strings.ToLower(filepath.Ext(fi.Name()))]
+	case info.RemuxURL != "":
+		info.URL, info.ContentType = info.RemuxURL, "video/mp4"
+		info.Message = "not direct-playable on a Chromecast, casting the MP4 remux from /remux/ instead"
+	case info.HLSURL != "":
+		info.URL, info.ContentType = info.HLSURL, "application/vnd.apple.mpegurl"
+		info.Message = "not direct-playable on a Chromecast, casting the HLS transcode from /hls/ instead"
+	default:
+		info.Message = "not direct-playable on a Chromecast; start the server with -ffmpeg to cast it through /remux/ or /hls/"
+	}
+	writeJSON(w, http.StatusOK, info)
+}
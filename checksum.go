@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxChecksums bounds concurrent checksum runs; each reads a whole file,
+// and more than two at once would only make the disk seek.
+const maxChecksums = 2
+
+var checksumSlots = make(chan struct{}, maxChecksums)
+
+// checksumJobKeep is how long a finished job can still be polled.
+const checksumJobKeep = 10 * time.Minute
+
+var checksumAlgos = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"md5":    md5.New,
+	"xxh64":  func() hash.Hash { return newXXH64() },
+}
+
+type checksumEntry struct {
+	Path    string    `json:"path"`
+	Algo    string    `json:"algo"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+	Hex     string    `json:"hex"`
+}
+
+// checksumJob is one file being hashed. Requests for a file that is already
+// being hashed with the same algorithm join its job.
+type checksumJob struct {
+	ID       string     `json:"job"`
+	Path     string     `json:"path"`
+	Algo     string     `json:"algo"`
+	Status   string     `json:"status"`
+	Bytes    int64      `json:"bytes"`
+	Size     int64      `json:"size"`
+	Hex      string     `json:"hex,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	full string
+	done chan struct{}
+}
+
+// checksumCache holds digests keyed by full path and algorithm; an entry
+// is only used while size and mtime still match.
+var checksumCache = struct {
+	sync.Mutex
+	entries  map[string]checksumEntry
+	jobs     map[string]*checksumJob
+	inflight map[string]*checksumJob
+	dirty    bool
+}{entries: map[string]checksumEntry{}, jobs: map[string]*checksumJob{}, inflight: map[string]*checksumJob{}}
+
+func checksumKey(full, algo string) string {
+	return full + "\x00" + algo
+}
+
+func checksumCacheFile() string {
+	return filepath.Join(cacheDir, "checksums.json")
+}
+
+func loadChecksumCache() {
+	if cacheDir == "" {
+		return
+	}
+	b, err := os.ReadFile(checksumCacheFile())
+	if err != nil {
+		return
+	}
+	var list []checksumEntry
+	if err := json.Unmarshal(b, &list); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: ignoring broken checksum cache:", err)
+		return
+	}
+	for _, e := range list {
+		checksumCache.entries[checksumKey(e.Path, e.Algo)] = e
+	}
+}
+
+// saveChecksumCache writes the cache out a few seconds after it changed.
+func saveChecksumCache() {
+	if cacheDir == "" {
+		return
+	}
+	checksumCache.Lock()
+	if checksumCache.dirty {
+		checksumCache.Unlock()
+		return
+	}
+	checksumCache.dirty = true
+	checksumCache.Unlock()
+	time.AfterFunc(5*time.Second, func() {
+		checksumCache.Lock()
+		list := make([]checksumEntry, 0, len(checksumCache.entries))
+		for _, e := range checksumCache.entries {
+			list = append(list, e)
+		}
+		checksumCache.dirty = false
+		checksumCache.Unlock()
+		if err := writeFileAtomic(checksumCacheFile(), list); err != nil {
+			fmt.Fprintln(os.Stderr, "cannot save checksum cache:", err)
+		}
+	})
+}
+
+// cachedChecksum returns a digest without computing one.
+func cachedChecksum(full, algo string, fi os.FileInfo) (string, bool) {
+	checksumCache.Lock()
+	defer checksumCache.Unlock()
+	e, ok := checksumCache.entries[checksumKey(full, algo)]
+	if !ok || e.Size != fi.Size() || !e.ModTime.Equal(fi.ModTime()) {
+		return "", false
+	}
+	return e.Hex, true
+}
+
+// setDigestHeaders announces digests that are already known on a file
+// response, in the RFC 9530 Repr-Digest form and the older RFC 3230
+// Digest header. Nothing is computed for it.
+func setDigestHeaders(w http.ResponseWriter, full string, fi os.FileInfo) {
+	var repr, digest []string
+	for _, a := range []struct{ algo, name, legacy string }{{"sha256", "sha-256", "SHA-256"}, {"md5", "md5", "MD5"}} {
+		h, ok := cachedChecksum(full, a.algo, fi)
+		if !ok {
+			continue
+		}
+		b, _ := hex.DecodeString(h)
+		enc := base64.StdEncoding.EncodeToString(b)
+		repr = append(repr, a.name+"=:"+enc+":")
+		digest = append(digest, a.legacy+"="+enc)
+	}
+	if len(repr) > 0 {
+		w.Header().Set("Repr-Digest", strings.Join(repr, ", "))
+		w.Header().Set("Digest", strings.Join(digest, ","))
+	}
+}
+
+// startChecksum returns the job hashing full, starting one if none runs.
+func startChecksum(full, rel, algo string, fi os.FileInfo) *checksumJob {
+	key := checksumKey(full, algo)
+	checksumCache.Lock()
+	defer checksumCache.Unlock()
+	if j := checksumCache.inflight[key]; j != nil {
+		return j
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	j := &checksumJob{ID: hex.EncodeToString(b), Path: rel, Algo: algo, Status: "queued", Size: fi.Size(), Started: time.Now(), full: full, done: make(chan struct{})}
+	checksumCache.jobs[j.ID] = j
+	checksumCache.inflight[key] = j
+	go j.run(fi)
+	return j
+}
+
+func (j *checksumJob) run(fi os.FileInfo) {
+	checksumSlots <- struct{}{}
+	checksumCache.Lock()
+	j.Status = "running"
+	checksumCache.Unlock()
+	sum, err := j.hash()
+	<-checksumSlots
+	// A file that changed while it was read has no meaningful digest.
+	if err == nil {
+		if now, serr := os.Stat(j.full); serr != nil || now.Size() != fi.Size() || !now.ModTime().Equal(fi.ModTime()) {
+			err = fmt.Errorf("file changed while it was read")
+		}
+	}
+	checksumCache.Lock()
+	delete(checksumCache.inflight, checksumKey(j.full, j.Algo))
+	now := time.Now()
+	j.Finished = &now
+	if err != nil {
+		j.Status, j.Error = "failed", err.Error()
+	} else {
+		j.Status, j.Hex = "done", sum
+		checksumCache.entries[checksumKey(j.full, j.Algo)] = checksumEntry{Path: j.full, Algo: j.Algo, Size: fi.Size(), ModTime: fi.ModTime(), Hex: sum}
+	}
+	checksumCache.Unlock()
+	close(j.done)
+	if err == nil {
+		saveChecksumCache()
+		elapsed, mbps := throughput(fi.Size(), j.Started)
+		fmt.Fprintf(os.Stdout, "checksum %s %s in %.2fs (%.2f MB/s)\n", j.Algo, j.Path, elapsed, mbps)
+	} else {
+		fmt.Fprintf(os.Stdout, "checksum %s %s failed: %v\n", j.Algo, j.Path, err)
+	}
+	time.AfterFunc(checksumJobKeep, func() {
+		checksumCache.Lock()
+		delete(checksumCache.jobs, j.ID)
+		checksumCache.Unlock()
+	})
+}
+
+// progressWriter tracks how far a job got.
+type progressWriter struct{ j *checksumJob }
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	checksumCache.Lock()
+	p.j.Bytes += int64(len(b))
+	checksumCache.Unlock()
+	return len(b), nil
+}
+
+func (j *checksumJob) hash() (string, error) {
+	f, err := os.Open(j.full)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := checksumAlgos[j.Algo]()
+	bp := getBuf()
+	defer putBuf(bp)
+	if _, err := io.CopyBuffer(io.MultiWriter(h, progressWriter{j}), struct{ io.Reader }{f}, *bp); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (j *checksumJob) snapshot() checksumJob {
+	checksumCache.Lock()
+	defer checksumCache.Unlock()
+	return *j
+}
+
+// checksumHandler serves /api/checksum?path=&algo=sha256|md5|xxh64. The
+// digest is computed on the server, so a copy can be verified without
+// reading it back over the network. With ?async=1 it answers 202 with a
+// job to poll through /api/checksum?job=<id> instead of waiting.
+func checksumHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if id := q.Get("job"); id != "" {
+		checksumCache.Lock()
+		j := checksumCache.jobs[id]
+		checksumCache.Unlock()
+		if j == nil {
+			jsonError(w, "no such job", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, j.snapshot())
+		return
+	}
+	algo := q.Get("algo")
+	if algo == "" {
+		algo = "sha256"
+	}
+	if checksumAlgos[algo] == nil {
+		jsonError(w, "algo must be sha256, md5 or xxh64", http.StatusBadRequest)
+		return
+	}
+	full, err := resolveFor(r, q.Get("path"))
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || !fi.Mode().IsRegular() {
+		jsonError(w, "not a file", http.StatusBadRequest)
+		return
+	}
+	rel := relPath(full)
+	if h, ok := cachedChecksum(full, algo, fi); ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"path": rel, "algo": algo, "hex": h, "cached": true})
+		return
+	}
+	j := startChecksum(full, rel, algo, fi)
+	if q.Get("async") == "1" {
+		w.Header().Set("Location", "/api/checksum?job="+j.ID)
+		writeJSON(w, http.StatusAccepted, j.snapshot())
+		return
+	}
+	select {
+	case <-j.done:
+	case <-r.Context().Done():
+		return
+	}
+	res := j.snapshot()
+	if res.Status != "done" {
+		jsonError(w, "checksum failed: "+res.Error, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"path": rel, "algo": algo, "hex": res.Hex, "cached": false})
+}
+
+// checksumHeaders are the request headers an upload's expected digests
+// come in.
+var checksumHeaders = map[string]string{"sha256": "X-Checksum-SHA256", "md5": "X-Checksum-MD5"}
+
+// checksumMismatch rejects an upload whose data does not hash to what the
+// client said it would.
+type checksumMismatch struct {
+	algo, expected, actual string
+}
+
+func (e *checksumMismatch) Error() string {
+	return e.algo + " mismatch"
+}
+
+// parseChecksum checks a client-supplied digest and returns it in lower
+// case.
+func parseChecksum(algo, v string) (string, error) {
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != checksumAlgos[algo]().Size() {
+		return "", fmt.Errorf("%s must be %d hex digits", algo, 2*checksumAlgos[algo]().Size())
+	}
+	return strings.ToLower(v), nil
+}
+
+// wantedChecksums reads the X-Checksum-* headers of an upload.
+func wantedChecksums(h http.Header) (map[string]string, error) {
+	want := map[string]string{}
+	for algo, name := range checksumHeaders {
+		if v := h.Get(name); v != "" {
+			sum, err := parseChecksum(algo, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			want[algo] = sum
+		}
+	}
+	return want, nil
+}
+
+// uploadHashes are computed while an upload is written: sha256 always, so
+// a later /api/checksum is free, and md5 when the client wants it checked.
+func uploadHashes(want map[string]string) map[string]hash.Hash {
+	hs := map[string]hash.Hash{"sha256": sha256.New()}
+	if want["md5"] != "" {
+		hs["md5"] = md5.New()
+	}
+	return hs
+}
+
+func hashWriter(hs map[string]hash.Hash) io.Writer {
+	ws := make([]io.Writer, 0, len(hs))
+	for _, h := range hs {
+		ws = append(ws, h)
+	}
+	return io.MultiWriter(ws...)
+}
+
+func sumHashes(hs map[string]hash.Hash) map[string]string {
+	got := map[string]string{}
+	for algo, h := range hs {
+		got[algo] = hex.EncodeToString(h.Sum(nil))
+	}
+	return got
+}
+
+func verifyChecksums(want, got map[string]string) error {
+	for algo, sum := range want {
+		if got[algo] != sum {
+			return &checksumMismatch{algo: algo, expected: sum, actual: got[algo]}
+		}
+	}
+	return nil
+}
+
+// rememberChecksums puts the digests of a file the server just wrote into
+// the cache.
+func rememberChecksums(full string, got map[string]string) {
+	fi, err := os.Stat(full)
+	if err != nil {
+		return
+	}
+	checksumCache.Lock()
+	for algo, sum := range got {
+		checksumCache.entries[checksumKey(full, algo)] = checksumEntry{Path: full, Algo: algo, Size: fi.Size(), ModTime: fi.ModTime(), Hex: sum}
+	}
+	checksumCache.Unlock()
+	saveChecksumCache()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const compressMinSize = 1024
+
+var noCompress bool
+
+var gzipPool = sync.Pool{New: func() interface{} {
+	gz, _ := gzip.NewWriterLevel(io.Discard, gzip.BestSpeed)
+	return gz
+}}
+
+func compressibleType(ct string) bool {
+	typ, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(typ, "text/") {
+		return true
+	}
+	switch typ {
+	case "application/json", "application/javascript", "application/xml", "application/x-subrip",
+		"audio/x-mpegurl", "application/vnd.apple.mpegurl", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// withCompression gzips text-like responses for clients that accept it.
+// Range requests, HEAD, WebSocket upgrades, the speedtest and /api/ping
+// are never touched.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" || strings.HasPrefix(r.URL.Path, "/speedtest") || r.URL.Path == "/api/ping" ||
+			!acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.finish()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(ae string) bool {
+	for _, part := range strings.Split(ae, ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(enc) == "gzip" {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipWriter holds back the first compressMinSize bytes of an eligible
+// response: if the body ends before that it is sent as is, otherwise it is
+// compressed and Content-Length is dropped.
+type gzipWriter struct {
+	http.ResponseWriter
+	code    int
+	decided bool
+	buf     []byte
+	gz      *gzip.Writer
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.code != 0 {
+		return
+	}
+	g.code = code
+	h := g.Header()
+	if code != http.StatusOK || h.Get("Content-Encoding") != "" || !compressibleType(h.Get("Content-Type")) {
+		g.passthrough()
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+func (g *gzipWriter) passthrough() {
+	g.decided = true
+	g.ResponseWriter.WriteHeader(g.code)
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if g.code == 0 {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.decided {
+		if g.gz != nil {
+			return g.gz.Write(p)
+		}
+		return g.ResponseWriter.Write(p)
+	}
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= compressMinSize {
+		g.startGzip()
+	}
+	return len(p), nil
+}
+
+func (g *gzipWriter) startGzip() {
+	h := g.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	g.decided = true
+	g.ResponseWriter.WriteHeader(g.code)
+	g.gz = gzipPool.Get().(*gzip.Writer)
+	g.gz.Reset(g.ResponseWriter)
+	g.gz.Write(g.buf)
+	g.buf = nil
+}
+
+// ReadFrom keeps sendfile available for responses that are not compressed,
+// which covers every video transfer.
+func (g *gzipWriter) ReadFrom(r io.Reader) (int64, error) {
+	if g.code == 0 {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.decided && g.gz == nil {
+		if rf, ok := g.ResponseWriter.(io.ReaderFrom); ok {
+			return rf.ReadFrom(r)
+		}
+	}
+	return io.Copy(struct{ io.Writer }{g}, r)
+}
+
+func (g *gzipWriter) Flush() {
+	if !g.decided && g.code != 0 {
+		g.startGzip()
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipWriter) finish() {
+	if !g.decided && g.code != 0 {
+		g.passthrough()
+		g.ResponseWriter.Write(g.buf)
+		return
+	}
+	if g.gz != nil {
+		g.gz.Close()
+		gzipPool.Put(g.gz)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin)
+
+package main
+
+import "time"
+
+// cpuTime is not available here; benchmarks report wall time only.
+func cpuTime() (time.Duration, bool) {
+	return 0, false
+}
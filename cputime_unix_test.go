@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTime is the user and system CPU time the process has used so far.
+func cpuTime() (time.Duration, bool) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, false
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), true
+}
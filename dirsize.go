@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const dirSizeWorkers = 2
+
+type dirSizeEntry struct {
+	mtime   time.Time
+	size    int64
+	pending bool
+}
+
+// dirSizeCache computes recursive directory sizes in the background. Entries
+// are keyed by path and invalidated when the directory's own mtime changes,
+// which is cheap and good enough to spot which folder is eating the disk.
+type dirSizeCache struct {
+	mu    sync.Mutex
+	sizes map[string]dirSizeEntry
+	jobs  chan string
+	once  sync.Once
+}
+
+var dirSizes = &dirSizeCache{sizes: map[string]dirSizeEntry{}, jobs: make(chan string, 256)}
+
+// lookup returns the cached size of the directory at full. On a miss it
+// queues a computation and reports ok=false.
+func (c *dirSizeCache) lookup(full string, mtime time.Time) (int64, bool) {
+	c.once.Do(func() {
+		for i := 0; i < dirSizeWorkers; i++ {
+			go c.worker()
+		}
+	})
+	c.mu.Lock()
+	e, found := c.sizes[full]
+	if found && e.mtime.Equal(mtime) {
+		c.mu.Unlock()
+		return e.size, !e.pending
+	}
+	c.sizes[full] = dirSizeEntry{mtime: mtime, pending: true}
+	c.mu.Unlock()
+	select {
+	case c.jobs <- full:
+	default:
+		c.mu.Lock()
+		delete(c.sizes, full)
+		c.mu.Unlock()
+	}
+	return 0, false
+}
+
+func (c *dirSizeCache) worker() {
+	for full := range c.jobs {
+		size := treeSize(full)
+		c.mu.Lock()
+		if e, ok := c.sizes[full]; ok && e.pending {
+			e.size, e.pending = size, false
+			c.sizes[full] = e
+		}
+		c.mu.Unlock()
+	}
+}
+
+func treeSize(full string) int64 {
+	var total int64
+	_ = walkShare(full, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !visible(relPath(p)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+func dirSizeHandler(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Query().Get("path")
+	full, err := resolveFor(r, p)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || !fi.IsDir() {
+		jsonError(w, "not a directory", http.StatusNotFound)
+		return
+	}
+	res := map[string]interface{}{"path": relPath(full)}
+	if size, ok := dirSizes.lookup(full, fi.ModTime()); ok {
+		res["status"] = "ready"
+		res["size"] = size
+	} else {
+		res["status"] = "pending"
+	}
+	writeJSON(w, http.StatusOK, res)
+}
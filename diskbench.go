@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// diskBenchEnabled allows /api/diskbench and /speedtest?diag=1, which put
+// real load on the disk behind -dir.
+var diskBenchEnabled bool
+
+// diskBenchBlock is the read size: large reads keep the syscall count out
+// of the figure.
+const diskBenchBlock = 4 << 20
+
+// diskBenchBusy lets one benchmark run at a time; two would only measure
+// each other.
+var diskBenchBusy sync.Mutex
+
+type diskResult struct {
+	File         string  `json:"file"`
+	Bytes        int64   `json:"bytes_read"`
+	MBPerS       float64 `json:"mb_per_s"`
+	DurationS    float64 `json:"duration_s"`
+	CacheDropped bool    `json:"cache_dropped"`
+}
+
+// diskBench reads up to n bytes of full and throws them away. The file is
+// dropped from the page cache first where the OS allows it, so the figure
+// is the disk's rather than memory's.
+func diskBench(full string, n int64) (diskResult, error) {
+	f, err := os.Open(full)
+	if err != nil {
+		return diskResult{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return diskResult{}, err
+	}
+	n = min(n, fi.Size())
+	res := diskResult{File: filepath.Base(full), CacheDropped: dropPageCache(f, fi.Size())}
+	buf := make([]byte, diskBenchBlock)
+	start := time.Now()
+	for res.Bytes < n {
+		nr, err := f.Read(buf[:min(int64(len(buf)), n-res.Bytes)])
+		res.Bytes += int64(nr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	elapsed := time.Since(start).Seconds()
+	if elapsed == 0 {
+		elapsed = 0.000001
+	}
+	res.DurationS = elapsed
+	res.MBPerS = float64(res.Bytes) / (1024 * 1024) / elapsed
+	// What was just read would make the next run look faster.
+	dropPageCache(f, fi.Size())
+	return res, nil
+}
+
+// runDiskBench answers for diskBench when it cannot run: disabled, busy or
+// no file. ok is false when it has.
+func runDiskBench(w http.ResponseWriter, r *http.Request, asJSON bool, n int64) (diskResult, bool) {
+	if !diskBenchEnabled {
+		writeError(w, asJSON, "disk benchmark is disabled (start with -diskbench)", http.StatusNotFound)
+		return diskResult{}, false
+	}
+	target, ok := speedTestFile(w, r, asJSON)
+	if !ok {
+		return diskResult{}, false
+	}
+	if target == "" {
+		writeError(w, asJSON, "no media file found for disk benchmark", http.StatusNotFound)
+		return diskResult{}, false
+	}
+	if !diskBenchBusy.TryLock() {
+		writeError(w, asJSON, "disk benchmark already running", http.StatusServiceUnavailable)
+		return diskResult{}, false
+	}
+	defer diskBenchBusy.Unlock()
+	res, err := diskBench(target, n)
+	if err != nil {
+		writeError(w, asJSON, "cannot read file", http.StatusInternalServerError)
+		return diskResult{}, false
+	}
+	return res, true
+}
+
+// diskBenchHandler serves /api/diskbench?file=&bytes=: read speed of the
+// share's disk, without the network.
+func diskBenchHandler(w http.ResponseWriter, r *http.Request) {
+	n := speedBytes
+	if n <= 0 {
+		n = 50 << 20
+	}
+	if v := r.URL.Query().Get("bytes"); v != "" {
+		var err error
+		if n, err = parseBytes(v); err != nil || n <= 0 {
+			jsonError(w, "bytes must be a positive size such as 1GB", http.StatusBadRequest)
+			return
+		}
+	}
+	res, ok := runDiskBench(w, r, true, n)
+	if !ok {
+		return
+	}
+	js, _ := json.Marshal(res)
+	fmt.Fprintln(os.Stdout, string(js))
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,10 @@
+//go:build !(linux && (amd64 || arm64))
+
+package main
+
+import "os"
+
+// dropPageCache is not available here; benchmarks may read from memory.
+func dropPageCache(f *os.File, size int64) bool {
+	return false
+}
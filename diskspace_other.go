@@ -0,0 +1,8 @@
+//go:build !(linux || darwin)
+
+package main
+
+// diskSpace is not available here; /metrics leaves the disk out.
+func diskSpace(dir string) (free, size uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dlnaEnabled bool
+var dlnaName string
+
+// dlnaUUID identifies the server to TVs. It is derived from the host name
+// and shared directory so it stays the same across restarts.
+var dlnaUUID string
+
+const ssdpGroup = "239.255.255.250:1900"
+const ssdpMaxAge = 1800
+
+const (
+	dlnaDeviceType = "urn:schemas-upnp-org:device:MediaServer:1"
+	dlnaCDS        = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	dlnaCMS        = "urn:schemas-upnp-org:service:ConnectionManager:1"
+)
+
+// dlnaFlags marks files as streamable with byte seeking: streaming and
+// background transfer modes, connection stalling, DLNA 1.5.
+const dlnaFlags = "01700000000000000000000000000000"
+
+var dlnaServer = runtime.GOOS + "/1.0 UPnP/1.0 DLNADOC/1.50 fileserver/" + version
+
+// dlnaProfile is what a renderer is told about a file type. Profiles are
+// only named where the extension pins them down well enough; a wrong one
+// makes some TVs refuse a file they could play.
+type dlnaProfile struct {
+	mime string
+	pn   string
+}
+
+var dlnaProfiles = map[string]dlnaProfile{
+	".mkv":  {mime: "video/x-matroska"},
+	".mp4":  {mime: "video/mp4", pn: "AVC_MP4_HP_HD_AAC"},
+	".m4v":  {mime: "video/mp4", pn: "AVC_MP4_HP_HD_AAC"},
+	".avi":  {mime: "video/avi"},
+	".mpg":  {mime: "video/mpeg", pn: "MPEG_PS_PAL"},
+	".mpeg": {mime: "video/mpeg", pn: "MPEG_PS_PAL"},
+	".ts":   {mime: "video/vnd.dlna.mpeg-tts", pn: "MPEG_TS_HD_NA"},
+	".m2ts": {mime: "video/vnd.dlna.mpeg-tts", pn: "MPEG_TS_HD_NA"},
+	".mts":  {mime: "video/vnd.dlna.mpeg-tts", pn: "MPEG_TS_HD_NA"},
+	".wmv":  {mime: "video/x-ms-wmv", pn: "WMVHIGH_FULL"},
+	".jpg":  {mime: "image/jpeg", pn: "JPEG_LRG"},
+	".jpeg": {mime: "image/jpeg", pn: "JPEG_LRG"},
+	".png":  {mime: "image/png", pn: "PNG_LRG"},
+}
+
+// dlnaProfileFor reports how a file is offered to renderers, and whether
+// it is offered at all: disc images and other files a TV cannot play are
+// left out of the tree.
+func dlnaProfileFor(name string) (dlnaProfile, bool) {
+	if p, ok := dlnaProfiles[strings.ToLower(filepath.Ext(name))]; ok {
+		return p, true
+	}
+	mime := contentType(name)
+	if strings.HasPrefix(mime, "video/") || strings.HasPrefix(mime, "image/") {
+		return dlnaProfile{mime: mime}, true
+	}
+	return dlnaProfile{}, false
+}
+
+func (p dlnaProfile) features() string {
+	f := "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=" + dlnaFlags
+	if p.pn != "" {
+		f = "DLNA.ORG_PN=" + p.pn + ";" + f
+	}
+	return f
+}
+
+func (p dlnaProfile) protocolInfo() string {
+	return "http-get:*:" + p.mime + ":" + p.features()
+}
+
+// dlnaHeaders adds the headers DLNA renderers ask for when fetching a file,
+// leaving browsers alone. Samsung TVs refuse to play without
+// contentFeatures.dlna.org, spelled exactly so: the map is set directly to
+// keep Go from canonicalizing the names.
+func dlnaHeaders(w http.ResponseWriter, r *http.Request, name string) {
+	if !dlnaEnabled {
+		return
+	}
+	features, mode := r.Header.Get("getcontentFeatures.dlna.org"), r.Header.Get("transferMode.dlna.org")
+	if features == "" && mode == "" {
+		return
+	}
+	p, ok := dlnaProfileFor(name)
+	if !ok {
+		return
+	}
+	if features == "1" {
+		w.Header()["contentFeatures.dlna.org"] = []string{p.features()}
+	}
+	if mode == "" {
+		mode = "Streaming"
+		if strings.HasPrefix(p.mime, "image/") {
+			mode = "Interactive"
+		}
+	}
+	w.Header()["transferMode.dlna.org"] = []string{mode}
+	w.Header().Set("Content-Type", p.mime)
+}
+
+func checkDLNA() {
+	if !dlnaEnabled {
+		return
+	}
+	host, _ := os.Hostname()
+	if dlnaName == "" {
+		dlnaName = "fileserver"
+		if host != "" {
+			dlnaName += " (" + host + ")"
+		}
+	}
+	h := sha1.Sum([]byte(host + "\x00" + root))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	dlnaUUID = fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// ssdpIface is one network interface the server is announced on.
+type ssdpIface struct {
+	lanIface
+	conn *net.UDPConn
+}
+
+// startSSDP answers M-SEARCH discovery and sends periodic alive
+// notifications on the interfaces the HTTP listener is reachable on.
+func startSSDP(listenIP net.IP, port int) error {
+	group, err := net.ResolveUDPAddr("udp4", ssdpGroup)
+	if err != nil {
+		return err
+	}
+	var ifaces []*ssdpIface
+	for _, li := range lanInterfaces(listenIP) {
+		s := &ssdpIface{lanIface: li}
+		s.conn, err = net.ListenMulticastUDP("udp4", &s.ifi, group)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dlna: %s: %v\n", s.ifi.Name, err)
+			continue
+		}
+		ifaces = append(ifaces, s)
+	}
+	if len(ifaces) == 0 {
+		return fmt.Errorf("dlna: no multicast interface to announce on")
+	}
+	for _, s := range ifaces {
+		fmt.Fprintf(os.Stdout, "DLNA: announcing %q on %s (%v)\n", dlnaName, s.ifi.Name, s.ips)
+		go s.serve(port)
+	}
+	go func() {
+		for i := 0; ; i++ {
+			for _, s := range ifaces {
+				s.notify(group, port)
+			}
+			// A couple of quick repeats at startup cover lost packets.
+			if i < 2 {
+				time.Sleep(3 * time.Second)
+			} else {
+				time.Sleep(ssdpMaxAge / 3 * time.Second)
+			}
+		}
+	}()
+	return nil
+}
+
+// ssdpTargets lists every notification type the server answers to.
+func ssdpTargets() []string {
+	return []string{"upnp:rootdevice", "uuid:" + dlnaUUID, dlnaDeviceType, dlnaCDS, dlnaCMS}
+}
+
+func ssdpUSN(nt string) string {
+	if nt == "uuid:"+dlnaUUID {
+		return nt
+	}
+	return "uuid:" + dlnaUUID + "::" + nt
+}
+
+func dlnaLocation(ip net.IP, port int) string {
+	return "http://" + net.JoinHostPort(ip.String(), strconv.Itoa(port)) + "/dlna/device.xml"
+}
+
+func (s *ssdpIface) serve(port int) {
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dlna: %s: %v\n", s.ifi.Name, err)
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+		// Only the interface the reply would leave through answers.
+		local, ok := routeTo(src)
+		if !ok || !s.owns(local) {
+			continue
+		}
+		st := req.Header.Get("St")
+		var targets []string
+		for _, t := range ssdpTargets() {
+			if st == "ssdp:all" || st == t {
+				targets = append(targets, t)
+			}
+		}
+		for _, t := range targets {
+			msg := "HTTP/1.1 200 OK\r\n" +
+				"CACHE-CONTROL: max-age=" + strconv.Itoa(ssdpMaxAge) + "\r\n" +
+				"DATE: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+				"EXT:\r\n" +
+				"LOCATION: " + dlnaLocation(local, port) + "\r\n" +
+				"SERVER: " + dlnaServer + "\r\n" +
+				"ST: " + t + "\r\n" +
+				"USN: " + ssdpUSN(t) + "\r\n\r\n"
+			s.conn.WriteToUDP([]byte(msg), src)
+		}
+	}
+}
+
+func (s *ssdpIface) notify(group *net.UDPAddr, port int) {
+	for _, ip := range s.ips {
+		c, err := net.DialUDP("udp4", &net.UDPAddr{IP: ip}, group)
+		if err != nil {
+			continue
+		}
+		for _, nt := range ssdpTargets() {
+			msg := "NOTIFY * HTTP/1.1\r\n" +
+				"HOST: " + ssdpGroup + "\r\n" +
+				"CACHE-CONTROL: max-age=" + strconv.Itoa(ssdpMaxAge) + "\r\n" +
+				"LOCATION: " + dlnaLocation(ip, port) + "\r\n" +
+				"NT: " + nt + "\r\n" +
+				"NTS: ssdp:alive\r\n" +
+				"SERVER: " + dlnaServer + "\r\n" +
+				"USN: " + ssdpUSN(nt) + "\r\n\r\n"
+			c.Write([]byte(msg))
+		}
+		c.Close()
+	}
+}
+
+// dlnaHandler serves the UPnP device and service descriptions, SOAP
+// control and event subscriptions under /dlna/.
+func dlnaHandler(w http.ResponseWriter, r *http.Request) {
+	if !dlnaEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/dlna/device.xml":
+		writeXML(w, fmt.Sprintf(dlnaDeviceXML, xmlEscape(dlnaName), dlnaUUID))
+	case "/dlna/cds.xml":
+		writeXML(w, cdsSCPD)
+	case "/dlna/cms.xml":
+		writeXML(w, cmsSCPD)
+	case "/dlna/cds/control":
+		dlnaControl(w, r, dlnaCDS)
+	case "/dlna/cms/control":
+		dlnaControl(w, r, dlnaCMS)
+	case "/dlna/cds/event":
+		dlnaSubscribe(w, r, "<SystemUpdateID>1</SystemUpdateID>")
+	case "/dlna/cms/event":
+		dlnaSubscribe(w, r, "<SourceProtocolInfo>"+xmlEscape(sourceProtocolInfo())+"</SourceProtocolInfo><SinkProtocolInfo></SinkProtocolInfo><CurrentConnectionIDs>0</CurrentConnectionIDs>")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeXML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Write([]byte(body))
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func sourceProtocolInfo() string {
+	seen := map[string]bool{}
+	var list []string
+	for _, p := range dlnaProfiles {
+		if pi := p.protocolInfo(); !seen[pi] {
+			seen[pi] = true
+			list = append(list, pi)
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// soapRequest is a SOAP envelope around any action; only the arguments
+// this server reads are decoded.
+type soapRequest struct {
+	Body struct {
+		Action struct {
+			XMLName        xml.Name
+			ObjectID       string
+			BrowseFlag     string
+			StartingIndex  int
+			RequestedCount int
+		} `xml:",any"`
+	}
+}
+
+func dlnaControl(w http.ResponseWriter, r *http.Request, service string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req soapRequest
+	if err := xml.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeSOAPFault(w, 402, "Invalid Args")
+		return
+	}
+	a := req.Body.Action
+	switch service + "#" + a.XMLName.Local {
+	case dlnaCDS + "#Browse":
+		dlnaBrowse(w, r, a.ObjectID, a.BrowseFlag, a.StartingIndex, a.RequestedCount)
+	case dlnaCDS + "#GetSystemUpdateID":
+		writeSOAP(w, service, "GetSystemUpdateID", "Id", "1")
+	case dlnaCDS + "#GetSearchCapabilities":
+		writeSOAP(w, service, "GetSearchCapabilities", "SearchCaps", "")
+	case dlnaCDS + "#GetSortCapabilities":
+		writeSOAP(w, service, "GetSortCapabilities", "SortCaps", "")
+	case dlnaCMS + "#GetProtocolInfo":
+		writeSOAP(w, service, "GetProtocolInfo", "Source", sourceProtocolInfo(), "Sink", "")
+	case dlnaCMS + "#GetCurrentConnectionIDs":
+		writeSOAP(w, service, "GetCurrentConnectionIDs", "ConnectionIDs", "0")
+	case dlnaCMS + "#GetCurrentConnectionInfo":
+		writeSOAP(w, service, "GetCurrentConnectionInfo", "RcsID", "-1", "AVTransportID", "-1", "ProtocolInfo", "",
+			"PeerConnectionManager", "", "PeerConnectionID", "-1", "Direction", "Output", "Status", "OK")
+	default:
+		writeSOAPFault(w, 401, "Invalid Action")
+	}
+}
+
+// writeSOAP sends an action response; args alternate name and value.
+func writeSOAP(w http.ResponseWriter, service, action string, args ...string) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	b.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&b, `<u:%sResponse xmlns:u="%s">`, action, service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, "<%s>%s</%s>", args[i], xmlEscape(args[i+1]), args[i])
+	}
+	fmt.Fprintf(&b, `</u:%sResponse></s:Body></s:Envelope>`, action)
+	w.Header()["EXT"] = []string{""}
+	w.Header().Set("Server", dlnaServer)
+	writeXML(w, b.String())
+}
+
+func writeSOAPFault(w http.ResponseWriter, code int, desc string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault>`+
+		`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">`+
+		`<errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, xmlEscape(desc))
+}
+
+// dlnaObjectID maps a share path to a ContentDirectory object id: "0" is
+// the root, everything else is the path relative to it.
+func dlnaObjectID(upath string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+upath), "/")
+	if rel == "" {
+		return "0"
+	}
+	return rel
+}
+
+func dlnaParentID(upath string) string {
+	if dlnaObjectID(upath) == "0" {
+		return "-1"
+	}
+	return dlnaObjectID(path.Dir(path.Clean("/" + upath)))
+}
+
+// dlnaBrowse answers Browse from the same directory listing the web pages
+// use, so hidden and excluded files stay hidden from TVs too.
+func dlnaBrowse(w http.ResponseWriter, r *http.Request, id, flag string, start, count int) {
+	upath := "/"
+	if id != "0" && id != "" {
+		upath = path.Clean("/" + id)
+	}
+	full, err := resolveFor(r, upath)
+	if err != nil {
+		writeSOAPFault(w, 701, "No such object")
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil {
+		writeSOAPFault(w, 701, "No such object")
+		return
+	}
+	base := "http://" + r.Host
+	var didl strings.Builder
+	returned, total := 0, 0
+	switch flag {
+	case "BrowseMetadata":
+		if fi.IsDir() {
+			writeDIDLContainer(&didl, upath, fi.Name(), childCount(full, upath))
+		} else {
+			p, ok := dlnaProfileFor(fi.Name())
+			if !ok {
+				writeSOAPFault(w, 701, "No such object")
+				return
+			}
+			writeDIDLItem(&didl, base, upath, full, fi, p)
+		}
+		returned, total = 1, 1
+	case "BrowseDirectChildren":
+		if !fi.IsDir() {
+			writeSOAPFault(w, 710, "No such container")
+			return
+		}
+		lst, err := listDir(full, upath, listOptions{sort: "name", order: "asc", page: 1, perPage: math.MaxInt32, kind: "all", client: r})
+		if err != nil {
+			writeSOAPFault(w, 501, "Action Failed")
+			return
+		}
+		var entries []dirEntry
+		for _, e := range lst.Entries {
+			if _, ok := dlnaProfileFor(e.Name); e.IsDir || ok {
+				entries = append(entries, e)
+			}
+		}
+		total = len(entries)
+		if start > len(entries) {
+			start = len(entries)
+		}
+		end := len(entries)
+		if count > 0 && start+count < end {
+			end = start + count
+		}
+		for _, e := range entries[start:end] {
+			p := path.Join(upath, e.Name)
+			if e.IsDir {
+				writeDIDLContainer(&didl, p, e.Name, childCount(filepath.Join(full, e.Name), p))
+				continue
+			}
+			efi, err := e.de.Info()
+			if err != nil {
+				continue
+			}
+			prof, _ := dlnaProfileFor(e.Name)
+			writeDIDLItem(&didl, base, p, filepath.Join(full, e.Name), efi, prof)
+		}
+		returned = end - start
+	default:
+		writeSOAPFault(w, 402, "Invalid Args")
+		return
+	}
+	result := `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/" xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/">` +
+		didl.String() + `</DIDL-Lite>`
+	writeSOAP(w, dlnaCDS, "Browse", "Result", result, "NumberReturned", strconv.Itoa(returned),
+		"TotalMatches", strconv.Itoa(total), "UpdateID", "1")
+}
+
+// childCount counts what a folder would list, without stat'ing anything.
+func childCount(full, upath string) int {
+	des, err := readShareDir(full)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, de := range des {
+		if !visible(path.Join(upath, de.Name())) {
+			continue
+		}
+		if _, ok := dlnaProfileFor(de.Name()); de.IsDir() || ok {
+			n++
+		}
+	}
+	return n
+}
+
+func writeDIDLContainer(b *strings.Builder, upath, name string, children int) {
+	if upath == "/" {
+		name = dlnaName
+	}
+	fmt.Fprintf(b, `<container id="%s" parentID="%s" childCount="%d" restricted="1" searchable="0"><dc:title>%s</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`,
+		xmlEscape(dlnaObjectID(upath)), xmlEscape(dlnaParentID(upath)), children, xmlEscape(name))
+}
+
+func writeDIDLItem(b *strings.Builder, base, upath, full string, fi os.FileInfo, p dlnaProfile) {
+	class := "object.item.videoItem"
+	if strings.HasPrefix(p.mime, "image/") {
+		class = "object.item.imageItem.photo"
+	}
+	title := strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name()))
+	res := fmt.Sprintf(` protocolInfo="%s" size="%d"`, xmlEscape(p.protocolInfo()), fi.Size())
+	if info, ok := cachedMediaInfo(full, fi.Size(), fi.ModTime()); ok && info.DurationS > 0 {
+		res += ` duration="` + dlnaDuration(info.DurationS) + `"`
+	}
+	fmt.Fprintf(b, `<item id="%s" parentID="%s" restricted="1"><dc:title>%s</dc:title><upnp:class>%s</upnp:class><dc:date>%s</dc:date><res%s>%s</res></item>`,
+		xmlEscape(dlnaObjectID(upath)), xmlEscape(dlnaParentID(upath)), xmlEscape(title), class,
+		fi.ModTime().UTC().Format("2006-01-02T15:04:05"), res, xmlEscape(base+escapePath(upath)))
+}
+
+// dlnaDuration formats seconds as H:MM:SS.mmm, the form DIDL-Lite uses.
+func dlnaDuration(s float64) string {
+	ms := int64(math.Round(s * 1000))
+	return fmt.Sprintf("%d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// dlnaSubscribe accepts GENA event subscriptions. Nothing ever changes, so
+// the only event sent is the initial one carrying the current state.
+func dlnaSubscribe(w http.ResponseWriter, r *http.Request, props string) {
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid := r.Header.Get("Sid")
+		callback := strings.Trim(r.Header.Get("Callback"), "<> ")
+		if sid == "" {
+			if i := strings.Index(callback, ">"); i >= 0 {
+				callback = callback[:i]
+			}
+			if !strings.HasPrefix(callback, "http://") {
+				http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+				return
+			}
+			id := make([]byte, 16)
+			rand.Read(id)
+			sid = "uuid:" + hex.EncodeToString(id)
+			go sendInitialEvent(callback, sid, props)
+		}
+		w.Header()["SID"] = []string{sid}
+		w.Header()["TIMEOUT"] = []string{"Second-" + strconv.Itoa(ssdpMaxAge)}
+		w.Header().Set("Server", dlnaServer)
+		w.WriteHeader(http.StatusOK)
+	case "UNSUBSCRIBE":
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.Header().Set("Allow", "SUBSCRIBE, UNSUBSCRIBE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func sendInitialEvent(callback, sid, props string) {
+	body := `<?xml version="1.0" encoding="utf-8"?><e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0"><e:property>` + props + `</e:property></e:propertyset>`
+	req, err := http.NewRequest("NOTIFY", callback, strings.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("NTS", "upnp:propchange")
+	req.Header.Set("SID", sid)
+	req.Header.Set("SEQ", "0")
+	client := http.Client{Timeout: 5 * time.Second}
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+const dlnaDeviceXML = `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+<friendlyName>%s</friendlyName>
+<manufacturer>local-movies-sharing-server</manufacturer>
+<modelName>fileserver</modelName>
+<modelNumber>1</modelNumber>
+<UDN>uuid:%s</UDN>
+<dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
+<presentationURL>/</presentationURL>
+<serviceList>
+<service>
+<serviceType>urn:schemas-upnp-org:service:ContentDirectory:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+<SCPDURL>/dlna/cds.xml</SCPDURL>
+<controlURL>/dlna/cds/control</controlURL>
+<eventSubURL>/dlna/cds/event</eventSubURL>
+</service>
+<service>
+<serviceType>urn:schemas-upnp-org:service:ConnectionManager:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+<SCPDURL>/dlna/cms.xml</SCPDURL>
+<controlURL>/dlna/cms/control</controlURL>
+<eventSubURL>/dlna/cms/event</eventSubURL>
+</service>
+</serviceList>
+</device>
+</root>`
+
+const cdsSCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>Browse</name><argumentList>
+<argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+<argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+<argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+<argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+<argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+<argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+<argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetSearchCapabilities</name><argumentList>
+<argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetSortCapabilities</name><argumentList>
+<argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetSystemUpdateID</name><argumentList>
+<argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+</argumentList></action>
+</actionList>
+<serviceStateTable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType><allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+</serviceStateTable>
+</scpd>`
+
+const cmsSCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>GetProtocolInfo</name><argumentList>
+<argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+<argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetCurrentConnectionIDs</name><argumentList>
+<argument><name>ConnectionIDs</name><direction>out</direction><relatedStateVariable>CurrentConnectionIDs</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetCurrentConnectionInfo</name><argumentList>
+<argument><name>ConnectionID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+<argument><name>RcsID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_RcsID</relatedStateVariable></argument>
+<argument><name>AVTransportID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_AVTransportID</relatedStateVariable></argument>
+<argument><name>ProtocolInfo</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ProtocolInfo</relatedStateVariable></argument>
+<argument><name>PeerConnectionManager</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionManager</relatedStateVariable></argument>
+<argument><name>PeerConnectionID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+<argument><name>Direction</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Direction</relatedStateVariable></argument>
+<argument><name>Status</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionStatus</relatedStateVariable></argument>
+</argumentList></action>
+</actionList>
+<serviceStateTable>
+<stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>CurrentConnectionIDs</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionStatus</name><dataType>string</dataType><allowedValueList><allowedValue>OK</allowedValue><allowedValue>ContentFormatMismatch</allowedValue><allowedValue>InsufficientBandwidth</allowedValue><allowedValue>UnreliableChannel</allowedValue><allowedValue>Unknown</allowedValue></allowedValueList></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionManager</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Direction</name><dataType>string</dataType><allowedValueList><allowedValue>Input</allowedValue><allowedValue>Output</allowedValue></allowedValueList></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ProtocolInfo</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionID</name><dataType>i4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_AVTransportID</name><dataType>i4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_RcsID</name><dataType>i4</dataType></stateVariable>
+</serviceStateTable>
+</scpd>`
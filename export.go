@@ -0,0 +1,83 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// strmSidecar reports whether a file is metadata Kodi reads next to a
+// video: .nfo files and artwork.
+func strmSidecar(it libraryItem) bool {
+	return it.Kind == "image" || strings.EqualFold(path.Ext(it.Path), ".nfo")
+}
+
+// exportStrmHandler serves /api/export/strm: a zip mirroring the media
+// tree with every video replaced by a .strm file holding its URL, which
+// Kodi can scan as a library. ?base= sets the server address written into
+// the files and ?with-metadata=1 adds .nfo files and artwork as they are.
+func exportStrmHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	base := baseURL(r)
+	if v := q.Get("base"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			jsonError(w, "base must be an http:// or https:// URL", http.StatusBadRequest)
+			return
+		}
+		base = strings.TrimSuffix(v, "/")
+	}
+	withMeta := q.Get("with-metadata") == "1"
+	items, _ := library.get(false)
+	items = visibleTo(r, items)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", attachment("strm.zip"))
+	if r.Method == http.MethodHead {
+		return
+	}
+	zw := zip.NewWriter(w)
+	for _, it := range items {
+		switch {
+		case it.Kind == "video":
+			name := strings.TrimSuffix(it.Path, path.Ext(it.Path)) + ".strm"
+			f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: it.ModTime})
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(f, withToken(r, base+it.URL))
+		case withMeta && strmSidecar(it):
+			if err := zipFile(zw, it); err != nil {
+				fmt.Fprintf(os.Stderr, "export: %s: %v\n", it.Path, err)
+				if r.Context().Err() != nil {
+					return
+				}
+			}
+		}
+	}
+	zw.Close()
+}
+
+// zipFile stores a file in the archive as it is on disk.
+func zipFile(zw *zip.Writer, it libraryItem) error {
+	src, err := os.Open(filepath.Join(root, filepath.FromSlash(it.Path)))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	method := zip.Store
+	if it.Kind != "image" {
+		method = zip.Deflate
+	}
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: it.Path, Method: method, Modified: it.ModTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	return err
+}
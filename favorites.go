@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pruneFavorites drops favorites whose target is gone or excluded instead
+// of showing them greyed out.
+var pruneFavorites bool
+
+type favoriteItem struct {
+	Path    string    `json:"path"`
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	IsDir   bool      `json:"is_dir"`
+	Missing bool      `json:"missing,omitempty"`
+	Added   time.Time `json:"added"`
+}
+
+func favoriteSet(client string) map[string]bool {
+	state.Lock()
+	defer state.Unlock()
+	set := make(map[string]bool, len(state.data.Favorites[client]))
+	for p := range state.data.Favorites[client] {
+		set[p] = true
+	}
+	return set
+}
+
+// markFavorites flags the client's favorites among listing entries.
+func markFavorites(client, upath string, entries []dirEntry) {
+	set := favoriteSet(client)
+	if len(set) == 0 {
+		return
+	}
+	for i, e := range entries {
+		entries[i].Favorite = set[strings.TrimPrefix(path.Join(upath, e.Name), "/")]
+	}
+}
+
+// favoritesFor lists the client's favorites by path, leaving out those r
+// may not reach.
+func favoritesFor(r *http.Request, client string) []favoriteItem {
+	state.Lock()
+	saved := make(map[string]time.Time, len(state.data.Favorites[client]))
+	for p, t := range state.data.Favorites[client] {
+		saved[p] = t
+	}
+	state.Unlock()
+	items := []favoriteItem{}
+	var gone []string
+	for p, added := range saved {
+		it := favoriteItem{Path: p, Name: path.Base(p), URL: escapePath("/" + p), Added: added}
+		full, err := resolvePath("/" + p)
+		var fi os.FileInfo
+		if err == nil {
+			fi, err = os.Stat(full)
+		}
+		switch {
+		case err != nil && pruneFavorites:
+			gone = append(gone, p)
+			continue
+		case err != nil:
+			it.Missing = true
+		case !accessible(r, p, fi.IsDir()):
+			continue
+		case fi.IsDir():
+			it.IsDir, it.URL = true, it.URL+"/"
+		}
+		items = append(items, it)
+	}
+	if len(gone) > 0 {
+		state.Lock()
+		for _, p := range gone {
+			delete(state.data.Favorites[client], p)
+		}
+		state.Unlock()
+		saveState()
+	}
+	sort.Slice(items, func(i, j int) bool { return naturalCompare(items[i].Path, items[j].Path) < 0 })
+	return items
+}
+
+// favoritesHandler serves GET /api/favorites and POST or DELETE with
+// {path} to add or remove one; DELETE also takes ?path=.
+func favoritesHandler(w http.ResponseWriter, r *http.Request) {
+	client := clientID(w, r)
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		items := favoritesFor(r, client)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"count": len(items), "items": items})
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+	}
+	req.Path = r.URL.Query().Get("path")
+	if req.Path == "" {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			jsonError(w, "body must be JSON {path}", http.StatusBadRequest)
+			return
+		}
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+req.Path), "/")
+	if rel == "" {
+		jsonError(w, "path must name a file or directory below the root", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		state.Lock()
+		delete(state.data.Favorites[client], rel)
+		state.Unlock()
+		saveState()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	full, err := resolveFor(r, "/"+rel)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil {
+		jsonError(w, "not found", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	state.Lock()
+	if state.data.Favorites[client] == nil {
+		state.data.Favorites[client] = map[string]time.Time{}
+	}
+	if t, ok := state.data.Favorites[client][rel]; ok {
+		now = t
+	} else {
+		state.data.Favorites[client][rel] = now
+	}
+	state.Unlock()
+	saveState()
+	it := favoriteItem{Path: rel, Name: path.Base(rel), URL: escapePath("/" + rel), IsDir: fi.IsDir(), Added: now}
+	if it.IsDir {
+		it.URL += "/"
+	}
+	writeJSON(w, http.StatusOK, it)
+}
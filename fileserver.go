@@ -2,88 +2,607 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"mime"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var dir string
+var root string
 var addr string
 var speedBytes int64
 
+// version is reported to network clients; release builds set it with
+// -ldflags "-X main.version=...".
+var version = "1.0"
+
 func main() {
 	flag.StringVar(&dir, "dir", ".", "")
 	flag.StringVar(&addr, "addr", "0.0.0.0:8080", "")
 	flag.Int64Var(&speedBytes, "speedbytes", 50<<20, "bytes to stream in /speedtest default 50MB")
+	flag.BoolVar(&diskBenchEnabled, "diskbench", false, "enable /api/diskbench and /speedtest?diag=1, which read files at full speed to benchmark the disk")
+	flag.BoolVar(&noSpeedHistory, "no-speedtest-history", false, "do not keep speedtest results for /api/speedtest/history")
+	flag.BoolVar(&showHidden, "show-hidden", false, "list and serve dotfiles and system junk (.DS_Store, Thumbs.db, ...)")
+	flag.Var(&excludes, "exclude", excludeUsage)
+	flag.StringVar(&mediaExtList, "media-ext", "mkv,mp4,avi,ts,m2ts,iso", "comma-separated extensions treated as media files")
+	flag.DurationVar(&libraryRefresh, "library-refresh", 5*time.Minute, "how long the /api/library index is cached before the share is walked again")
+	flag.Var(&bufSize, "bufsize", "I/O buffer size for streaming copies, e.g. 256KB or 4MB (32KB-64MB)")
+	flag.Var(&limitPerConn, "limit-per-conn", "per-connection bandwidth limit for file transfers, e.g. 10MB (bytes per second, 0 = unlimited)")
+	flag.Var(&limitTotal, "limit-total", "bandwidth cap shared by all file transfers, e.g. 40MB (bytes per second, 0 = unlimited)")
+	flag.Var(&limitUpload, "limit-upload", "per-connection bandwidth limit for uploads, e.g. 5MB (bytes per second, 0 = unlimited); uploads also count against -limit-total")
+	flag.IntVar(&maxTransfers, "max-transfers", 0, "maximum concurrent file transfers (0 = unlimited); files below -small-file are not counted")
+	flag.DurationVar(&transferWait, "transfer-wait", 5*time.Second, "how long a transfer waits for a free slot before getting 503 (0 = reject at once)")
+	flag.Var(&smallFile, "small-file", "files smaller than this bypass -max-transfers")
+	flag.Var(&mimeOverrides, "mime", "ext=type content type override, e.g. mkv=video/webm (repeatable)")
+	flag.BoolVar(&noTranscodeSubs, "no-transcode-subs", false, "serve subtitle files as raw bytes instead of converting them to UTF-8")
+	flag.BoolVar(&noCompress, "no-compress", false, "disable gzip compression of listings, JSON and text files")
+	flag.StringVar(&ffmpegPath, "ffmpeg", "", "ffmpeg binary enabling /hls/ transcoding, /remux/ and /audio/ (disabled when empty)")
+	flag.IntVar(&maxTranscodes, "max-transcodes", 2, "maximum concurrent ffmpeg processes for /hls/, /remux/ and /audio/ (0 = unlimited)")
+	flag.DurationVar(&transcodeIdle, "transcode-idle", 30*time.Second, "stop a transcode when its client has fetched nothing for this long")
+	flag.StringVar(&hwaccel, "hwaccel", "none", hwaccelUsage)
+	flag.StringVar(&vaapiDevice, "vaapi-device", "/dev/dri/renderD128", "DRM render node used by -hwaccel vaapi")
+	flag.StringVar(&ffprobePath, "ffprobe", "ffprobe", "ffprobe binary for /api/mediainfo (disabled when not found)")
+	flag.StringVar(&cacheDir, "cache-dir", "", "directory for persistent caches such as media info (memory only when empty)")
+	flag.StringVar(&mdnsName, "name", "fileserver", "name the server is announced under via mDNS; it is also reachable as <name>.local")
+	flag.BoolVar(&noMDNS, "no-mdns", false, "do not announce the server on the local network via mDNS")
+	flag.BoolVar(&dlnaEnabled, "dlna", false, "announce the share as a DLNA/UPnP media server for TVs on the local network")
+	flag.StringVar(&dlnaName, "dlna-name", "", "name TVs show for the DLNA server (default \"fileserver (<hostname>)\")")
+	flag.StringVar(&stateFile, "state", defaultStateFile(), "JSON file keeping watch progress, favorites and file statistics between restarts (memory only when empty); speedtest results go next to it")
+	flag.DurationVar(&progressRetention, "progress-retention", 180*24*time.Hour, "forget a watch position this long after it was last updated (0 = never)")
+	flag.BoolVar(&pruneFavorites, "prune-favorites", false, "forget favorites whose file or directory is gone instead of greying them out")
+	flag.BoolVar(&noHistory, "no-history", false, "do not collect per-file download and play statistics")
+	flag.BoolVar(&allowUpload, "allow-upload", false, "accept uploads into the share through POST /upload and PUT /files/<path>, renames through POST /api/move and new directories through POST /api/mkdir")
+	flag.Var(&maxUploadSize, "max-upload-size", "largest accepted upload request, e.g. 20GB (0 = unlimited)")
+	flag.DurationVar(&uploadTTL, "upload-ttl", 24*time.Hour, "discard an unfinished resumable upload this long after its last data arrived (0 = never)")
+	flag.DurationVar(&tempMaxAge, "temp-max-age", 24*time.Hour, "remove temporary files left by interrupted uploads and moves once they are this old, at startup and hourly (0 = never)")
+	flag.BoolVar(&allowDelete, "allow-delete", false, "allow DELETE /files/<path>, which moves files into .trash/ in the share")
+	flag.StringVar(&templatePath, "template", "", "html/template file overriding the built-in directory listing")
+	flag.Var(&authPairs, "auth", "require HTTP Basic authentication as user:pass on every route (repeatable for several accounts)")
+	flag.StringVar(&authFile, "auth-file", "", "file of user:bcrypt-hash lines, as written by htpasswd -B, accepted on top of -auth")
+	flag.StringVar(&certFile, "cert", "", "TLS certificate file (PEM); with -key the server speaks HTTPS only")
+	flag.StringVar(&keyFile, "key", "", "TLS private key file (PEM) for -cert")
+	flag.BoolVar(&tlsSelfSigned, "tls-self-signed", false, "serve HTTPS with a self-signed certificate made on first start and kept next to -state")
+	flag.StringVar(&httpRedirect, "http-redirect", "", "with HTTPS, also listen for plain HTTP on this address, e.g. :8081, and redirect it to HTTPS")
+	flag.Var(&acmeDomains, "acme-domain", "serve HTTPS with certificates from Let's Encrypt for this public domain name (repeatable); listens on :443 unless -addr is given")
+	flag.StringVar(&acmeCache, "acme-cache", "", "directory keeping ACME account and certificates between restarts (default: fileserver-acme next to -state)")
+	flag.StringVar(&acmeEmail, "acme-email", "", "contact address Let's Encrypt sends expiry notices to")
+	flag.StringVar(&acmeHTTP, "acme-http", "", "with -acme-domain, also listen for plain HTTP on this address, e.g. :80, answering HTTP-01 challenges and redirecting the rest to HTTPS")
+	flag.StringVar(&mtlsCA, "mtls-ca", "", "with HTTPS, require a client certificate signed by a CA in this PEM file on every connection")
+	flag.Var(&mtlsAdmins, "mtls-admin-cn", "client certificate common name allowed to upload, move and delete; every other certificate is read-only (repeatable)")
+	flag.Var(&allowSpecs, "allow", "only accept clients from this address or CIDR, e.g. 192.168.1.0/24 (repeatable)")
+	flag.Var(&denySpecs, "deny", "refuse clients from this address or CIDR, even one -allow covers (repeatable)")
+	flag.Var(&proxySpecs, "trusted-proxy", "address or CIDR of a reverse proxy whose X-Forwarded-For names the client to check -allow and -deny against (repeatable)")
+	flag.Float64Var(&requestRate, "rate", 0, "requests per second one client may make to listings, search, the API and speedtest, e.g. 10 (0 = unlimited); file transfers are not counted")
+	flag.IntVar(&requestBurst, "burst", 30, "requests one client may make at once before -rate applies")
+	flag.Var(&rateExemptSpecs, "rate-exempt", "address or CIDR -rate does not apply to, on top of loopback (repeatable)")
+	flag.Var(&followSymlinks, "follow-symlinks", "symlinks in the share: off hides them, root follows those that stay inside -dir, all follows every one")
+	flag.StringVar(&usersFile, "users", "", "JSON list of {username, hash, role} users who sign in at /login; hash is bcrypt, role viewer or admin (only admins upload, move and delete)")
+	flag.DurationVar(&sessionIdle, "session-idle", 7*24*time.Hour, "sign a -users session out after this long without a request (0 = never)")
+	flag.Var(&allowedHostSpecs, "allowed-hosts", "comma-separated host names the server answers to besides IP addresses, localhost, *.local and its own hostname, e.g. movies.home,*.lan (repeatable)")
+	flag.BoolVar(&allowEmptyHost, "allow-empty-host", false, "answer requests without a Host header, as some old HTTP/1.0 TVs send")
+	flag.BoolVar(&noHostCheck, "no-host-check", false, "answer requests for any Host header")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 20*time.Second, "drop a connection that has not sent its request headers within this long (0 = never)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "close a keep-alive connection after this long without a request (0 = never)")
+	flag.DurationVar(&stallTimeout, "stall-timeout", time.Minute, "give up on a response when one write to the client takes longer than this, e.g. a phone that went away mid-movie (0 = never); streams of any length are fine while the client keeps reading")
+	flag.Var(&maxHeaderBytes, "max-header-bytes", "largest request header accepted, e.g. 64KB")
+	flag.StringVar(&accessLogFormat, "log-format", "clf", "access log format: clf (Combined Log Format plus the time taken) or json")
+	flag.StringVar(&accessLogPath, "access-log", "", "append the access log to this file instead of stdout")
+	flag.BoolVar(&quietLog, "quiet", false, "write no access log; warnings and errors are still printed")
+	flag.BoolVar(&metricsEnabled, "metrics", false, "serve Prometheus metrics at /metrics")
+	flag.BoolVar(&metricsNoAuth, "metrics-no-auth", false, "let /metrics be scraped without the credentials -auth, -token or -users ask for")
+	flag.Var(&tokenSpecs, "token", "accept a token as Authorization: Bearer or ?token=, given as secret, name:secret or name:secret:read|write (repeatable; a secret of auto is generated and printed)")
 	flag.Parse()
+	mediaExts = parseMediaExts(mediaExtList)
+	if err := registerMIME(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	loadTemplates()
+	if maxTransfers > 0 {
+		transferSlots = make(chan struct{}, maxTransfers)
+	}
+	if limitTotal > 0 {
+		globalBucket = newSharedBucket(int64(limitTotal))
+	}
+	if err := checkBufSize(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkExcludes(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkIPRules(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkRateLimit(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkTLS(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkMetrics(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkAccessLog(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkHosts(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if acmeEnabled() {
+		// The CA checks TLS-ALPN-01 on port 443; a port-forward can still
+		// point that at another -addr.
+		explicit := false
+		flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "addr" })
+		if !explicit {
+			addr = ":443"
+		}
+	}
+	if err := loadAccounts(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := loadUsers(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkFFmpeg(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkHWAccel(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if ffmpegPath != "" {
+		stopTranscodesOnSignal()
+	}
+	if err := checkFFprobe(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	info, err := os.Stat(dir)
 	if err != nil || !info.IsDir() {
 		fmt.Fprintln(os.Stderr, "invalid dir")
 		os.Exit(1)
 	}
+	root, err = filepath.Abs(dir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid dir:", err)
+		os.Exit(1)
+	}
+	checkDLNA()
+	loadState()
+	loadChecksumCache()
+	startStats()
+	loadSpeedHistory()
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/speedtest", speedTestHandler)
-	server := &http.Server{Addr: addr, ReadTimeout: 0, WriteTimeout: 0, IdleTimeout: 0}
+	http.HandleFunc("/speedtest/upload", speedUploadHandler)
+	http.HandleFunc("/speedtest/ui", speedTestUIHandler)
+	http.HandleFunc("/api/speedtest/history", speedHistoryHandler)
+	http.HandleFunc("/api/speedtest/result", speedResultHandler)
+	http.HandleFunc("/api/speedtest/start", speedStartHandler)
+	http.HandleFunc("/api/speedtest/result/", speedTestResultHandler)
+	http.HandleFunc("/api/ping", pingHandler)
+	http.HandleFunc("/api/diskbench", diskBenchHandler)
+	http.HandleFunc("/api/library", libraryHandler)
+	http.HandleFunc("/api/search", searchHandler)
+	http.HandleFunc("/api/dirsize", dirSizeHandler)
+	http.HandleFunc("/api/checksum", checksumHandler)
+	http.HandleFunc("/api/recent", recentAPIHandler)
+	http.HandleFunc("/api/subs", subsHandler)
+	http.HandleFunc("/play/", playHandler)
+	http.HandleFunc("/hls/", hlsHandler)
+	http.HandleFunc("/remux/", remuxHandler)
+	http.HandleFunc("/audio/", audioHandler)
+	http.HandleFunc("/api/transcodes", transcodesHandler)
+	http.HandleFunc("/api/mediainfo", mediaInfoHandler)
+	http.HandleFunc("/api/chapters", chaptersHandler)
+	http.HandleFunc("/api/cast-info", castInfoHandler)
+	http.HandleFunc("/api/progress", progressHandler)
+	http.HandleFunc("/api/continue", continueHandler)
+	http.HandleFunc("/api/favorites", favoritesHandler)
+	http.HandleFunc("/api/stats/files", fileStatsHandler)
+	http.HandleFunc("/api/party", partyCreateHandler)
+	http.HandleFunc("/party/", partyHandler)
+	http.HandleFunc("/api/qr", qrHandler)
+	http.HandleFunc("/api/export/strm", exportStrmHandler)
+	http.HandleFunc("/api/thumb", thumbHandler)
+	http.HandleFunc("/api/frame", frameHandler)
+	http.HandleFunc("/api/trickplay", trickplayHandler)
+	http.HandleFunc("/api/trickplay/", trickplayFileHandler)
+	http.HandleFunc("/recent", recentPageHandler)
+	http.HandleFunc("/playlist.m3u", playlistHandler)
+	http.HandleFunc("/zip/", zipHandler)
+	http.HandleFunc("/tar/", tarHandler)
+	http.HandleFunc("/api/archive", archiveHandler)
+	http.HandleFunc("/dlna/", dlnaHandler)
+	http.HandleFunc("/api/share", shareAPIHandler)
+	http.HandleFunc("/api/share/", shareDeleteHandler)
+	http.HandleFunc("/s/", shareHandler)
+	if metricsEnabled {
+		http.HandleFunc("/metrics", metricsHandler)
+	}
+	if users != nil {
+		http.HandleFunc("/login", loginHandler)
+		http.HandleFunc("/logout", logoutHandler)
+	}
+	if allowUpload || allowDelete {
+		http.HandleFunc("/files/", filesHandler)
+	}
+	if allowDelete {
+		http.HandleFunc("/api/trash", trashHandler)
+		http.HandleFunc("/api/trash/restore", trashRestoreHandler)
+	}
+	if allowUpload {
+		http.HandleFunc("/upload", uploadHandler)
+		http.HandleFunc("/api/move", moveHandler)
+		http.HandleFunc("/api/mkdir", mkdirHandler)
+		http.HandleFunc("/api/uploads", uploadsHandler)
+		http.HandleFunc("/api/uploads/", uploadSessionHandler)
+		startUploadGC()
+		startTempSweep()
+	}
+	var handler http.Handler = http.DefaultServeMux
+	if !noCompress {
+		handler = withCompression(handler)
+	}
+	if authEnabled() {
+		handler = withAuth(handler)
+	}
+	handler = withSameOrigin(handler)
+	if requestRate > 0 {
+		// Outside withAuth, so guessing passwords counts as well.
+		handler = withRateLimit(handler)
+	}
+	if ipRulesEnabled() && trustedProxies != nil {
+		handler = withIPRules(handler)
+	}
+	if !noHostCheck {
+		handler = withHostCheck(handler)
+	}
+	if metricsEnabled {
+		handler = withMetrics(handler)
+	}
+	if !quietLog {
+		handler = withAccessLog(handler)
+	}
+	if stallTimeout > 0 {
+		handler = withWriteDeadline(handler)
+	}
+	server := newServer(handler)
+	server.Addr = addr
+	server.ConnContext = authConnContext
+	if metricsEnabled {
+		server.ConnState = trackConn
+	}
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "listen error:", err)
 		os.Exit(1)
 	}
-	fmt.Printf("Serving %s on http://%s\n", dir, ln.Addr().String())
-	if err := server.Serve(ln); err != nil {
+	if ipRulesEnabled() {
+		ln = filteredListener{ln}
+	}
+	fmt.Printf("Serving %s on %s://%s\n", dir, scheme(), ln.Addr().String())
+	tcp := ln.Addr().(*net.TCPAddr)
+	initLANURLs(tcp.IP, tcp.Port)
+	printShareQR(tcp.Port)
+	if !noMDNS {
+		startMDNS(tcp.IP, tcp.Port)
+	}
+	if dlnaEnabled {
+		if err := startSSDP(tcp.IP, tcp.Port); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if tlsEnabled() {
+		server.TLSConfig = tlsConfig()
+		if tlsSelfSigned {
+			if err := startSelfSigned(server.TLSConfig, tcp.IP); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		if acmeEnabled() {
+			m := acmeManager()
+			startACME(server.TLSConfig, m)
+			startACMEHTTP(m)
+		}
+		startHTTPRedirect(tcp.Port)
+		err = server.ServeTLS(ln, certFile, keyFile)
+	} else {
+		err = server.Serve(ln)
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, "server error:", err)
 	}
 }
 
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+var errBadPath = errors.New("bad path")
+var errForbidden = errors.New("forbidden")
+
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	upath := filepath.Clean(r.URL.Path)
-	full := filepath.Join(dir, upath)
+	asJSON := wantsJSON(r)
+	upath, err := requestPath(r)
+	if err != nil {
+		writeError(w, asJSON, "bad path", http.StatusBadRequest)
+		return
+	}
+	full, err := resolveFor(r, upath)
+	if err != nil {
+		writePathError(w, asJSON, err)
+		return
+	}
 	fi, err := os.Stat(full)
 	if err != nil {
-		http.NotFound(w, r)
+		writeError(w, asJSON, "not found", http.StatusNotFound)
 		return
 	}
-	if fi.IsDir() {
-		f, err := os.Open(full)
-		if err != nil {
-			http.Error(w, "cannot open dir", http.StatusInternalServerError)
+	trailing := strings.HasSuffix(r.URL.Path, "/")
+	if fi.IsDir() && !trailing {
+		localRedirect(w, r, path.Base(r.URL.EscapedPath())+"/")
+		return
+	}
+	if !fi.IsDir() && trailing {
+		localRedirect(w, r, "../"+path.Base(r.URL.EscapedPath()))
+		return
+	}
+	if !fi.IsDir() {
+		if castMedia(fi.Name()) && allowCORS(w, r) {
 			return
 		}
-		list, err := f.Readdir(-1)
-		_ = f.Close()
-		if err != nil {
-			http.Error(w, "cannot read dir", http.StatusInternalServerError)
+		if asJSON && r.URL.Query().Get("format") == "json" {
+			writeError(w, asJSON, "not a directory", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("as") == "vtt" && strings.EqualFold(filepath.Ext(full), ".srt") {
+			serveVTT(w, r, full, fi)
 			return
 		}
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		fmt.Fprintf(w, "<html><head><meta charset='utf-8'><title>%s</title></head><body><h1>%s</h1><ul>", upath, upath)
-		for _, e := range list {
-			name := e.Name()
-			href := filepath.ToSlash(filepath.Join(upath, name))
-			fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> %s</li>", href, name, human(e.Size()))
+		if !noTranscodeSubs && textSubtitleExts[strings.ToLower(filepath.Ext(full))] {
+			serveSubtitle(w, r, full, fi)
+			return
+		}
+		dlnaHeaders(w, r, fi.Name())
+		serveFileFast(w, r, full, fi)
+		return
+	}
+	serveListing(w, r, full, upath, asJSON)
+}
+
+// requestPath decodes the request path one segment at a time and returns it
+// cleaned and slash-separated. Decoding per segment means an encoded "%2F"
+// cannot be used to smuggle an extra separator into the path.
+func requestPath(r *http.Request) (string, error) {
+	return decodePath(r.URL.EscapedPath())
+}
+
+// decodePath is requestPath for an escaped path with a route prefix such as
+// "/play" already removed.
+func decodePath(escaped string) (string, error) {
+	segs := strings.Split(escaped, "/")
+	for i, seg := range segs {
+		dec, err := url.PathUnescape(seg)
+		if err != nil {
+			return "", errBadPath
+		}
+		if strings.ContainsAny(dec, "/\x00") {
+			return "", errBadPath
+		}
+		segs[i] = dec
+	}
+	return path.Clean("/" + strings.Join(segs, "/")), nil
+}
+
+// resolvePath maps a slash-separated request path onto the filesystem under
+// root. Paths that are not local (drive letters, reserved names, stray "..")
+// or that lead through a symlink -follow-symlinks does not follow yield
+// errForbidden; paths that do not exist, dangle or are not visible yield
+// os.ErrNotExist, as do all symlinks with -follow-symlinks=off.
+func resolvePath(upath string) (string, error) {
+	rel := strings.TrimPrefix(path.Clean("/"+upath), "/")
+	if rel == "" {
+		return root, nil
+	}
+	if !visible(rel) {
+		return "", os.ErrNotExist
+	}
+	local := filepath.FromSlash(rel)
+	if !filepath.IsLocal(local) {
+		return "", errForbidden
+	}
+	full := filepath.Join(root, local)
+	real, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return "", os.ErrNotExist
+	}
+	if !targetAllowed(full, real) {
+		if followSymlinks == "off" {
+			return "", os.ErrNotExist
 		}
-		fmt.Fprint(w, "</ul></body></html>")
+		return "", errForbidden
+	}
+	// A link must not be a way round -exclude or the hidden names.
+	if real != full && !targetVisible(real) {
+		return "", os.ErrNotExist
+	}
+	return full, nil
+}
+
+func insideRoot(p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel == "." || filepath.IsLocal(rel)
+}
+
+// escapePath percent-encodes every segment of a slash-separated path so that
+// names containing '#', '?', '%' or spaces survive as a single link target.
+func escapePath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+// baseURL is the scheme and host the client reached the server at, for
+// absolute links that are opened outside the browser.
+func baseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+func dirURL(p string) string {
+	if p == "/" {
+		return "/"
+	}
+	return escapePath(p) + "/"
+}
+
+// localRedirect issues a relative redirect, as http.FileServer does, so it
+// keeps working when the server is mounted below a path prefix. The query
+// string is carried over.
+func localRedirect(w http.ResponseWriter, r *http.Request, target string) {
+	if q := r.URL.RawQuery; q != "" {
+		target += "?" + q
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeError(w http.ResponseWriter, asJSON bool, msg string, code int) {
+	if asJSON {
+		jsonError(w, msg, code)
+		return
+	}
+	http.Error(w, msg, code)
+}
+
+func writePathError(w http.ResponseWriter, asJSON bool, err error) {
+	if errors.Is(err, errForbidden) {
+		writeError(w, asJSON, "forbidden", http.StatusForbidden)
 		return
 	}
-	serveFileFast(w, r, full, fi)
+	writeError(w, asJSON, "not found", http.StatusNotFound)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "cannot encode json", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(js)
+}
+
+func jsonError(w http.ResponseWriter, msg string, code int) {
+	writeJSON(w, code, map[string]string{"error": msg})
 }
 
 func serveFileFast(w http.ResponseWriter, r *http.Request, path string, fi os.FileInfo) {
+	etag := fileETag(fi)
+	w.Header().Set("ETag", etag)
+	setDigestHeaders(w, path, fi)
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", contentType(fi.Name()))
+	}
+	if r.URL.Query().Get("download") == "1" {
+		w.Header().Set("Content-Disposition", attachment(fi.Name()))
+	}
+	if notModified(r, etag, fi.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method != http.MethodHead && fi.Size() >= int64(smallFile) {
+		release, ok := acquireTransfer(r, fi.Name())
+		if !ok {
+			writeBusy(w)
+			return
+		}
+		defer release()
+	}
+	w, done, err := throttle(w, r, fi.Name())
+	defer done()
+	if err != nil {
+		http.Error(w, "bad limit", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodHead {
+		var served func()
+		w, served = countServed(w, relPath(path))
+		defer served()
+	}
 	if r.Header.Get("Range") != "" {
 		f, err := os.Open(path)
 		if err != nil {
 			http.Error(w, "cannot open file", http.StatusInternalServerError)
 			return
 		}
-		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+		cw := &countingWriter{ResponseWriter: w}
+		start := time.Now()
+		http.ServeContent(cw, r, fi.Name(), fi.ModTime(), f)
 		_ = f.Close()
+		switch {
+		case r.Method == http.MethodHead || cw.n == 0:
+		case r.Context().Err() != nil || cw.err != nil:
+			logPartialTransfer(fi.Name()+" range "+r.Header.Get("Range"), cw.n, fi.Size(), start, r.RemoteAddr, failureReason(r, cw.err))
+		default:
+			logRangeTransfer(fi.Name(), r.Header.Get("Range"), cw.n, start, r.RemoteAddr)
+		}
+		if r.Method != http.MethodHead && cw.status < 300 {
+			recordTransfer(r, path, cw.n, r.Context().Err() == nil && cw.err == nil && cw.n == fi.Size(), strings.HasPrefix(r.Header.Get("Range"), "bytes=0-"))
+		}
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", fi.Size()))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if r.Method == http.MethodHead {
 		return
 	}
 	f, err := os.Open(path)
@@ -92,103 +611,107 @@ func serveFileFast(w http.ResponseWriter, r *http.Request, path string, fi os.Fi
 		return
 	}
 	defer f.Close()
-	typ := mime.TypeByExtension(strings.ToLower(filepath.Ext(path)))
-	if typ == "" {
-		typ = "application/octet-stream"
-	}
-	w.Header().Set("Content-Type", typ)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fi.Size()))
-	w.Header().Set("Accept-Ranges", "bytes")
-	buf := make([]byte, 1<<20)
 	start := time.Now()
-	n, err := io.CopyBuffer(w, f, buf)
-	if err != nil {
+	n, err := copyFile(w, r, f)
+	if err != nil || n < fi.Size() {
+		logPartialTransfer(fi.Name(), n, fi.Size(), start, r.RemoteAddr, failureReason(r, err))
+		recordTransfer(r, path, n, false, true)
 		return
 	}
-	elapsed := time.Since(start).Seconds()
-	if elapsed == 0 {
-		elapsed = 0.000001
-	}
-	fmt.Fprintf(os.Stdout, "%s transferred %s in %.2fs (%.2f MB/s)\n", fi.Name(), human(n), elapsed, float64(n)/(1024*1024)/elapsed)
+	logTransfer(fi.Name(), n, start, r.RemoteAddr)
+	recordTransfer(r, path, n, true, true)
 }
 
-func speedTestHandler(w http.ResponseWriter, r *http.Request) {
-	fileParam := r.URL.Query().Get("file")
-	var target string
-	if fileParam != "" {
-		candidate := filepath.Join(dir, filepath.Clean("/"+fileParam))
-		if fi, err := os.Stat(candidate); err == nil && !fi.IsDir() {
-			target = candidate
+// attachment builds a Content-Disposition header that forces a download.
+// Browsers use the RFC 5987 filename* parameter; curl -OJ only reads the
+// quoted filename, which therefore keeps the raw UTF-8 name with quotes,
+// backslashes and control characters replaced.
+func attachment(name string) string {
+	var fallback, ext strings.Builder
+	for _, r := range name {
+		switch {
+		case r < 0x20 || r == 0x7f || r == '\\':
+			fallback.WriteByte('_')
+		case r == '"':
+			fallback.WriteByte('\'')
+		default:
+			fallback.WriteRune(r)
 		}
 	}
-	if target == "" {
-		found := ""
-		_ = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
-			if err != nil || info.IsDir() {
-				return nil
-			}
-			ext := strings.ToLower(filepath.Ext(p))
-			if ext == ".mkv" || ext == ".mp4" || ext == ".ts" || ext == ".m2ts" || ext == ".iso" {
-				found = p
-				return io.EOF
+	for _, b := range []byte(name) {
+		if b < 0x80 && (b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0) {
+			ext.WriteByte(b)
+		} else {
+			fmt.Fprintf(&ext, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf("attachment; filename=\"%s\"; filename*=UTF-8''%s", fallback.String(), ext.String())
+}
+
+// fileETag derives a weak validator from size and mtime, so it changes
+// whenever the file is replaced or rewritten.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf("W/\"%x-%x\"", fi.Size(), fi.ModTime().UnixNano())
+}
+
+// notModified evaluates If-None-Match and, when that is absent,
+// If-Modified-Since, following RFC 9110 precedence.
+func notModified(r *http.Request, etag string, mtime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
 			}
-			return nil
-		})
-		if found == "" {
-			http.Error(w, "no media file found for speedtest", http.StatusNotFound)
-			return
 		}
-		target = found
+		return false
 	}
-	f, err := os.Open(target)
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
 	if err != nil {
-		http.Error(w, "cannot open file", http.StatusInternalServerError)
-		return
+		return false
 	}
-	defer f.Close()
-	size := speedBytes
-	if size <= 0 {
-		size = 50 << 20
+	return !mtime.Truncate(time.Second).After(ims)
+}
+
+// byteSize is a flag holding a byte count written with optional human units.
+type byteSize int64
+
+func (b *byteSize) String() string { return strconv.FormatInt(int64(*b), 10) }
+
+func (b *byteSize) Set(v string) error {
+	n, err := parseBytes(v)
+	if err != nil {
+		return err
 	}
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
-	w.Header().Set("Accept-Ranges", "bytes")
-	buf := make([]byte, 1<<20)
-	remaining := size
-	start := time.Now()
-	total := int64(0)
-	for remaining > 0 {
-		toRead := int64(len(buf))
-		if remaining < toRead {
-			toRead = remaining
-		}
-		nr, err := f.Read(buf[:toRead])
-		if nr > 0 {
-			nw, errw := w.Write(buf[:nr])
-			if errw != nil || nw != nr {
-				break
-			}
-			total += int64(nw)
-			remaining -= int64(nw)
-		}
-		if err != nil {
-			break
+	*b = byteSize(n)
+	return nil
+}
+
+// parseBytes accepts plain byte counts and sizes such as "256K", "4MB" or
+// "1.5GiB". Units are powers of 1024, matching human.
+func parseBytes(v string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			mult = int64(1) << (10 * (i + 1))
+			s = s[:len(s)-1]
 		}
 	}
-	elapsed := time.Since(start).Seconds()
-	if elapsed == 0 {
-		elapsed = 0.000001
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid size %q", v)
 	}
-	res := map[string]interface{}{
-		"file":       filepath.Base(target),
-		"bytes_sent": total,
-		"mb_per_s":   float64(total) / (1024*1024) / elapsed,
-		"duration_s": elapsed,
+	// float64(math.MaxInt64) rounds up to 2^63, which no int64 holds.
+	n := f * float64(mult)
+	if n >= float64(math.MaxInt64) {
+		return 0, fmt.Errorf("size %q is too large", v)
 	}
-	js, _ := json.Marshal(res)
-	fmt.Fprintln(os.Stdout, string(js))
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	return int64(n), nil
 }
 
 func human(n int64) string {
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupRoot makes a share in a temporary directory holding files, given as
+// slash-separated paths with their contents; a path ending in "/" is a
+// directory. The settings tests change are put back afterwards.
+func setupRoot(t testing.TB, files map[string]string) string {
+	t.Helper()
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRoot, oldExcludes, oldHidden, oldFollow, oldFold := root, excludes, showHidden, followSymlinks, excludeFold
+	t.Cleanup(func() {
+		waitDirSizes()
+		root, excludes, showHidden, followSymlinks, excludeFold = oldRoot, oldExcludes, oldHidden, oldFollow, oldFold
+		library.invalidate()
+	})
+	root, excludes, showHidden, followSymlinks = dir, nil, false, "root"
+	if mediaExts == nil {
+		mediaExts = parseMediaExts("mkv,mp4,avi,ts,m2ts,iso")
+	}
+	if err := registerMIME(); err != nil {
+		t.Fatal(err)
+	}
+	library.invalidate()
+	for name, body := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// waitDirSizes waits for the sizes listings queued to be computed, which
+// read root and the -exclude patterns from their own goroutines.
+func waitDirSizes() {
+	for {
+		dirSizes.mu.Lock()
+		pending := 0
+		for _, e := range dirSizes.sizes {
+			if e.pending {
+				pending++
+			}
+		}
+		dirSizes.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// serve runs one request through h. header is a list of name, value pairs.
+func serve(h http.HandlerFunc, method, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// body reads the whole response body.
+func body(t testing.TB, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	b, err := io.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestEscapePath(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"/Movies/film.mkv", "/Movies/film.mkv"},
+		{"/My Movies/film one.mkv", "/My%20Movies/film%20one.mkv"},
+		{"/Movie #1 [1080p].mkv", "/Movie%20%231%20%5B1080p%5D.mkv"},
+		{"/100% a+b.mkv", "/100%25%20a+b.mkv"},
+		{"/what?.mkv", "/what%3F.mkv"},
+		{"/Фильм.mkv", "/%D0%A4%D0%B8%D0%BB%D1%8C%D0%BC.mkv"},
+	}
+	for _, tt := range tests {
+		got := escapePath(tt.in)
+		if got != tt.want {
+			t.Errorf("escapePath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		back, err := decodePath(got)
+		if err != nil || back != tt.in {
+			t.Errorf("decodePath(%q) = %q, %v, want %q", got, back, err, tt.in)
+		}
+	}
+}
+
+func TestListingLinksRoundTrip(t *testing.T) {
+	names := []string{"film one.mkv", "Movie #1 [1080p].mkv", "100% a+b.mkv", "what?.txt", "Фильм «ёж».mkv", "a&b=c;d.txt"}
+	files := map[string]string{"Season 1 + extras/": ""}
+	for _, n := range names {
+		files["Season 1 + extras/"+n] = n
+	}
+	setupRoot(t, files)
+
+	w := serve(indexHandler, http.MethodGet, "/Season%201%20+%20extras/?format=json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET = %d", w.Code)
+	}
+	var lst dirListing
+	if err := json.Unmarshal([]byte(body(t, w)), &lst); err != nil {
+		t.Fatal(err)
+	}
+	if lst.Path != "/Season 1 + extras" || lst.Total != len(names) || len(lst.Entries) != len(names) {
+		t.Fatalf("listing path %q with %d of %d entries", lst.Path, len(lst.Entries), lst.Total)
+	}
+	for _, e := range lst.Entries {
+		if e.IsDir || e.Size != int64(len(e.Name)) {
+			t.Errorf("%q: is_dir %v, size %d", e.Name, e.IsDir, e.Size)
+		}
+		w := serve(indexHandler, http.MethodGet, e.URL)
+		if w.Code != http.StatusOK || body(t, w) != e.Name {
+			t.Errorf("GET %q for %q = %d", e.URL, e.Name, w.Code)
+		}
+	}
+}
+
+func TestFollowListingLinks(t *testing.T) {
+	names := []string{"film one.mkv", "Movie #1 [1080p] 100% a+b.mkv", "Фильм.mkv", "semi;colon=eq&amp.txt", "tab\tname.txt"}
+	files := map[string]string{}
+	for _, n := range names {
+		files["My Movies/"+n] = n
+	}
+	setupRoot(t, files)
+	srv := httptest.NewServer(http.HandlerFunc(indexHandler))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/My%20Movies/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	links := listingLinks(string(b))
+	for _, n := range names {
+		href, ok := links[n]
+		if !ok {
+			t.Errorf("no link for %q", n)
+			continue
+		}
+		u, err := res.Request.URL.Parse(href)
+		if err != nil {
+			t.Errorf("link %q: %v", href, err)
+			continue
+		}
+		got, err := http.Get(u.String())
+		if err != nil {
+			t.Errorf("GET %s: %v", u, err)
+			continue
+		}
+		b, _ := io.ReadAll(got.Body)
+		got.Body.Close()
+		if got.StatusCode != http.StatusOK || string(b) != n {
+			t.Errorf("GET %s = %d %q, want 200 %q", u, got.StatusCode, b, n)
+		}
+	}
+}
+
+func TestRequestPathDecoding(t *testing.T) {
+	setupRoot(t, map[string]string{"My Movies/film one.mkv": "film", "a/b.txt": "b"})
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/My%20Movies/film%20one.mkv", http.StatusOK},
+		{"/My%20Movies/film%20one%2Emkv", http.StatusOK},
+		{"/a%2Fb.txt", http.StatusBadRequest},
+		{"/a/b%00.txt", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := serve(indexHandler, http.MethodGet, tt.target); w.Code != tt.code {
+			t.Errorf("GET %s = %d, want %d", tt.target, w.Code, tt.code)
+		}
+	}
+	for _, bad := range []string{"/a/%zz", "/a%2f..%2f..", "/%00"} {
+		if p, err := decodePath(bad); err == nil {
+			t.Errorf("decodePath(%q) = %q, want an error", bad, p)
+		}
+	}
+}
+
+func TestResolvePathConfined(t *testing.T) {
+	dir := setupRoot(t, map[string]string{"Movies/film.mkv": "film"})
+	if err := os.Symlink("/etc", filepath.Join(dir, "etclink")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	tests := []struct {
+		upath string
+		err   error
+	}{
+		{"/Movies/film.mkv", nil},
+		{"/Movies/../Movies/film.mkv", nil},
+		{"/../../etc/passwd", os.ErrNotExist},
+		{"/Movies/../../../etc/passwd", os.ErrNotExist},
+		{`/..\..\etc\passwd`, os.ErrNotExist},
+		{`/Movies\..\..\etc\passwd`, os.ErrNotExist},
+		{"/etclink/passwd", errForbidden},
+		{"/etclink", errForbidden},
+	}
+	for _, tt := range tests {
+		full, err := resolvePath(tt.upath)
+		if err != tt.err {
+			t.Errorf("resolvePath(%q) = %q, %v, want %v", tt.upath, full, err, tt.err)
+			continue
+		}
+		if err == nil && !insideRoot(full) {
+			t.Errorf("resolvePath(%q) = %q, outside the root", tt.upath, full)
+		}
+	}
+}
+
+func TestTraversalRequests(t *testing.T) {
+	dir := setupRoot(t, map[string]string{"Movies/film.mkv": "film"})
+	if err := os.Symlink("/etc", filepath.Join(dir, "etclink")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/Movies/film.mkv", http.StatusOK},
+		{"/%2e%2e/%2e%2e/etc/passwd", http.StatusNotFound},
+		{"/Movies/%2E%2E/%2E%2E/etc/passwd", http.StatusNotFound},
+		{"/..%2F..%2Fetc/passwd", http.StatusBadRequest},
+		{"/Movies/..%5C..%5Cetc%5Cpasswd", http.StatusNotFound},
+		{"/etclink/passwd", http.StatusForbidden},
+		{"/etclink/", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := serve(indexHandler, http.MethodGet, tt.target)
+		if w.Code != tt.code {
+			t.Errorf("GET %s = %d, want %d", tt.target, w.Code, tt.code)
+		}
+	}
+}
+
+func TestSlashRedirects(t *testing.T) {
+	setupRoot(t, map[string]string{"Movies/film one.mkv": "film"})
+	tests := []struct {
+		target   string
+		code     int
+		location string
+	}{
+		{"/", http.StatusOK, ""},
+		{"/Movies", http.StatusMovedPermanently, "/Movies/"},
+		{"/Movies?sort=size&order=desc", http.StatusMovedPermanently, "/Movies/?sort=size&order=desc"},
+		{"/Movies/", http.StatusOK, ""},
+		{"/Movies/film%20one.mkv/", http.StatusMovedPermanently, "/Movies/film%20one.mkv"},
+		{"/Movies/film%20one.mkv/?t=1", http.StatusMovedPermanently, "/Movies/film%20one.mkv?t=1"},
+		{"/Movies/film%20one.mkv", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		w := serve(indexHandler, http.MethodGet, tt.target)
+		if w.Code != tt.code {
+			t.Errorf("GET %s = %d, want %d", tt.target, w.Code, tt.code)
+			continue
+		}
+		if tt.location == "" {
+			continue
+		}
+		if got := resolveLocation(t, tt.target, w); got != tt.location {
+			t.Errorf("GET %s redirects to %s, want %s", tt.target, got, tt.location)
+		}
+	}
+}
+
+// TestSlashRedirectsUnderPrefix checks that the redirects are relative, so
+// they still land right when a proxy mounts the share below a prefix.
+func TestSlashRedirectsUnderPrefix(t *testing.T) {
+	setupRoot(t, map[string]string{"Movies/film.mkv": "film"})
+	h := http.StripPrefix("/media", http.HandlerFunc(indexHandler)).ServeHTTP
+	if got := resolveLocation(t, "/media/Movies", serve(h, http.MethodGet, "/media/Movies")); got != "/media/Movies/" {
+		t.Errorf("redirect to %s, want /media/Movies/", got)
+	}
+	if got := resolveLocation(t, "/media/Movies/film.mkv/", serve(h, http.MethodGet, "/media/Movies/film.mkv/")); got != "/media/Movies/film.mkv" {
+		t.Errorf("redirect to %s, want /media/Movies/film.mkv", got)
+	}
+}
+
+// resolveLocation resolves w's Location header against the request target.
+func resolveLocation(t testing.TB, target string, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	base, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, err := base.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc.RequestURI()
+}
+
+func TestHeadLargeFile(t *testing.T) {
+	dir := setupRoot(t, nil)
+	const size = 3 << 30
+	f, err := os.Create(filepath.Join(dir, "big movie.mkv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		header []string
+		code   int
+		length string
+	}{
+		{"full", nil, http.StatusOK, "3221225472"},
+		{"range", []string{"Range", "bytes=100-199"}, http.StatusPartialContent, "100"},
+		{"open range", []string{"Range", "bytes=-10"}, http.StatusPartialContent, "10"},
+		{"not modified", []string{"If-None-Match", fileETag(fi)}, http.StatusNotModified, ""},
+	}
+	for _, tt := range tests {
+		w := serve(indexHandler, http.MethodHead, "/big%20movie.mkv", tt.header...)
+		if w.Code != tt.code {
+			t.Errorf("%s: HEAD = %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("%s: HEAD wrote %d body bytes", tt.name, w.Body.Len())
+		}
+		h := w.Header()
+		if got := h.Get("Content-Length"); got != tt.length {
+			t.Errorf("%s: Content-Length %q, want %q", tt.name, got, tt.length)
+		}
+		if tt.code == http.StatusNotModified {
+			continue
+		}
+		if got := h.Get("Content-Type"); got != "video/x-matroska" {
+			t.Errorf("%s: Content-Type %q", tt.name, got)
+		}
+		if h.Get("Accept-Ranges") != "bytes" || h.Get("ETag") == "" || h.Get("Last-Modified") == "" {
+			t.Errorf("%s: missing Accept-Ranges, ETag or Last-Modified: %v", tt.name, h)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1048576", 1 << 20, true},
+		{"256K", 256 << 10, true},
+		{"4MB", 4 << 20, true},
+		{"1.5GiB", 3 << 29, true},
+		{" 2 t ", 2 << 40, true},
+		{"8191P", 0, false},
+		{"-1", 0, false},
+		{"inf", 0, false},
+		{"+Inf", 0, false},
+		{"NaN", 0, false},
+		{"1e30", 0, false},
+		{"9223372036854775807", 0, false},
+		{"8388608T", 0, false},
+		{"8388607T", 8388607 << 40, true},
+		{"", 0, false},
+		{"MB", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseBytes(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseBytes(%q) = %d, %v, want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
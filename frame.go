@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+func frameArgs(full string, at float64, width int) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin",
+		"-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", full, "-frames:v", "1"}
+	if width > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:-2", width))
+	}
+	return append(args, "-q:v", "3", "-f", "image2pipe", "-c:v", "mjpeg", "pipe:1")
+}
+
+// frameHandler captures one JPEG at ?t= seconds and streams it straight
+// from ffmpeg. Captures share the thumbnail worker pool.
+func frameHandler(w http.ResponseWriter, r *http.Request) {
+	if ffmpegPath == "" {
+		jsonError(w, "frame capture is disabled: start with -ffmpeg", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	at, err := strconv.ParseFloat(q.Get("t"), 64)
+	if err != nil || at < 0 {
+		jsonError(w, "t must be a non-negative number of seconds", http.StatusBadRequest)
+		return
+	}
+	width := 0
+	if v := q.Get("w"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 32 || n > 3840 {
+			jsonError(w, "w must be between 32 and 3840", http.StatusBadRequest)
+			return
+		}
+		width = n
+	}
+	full, err := resolveFor(r, q.Get("path"))
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() || fileKind(fi.Name()) != "video" {
+		jsonError(w, "not a video", http.StatusNotFound)
+		return
+	}
+	if ffprobePath != "" {
+		// Seeking past the end yields no frame at all, so stay a moment
+		// short of it.
+		if info, err := probeMedia(full, fi); err == nil && info.DurationS > 0 && at > info.DurationS-1 {
+			at = max(0, info.DurationS-1)
+		}
+	}
+	// claimed is set by whichever side gets there first: the worker starting
+	// the capture, or the handler giving up because the client left while
+	// the job was still queued.
+	var claimed atomic.Int32
+	done := make(chan struct{})
+	cw := &countingWriter{ResponseWriter: w}
+	var stderr bytes.Buffer
+	var runErr error
+	job := func() {
+		defer close(done)
+		if !claimed.CompareAndSwap(0, 1) || r.Context().Err() != nil {
+			return
+		}
+		cmd := exec.CommandContext(r.Context(), ffmpegPath, frameArgs(full, at, width)...)
+		cmd.Stdout, cmd.Stderr = cw, &stderr
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		runErr = cmd.Run()
+	}
+	if !submitFFmpegJob(job) {
+		w.Header().Set("Retry-After", "5")
+		jsonError(w, "too many frame captures queued, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		if claimed.CompareAndSwap(0, 2) {
+			return
+		}
+		<-done
+	}
+	if cw.n == 0 && r.Context().Err() == nil {
+		w.Header().Del("Cache-Control")
+		msg := strings.TrimSpace(stderr.String())
+		if runErr != nil && msg == "" {
+			msg = runErr.Error()
+		}
+		fmt.Fprintf(os.Stderr, "frame: %s at %.1fs: %s\n", fi.Name(), at, msg)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "no frame at that time", "detail": strings.ReplaceAll(msg, full, relPath(full))})
+	}
+}
@@ -1,3 +1,10 @@
 module local-movies-sharing-server
 
 go 1.25.2
+
+require golang.org/x/crypto v0.55.0
+
+require (
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/text v0.41.0 // indirect
+)
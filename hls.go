@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const hlsSegmentSeconds = 6
+
+// hlsReadyTimeout is how long a playlist or segment request waits for
+// ffmpeg to produce it before giving up.
+const hlsReadyTimeout = 30 * time.Second
+
+var ffmpegPath string
+var transcodeIdle time.Duration
+
+var hlsSegmentName = regexp.MustCompile(`^seg\d{5}\.ts$`)
+
+// hlsSession is one running ffmpeg segmenting a file into a temp dir. A
+// client gets one session per file; seeking replaces it.
+type hlsSession struct {
+	*transcode
+	dir      string
+	cmd      *exec.Cmd
+	log      *ffmpegLog
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+var hlsSessions = struct {
+	sync.Mutex
+	byID  map[string]*hlsSession
+	byKey map[string]*hlsSession
+}{byID: map[string]*hlsSession{}, byKey: map[string]*hlsSession{}}
+
+// checkFFmpeg resolves -ffmpeg to an executable.
+func checkFFmpeg() error {
+	if ffmpegPath == "" {
+		return nil
+	}
+	p, err := exec.LookPath(ffmpegPath)
+	if err != nil {
+		return fmt.Errorf("invalid -ffmpeg: %v", err)
+	}
+	ffmpegPath = p
+	return nil
+}
+
+func hlsArgs(input, dir string, start float64, hw hwProfile) []string {
+	args := append(ffmpegBaseArgs(), hw.decode...)
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start, 'f', 3, 64))
+	}
+	args = append(args, "-i", input, "-map", "0:v:0", "-map", "0:a:0?")
+	args = append(args, hw.encode...)
+	return append(args, "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds),
+		"-c:a", "aac", "-ac", "2", "-b:a", "160k",
+		"-f", "hls", "-hls_time", strconv.Itoa(hlsSegmentSeconds), "-hls_playlist_type", "event", "-start_number", "0",
+		"-hls_segment_filename", filepath.Join(dir, "seg%05d.ts"),
+		filepath.Join(dir, "index.m3u8"))
+}
+
+func (s *hlsSession) running() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func startHLS(full, client, owner string, start float64) (*hlsSession, error) {
+	t := &transcode{id: newTranscodeID(), kind: "hls", path: full, client: client, owner: owner, hwaccel: hwaccel, start: start, started: time.Now()}
+	s := &hlsSession{transcode: t, done: make(chan struct{})}
+	t.stop = s.stop
+	if err := registerTranscode(t); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "fileserver-hls-")
+	if err != nil {
+		unregisterTranscode(t)
+		return nil, err
+	}
+	s.dir, s.log = dir, &ffmpegLog{t: t}
+	hw, _ := hwProfileFor(t.hwaccel)
+	s.cmd = exec.Command(ffmpegPath, hlsArgs(full, dir, start, hw)...)
+	s.cmd.Stderr = s.log
+	if err := s.cmd.Start(); err != nil {
+		unregisterTranscode(t)
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	go func() {
+		s.cmd.Wait()
+		close(s.done)
+	}()
+	fmt.Fprintf(os.Stdout, "hls: %s started at %.0fs for %s (hwaccel %s)\n", filepath.Base(full), start, client, t.hwaccel)
+	return s, nil
+}
+
+// stop kills ffmpeg and removes the session's segments.
+func (s *hlsSession) stop(reason string) {
+	s.stopOnce.Do(func() {
+		hlsSessions.Lock()
+		if hlsSessions.byID[s.id] == s {
+			delete(hlsSessions.byID, s.id)
+		}
+		if key := s.path + "\x00" + s.client; hlsSessions.byKey[key] == s {
+			delete(hlsSessions.byKey, key)
+		}
+		hlsSessions.Unlock()
+		unregisterTranscode(s.transcode)
+		s.cmd.Process.Kill()
+		<-s.done
+		os.RemoveAll(s.dir)
+		fmt.Fprintf(os.Stdout, "hls: %s for %s stopped: %s\n", filepath.Base(s.path), s.client, reason)
+	})
+}
+
+// hlsSessionFor returns the client's session for full, replacing it when
+// the requested start offset differs. owner is who a new session is
+// started for.
+func hlsSessionFor(full, client, owner string, start float64) (*hlsSession, error) {
+	key := full + "\x00" + client
+	hlsSessions.Lock()
+	old := hlsSessions.byKey[key]
+	hlsSessions.Unlock()
+	if old != nil {
+		if old.start == start {
+			return old, nil
+		}
+		old.stop("seek")
+	}
+	s, err := startHLS(full, client, owner, start)
+	if err != nil {
+		return nil, err
+	}
+	hlsSessions.Lock()
+	hlsSessions.byID[s.id], hlsSessions.byKey[key] = s, s
+	hlsSessions.Unlock()
+	return s, nil
+}
+
+// playlist returns ffmpeg's playlist once it lists at least one segment.
+func (s *hlsSession) playlist() ([]byte, error) {
+	deadline := time.Now().Add(hlsReadyTimeout)
+	for {
+		b, err := os.ReadFile(filepath.Join(s.dir, "index.m3u8"))
+		if err == nil && bytes.Contains(b, []byte(".ts")) {
+			return b, nil
+		}
+		if !s.running() {
+			return nil, fmt.Errorf("ffmpeg exited: %s", s.log)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for ffmpeg")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// segmentReady waits until name is listed in the playlist, which ffmpeg
+// only does once the segment is complete.
+func (s *hlsSession) segmentReady(name string) bool {
+	deadline := time.Now().Add(hlsReadyTimeout)
+	for {
+		b, _ := os.ReadFile(filepath.Join(s.dir, "index.m3u8"))
+		if bytes.Contains(b, []byte(name)) {
+			return true
+		}
+		if !s.running() || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	if ffmpegPath == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if allowCORS(w, r) {
+		return
+	}
+	upath, err := decodePath(strings.TrimPrefix(r.URL.EscapedPath(), "/hls"))
+	if err != nil {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+	name := path.Base(upath)
+	full, err := resolveFor(r, path.Dir(upath))
+	if err != nil {
+		writePathError(w, false, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() || fileKind(fi.Name()) != "video" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case name == "index.m3u8":
+		serveHLSPlaylist(w, r, full)
+	case hlsSegmentName.MatchString(name):
+		serveHLSSegment(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func serveHLSPlaylist(w http.ResponseWriter, r *http.Request, full string) {
+	start := 0.0
+	if v := r.URL.Query().Get("t"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t < 0 {
+			http.Error(w, "t must be a non-negative number of seconds", http.StatusBadRequest)
+			return
+		}
+		start = t
+	}
+	s, err := hlsSessionFor(full, clientHost(r), transcodeOwner(r), start)
+	if err == errTooManyTranscodes {
+		writeTranscodeLimit(w)
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "hls:", err)
+		http.Error(w, "cannot start transcode", http.StatusInternalServerError)
+		return
+	}
+	s.touch()
+	b, err := s.playlist()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hls: %s: %v\n", filepath.Base(full), err)
+		s.stop("failed")
+		http.Error(w, "transcode failed", http.StatusInternalServerError)
+		return
+	}
+	// Segment URIs carry the session id so that a segment left over from
+	// before a seek is never mistaken for one of the new session's.
+	lines := strings.Split(string(b), "\n")
+	for i, l := range lines {
+		if l != "" && !strings.HasPrefix(l, "#") {
+			lines[i] = withToken(r, l+"?s="+s.id)
+		}
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(strings.Join(lines, "\n")))
+}
+
+func serveHLSSegment(w http.ResponseWriter, r *http.Request, name string) {
+	hlsSessions.Lock()
+	s := hlsSessions.byID[r.URL.Query().Get("s")]
+	hlsSessions.Unlock()
+	if s == nil {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	s.touch()
+	if !s.segmentReady(name) {
+		http.Error(w, "segment not available", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		http.Error(w, "segment not available", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "video/mp2t")
+	w, served := countServed(w, relPath(s.path))
+	defer served()
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// allowedHostSpecs are -allowed-hosts: names the server answers to on top
+// of IP literals, localhost, *.local, the machine's hostname and the
+// -acme-domain names. A leading "*." matches any subdomain.
+var allowedHostSpecs stringList
+var allowEmptyHost bool
+var noHostCheck bool
+
+var allowedHosts []string
+
+// refusedHosts remembers which Host headers were logged, so a page
+// retrying the same rebinding in a loop is logged once. It is capped as the
+// names come from clients.
+var refusedHosts = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+const maxRefusedHosts = 256
+
+func checkHosts() error {
+	allowedHosts = []string{"localhost", "*.local"}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		allowedHosts = append(allowedHosts, strings.ToLower(h))
+	}
+	allowedHosts = append(allowedHosts, acmeDomains...)
+	for _, v := range allowedHostSpecs {
+		for _, h := range strings.Split(v, ",") {
+			h = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")
+			if h == "" {
+				continue
+			}
+			if _, err := netip.ParseAddr(strings.Trim(h, "[]")); err == nil {
+				// IP literals are always let in.
+				continue
+			}
+			name := strings.TrimPrefix(h, "*.")
+			if name == "" || strings.ContainsAny(name, "*:/ ") {
+				return fmt.Errorf("bad -allowed-hosts %q: want a host name such as movies.home or *.home", h)
+			}
+			allowedHosts = append(allowedHosts, h)
+		}
+	}
+	return nil
+}
+
+// hostAllowed reports whether the Host header h, with or without a port,
+// names this server.
+func hostAllowed(h string) bool {
+	if h == "" {
+		return allowEmptyHost
+	}
+	if host, _, err := net.SplitHostPort(h); err == nil {
+		h = host
+	}
+	h = strings.TrimSuffix(strings.ToLower(strings.Trim(h, "[]")), ".")
+	if _, err := netip.ParseAddr(h); err == nil {
+		// A rebinding attack needs a name it controls; an address is what
+		// the client really connected to.
+		return true
+	}
+	for _, a := range allowedHosts {
+		if suffix, ok := strings.CutPrefix(a, "*"); ok {
+			if strings.HasSuffix(h, suffix) && len(h) > len(suffix) {
+				return true
+			}
+		} else if h == a {
+			return true
+		}
+	}
+	return false
+}
+
+// withHostCheck answers 421 to requests for a Host this server does not go
+// by: a page on another site that re-pointed its own name at a LAN address
+// would otherwise be able to read the share.
+func withHostCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hostAllowed(r.Host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		refusedHosts.Lock()
+		first := !refusedHosts.m[r.Host] && len(refusedHosts.m) < maxRefusedHosts
+		if first {
+			refusedHosts.m[r.Host] = true
+		}
+		refusedHosts.Unlock()
+		if first {
+			fmt.Fprintf(os.Stdout, "refused Host %q from %s (add it to -allowed-hosts if it is this server)\n", r.Host, clientHost(r))
+		}
+		writeError(w, strings.HasPrefix(r.URL.Path, "/api/") || wantsJSON(r), "unknown host", http.StatusMisdirectedRequest)
+	})
+}
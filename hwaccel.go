@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var hwaccel string
+var vaapiDevice string
+
+// hwProfile holds the ffmpeg options for one kind of acceleration: decode
+// goes before -i, encode replaces the software x264 options.
+type hwProfile struct {
+	decode []string
+	encode []string
+}
+
+const hwaccelUsage = "hardware acceleration for transcoding: vaapi, qsv, nvenc, videotoolbox or none"
+
+func hwProfileFor(name string) (hwProfile, bool) {
+	switch name {
+	case "none":
+		return hwProfile{encode: []string{"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p"}}, true
+	case "vaapi":
+		// Frames decoded in software are uploaded, and 10-bit hardware
+		// frames are converted, so any source ends up as NV12 surfaces.
+		return hwProfile{
+			decode: []string{"-hwaccel", "vaapi", "-hwaccel_output_format", "vaapi", "-vaapi_device", vaapiDevice},
+			encode: []string{"-vf", "format=nv12|vaapi,hwupload,scale_vaapi=format=nv12", "-c:v", "h264_vaapi"},
+		}, true
+	case "qsv":
+		return hwProfile{
+			decode: []string{"-hwaccel", "qsv"},
+			encode: []string{"-c:v", "h264_qsv", "-preset", "veryfast", "-pix_fmt", "nv12"},
+		}, true
+	case "nvenc":
+		return hwProfile{
+			decode: []string{"-hwaccel", "cuda"},
+			encode: []string{"-c:v", "h264_nvenc", "-preset", "p4", "-pix_fmt", "yuv420p"},
+		}, true
+	case "videotoolbox":
+		return hwProfile{
+			decode: []string{"-hwaccel", "videotoolbox"},
+			encode: []string{"-c:v", "h264_videotoolbox", "-b:v", "8M", "-pix_fmt", "yuv420p"},
+		}, true
+	}
+	return hwProfile{}, false
+}
+
+// checkHWAccel validates -hwaccel and encodes one second of a test pattern
+// with it. A device that does not work is reported and software encoding is
+// used instead, so a missing driver never takes transcoding down.
+func checkHWAccel() error {
+	p, ok := hwProfileFor(hwaccel)
+	if !ok {
+		return fmt.Errorf("unknown -hwaccel %q: use vaapi, qsv, nvenc, videotoolbox or none", hwaccel)
+	}
+	if hwaccel == "none" || ffmpegPath == "" {
+		return nil
+	}
+	args := append([]string{"-hide_banner", "-loglevel", "error", "-nostdin"}, p.decode...)
+	args = append(args, "-f", "lavfi", "-i", "testsrc2=size=1280x720:rate=25:duration=1")
+	args = append(args, p.encode...)
+	args = append(args, "-f", "null", "-")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		fmt.Fprintf(os.Stderr, "warning: -hwaccel %s does not work, falling back to software encoding: %s\n", hwaccel, msg)
+		hwaccel = "none"
+		return nil
+	}
+	fmt.Fprintf(os.Stdout, "hwaccel: %s ok\n", hwaccel)
+	return nil
+}
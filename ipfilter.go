@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// allowSpecs, denySpecs and proxySpecs are the -allow, -deny and
+// -trusted-proxy flags: CIDRs or single addresses.
+var allowSpecs, denySpecs, proxySpecs stringList
+
+var allowNets, denyNets, trustedProxies []netip.Prefix
+
+// parsePrefixes reads CIDRs and bare addresses, the latter as a prefix
+// covering just that address.
+func parsePrefixes(flagName string, specs stringList) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, v := range specs {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if p, err := netip.ParsePrefix(s); err == nil {
+				if p.Addr().Is4In6() {
+					p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+				}
+				out = append(out, p.Masked())
+				continue
+			}
+			a, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("bad -%s %q: want an address or CIDR such as 192.168.1.0/24", flagName, s)
+			}
+			a = a.Unmap().WithZone("")
+			out = append(out, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+	return out, nil
+}
+
+func checkIPRules() (err error) {
+	if allowNets, err = parsePrefixes("allow", allowSpecs); err != nil {
+		return err
+	}
+	if denyNets, err = parsePrefixes("deny", denySpecs); err != nil {
+		return err
+	}
+	trustedProxies, err = parsePrefixes("trusted-proxy", proxySpecs)
+	return err
+}
+
+func ipRulesEnabled() bool {
+	return allowNets != nil || denyNets != nil
+}
+
+func inPrefixes(ip netip.Addr, nets []netip.Prefix) bool {
+	for _, p := range nets {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed applies -deny, then -allow; without -allow everything not
+// denied gets in.
+func ipAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap().WithZone("")
+	if inPrefixes(ip, denyNets) {
+		return false
+	}
+	return allowNets == nil || inPrefixes(ip, allowNets)
+}
+
+func remoteIP(remoteAddr string) netip.Addr {
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap().WithZone("")
+}
+
+// clientIP is the address r came from. Behind a -trusted-proxy it is the
+// last X-Forwarded-For entry the proxies did not add themselves; anything
+// further left was written by the client and proves nothing.
+func clientIP(r *http.Request) netip.Addr {
+	ip := remoteIP(r.RemoteAddr)
+	if !ip.IsValid() || !inPrefixes(ip, trustedProxies) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = hop.Unmap().WithZone("")
+		if !inPrefixes(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// filteredListener closes connections from denied addresses as they are
+// accepted, before TLS or HTTP. Proxies are let through so the client
+// behind them can be checked per request.
+type filteredListener struct {
+	net.Listener
+}
+
+func (l filteredListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return c, err
+		}
+		ip := remoteIP(c.RemoteAddr().String())
+		if inPrefixes(ip, trustedProxies) || ipAllowed(ip) {
+			return c, nil
+		}
+		fmt.Fprintf(os.Stdout, "denied connection from %s\n", ip)
+		c.Close()
+	}
+}
+
+// withIPRules answers 403 to clients a trusted proxy forwarded from a
+// denied address.
+func withIPRules(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r); !ipAllowed(ip) {
+			fmt.Fprintf(os.Stdout, "denied %s %s from %s via %s\n", r.Method, r.URL.Path, ip, clientHost(r))
+			jsonError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
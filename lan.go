@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+)
+
+// lanIface is a network interface the server can be announced on, with the
+// IPv4 addresses it is reachable at there.
+type lanIface struct {
+	ifi net.Interface
+	ips []net.IP
+}
+
+// lanInterfaces lists the multicast-capable interfaces the HTTP listener is
+// reachable on: all of them when it listens on every address, otherwise
+// only the one holding listenIP.
+func lanInterfaces(listenIP net.IP) []lanIface {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var out []lanIface
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		li := lanIface{ifi: ifi}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || ipn.IP.To4() == nil {
+				continue
+			}
+			if listenIP != nil && !listenIP.IsUnspecified() && !listenIP.Equal(ipn.IP) {
+				continue
+			}
+			li.ips = append(li.ips, ipn.IP.To4())
+		}
+		if len(li.ips) > 0 {
+			out = append(out, li)
+		}
+	}
+	return out
+}
+
+func (li lanIface) owns(ip net.IP) bool {
+	for _, own := range li.ips {
+		if own.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTo returns the local address packets to dst are sent from. A
+// multicast socket sees packets arriving on every interface, so this is how
+// a responder tells whether a query is its interface's to answer.
+func routeTo(dst *net.UDPAddr) (net.IP, bool) {
+	c, err := net.DialUDP("udp4", nil, dst)
+	if err != nil {
+		return nil, false
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var mediaExtList string
+var mediaExts map[string]bool
+var libraryRefresh time.Duration
+
+type libraryItem struct {
+	Path    string    `json:"path"`
+	URL     string    `json:"url"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+	Kind    string    `json:"kind"`
+}
+
+type libraryResponse struct {
+	Generated  time.Time     `json:"generated"`
+	Count      int           `json:"count"`
+	TotalBytes int64         `json:"total_bytes"`
+	Items      []libraryItem `json:"items"`
+}
+
+// libraryIndex caches a recursive walk of every visible file under root; the
+// library, search and other tree-wide endpoints all read from it. The walk
+// is repeated at most once per libraryRefresh unless a refresh is forced.
+type libraryIndex struct {
+	mu    sync.Mutex
+	items []libraryItem
+	built time.Time
+}
+
+var library libraryIndex
+
+func parseMediaExts(list string) map[string]bool {
+	exts := map[string]bool{}
+	for _, e := range strings.Split(list, ",") {
+		e = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), "."))
+		if e != "" {
+			exts["."+e] = true
+		}
+	}
+	return exts
+}
+
+var subtitleExts = map[string]bool{".srt": true, ".ass": true, ".ssa": true, ".vtt": true, ".sub": true, ".idx": true, ".sup": true}
+var imageExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".bmp": true}
+
+func isMedia(name string) bool {
+	return mediaExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// fileKind classifies a file name as "video", "subtitle", "image" or
+// "other". Every endpoint that needs to know what a file is asks here.
+func fileKind(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case mediaExts[ext]:
+		return "video"
+	case subtitleExts[ext]:
+		return "subtitle"
+	case imageExts[ext]:
+		return "image"
+	}
+	return "other"
+}
+
+func (l *libraryIndex) get(refresh bool) ([]libraryItem, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if refresh || l.built.IsZero() || time.Since(l.built) > libraryRefresh {
+		l.items = scanLibrary()
+		l.built = time.Now()
+	}
+	return l.items, l.built
+}
+
+// invalidate makes the next get walk the share again, after the server
+// itself changed it.
+func (l *libraryIndex) invalidate() {
+	l.mu.Lock()
+	l.built = time.Time{}
+	l.mu.Unlock()
+}
+
+func scanLibrary() []libraryItem {
+	items := []libraryItem{}
+	_ = walkShare(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel := relPath(p)
+		if !visible(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		items = append(items, libraryItem{Path: rel, URL: escapePath("/" + rel), Size: info.Size(), ModTime: info.ModTime(), Kind: fileKind(rel)})
+		return nil
+	})
+	sort.SliceStable(items, func(i, j int) bool { return naturalCompare(items[i].Path, items[j].Path) < 0 })
+	return items
+}
+
+func libraryHandler(w http.ResponseWriter, r *http.Request) {
+	all, built := library.get(r.URL.Query().Get("refresh") == "1")
+	all = visibleTo(r, all)
+	res := libraryResponse{Generated: built, Items: []libraryItem{}}
+	for _, it := range all {
+		if it.Kind != "video" {
+			continue
+		}
+		res.Items = append(res.Items, it)
+		res.TotalBytes += it.Size
+	}
+	res.Count = len(res.Items)
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPerPage = 500
+const maxPerPage = 10000
+
+type dirEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+	IsDir   bool      `json:"is_dir"`
+	URL     string    `json:"url"`
+	Kind    string    `json:"kind"`
+	MIME    string    `json:"mime,omitempty"`
+	Pending bool      `json:"size_pending,omitempty"`
+	// Duration is only filled in from media info that is already cached;
+	// listing a directory never runs ffprobe.
+	Duration float64 `json:"duration_s,omitempty"`
+	Thumb    string  `json:"thumb,omitempty"`
+	// Favorite is set for the favorites of the client asking.
+	Favorite bool `json:"favorite,omitempty"`
+	// Plays counts downloads and plays of the file, when history is kept.
+	Plays int64 `json:"plays,omitempty"`
+
+	de os.DirEntry
+}
+
+type crumb struct {
+	Name string
+	URL  string
+}
+
+type dirListing struct {
+	Path    string     `json:"path"`
+	Total   int        `json:"total"`
+	Page    int        `json:"page"`
+	PerPage int        `json:"per_page"`
+	Pages   int        `json:"pages"`
+	Entries []dirEntry `json:"entries"`
+}
+
+type listOptions struct {
+	sort    string
+	order   string
+	page    int
+	perPage int
+	kind    string
+	exts    map[string]bool
+	// client is who the listing is for; directories its .access rules
+	// hide from it are left out.
+	client *http.Request
+}
+
+var listKinds = map[string]bool{"all": true, "video": true, "subtitle": true, "image": true, "other": true}
+
+func parseListOptions(r *http.Request) (listOptions, error) {
+	q := r.URL.Query()
+	opt := listOptions{sort: q.Get("sort"), order: q.Get("order"), page: 1, perPage: defaultPerPage, client: r}
+	if opt.sort != "size" && opt.sort != "mtime" {
+		opt.sort = "name"
+	}
+	if opt.order != "desc" {
+		opt.order = "asc"
+	}
+	if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opt, fmt.Errorf("page must be a positive integer")
+		}
+		opt.page = n
+	}
+	if v := q.Get("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPerPage {
+			return opt, fmt.Errorf("per_page must be between 1 and %d", maxPerPage)
+		}
+		opt.perPage = n
+	}
+	opt.kind = q.Get("type")
+	if opt.kind == "" {
+		opt.kind = "all"
+	}
+	if !listKinds[opt.kind] {
+		return opt, fmt.Errorf("unknown type %q: use video, subtitle, image, other or all", opt.kind)
+	}
+	if v := q.Get("ext"); v != "" {
+		opt.exts = parseMediaExts(v)
+	}
+	return opt, nil
+}
+
+// filtered reports whether the type/ext filters hide a file. Directories are
+// never filtered so navigation keeps working.
+func (opt listOptions) filtered(e dirEntry) bool {
+	if e.IsDir {
+		return false
+	}
+	if opt.kind != "all" && e.Kind != opt.kind {
+		return true
+	}
+	return opt.exts != nil && !opt.exts[strings.ToLower(path.Ext(e.Name))]
+}
+
+// filterLabel describes the active filters for the listing page.
+func (opt listOptions) filterLabel(q url.Values) string {
+	var parts []string
+	if opt.kind != "all" {
+		parts = append(parts, "type="+opt.kind)
+	}
+	if v := q.Get("ext"); v != "" {
+		parts = append(parts, "ext="+v)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func serveListing(w http.ResponseWriter, r *http.Request, full, upath string, asJSON bool) {
+	opt, err := parseListOptions(r)
+	if err != nil {
+		writeError(w, asJSON, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lst, err := listDir(full, upath, opt)
+	if err != nil {
+		writeError(w, asJSON, "cannot read dir", http.StatusInternalServerError)
+		return
+	}
+	// clientID hands out a new id each time a cookieless request asks, so
+	// it is asked once.
+	client := clientID(w, r)
+	markFavorites(client, upath, lst.Entries)
+	markPlays(upath, lst.Entries)
+	if asJSON {
+		writeJSON(w, http.StatusOK, lst)
+		return
+	}
+	q := r.URL.Query()
+	page := listingPage{
+		Path:        upath,
+		Breadcrumbs: breadcrumbs(upath),
+		Entries:     lst.Entries,
+		Page:        lst.Page,
+		Pages:       lst.Pages,
+		Total:       lst.Total,
+		ZipURL:      zipURL(upath),
+		CanDelete:   allowDelete && canWrite(r),
+		CanWrite:    allowUpload && canWrite(r),
+		User:        sessionUser(r),
+	}
+	if upath != "/" {
+		page.Parent = dirURL(path.Dir(upath))
+	} else {
+		page.ShareURL = shareURL(r)
+		page.Continue = continueWatching(r, client)
+		page.Favorites = favoritesFor(r, client)
+	}
+	for _, e := range lst.Entries {
+		if e.Kind == "video" {
+			page.PlaylistURL = playlistURL(upath)
+			break
+		}
+	}
+	if page.Filter = opt.filterLabel(q); page.Filter != "" {
+		page.ClearFilterURL = queryWith(q, "type", "", "ext", "", "page", "")
+	}
+	for _, col := range []struct{ key, label string }{{"name", "Name"}, {"size", "Size"}, {"mtime", "Modified"}} {
+		next := "asc"
+		if col.key == "mtime" {
+			next = "desc"
+		}
+		mark := ""
+		if col.key == opt.sort {
+			if opt.order == "asc" {
+				next, mark = "desc", " ↑"
+			} else {
+				next, mark = "asc", " ↓"
+			}
+		}
+		page.SortLinks = append(page.SortLinks, sortLink{Label: col.label, URL: queryWith(q, "sort", col.key, "order", next, "page", ""), Mark: mark})
+	}
+	if lst.Page > 1 {
+		page.PrevURL = queryWith(q, "page", strconv.Itoa(lst.Page-1))
+	}
+	if lst.Page < lst.Pages {
+		page.NextURL = queryWith(q, "page", strconv.Itoa(lst.Page+1))
+	}
+	renderTemplate(w, listingTemplate, embeddedListing, page)
+}
+
+// queryWith returns "?"+q with the given key/value pairs replaced. An empty
+// value removes the key.
+func queryWith(q url.Values, kv ...string) string {
+	out := url.Values{}
+	for k, v := range q {
+		out[k] = v
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] == "" {
+			out.Del(kv[i])
+		} else {
+			out.Set(kv[i], kv[i+1])
+		}
+	}
+	return "?" + out.Encode()
+}
+
+// breadcrumbs returns one link per ancestor of upath, starting at the share
+// root, so the listing can never link above it.
+func breadcrumbs(upath string) []crumb {
+	crumbs := []crumb{{Name: "/", URL: "/"}}
+	cur := ""
+	for _, seg := range strings.Split(strings.Trim(upath, "/"), "/") {
+		if seg == "" {
+			continue
+		}
+		cur += "/" + seg
+		crumbs = append(crumbs, crumb{Name: seg, URL: dirURL(cur)})
+	}
+	return crumbs
+}
+
+// listDir reads one page of the directory at full. When sorting by name only
+// the entries on the requested page are stat'ed; other orders need size or
+// mtime for every entry.
+func listDir(full, upath string, opt listOptions) (dirListing, error) {
+	des, err := readShareDir(full)
+	if err != nil {
+		return dirListing{}, err
+	}
+	entries := make([]dirEntry, 0, len(des))
+	for _, de := range des {
+		name := de.Name()
+		if !visible(path.Join(upath, name)) {
+			continue
+		}
+		// Files share their directory's rules, except links to files under
+		// other rules.
+		if ok, hidden := accessFor(opt.client, path.Join(upath, name), de.IsDir()); !ok && hidden {
+			continue
+		}
+		u, kind := escapePath(path.Join(upath, name)), "dir"
+		if de.IsDir() {
+			u += "/"
+		} else {
+			kind = fileKind(name)
+		}
+		e := dirEntry{Name: name, IsDir: de.IsDir(), URL: u, Kind: kind, de: de}
+		if !e.IsDir {
+			e.MIME = contentType(name)
+		}
+		if opt.filtered(e) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if opt.sort != "name" {
+		entries = statEntries(entries)
+	}
+	sortEntries(entries, opt.sort, opt.order)
+	lst := dirListing{Path: upath, Total: len(entries), Page: opt.page, PerPage: opt.perPage}
+	lst.Pages = (lst.Total + opt.perPage - 1) / opt.perPage
+	start := (opt.page - 1) * opt.perPage
+	if start > len(entries) {
+		start = len(entries)
+	}
+	end := start + opt.perPage
+	if end > len(entries) {
+		end = len(entries)
+	}
+	lst.Entries = entries[start:end]
+	if opt.sort == "name" {
+		lst.Entries = statEntries(lst.Entries)
+	}
+	for i, e := range lst.Entries {
+		switch {
+		case e.IsDir:
+			size, ok := dirSizes.lookup(filepath.Join(full, e.Name), e.ModTime)
+			lst.Entries[i].Size, lst.Entries[i].Pending = size, !ok
+		case e.Kind == "video":
+			if thumbsEnabled() {
+				lst.Entries[i].Thumb = thumbURL(strings.TrimPrefix(path.Join(upath, e.Name), "/"), defaultThumbWidth)
+			}
+			if info, ok := cachedMediaInfo(filepath.Join(full, e.Name), e.Size, e.ModTime); ok {
+				lst.Entries[i].Duration = info.DurationS
+			}
+		}
+	}
+	return lst, nil
+}
+
+// statEntries fills in size and mtime, dropping entries that vanished since
+// the directory was read.
+func statEntries(entries []dirEntry) []dirEntry {
+	out := entries[:0]
+	for _, e := range entries {
+		info, err := e.de.Info()
+		if err != nil {
+			continue
+		}
+		if !e.IsDir {
+			e.Size = info.Size()
+		}
+		e.ModTime = info.ModTime()
+		out = append(out, e)
+	}
+	return out
+}
+
+// sortEntries orders entries in place, always keeping directories ahead of
+// files regardless of the requested order. Names compare naturally, so
+// "Episode 2" sorts before "Episode 10".
+func sortEntries(entries []dirEntry, sortBy, order string) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		c := 0
+		switch sortBy {
+		case "size":
+			c = cmpInt64(a.Size, b.Size)
+		case "mtime":
+			c = a.ModTime.Compare(b.ModTime)
+		}
+		if c == 0 {
+			c = naturalCompare(a.Name, b.Name)
+		}
+		if order == "desc" {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var linkRE = regexp.MustCompile(`<a href="([^"]*)">([^<]*)</a>`)
+
+// listingLinks maps the text of each link on a listing page to its href.
+func listingLinks(page string) map[string]string {
+	links := map[string]string{}
+	for _, m := range linkRE.FindAllStringSubmatch(page, -1) {
+		links[html.UnescapeString(m[2])] = html.UnescapeString(m[1])
+	}
+	return links
+}
+
+func TestListingEscapesNames(t *testing.T) {
+	names := []string{
+		`<img src=x onerror=alert(1)>.mkv`,
+		`"quoted" & 'single'.txt`,
+		`a<b>c.srt`,
+		`🎬 Film 🍿.mkv`,
+	}
+	files := map[string]string{"<i>dir/": ""}
+	for _, n := range names {
+		files[n] = n
+	}
+	setupRoot(t, files)
+
+	w := serve(indexHandler, http.MethodGet, "/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET / = %d", w.Code)
+	}
+	page := body(t, w)
+	for _, raw := range []string{"<img src=x", "<i>dir", "<b>c", `"quoted"`} {
+		if strings.Contains(page, raw) {
+			t.Errorf("listing contains unescaped %q", raw)
+		}
+	}
+	links := listingLinks(page)
+	for _, n := range names {
+		href, ok := links[n]
+		if !ok {
+			t.Errorf("no link with text %q", n)
+			continue
+		}
+		w := serve(indexHandler, http.MethodGet, href)
+		if w.Code != http.StatusOK || body(t, w) != n {
+			t.Errorf("link %q for %q = %d", href, n, w.Code)
+		}
+	}
+	if href := links["<i>dir/"]; href == "" {
+		t.Error("no link for the <i>dir directory")
+	} else if w := serve(indexHandler, http.MethodGet, href); w.Code != http.StatusOK {
+		t.Errorf("directory link %q = %d", href, w.Code)
+	}
+}
+
+func TestListingEscapesTitle(t *testing.T) {
+	setupRoot(t, map[string]string{"<i>dir/x.txt": "x"})
+	w := serve(indexHandler, http.MethodGet, "/%3Ci%3Edir/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET = %d", w.Code)
+	}
+	page := body(t, w)
+	if strings.Contains(page, "<i>") {
+		t.Error("page title or heading contains the unescaped directory name")
+	}
+	if !strings.Contains(page, "&lt;i&gt;dir") {
+		t.Error("page does not show the escaped directory name")
+	}
+}
+
+func TestListingSetsOneClientCookie(t *testing.T) {
+	setupRoot(t, map[string]string{"film.mkv": "film"})
+	for _, target := range []string{"/", "/?format=json"} {
+		var ids []string
+		for _, c := range serve(indexHandler, http.MethodGet, target).Result().Cookies() {
+			if c.Name == clientCookie {
+				ids = append(ids, c.Value)
+			}
+		}
+		if len(ids) != 1 {
+			t.Errorf("GET %s sets %d %s cookies %q, want 1", target, len(ids), clientCookie, ids)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var mdnsName string
+var noMDNS bool
+
+const mdnsGroup = "224.0.0.251:5353"
+
+// TTLs recommended by RFC 6762: records naming the host go stale quickly,
+// the service records are good for a long time.
+const mdnsHostTTL = 120
+const mdnsServiceTTL = 4500
+
+// mdnsRescan is how often interfaces are checked for new or changed
+// addresses, which are then announced.
+const mdnsRescan = 30 * time.Second
+
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+	dnsClassIN = 1
+	// dnsCacheFlush marks a record as the only one of its name and type;
+	// dnsUnicast in a question asks for a unicast reply.
+	dnsCacheFlush = 0x8000
+	dnsUnicast    = 0x8000
+)
+
+type dnsRecord struct {
+	name  []string
+	typ   uint16
+	flush bool
+	ttl   uint32
+	data  []byte
+}
+
+type dnsQuestion struct {
+	name    []string
+	typ     uint16
+	unicast bool
+}
+
+type mdnsIface struct {
+	lanIface
+	conn *net.UDPConn
+}
+
+// mdnsResponder announces the server as an _http._tcp service (_https._tcp
+// with HTTPS) and answers queries for it, for its host name and for
+// service enumeration.
+type mdnsResponder struct {
+	mu       sync.Mutex
+	ifaces   map[string]*mdnsIface
+	listenIP net.IP
+	port     int
+	group    *net.UDPAddr
+	instance []string
+	host     []string
+}
+
+var (
+	dnsServices = []string{"_services", "_dns-sd", "_udp", "local"}
+	dnsHTTP     = []string{"_http", "_tcp", "local"}
+)
+
+// mdnsHostLabel turns an instance name such as "Movies" into the host
+// label it is reachable under, "movies".
+func mdnsHostLabel(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	label := strings.Trim(b.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimRight(label[:63], "-")
+	}
+	if label == "" {
+		label = "fileserver"
+	}
+	return label
+}
+
+// startMDNS registers the server on the LAN. Failing to announce is not
+// fatal: the server is still reachable by address.
+func startMDNS(listenIP net.IP, port int) {
+	group, err := net.ResolveUDPAddr("udp4", mdnsGroup)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mdns:", err)
+		return
+	}
+	if tlsEnabled() {
+		dnsHTTP = []string{"_https", "_tcp", "local"}
+	}
+	instance := mdnsName
+	if len(instance) > 63 {
+		instance = instance[:63]
+	}
+	m := &mdnsResponder{
+		ifaces:   map[string]*mdnsIface{},
+		listenIP: listenIP,
+		port:     port,
+		group:    group,
+		instance: append([]string{instance}, dnsHTTP...),
+		host:     []string{mdnsHostLabel(mdnsName), "local"},
+	}
+	m.rescan()
+	m.mu.Lock()
+	n := len(m.ifaces)
+	m.mu.Unlock()
+	if n == 0 && !listenIP.IsLoopback() {
+		fmt.Fprintln(os.Stderr, "mdns: no multicast interface to announce on")
+	}
+	onShutdown(m.goodbye)
+	go func() {
+		for range time.Tick(mdnsRescan) {
+			m.rescan()
+		}
+	}()
+}
+
+// rescan opens interfaces that appeared since the last scan and announces
+// again on those whose addresses changed.
+func (m *mdnsResponder) rescan() {
+	current := map[string]bool{}
+	for _, li := range lanInterfaces(m.listenIP) {
+		current[li.ifi.Name] = true
+		m.mu.Lock()
+		mi := m.ifaces[li.ifi.Name]
+		m.mu.Unlock()
+		if mi != nil {
+			m.mu.Lock()
+			old := mi.ips
+			changed := fmt.Sprint(old) != fmt.Sprint(li.ips)
+			mi.ips = li.ips
+			m.mu.Unlock()
+			if changed {
+				m.send(mi, nil, m.hostRecords(old, 0), nil)
+				go m.announce(mi)
+			}
+			continue
+		}
+		conn, err := net.ListenMulticastUDP("udp4", &li.ifi, m.group)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mdns: %s: %v\n", li.ifi.Name, err)
+			continue
+		}
+		mi = &mdnsIface{lanIface: li, conn: conn}
+		m.mu.Lock()
+		m.ifaces[li.ifi.Name] = mi
+		m.mu.Unlock()
+		fmt.Fprintf(os.Stdout, "mDNS: announcing %q as %s://%s:%d/ on %s (%v)\n",
+			mdnsName, scheme(), strings.Join(m.host, "."), m.port, li.ifi.Name, li.ips)
+		go m.serve(mi)
+		go m.announce(mi)
+	}
+	m.mu.Lock()
+	for name, mi := range m.ifaces {
+		if !current[name] {
+			mi.conn.Close()
+			delete(m.ifaces, name)
+		}
+	}
+	m.mu.Unlock()
+}
+
+// announce sends every record unsolicited, twice a second apart as RFC 6762
+// asks, so browsers already listening pick the server up at once.
+func (m *mdnsResponder) announce(mi *mdnsIface) {
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		m.send(mi, nil, m.allRecords(m.ipsOf(mi), 1), nil)
+	}
+}
+
+// goodbye withdraws the registration by resending it with a zero TTL.
+func (m *mdnsResponder) goodbye() {
+	m.mu.Lock()
+	ifaces := make([]*mdnsIface, 0, len(m.ifaces))
+	for _, mi := range m.ifaces {
+		ifaces = append(ifaces, mi)
+	}
+	m.mu.Unlock()
+	for _, mi := range ifaces {
+		m.send(mi, nil, m.allRecords(m.ipsOf(mi), 0), nil)
+	}
+}
+
+func (m *mdnsResponder) ipsOf(mi *mdnsIface) []net.IP {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return mi.ips
+}
+
+// allRecords is the full registration. scale multiplies the TTLs; zero
+// makes it a goodbye.
+func (m *mdnsResponder) allRecords(ips []net.IP, scale uint32) []dnsRecord {
+	recs := []dnsRecord{m.ptrRecord(scale), m.srvRecord(scale), m.txtRecord(scale)}
+	recs = append(recs, m.hostRecords(ips, scale)...)
+	return append(recs, dnsRecord{name: dnsServices, typ: dnsTypePTR, ttl: mdnsServiceTTL * scale, data: encodeName(dnsHTTP)})
+}
+
+func (m *mdnsResponder) ptrRecord(scale uint32) dnsRecord {
+	return dnsRecord{name: dnsHTTP, typ: dnsTypePTR, ttl: mdnsServiceTTL * scale, data: encodeName(m.instance)}
+}
+
+func (m *mdnsResponder) srvRecord(scale uint32) dnsRecord {
+	data := make([]byte, 6)
+	binary.BigEndian.PutUint16(data[4:], uint16(m.port))
+	return dnsRecord{name: m.instance, typ: dnsTypeSRV, flush: true, ttl: mdnsHostTTL * scale, data: append(data, encodeName(m.host)...)}
+}
+
+func (m *mdnsResponder) txtRecord(scale uint32) dnsRecord {
+	var data []byte
+	for _, kv := range []string{"path=/", "version=" + version} {
+		data = append(data, byte(len(kv)))
+		data = append(data, kv...)
+	}
+	return dnsRecord{name: m.instance, typ: dnsTypeTXT, flush: true, ttl: mdnsServiceTTL * scale, data: data}
+}
+
+func (m *mdnsResponder) hostRecords(ips []net.IP, scale uint32) []dnsRecord {
+	var recs []dnsRecord
+	for _, ip := range ips {
+		recs = append(recs, dnsRecord{name: m.host, typ: dnsTypeA, flush: true, ttl: mdnsHostTTL * scale, data: []byte(ip.To4())})
+	}
+	return recs
+}
+
+// answer returns the records that answer q, and the ones a querier will
+// want next, for the additional section.
+func (m *mdnsResponder) answer(q dnsQuestion, ips []net.IP) (answers, extra []dnsRecord) {
+	is := func(typ uint16) bool { return q.typ == typ || q.typ == dnsTypeANY }
+	switch {
+	case sameName(q.name, dnsServices) && is(dnsTypePTR):
+		answers = append(answers, dnsRecord{name: dnsServices, typ: dnsTypePTR, ttl: mdnsServiceTTL, data: encodeName(dnsHTTP)})
+	case sameName(q.name, dnsHTTP) && is(dnsTypePTR):
+		answers = append(answers, m.ptrRecord(1))
+		extra = append([]dnsRecord{m.srvRecord(1), m.txtRecord(1)}, m.hostRecords(ips, 1)...)
+	case sameName(q.name, m.instance):
+		if is(dnsTypeSRV) {
+			answers = append(answers, m.srvRecord(1))
+			extra = m.hostRecords(ips, 1)
+		}
+		if is(dnsTypeTXT) {
+			answers = append(answers, m.txtRecord(1))
+		}
+	case sameName(q.name, m.host) && is(dnsTypeA):
+		answers = m.hostRecords(ips, 1)
+	}
+	return answers, extra
+}
+
+func (m *mdnsResponder) serve(mi *mdnsIface) {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := mi.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintf(os.Stderr, "mdns: %s: %v\n", mi.ifi.Name, err)
+			}
+			return
+		}
+		id, questions, err := parseQuery(buf[:n])
+		if err != nil || len(questions) == 0 {
+			continue
+		}
+		// Only the interface the reply would leave through answers.
+		local, ok := routeTo(src)
+		ips := m.ipsOf(mi)
+		if !ok || !(lanIface{ips: ips}).owns(local) {
+			continue
+		}
+		var answers, extra []dnsRecord
+		unicast := false
+		for _, q := range questions {
+			a, e := m.answer(q, ips)
+			if len(a) > 0 && q.unicast {
+				unicast = true
+			}
+			answers, extra = append(answers, a...), append(extra, e...)
+		}
+		if len(answers) == 0 {
+			continue
+		}
+		switch {
+		case src.Port != 5353:
+			// A plain DNS resolver asking the group directly: it wants a
+			// normal reply with the query id and short TTLs.
+			for i := range answers {
+				answers[i].ttl, answers[i].flush = 10, false
+			}
+			mi.conn.WriteToUDP(encodeResponse(id, questions, answers, nil), src)
+		case unicast:
+			mi.conn.WriteToUDP(encodeResponse(0, nil, answers, extra), src)
+		default:
+			m.send(mi, nil, answers, extra)
+		}
+	}
+}
+
+// send multicasts a response on mi's interface.
+func (m *mdnsResponder) send(mi *mdnsIface, questions []dnsQuestion, answers, extra []dnsRecord) {
+	if len(answers) == 0 {
+		return
+	}
+	mi.conn.WriteToUDP(encodeResponse(0, questions, answers, extra), m.group)
+}
+
+func sameName(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeName(labels []string) []byte {
+	var b []byte
+	for _, l := range labels {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+func encodeResponse(id uint16, questions []dnsQuestion, answers, extra []dnsRecord) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(b[4:], uint16(len(questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(extra)))
+	for _, q := range questions {
+		b = append(b, encodeName(q.name)...)
+		b = binary.BigEndian.AppendUint16(b, q.typ)
+		b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	}
+	for _, r := range append(answers, extra...) {
+		class := uint16(dnsClassIN)
+		if r.flush {
+			class |= dnsCacheFlush
+		}
+		b = append(b, encodeName(r.name)...)
+		b = binary.BigEndian.AppendUint16(b, r.typ)
+		b = binary.BigEndian.AppendUint16(b, class)
+		b = binary.BigEndian.AppendUint32(b, r.ttl)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(r.data)))
+		b = append(b, r.data...)
+	}
+	return b
+}
+
+var errBadDNS = errors.New("malformed dns message")
+
+// parseQuery reads the questions of an mDNS query; responses and anything
+// malformed are rejected.
+func parseQuery(msg []byte) (uint16, []dnsQuestion, error) {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return 0, nil, errBadDNS
+	}
+	id := binary.BigEndian.Uint16(msg[0:])
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	off := 12
+	var questions []dnsQuestion
+	for i := 0; i < qd; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return 0, nil, errBadDNS
+		}
+		class := binary.BigEndian.Uint16(msg[next+2:])
+		questions = append(questions, dnsQuestion{
+			name:    name,
+			typ:     binary.BigEndian.Uint16(msg[next:]),
+			unicast: class&dnsUnicast != 0,
+		})
+		off = next + 4
+	}
+	return id, questions, nil
+}
+
+// readName decodes a possibly compressed name at off and returns it with
+// the offset just past it.
+func readName(msg []byte, off int) ([]string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return nil, 0, errBadDNS
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return labels, next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return nil, 0, errBadDNS
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case l > 63 || off+1+l > len(msg):
+			return nil, 0, errBadDNS
+		default:
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
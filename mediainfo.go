@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const probeTimeout = 30 * time.Second
+
+// maxProbes bounds concurrent ffprobe runs.
+const maxProbes = 4
+
+var probeSlots = make(chan struct{}, maxProbes)
+
+var ffprobePath string
+
+// cacheDir, when set, is where probe results and other generated data are
+// kept across restarts.
+var cacheDir string
+
+type mediaInfo struct {
+	Container string         `json:"container"`
+	DurationS float64        `json:"duration_s"`
+	Bitrate   int64          `json:"bitrate,omitempty"`
+	Video     *videoStream   `json:"video,omitempty"`
+	Audio     []audioStream  `json:"audio"`
+	Subtitles []subtitleInfo `json:"subtitles"`
+	Chapters  []chapter      `json:"chapters"`
+}
+
+type chapter struct {
+	StartS float64 `json:"start_s"`
+	EndS   float64 `json:"end_s"`
+	Title  string  `json:"title"`
+}
+
+type videoStream struct {
+	Codec   string `json:"codec"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Bitrate int64  `json:"bitrate,omitempty"`
+}
+
+type audioStream struct {
+	Codec    string `json:"codec"`
+	Channels int    `json:"channels"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Default  bool   `json:"default"`
+}
+
+type subtitleInfo struct {
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Forced   bool   `json:"forced"`
+}
+
+// ffprobeOutput is the part of `ffprobe -of json -show_format -show_streams`
+// that mediaInfo is built from.
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType   string            `json:"codec_type"`
+		CodecName   string            `json:"codec_name"`
+		Width       int               `json:"width"`
+		Height      int               `json:"height"`
+		BitRate     string            `json:"bit_rate"`
+		Channels    int               `json:"channels"`
+		Tags        map[string]string `json:"tags"`
+		Disposition map[string]int    `json:"disposition"`
+	} `json:"streams"`
+	Chapters []struct {
+		StartTime string            `json:"start_time"`
+		EndTime   string            `json:"end_time"`
+		Tags      map[string]string `json:"tags"`
+	} `json:"chapters"`
+}
+
+type probeEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+	Info    mediaInfo `json:"info"`
+}
+
+// probeCache holds ffprobe results keyed by full path; an entry is only
+// used while size and mtime still match. Concurrent requests for the same
+// file share one ffprobe run.
+var probeCache = struct {
+	sync.Mutex
+	entries  map[string]probeEntry
+	inflight map[string]chan struct{}
+	dirty    bool
+}{entries: map[string]probeEntry{}, inflight: map[string]chan struct{}{}}
+
+// checkFFprobe resolves -ffprobe. The default is looked up on PATH and
+// silently disables /api/mediainfo when missing; an explicit path that does
+// not exist is an error.
+func checkFFprobe() error {
+	explicit := false
+	flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "ffprobe" })
+	p, err := exec.LookPath(ffprobePath)
+	if err != nil {
+		if explicit {
+			return fmt.Errorf("invalid -ffprobe: %v", err)
+		}
+		ffprobePath = ""
+		return nil
+	}
+	ffprobePath = p
+	loadProbeCache()
+	return nil
+}
+
+func probeCacheFile() string {
+	return filepath.Join(cacheDir, "mediainfo.json")
+}
+
+func loadProbeCache() {
+	if cacheDir == "" {
+		return
+	}
+	b, err := os.ReadFile(probeCacheFile())
+	if err != nil {
+		return
+	}
+	var list []probeEntry
+	if err := json.Unmarshal(b, &list); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: ignoring broken media info cache:", err)
+		return
+	}
+	for _, e := range list {
+		probeCache.entries[e.Path] = e
+	}
+}
+
+// saveProbeCache writes the cache out a few seconds after it changed, so a
+// folder being probed file by file is saved once rather than per file.
+func saveProbeCache() {
+	if cacheDir == "" {
+		return
+	}
+	probeCache.Lock()
+	if probeCache.dirty {
+		probeCache.Unlock()
+		return
+	}
+	probeCache.dirty = true
+	probeCache.Unlock()
+	time.AfterFunc(5*time.Second, func() {
+		probeCache.Lock()
+		list := make([]probeEntry, 0, len(probeCache.entries))
+		for _, e := range probeCache.entries {
+			list = append(list, e)
+		}
+		probeCache.dirty = false
+		probeCache.Unlock()
+		if err := writeFileAtomic(probeCacheFile(), list); err != nil {
+			fmt.Fprintln(os.Stderr, "cannot save media info cache:", err)
+		}
+	})
+}
+
+// writeFileAtomic stores v as JSON at name through a temp file and rename,
+// so a crash never leaves a truncated file behind.
+func writeFileAtomic(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeBytesAtomic(name, b)
+}
+
+// writeBytesAtomic is writeFileAtomic for data that is not JSON. The file
+// is created private to the user.
+func writeBytesAtomic(name string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// cachedMediaInfo returns a probe result without probing. Entries saved
+// before chapters were probed have none and count as stale.
+func cachedMediaInfo(full string, size int64, mtime time.Time) (mediaInfo, bool) {
+	probeCache.Lock()
+	e, ok := probeCache.entries[full]
+	probeCache.Unlock()
+	if !ok || e.Size != size || !e.ModTime.Equal(mtime) || e.Info.Chapters == nil {
+		return mediaInfo{}, false
+	}
+	return e.Info, true
+}
+
+func probeMedia(full string, fi os.FileInfo) (mediaInfo, error) {
+	for {
+		if info, ok := cachedMediaInfo(full, fi.Size(), fi.ModTime()); ok {
+			return info, nil
+		}
+		probeCache.Lock()
+		wait, busy := probeCache.inflight[full]
+		if !busy {
+			probeCache.inflight[full] = make(chan struct{})
+		}
+		probeCache.Unlock()
+		if !busy {
+			break
+		}
+		<-wait
+	}
+	info, err := runFFprobe(full)
+	probeCache.Lock()
+	if err == nil {
+		probeCache.entries[full] = probeEntry{Path: full, Size: fi.Size(), ModTime: fi.ModTime(), Info: info}
+	}
+	close(probeCache.inflight[full])
+	delete(probeCache.inflight, full)
+	probeCache.Unlock()
+	if err == nil {
+		saveProbeCache()
+	}
+	return info, err
+}
+
+func runFFprobe(full string) (mediaInfo, error) {
+	probeSlots <- struct{}{}
+	defer func() { <-probeSlots }()
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffprobePath, "-v", "error", "-of", "json", "-show_format", "-show_streams", "-show_chapters", full)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return mediaInfo{}, fmt.Errorf("%v: %s", err, msg)
+		}
+		return mediaInfo{}, err
+	}
+	var out ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return mediaInfo{}, err
+	}
+	info := mediaInfo{Container: out.Format.FormatName, Audio: []audioStream{}, Subtitles: []subtitleInfo{}, Chapters: []chapter{}}
+	info.DurationS, _ = strconv.ParseFloat(out.Format.Duration, 64)
+	info.Bitrate, _ = strconv.ParseInt(out.Format.BitRate, 10, 64)
+	for _, s := range out.Streams {
+		switch s.CodecType {
+		case "video":
+			// Cover art shows up as a one-frame video stream; the first
+			// real stream is the one that is wanted.
+			if info.Video != nil || s.Disposition["attached_pic"] == 1 {
+				continue
+			}
+			br, _ := strconv.ParseInt(s.BitRate, 10, 64)
+			info.Video = &videoStream{Codec: s.CodecName, Width: s.Width, Height: s.Height, Bitrate: br}
+		case "audio":
+			info.Audio = append(info.Audio, audioStream{Codec: s.CodecName, Channels: s.Channels, Language: s.Tags["language"], Title: s.Tags["title"], Default: s.Disposition["default"] == 1})
+		case "subtitle":
+			info.Subtitles = append(info.Subtitles, subtitleInfo{Codec: s.CodecName, Language: s.Tags["language"], Title: s.Tags["title"], Forced: s.Disposition["forced"] == 1})
+		}
+	}
+	for i, c := range out.Chapters {
+		ch := chapter{Title: c.Tags["title"]}
+		ch.StartS, _ = strconv.ParseFloat(c.StartTime, 64)
+		ch.EndS, _ = strconv.ParseFloat(c.EndTime, 64)
+		if ch.Title == "" {
+			ch.Title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		info.Chapters = append(info.Chapters, ch)
+	}
+	return info, nil
+}
+
+// probedFile resolves ?path= to a regular file and probes it, writing the
+// error response itself when either fails.
+func probedFile(w http.ResponseWriter, r *http.Request) (mediaInfo, bool) {
+	if ffprobePath == "" {
+		jsonError(w, "media info is disabled: ffprobe not found", http.StatusNotFound)
+		return mediaInfo{}, false
+	}
+	full, err := resolveFor(r, r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, true, err)
+		return mediaInfo{}, false
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() {
+		jsonError(w, "not a file", http.StatusNotFound)
+		return mediaInfo{}, false
+	}
+	info, err := probeMedia(full, fi)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ffprobe: %s: %v\n", fi.Name(), err)
+		detail := strings.ReplaceAll(err.Error(), full, relPath(full))
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "cannot read media info", "detail": detail})
+		return mediaInfo{}, false
+	}
+	return info, true
+}
+
+func mediaInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if info, ok := probedFile(w, r); ok {
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+func chaptersHandler(w http.ResponseWriter, r *http.Request) {
+	if info, ok := probedFile(w, r); ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"count": len(info.Chapters), "chapters": info.Chapters})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsEnabled serves /metrics in the Prometheus text format;
+// metricsNoAuth lets it be scraped without credentials.
+var metricsEnabled bool
+var metricsNoAuth bool
+
+var startTime = time.Now()
+
+func checkMetrics() error {
+	if metricsNoAuth && !metricsEnabled {
+		return fmt.Errorf("-metrics-no-auth needs -metrics")
+	}
+	return nil
+}
+
+// latencyBuckets are the usual Prometheus buckets, plus some for the
+// requests that stream a movie for an hour.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 60, 600, 3600}
+
+type latency struct {
+	counts []uint64
+	sum    float64
+	n      uint64
+}
+
+// requestMetrics is keyed by handler pattern and status code.
+var requestMetrics = struct {
+	sync.Mutex
+	m map[[2]string]*latency
+}{m: map[[2]string]*latency{}}
+
+var servedBytes atomic.Int64
+
+// dirServed counts bytes by top-level directory of the share; "/" is the
+// files at the root.
+var dirServed = struct {
+	sync.Mutex
+	m map[string]*atomic.Int64
+}{m: map[string]*atomic.Int64{}}
+
+var activeTransfers atomic.Int64
+var activeConns atomic.Int64
+
+// speedQuantileWindow is how many recent results per direction the
+// speedtest quantiles are taken over.
+const speedQuantileWindow = 500
+
+type speedStats struct {
+	recent []float64
+	sum    float64
+	n      uint64
+}
+
+var speedMetrics = struct {
+	sync.Mutex
+	m map[string]*speedStats
+}{m: map[string]*speedStats{}}
+
+func observeSpeed(direction string, mbps float64) {
+	speedMetrics.Lock()
+	defer speedMetrics.Unlock()
+	s := speedMetrics.m[direction]
+	if s == nil {
+		s = &speedStats{}
+		speedMetrics.m[direction] = s
+	}
+	s.recent = append(s.recent, mbps)
+	if len(s.recent) > speedQuantileWindow {
+		s.recent = s.recent[len(s.recent)-speedQuantileWindow:]
+	}
+	s.sum += mbps
+	s.n++
+}
+
+// trackConn keeps the open connections gauge, as http.Server.ConnState.
+func trackConn(c net.Conn, s http.ConnState) {
+	switch s {
+	case http.StateNew:
+		activeConns.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		activeConns.Add(-1)
+	}
+}
+
+// topDir is the top-level directory a root-relative path is in, "/" for
+// one at the root. A directory itself is given with a trailing slash.
+func topDir(rel string) string {
+	rel = strings.TrimPrefix(rel, "/")
+	first, _, ok := strings.Cut(rel, "/")
+	if !ok || first == "" || first == "." {
+		return "/"
+	}
+	return first
+}
+
+func dirCounter(rel string) *atomic.Int64 {
+	d := topDir(rel)
+	dirServed.Lock()
+	defer dirServed.Unlock()
+	c := dirServed.m[d]
+	if c == nil {
+		c = &atomic.Int64{}
+		dirServed.m[d] = c
+	}
+	return c
+}
+
+// servedWriter adds the body bytes of a transfer to the served counters as
+// they are written, so an hour-long stream shows up while it runs.
+type servedWriter struct {
+	http.ResponseWriter
+	dir *atomic.Int64
+}
+
+func (s *servedWriter) add(n int) {
+	servedBytes.Add(int64(n))
+	s.dir.Add(int64(n))
+}
+
+func (s *servedWriter) Write(p []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(p)
+	s.add(n)
+	return n, err
+}
+
+// ReadFrom keeps sendfile, counting after each deadlineChunk.
+func (s *servedWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := s.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{s}, src)
+	}
+	return readFromChunks(rf, src, func(n int64) { s.add(int(n)) })
+}
+
+func (s *servedWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *servedWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// countServed counts a transfer of the share path rel: its bytes and, until
+// done is called, one active transfer.
+func countServed(w http.ResponseWriter, rel string) (http.ResponseWriter, func()) {
+	if !metricsEnabled {
+		return w, func() {}
+	}
+	activeTransfers.Add(1)
+	return &servedWriter{ResponseWriter: w, dir: dirCounter(rel)}, func() { activeTransfers.Add(-1) }
+}
+
+// handlerLabel is the mux pattern r is routed to, which keeps the label's
+// values to the few the server registers.
+func handlerLabel(r *http.Request) string {
+	if _, pattern := http.DefaultServeMux.Handler(r); pattern != "" {
+		return pattern
+	}
+	return "other"
+}
+
+// withMetrics counts every request and how long it took by handler and
+// status.
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler := handlerLabel(r)
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		status := cw.status
+		switch {
+		case status == 0 && r.Header.Get("Upgrade") != "":
+			status = http.StatusSwitchingProtocols
+		case status == 0:
+			status = http.StatusOK
+		}
+		secs := time.Since(start).Seconds()
+		key := [2]string{handler, strconv.Itoa(status)}
+		requestMetrics.Lock()
+		l := requestMetrics.m[key]
+		if l == nil {
+			l = &latency{counts: make([]uint64, len(latencyBuckets))}
+			requestMetrics.m[key] = l
+		}
+		for i, b := range latencyBuckets {
+			if secs <= b {
+				l.counts[i]++
+			}
+		}
+		l.sum += secs
+		l.n++
+		requestMetrics.Unlock()
+	})
+}
+
+// labelValue escapes a label value for the text format.
+func labelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func promFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// quantile of sorted values, by nearest rank.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
+
+// metricsHandler serves /metrics in the Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	requestMetrics.Lock()
+	keys := make([][2]string, 0, len(requestMetrics.m))
+	for k := range requestMetrics.m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	metric("fileserver_http_requests_total", "counter", "Requests answered, by handler and status code.")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "fileserver_http_requests_total{handler=\"%s\",code=\"%s\"} %d\n", labelValue(k[0]), k[1], requestMetrics.m[k].n)
+	}
+	metric("fileserver_http_request_duration_seconds", "histogram", "Time from the request to the end of the response, by handler and status code.")
+	for _, k := range keys {
+		l := requestMetrics.m[k]
+		labels := fmt.Sprintf("handler=\"%s\",code=\"%s\"", labelValue(k[0]), k[1])
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(&b, "fileserver_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, promFloat(bound), l.counts[i])
+		}
+		fmt.Fprintf(&b, "fileserver_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, l.n)
+		fmt.Fprintf(&b, "fileserver_http_request_duration_seconds_sum{%s} %s\n", labels, promFloat(l.sum))
+		fmt.Fprintf(&b, "fileserver_http_request_duration_seconds_count{%s} %d\n", labels, l.n)
+	}
+	requestMetrics.Unlock()
+
+	metric("fileserver_served_bytes_total", "counter", "File, archive and transcode bytes sent to clients.")
+	fmt.Fprintf(&b, "fileserver_served_bytes_total %d\n", servedBytes.Load())
+	dirServed.Lock()
+	dirs := make([]string, 0, len(dirServed.m))
+	for d := range dirServed.m {
+		dirs = append(dirs, d)
+	}
+	slices.Sort(dirs)
+	metric("fileserver_dir_served_bytes_total", "counter", "Bytes sent to clients by top-level directory of the share.")
+	for _, d := range dirs {
+		fmt.Fprintf(&b, "fileserver_dir_served_bytes_total{dir=\"%s\"} %d\n", labelValue(d), dirServed.m[d].Load())
+	}
+	dirServed.Unlock()
+
+	metric("fileserver_active_transfers", "gauge", "File, archive and transcode transfers in progress.")
+	fmt.Fprintf(&b, "fileserver_active_transfers %d\n", activeTransfers.Load())
+	metric("fileserver_active_connections", "gauge", "Open client connections.")
+	fmt.Fprintf(&b, "fileserver_active_connections %d\n", activeConns.Load())
+
+	speedMetrics.Lock()
+	directions := make([]string, 0, len(speedMetrics.m))
+	for d := range speedMetrics.m {
+		directions = append(directions, d)
+	}
+	slices.Sort(directions)
+	metric("fileserver_speedtest_mb_per_second", "summary", "Speedtest results in MB/s; quantiles over the last "+strconv.Itoa(speedQuantileWindow)+" per direction.")
+	for _, d := range directions {
+		s := speedMetrics.m[d]
+		sorted := slices.Sorted(slices.Values(s.recent))
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			fmt.Fprintf(&b, "fileserver_speedtest_mb_per_second{direction=\"%s\",quantile=\"%s\"} %s\n", labelValue(d), promFloat(q), promFloat(quantile(sorted, q)))
+		}
+		fmt.Fprintf(&b, "fileserver_speedtest_mb_per_second_sum{direction=\"%s\"} %s\n", labelValue(d), promFloat(s.sum))
+		fmt.Fprintf(&b, "fileserver_speedtest_mb_per_second_count{direction=\"%s\"} %d\n", labelValue(d), s.n)
+	}
+	speedMetrics.Unlock()
+
+	if free, size, ok := diskSpace(root); ok {
+		metric("fileserver_disk_free_bytes", "gauge", "Space left for unprivileged users on the filesystem holding the share.")
+		fmt.Fprintf(&b, "fileserver_disk_free_bytes %d\n", free)
+		metric("fileserver_disk_size_bytes", "gauge", "Size of the filesystem holding the share.")
+		fmt.Fprintf(&b, "fileserver_disk_size_bytes %d\n", size)
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	metric("fileserver_build_info", "gauge", "Always 1, labelled with the server version.")
+	fmt.Fprintf(&b, "fileserver_build_info{version=\"%s\"} 1\n", labelValue(version))
+	metric("process_start_time_seconds", "gauge", "Start time of the process since the Unix epoch in seconds.")
+	fmt.Fprintf(&b, "process_start_time_seconds %d\n", startTime.Unix())
+	metric("go_info", "gauge", "Information about the Go environment.")
+	fmt.Fprintf(&b, "go_info{version=\"%s\"} 1\n", runtime.Version())
+	metric("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	fmt.Fprintf(&b, "go_goroutines %d\n", runtime.NumGoroutine())
+	metric("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	fmt.Fprintf(&b, "go_memstats_alloc_bytes %d\n", ms.Alloc)
+	metric("go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.")
+	fmt.Fprintf(&b, "go_memstats_heap_inuse_bytes %d\n", ms.HeapInuse)
+	metric("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from the system.")
+	fmt.Fprintf(&b, "go_memstats_sys_bytes %d\n", ms.Sys)
+	metric("go_memstats_next_gc_bytes", "gauge", "Number of heap bytes when the next garbage collection will take place.")
+	fmt.Fprintf(&b, "go_memstats_next_gc_bytes %d\n", ms.NextGC)
+	metric("go_gc_cycles_total", "counter", "Number of completed garbage collection cycles.")
+	fmt.Fprintf(&b, "go_gc_cycles_total %d\n", ms.NumGC)
+	metric("go_gc_pause_seconds_total", "counter", "Time the world was stopped for garbage collection.")
+	fmt.Fprintf(&b, "go_gc_pause_seconds_total %s\n", promFloat(float64(ms.PauseTotalNs)/1e9))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+var mimeOverrides stringList
+
+// builtinMIME covers media, subtitle and playlist types that bare systems
+// without /etc/mime.types do not know about.
+var builtinMIME = map[string]string{
+	".mkv":  "video/x-matroska",
+	".mk3d": "video/x-matroska",
+	".mka":  "audio/x-matroska",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".mov":  "video/quicktime",
+	".avi":  "video/x-msvideo",
+	".wmv":  "video/x-ms-wmv",
+	".flv":  "video/x-flv",
+	".mpg":  "video/mpeg",
+	".mpeg": "video/mpeg",
+	".ts":   "video/mp2t",
+	".m2ts": "video/mp2t",
+	".mts":  "video/mp2t",
+	".iso":  "application/x-iso9660-image",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".ac3":  "audio/ac3",
+	".dts":  "audio/vnd.dts",
+	".srt":  "text/plain",
+	".ass":  "text/plain",
+	".ssa":  "text/plain",
+	".sub":  "text/plain",
+	".vtt":  "text/vtt",
+	".nfo":  "text/plain",
+	".m3u":  "audio/x-mpegurl",
+	".m3u8": "audio/x-mpegurl",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+}
+
+// mimeTypes is builtinMIME with -mime overrides applied.
+var mimeTypes = map[string]string{}
+
+// registerMIME installs the built-in table and -mime overrides, both in
+// mimeTypes and in the mime package so http.ServeContent agrees with us.
+func registerMIME() error {
+	for ext, typ := range builtinMIME {
+		mimeTypes[ext] = typ
+	}
+	for _, o := range mimeOverrides {
+		ext, typ, ok := strings.Cut(o, "=")
+		ext = "." + strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		typ = strings.TrimSpace(typ)
+		if !ok || ext == "." || typ == "" {
+			return fmt.Errorf("bad -mime %q: want ext=type", o)
+		}
+		if _, _, err := mime.ParseMediaType(typ); err != nil {
+			return fmt.Errorf("bad -mime %q: %v", o, err)
+		}
+		mimeTypes[ext] = typ
+	}
+	for ext, typ := range mimeTypes {
+		if err := mime.AddExtensionType(ext, typ); err != nil {
+			return fmt.Errorf("cannot register %s: %v", ext, err)
+		}
+	}
+	return nil
+}
+
+// contentType is the single source of Content-Type for served files.
+func contentType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if typ, ok := mimeTypes[ext]; ok {
+		return typ
+	}
+	if typ := mime.TypeByExtension(ext); typ != "" {
+		return typ
+	}
+	return "application/octet-stream"
+}
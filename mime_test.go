@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinMIME(t *testing.T) {
+	files := map[string]string{}
+	for ext := range builtinMIME {
+		files["file"+ext] = "1\n00:00:01,000 --> 00:00:02,000\nx\n"
+	}
+	setupRoot(t, files)
+	var lst dirListing
+	if err := json.Unmarshal([]byte(body(t, serve(indexHandler, http.MethodGet, "/?format=json"))), &lst); err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]string{}
+	for _, e := range lst.Entries {
+		listed[e.Name] = e.MIME
+	}
+	for ext, want := range builtinMIME {
+		if got := contentType("Film" + strings.ToUpper(ext)); got != want {
+			t.Errorf("contentType(%s) = %q, want %q", strings.ToUpper(ext), got, want)
+		}
+		if got := listed["file"+ext]; got != want {
+			t.Errorf("listing gives %s %q, want %q", ext, got, want)
+		}
+		w := serve(indexHandler, http.MethodHead, "/file"+ext)
+		got, _, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if err != nil || got != want {
+			t.Errorf("HEAD /file%s: Content-Type %q, want %q", ext, w.Header().Get("Content-Type"), want)
+		}
+	}
+	if got := contentType("file.unknown-ext"); got != "application/octet-stream" {
+		t.Errorf("unknown extension gives %q", got)
+	}
+}
+
+func TestMIMEOverrides(t *testing.T) {
+	old := mimeOverrides
+	defer func() {
+		mimeOverrides = old
+		registerMIME()
+	}()
+	mimeOverrides = stringList{"mkv=video/webm", " .NFO = text/x-nfo ", "xyz=application/x-xyz"}
+	if err := registerMIME(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a.mkv": "video/webm", "a.nfo": "text/x-nfo", "a.XYZ": "application/x-xyz", "a.mp4": "video/mp4"} {
+		if got := contentType(name); got != want {
+			t.Errorf("contentType(%s) = %q, want %q", name, got, want)
+		}
+	}
+	if got := mime.TypeByExtension(".xyz"); got != "application/x-xyz" {
+		t.Errorf("mime package gives .xyz %q", got)
+	}
+	for _, bad := range []string{"mkv", "=video/webm", "mkv=", "mkv=not a type/"} {
+		mimeOverrides = stringList{bad}
+		if err := registerMIME(); err == nil {
+			t.Errorf("-mime %q accepted", bad)
+		}
+	}
+}
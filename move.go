@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+type moveResult struct {
+	From  string `json:"from"`
+	Path  string `json:"path"`
+	URL   string `json:"url"`
+	IsDir bool   `json:"is_dir"`
+}
+
+// duplicateFile copies one file with its mode and times and syncs it, so the
+// source can be removed once every copy returned.
+func duplicateFile(src, dst string, fi os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	bp := getBuf()
+	_, err = io.CopyBuffer(out, in, *bp)
+	putBuf(bp)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+	}
+	return err
+}
+
+// copyTree copies src, a file or a directory, to dst, which must not exist.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			return os.Mkdir(target, fi.Mode().Perm()|0o700)
+		case fi.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			return duplicateFile(p, target, fi)
+		}
+		return nil
+	})
+}
+
+// moveAcross moves src to dst on another filesystem: it copies into a
+// hidden directory next to dst, moves the copy into place and only then
+// removes src.
+func moveAcross(src, dst string, overwrite bool) error {
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), ".move-*.part")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	copied := filepath.Join(tmp, filepath.Base(dst))
+	if err := copyTree(src, copied); err != nil {
+		return err
+	}
+	if err := moveInPlace(copied, dst, overwrite); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// moveInPlace renames on one filesystem. Files go through placeFile, which
+// never replaces without overwrite; directories are checked first.
+func moveInPlace(src, dst string, overwrite bool) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return placeFile(src, dst, overwrite)
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return errExists
+	}
+	return os.Rename(src, dst)
+}
+
+func writeMoveError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errExists):
+		jsonError(w, "destination exists (add ?overwrite=1 to replace it)", http.StatusConflict)
+	case errors.Is(err, errIsDir):
+		jsonError(w, "destination is a directory", http.StatusConflict)
+	default:
+		jsonError(w, "cannot move", http.StatusInternalServerError)
+	}
+}
+
+// moveHandler serves POST /api/move {from, to}. ?mkdirs=1 creates missing
+// parents of to and ?overwrite=1 replaces an existing file there.
+// Players that have the file open keep reading it, as the open descriptor
+// follows the rename.
+func moveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8192)).Decode(&req); err != nil || req.From == "" || req.To == "" {
+		jsonError(w, "body must be JSON {from, to}", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	overwrite := q.Get("overwrite") == "1"
+	fromRel := strings.TrimPrefix(path.Clean("/"+req.From), "/")
+	toRel := strings.TrimPrefix(path.Clean("/"+req.To), "/")
+	if fromRel == "" {
+		jsonError(w, "cannot move the share root", http.StatusForbidden)
+		return
+	}
+	if toRel == fromRel || strings.HasPrefix(toRel, fromRel+"/") {
+		jsonError(w, "cannot move a path into itself", http.StatusBadRequest)
+		return
+	}
+	src, err := resolveFor(r, req.From)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	if toRel == "" || !visible(toRel) {
+		writePathError(w, true, errForbidden)
+		return
+	}
+	if q.Get("mkdirs") == "1" {
+		if err := mkdirInRoot(r, filepath.Join(root, filepath.FromSlash(path.Dir(toRel)))); err != nil {
+			writePathError(w, true, err)
+			return
+		}
+	}
+	dst, _, err := resolveNewPath(r, toRel)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	fi, err := os.Lstat(src)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	if dfi, err := os.Lstat(dst); err == nil {
+		switch {
+		case dfi.IsDir():
+			writeMoveError(w, errIsDir)
+			return
+		case !overwrite:
+			writeMoveError(w, errExists)
+			return
+		}
+	}
+	err = moveInPlace(src, dst, overwrite)
+	if errors.Is(err, syscall.EXDEV) {
+		err = moveAcross(src, dst, overwrite)
+	}
+	if err != nil {
+		if !errors.Is(err, errExists) {
+			fmt.Fprintf(os.Stdout, "move %s to %s by %s failed: %v\n", fromRel, toRel, r.RemoteAddr, err)
+		}
+		writeMoveError(w, err)
+		return
+	}
+	library.invalidate()
+	fmt.Fprintf(os.Stdout, "move %s to %s by %s\n", fromRel, toRel, r.RemoteAddr)
+	res := moveResult{From: fromRel, Path: toRel, URL: escapePath("/" + toRel), IsDir: fi.IsDir()}
+	if res.IsDir {
+		res.URL += "/"
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// mkdirHandler serves POST /api/mkdir {path}, creating the directory and
+// any missing parents. An existing directory is not an error.
+func mkdirHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8192)).Decode(&req); err != nil || req.Path == "" {
+		jsonError(w, "body must be JSON {path}", http.StatusBadRequest)
+		return
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+req.Path), "/")
+	if rel == "" {
+		jsonError(w, "path is the share root", http.StatusBadRequest)
+		return
+	}
+	if !visible(rel) {
+		fmt.Fprintf(os.Stdout, "warning: mkdir %s by %s refused, the name is hidden or excluded\n", rel, r.RemoteAddr)
+		jsonError(w, "directory would be invisible: dotfiles, system names and -exclude matches are not shared", http.StatusBadRequest)
+		return
+	}
+	if ok, hidden := accessFor(r, rel, true); !ok {
+		if hidden {
+			jsonError(w, "not found", http.StatusNotFound)
+		} else {
+			jsonError(w, "forbidden", http.StatusForbidden)
+		}
+		return
+	}
+	full := filepath.Join(root, filepath.FromSlash(rel))
+	res := map[string]interface{}{"path": rel, "url": escapePath("/"+rel) + "/", "created": false}
+	if fi, err := os.Stat(full); err == nil {
+		if !fi.IsDir() {
+			jsonError(w, "path exists as a file", http.StatusConflict)
+			return
+		}
+		if _, err := resolveFor(r, rel); err != nil {
+			writePathError(w, true, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+	err := mkdirInRoot(r, full)
+	if errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.EEXIST) {
+		jsonError(w, "a parent of path is a file", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errForbidden) || errors.Is(err, os.ErrNotExist) {
+		writePathError(w, true, err)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "mkdir %s by %s failed: %v\n", rel, r.RemoteAddr, err)
+		jsonError(w, "cannot create directory", http.StatusInternalServerError)
+		return
+	}
+	library.invalidate()
+	fmt.Fprintf(os.Stdout, "mkdir %s by %s\n", rel, r.RemoteAddr)
+	res["created"] = true
+	writeJSON(w, http.StatusCreated, res)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+)
+
+// mtlsCA is a PEM bundle of CAs whose client certificates are required on
+// every connection. mtlsAdmins are the common names allowed to change the
+// share; when there are any, every other certificate is read-only.
+var mtlsCA string
+var mtlsAdmins stringList
+
+var mtlsPool *x509.CertPool
+
+func mtlsEnabled() bool {
+	return mtlsPool != nil
+}
+
+func checkMTLS() error {
+	if mtlsCA == "" {
+		if len(mtlsAdmins) > 0 {
+			return fmt.Errorf("-mtls-admin-cn needs -mtls-ca")
+		}
+		return nil
+	}
+	if !tlsEnabled() {
+		return fmt.Errorf("-mtls-ca needs HTTPS: -cert and -key, -tls-self-signed or -acme-domain")
+	}
+	b, err := os.ReadFile(mtlsCA)
+	if err != nil {
+		return fmt.Errorf("-mtls-ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("-mtls-ca: no PEM certificates in %s", mtlsCA)
+	}
+	mtlsPool = pool
+	return nil
+}
+
+// requireClientCerts makes the handshake fail for clients without a
+// certificate signed by -mtls-ca, before any HTTP is read.
+func requireClientCerts(cfg *tls.Config) {
+	if mtlsPool == nil {
+		return
+	}
+	cfg.ClientCAs = mtlsPool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+}
+
+// certIdentity returns who the verified client certificate of r belongs
+// to, or nil without one.
+func certIdentity(r *http.Request) *authInfo {
+	if mtlsPool == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	c := r.TLS.VerifiedChains[0][0]
+	cn := c.Subject.CommonName
+	return &authInfo{
+		who:   fmt.Sprintf("cert CN=%s serial %X", cn, c.SerialNumber),
+		name:  cn,
+		write: len(mtlsAdmins) == 0 || slices.Contains(mtlsAdmins, cn),
+	}
+}
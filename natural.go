@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// naturalCompare orders strings the way people number things: runs of ASCII
+// digits compare by numeric value ("Episode 2" < "Episode 10"), everything
+// else compares case-insensitively. Digit runs are compared as strings after
+// stripping leading zeros, so arbitrarily long numbers never overflow. Ties
+// fall back to fewer leading zeros first and finally to a plain byte
+// comparison, which keeps the order total and stable.
+func naturalCompare(a, b string) int {
+	zeros := 0
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			si, sj := i, j
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			na, nb := strings.TrimLeft(a[si:i], "0"), strings.TrimLeft(b[sj:j], "0")
+			if len(na) != len(nb) {
+				return cmpInt64(int64(len(na)), int64(len(nb)))
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			if zeros == 0 {
+				zeros = cmpInt64(int64(i-si), int64(j-sj))
+			}
+			continue
+		}
+		ra, wa := utf8.DecodeRuneInString(a[i:])
+		rb, wb := utf8.DecodeRuneInString(b[j:])
+		if la, lb := unicode.ToLower(ra), unicode.ToLower(rb); la != lb {
+			return cmpInt64(int64(la), int64(lb))
+		}
+		i += wa
+		j += wb
+	}
+	if c := cmpInt64(int64(len(a)-i), int64(len(b)-j)); c != 0 {
+		return c
+	}
+	if zeros != 0 {
+		return zeros
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNaturalCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"Episode 2.mkv", "Episode 10.mkv", -1},
+		{"Episode 10.mkv", "Episode 2.mkv", 1},
+		{"S01E02.mkv", "S01E10.mkv", -1},
+		{"S01E10.mkv", "S02E01.mkv", -1},
+		{"S2E1.mkv", "S10E1.mkv", -1},
+		{"episode 3.mkv", "Episode 4.mkv", -1},
+		{"Episode 4.mkv", "episode 3.mkv", 1},
+		{"Episode 02.mkv", "Episode 2.mkv", 1},
+		{"Episode 002.mkv", "Episode 02.mkv", 1},
+		{"Episode 02.mkv", "Episode 3.mkv", -1},
+		{"Film 1080p.mkv", "Film 720p.mkv", 1},
+		{"123", "45", 1},
+		{"007", "7", 1},
+		{"0", "00", -1},
+		{"99999999999999999999999999", "100000000000000000000000000", -1},
+		{"99999999999999999999999999", "99999999999999999999999999", 0},
+		{"a", "a1", -1},
+		{"", "a", -1},
+		{"Ёж 2", "ёж 10", -1},
+		{"same.mkv", "same.mkv", 0},
+	}
+	for _, tt := range tests {
+		if got := naturalCompare(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalCompare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := naturalCompare(tt.b, tt.a); got != -tt.want {
+			t.Errorf("naturalCompare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestNaturalSortSchemes(t *testing.T) {
+	tests := [][]string{
+		{"Episode 1.mkv", "Episode 2.mkv", "Episode 9.mkv", "Episode 10.mkv", "Episode 11.mkv", "Episode 100.mkv"},
+		{"Show.S01E01.mkv", "Show.S01E02.mkv", "Show.S01E10.mkv", "Show.S02E01.mkv", "Show.S10E01.mkv"},
+		{"1x01 Pilot.mkv", "1x2 Second.mkv", "1x10 Tenth.mkv", "2x01 Return.mkv"},
+		{"Part 1 of 3.mkv", "Part 2 of 3.mkv", "Part 3 of 3.mkv"},
+		{"[Group] Anime - 01 [1080p].mkv", "[Group] Anime - 02 [1080p].mkv", "[Group] Anime - 12 [1080p].mkv"},
+		{"cd1.avi", "CD2.avi", "cd10.avi"},
+	}
+	for _, want := range tests {
+		got := slices.Clone(want)
+		slices.Reverse(got)
+		slices.SortFunc(got, naturalCompare)
+		if !slices.Equal(got, want) {
+			t.Errorf("sorted to %q, want %q", got, want)
+		}
+	}
+}
+
+func TestListingNaturalOrder(t *testing.T) {
+	want := []string{"Episode 1.mkv", "Episode 2.mkv", "episode 3.mkv", "Episode 10.mkv", "Episode 21.mkv"}
+	files := map[string]string{}
+	for _, n := range want {
+		files["Show/"+n] = n
+	}
+	setupRoot(t, files)
+	var lst dirListing
+	if err := json.Unmarshal([]byte(body(t, serve(indexHandler, http.MethodGet, "/Show/?format=json"))), &lst); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range lst.Entries {
+		got = append(got, e.Name)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("listing order %q, want %q", got, want)
+	}
+
+	if err := json.Unmarshal([]byte(body(t, serve(indexHandler, http.MethodGet, "/Show/?format=json&order=desc"))), &lst); err != nil {
+		t.Fatal(err)
+	}
+	got = got[:0]
+	for _, e := range lst.Entries {
+		got = append(got, e.Name)
+	}
+	slices.Reverse(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("descending listing order reversed %q, want %q", got, want)
+	}
+
+	pl := body(t, serve(playlistHandler, http.MethodGet, "/playlist.m3u?path=Show"))
+	last := -1
+	for _, n := range want {
+		i := strings.Index(pl, escapePath(n))
+		if i < 0 || i < last {
+			t.Errorf("playlist is missing %q or has it out of order:\n%s", n, pl)
+		}
+		last = i
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed templates/party.html
+var partyHTML string
+
+var partyTemplate = mustTemplate("party", partyHTML)
+
+// partyEmptyGrace is how long a party without members is kept, so the
+// link can be passed on and a dropped connection can come back.
+const partyEmptyGrace = 5 * time.Minute
+
+const maxParties = 64
+
+// party is a group watching one video together. The first member to
+// connect controls playback; when it leaves the next one takes over.
+type party struct {
+	id   string
+	path string
+	mu   sync.Mutex
+	// members in the order they joined; members[0] is the controller.
+	members  []*partyMember
+	paused   bool
+	position float64
+	at       time.Time
+	expire   *time.Timer
+}
+
+// partyMember is one connection. Messages go out through a queue so that a
+// slow client never holds up the party; one that falls this far behind
+// misses updates until the next one.
+type partyMember struct {
+	c   *wsConn
+	out chan []byte
+}
+
+var parties = struct {
+	sync.Mutex
+	m map[string]*party
+}{m: map[string]*party{}}
+
+// partyMessage is sent both ways. Clients send play, pause, seek and, while
+// playing, tick; only the controller's are acted on. The server sends state
+// for members to follow and members when someone joins or leaves.
+type partyMessage struct {
+	Type       string  `json:"type"`
+	Position   float64 `json:"position"`
+	Paused     bool    `json:"paused"`
+	Controller bool    `json:"controller"`
+	Members    int     `json:"members"`
+}
+
+func getParty(id string) *party {
+	parties.Lock()
+	defer parties.Unlock()
+	return parties.m[id]
+}
+
+// now is where playback should be at this moment. p.mu must be held.
+func (p *party) now() float64 {
+	if p.paused {
+		return p.position
+	}
+	return p.position + time.Since(p.at).Seconds()
+}
+
+// expireLater removes the party unless someone joins within the grace
+// period. p.mu must be held.
+func (p *party) expireLater() {
+	p.expire = time.AfterFunc(partyEmptyGrace, func() {
+		p.mu.Lock()
+		empty := len(p.members) == 0
+		p.mu.Unlock()
+		if empty {
+			parties.Lock()
+			delete(parties.m, p.id)
+			parties.Unlock()
+		}
+	})
+}
+
+// send queues m for one member. p.mu must be held.
+func (p *party) send(pm *partyMember, m partyMessage) {
+	m.Controller, m.Members = len(p.members) > 0 && p.members[0] == pm, len(p.members)
+	b, _ := json.Marshal(m)
+	select {
+	case pm.out <- b:
+	default:
+	}
+}
+
+func (p *party) broadcastMembers() {
+	for _, c := range p.members {
+		p.send(c, partyMessage{Type: "members", Position: p.now(), Paused: p.paused})
+	}
+}
+
+func (p *party) join(pm *partyMember) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.expire != nil {
+		p.expire.Stop()
+	}
+	p.members = append(p.members, pm)
+	p.send(pm, partyMessage{Type: "state", Position: p.now(), Paused: p.paused})
+	p.broadcastMembers()
+}
+
+func (p *party) leave(pm *partyMember) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, m := range p.members {
+		if m == pm {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			break
+		}
+	}
+	close(pm.out)
+	if len(p.members) == 0 {
+		p.expireLater()
+		return
+	}
+	p.broadcastMembers()
+}
+
+// event applies a message from a member, if it is the controller, and
+// passes the new state on to everyone else.
+func (p *party) event(pm *partyMember, m partyMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.members) == 0 || p.members[0] != pm || m.Position < 0 {
+		return
+	}
+	switch m.Type {
+	case "play":
+		p.paused = false
+	case "pause":
+		p.paused = true
+	case "seek", "tick":
+	default:
+		return
+	}
+	p.position, p.at = m.Position, time.Now()
+	for _, other := range p.members[1:] {
+		p.send(other, partyMessage{Type: "state", Position: p.position, Paused: p.paused})
+	}
+}
+
+// partyCreateHandler serves POST /api/party {path}: a new party for a video
+// and the link to share.
+func partyCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		jsonError(w, "body must be JSON {path}", http.StatusBadRequest)
+		return
+	}
+	rel, _, ok := progressVideo(w, r, req.Path)
+	if !ok {
+		return
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	p := &party{id: hex.EncodeToString(b), path: rel, paused: true, at: time.Now()}
+	parties.Lock()
+	if len(parties.m) >= maxParties {
+		parties.Unlock()
+		jsonError(w, "too many parties", http.StatusServiceUnavailable)
+		return
+	}
+	parties.m[p.id] = p
+	parties.Unlock()
+	p.mu.Lock()
+	p.expireLater()
+	p.mu.Unlock()
+	writeJSON(w, http.StatusCreated, map[string]string{"id": p.id, "path": rel, "url": baseURL(r) + "/party/" + p.id})
+}
+
+type partyPage struct {
+	Name    string
+	URL     string
+	PlayURL string
+	Direct  bool
+}
+
+// partyHandler serves /party/<id>, the shared player, and /party/<id>/ws,
+// its WebSocket.
+func partyHandler(w http.ResponseWriter, r *http.Request) {
+	id, ws := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/party/"), "/ws")
+	p := getParty(id)
+	if p == nil {
+		http.Error(w, "no such party", http.StatusNotFound)
+		return
+	}
+	full, err := resolveFor(r, "/"+p.path)
+	if err == nil {
+		_, err = os.Stat(full)
+	}
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if !ws {
+		// Everyone has to be able to seek anywhere, so the file is played
+		// as it is rather than through /remux/.
+		renderTemplate(w, partyTemplate, partyTemplate, partyPage{
+			Name:    path.Base(p.path),
+			URL:     escapePath("/" + p.path),
+			PlayURL: playURL("/" + p.path),
+			Direct:  browserPlayable[strings.ToLower(path.Ext(p.path))],
+		})
+		return
+	}
+	c, err := wsUpgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	pm := &partyMember{c: c, out: make(chan []byte, 16)}
+	p.join(pm)
+	defer p.leave(pm)
+	go func() {
+		t := time.NewTicker(30 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case b, ok := <-pm.out:
+				if !ok {
+					return
+				}
+				c.writeText(b)
+			case <-t.C:
+				c.writeFrame(0x9, nil)
+			}
+		}
+	}()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+		b, err := c.read()
+		if err != nil {
+			return
+		}
+		var m partyMessage
+		if json.Unmarshal(b, &m) == nil {
+			p.event(pm, m)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	_ "embed"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed templates/play.html
+var playHTML string
+
+var playTemplate = mustTemplate("play", playHTML)
+
+// browserPlayable are the containers HTML5 video in common browsers and TVs
+// can open directly. Others still get a player page with a download link.
+var browserPlayable = map[string]bool{".mp4": true, ".m4v": true, ".webm": true, ".mov": true, ".ogv": true}
+
+type playPage struct {
+	Name     string
+	URL      string
+	Download string
+	DirURL   string
+	Direct   bool
+	Remux    bool
+	PrevURL  string
+	PrevName string
+	NextURL  string
+	NextName string
+	Tracks   []playTrack
+	// TrickplayVTT maps times to sprite tiles for previews while scrubbing;
+	// empty until the sprite sheet has been generated.
+	TrickplayVTT string
+	// ChaptersURL is fetched by the page itself, so opening the player
+	// never waits for ffprobe.
+	ChaptersURL string
+	// FramePath is the share-relative path for the "preview at" form,
+	// set when -ffmpeg is.
+	FramePath string
+	// CastInfoURL tells the Cast button what to send to a Chromecast.
+	CastInfoURL string
+	// ProgressPath is the share-relative path the page reports its
+	// position under; Start is where playback begins, from ?t= or the
+	// saved position, in which case Resumed is set.
+	ProgressPath string
+	Start        float64
+	Resumed      bool
+}
+
+type playTrack struct {
+	Label   string
+	SrcLang string
+	URL     string
+	Default bool
+}
+
+// subtitleLabel names a track for the player's selector.
+func subtitleLabel(t subtitleTrack) string {
+	label := languageNames[t.Lang]
+	switch {
+	case label != "":
+	case t.Lang != "":
+		label = strings.ToUpper(t.Lang)
+	default:
+		label = "Unknown"
+	}
+	if t.Forced {
+		label += " (forced)"
+	}
+	if t.SDH {
+		label += " (SDH)"
+	}
+	return label
+}
+
+// playTracks turns the sidecar subtitles of a video into <track> data.
+// Only formats with a WebVTT rendition are usable, and the first track
+// that is not forced is enabled by default.
+func playTracks(full string) []playTrack {
+	var tracks []playTrack
+	def := false
+	for _, t := range findSubtitles(full) {
+		if t.VTTURL == "" {
+			continue
+		}
+		pt := playTrack{Label: subtitleLabel(t), URL: t.VTTURL}
+		if len(t.Lang) <= 3 || strings.Contains(t.Lang, "-") {
+			pt.SrcLang = t.Lang
+		}
+		if !def && !t.Forced {
+			pt.Default, def = true, true
+		}
+		tracks = append(tracks, pt)
+	}
+	return tracks
+}
+
+func playURL(upath string) string {
+	return "/play" + escapePath(upath)
+}
+
+// adjacentVideos returns the videos before and after name in dir, in the
+// order the listing shows them.
+func adjacentVideos(full, upath string) (prev, next string) {
+	des, err := readShareDir(filepath.Dir(full))
+	if err != nil {
+		return "", ""
+	}
+	dir, name := path.Dir(upath), path.Base(upath)
+	var names []string
+	for _, de := range des {
+		if de.IsDir() || fileKind(de.Name()) != "video" || !visible(path.Join(dir, de.Name())) {
+			continue
+		}
+		names = append(names, de.Name())
+	}
+	sort.Slice(names, func(i, j int) bool { return naturalCompare(names[i], names[j]) < 0 })
+	for i, n := range names {
+		if n != name {
+			continue
+		}
+		if i > 0 {
+			prev = names[i-1]
+		}
+		if i+1 < len(names) {
+			next = names[i+1]
+		}
+	}
+	return prev, next
+}
+
+func playHandler(w http.ResponseWriter, r *http.Request) {
+	upath, err := decodePath(strings.TrimPrefix(r.URL.EscapedPath(), "/play"))
+	if err != nil {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+	full, err := resolveFor(r, upath)
+	if err != nil {
+		writePathError(w, false, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if fileKind(fi.Name()) != "video" {
+		http.Error(w, "not a video", http.StatusBadRequest)
+		return
+	}
+	page := playPage{
+		Name:   fi.Name(),
+		URL:    escapePath(upath),
+		DirURL: dirURL(path.Dir(upath)),
+		Direct: browserPlayable[strings.ToLower(filepath.Ext(fi.Name()))],
+	}
+	page.Download = page.URL + "?download=1"
+	// mkv usually holds codecs browsers play fine, so with ffmpeg around
+	// it is repackaged into MP4 instead of being offered for download.
+	if ffmpegPath != "" && strings.EqualFold(filepath.Ext(fi.Name()), ".mkv") {
+		page.URL, page.Direct, page.Remux = "/remux"+page.URL, true, true
+	}
+	page.ProgressPath = strings.TrimPrefix(upath, "/")
+	if v := r.URL.Query().Get("t"); v != "" {
+		if t, err := strconv.ParseFloat(v, 64); err == nil && t >= 0 {
+			page.Start = t
+		}
+	} else if t := resumeAt(clientID(w, r), page.ProgressPath); t > 0 {
+		page.Start, page.Resumed = t, true
+	}
+	// A remux cannot seek past what it has sent, so it starts there.
+	if page.Remux && page.Start > 0 {
+		page.Start = math.Floor(page.Start)
+		page.URL += "?t=" + strconv.Itoa(int(page.Start))
+	}
+	page.Tracks = playTracks(full)
+	page.CastInfoURL = "/api/cast-info?path=" + url.QueryEscape(strings.TrimPrefix(upath, "/"))
+	if ffprobePath != "" {
+		page.ChaptersURL = "/api/chapters?path=" + url.QueryEscape(strings.TrimPrefix(upath, "/"))
+	}
+	if ffmpegPath != "" {
+		page.FramePath = strings.TrimPrefix(upath, "/")
+	}
+	if trickplayEnabled() && trickReady(trickDir(full, fi)) {
+		page.TrickplayVTT = trickBaseURL(upath) + "/thumbs.vtt"
+	}
+	prev, next := adjacentVideos(full, upath)
+	if prev != "" {
+		page.PrevURL, page.PrevName = playURL(path.Join(path.Dir(upath), prev)), prev
+	}
+	if next != "" {
+		page.NextURL, page.NextName = playURL(path.Join(path.Dir(upath), next)), next
+	}
+	renderTemplate(w, playTemplate, playTemplate, page)
+}
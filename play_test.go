@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var trackRE = regexp.MustCompile(`<track ([^>]*)>`)
+var attrRE = regexp.MustCompile(`([a-z-]+)(?:="([^"]*)")?`)
+
+// pageTracks returns the attributes of each <track> on a play page.
+func pageTracks(page string) []map[string]string {
+	var tracks []map[string]string
+	for _, m := range trackRE.FindAllStringSubmatch(page, -1) {
+		attrs := map[string]string{}
+		for _, a := range attrRE.FindAllStringSubmatch(m[1], -1) {
+			attrs[a[1]] = html.UnescapeString(a[2])
+		}
+		tracks = append(tracks, attrs)
+	}
+	return tracks
+}
+
+func TestPlayTracks(t *testing.T) {
+	setupRoot(t, map[string]string{
+		"Film.mkv":            "video",
+		"Film.rus.forced.srt": testSRT,
+		"Film.srt":            testSRT,
+		"Film.en.srt":         testSRT,
+		"Film.de.vtt":         "WEBVTT\n\n00:01.000 --> 00:02.000\nHallo\n",
+		"Film.ass":            "[Script Info]\n",
+	})
+	w := serve(playHandler, http.MethodGet, "/play/Film.mkv")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /play/Film.mkv = %d", w.Code)
+	}
+	page := body(t, w)
+	if !strings.Contains(page, "<select") {
+		t.Error("play page has no track selector")
+	}
+	tracks := pageTracks(page)
+	wants := []struct{ label, srclang, url string }{
+		{"German", "de", "/Film.de.vtt"},
+		{"English", "en", "/Film.en.srt?as=vtt"},
+		{"Russian (forced)", "rus", "/Film.rus.forced.srt?as=vtt"},
+		{"Unknown", "", "/Film.srt?as=vtt"},
+	}
+	if len(tracks) != len(wants) {
+		t.Fatalf("page has %d tracks, want %d: %v", len(tracks), len(wants), tracks)
+	}
+	for i, want := range wants {
+		tr := tracks[i]
+		_, def := tr["default"]
+		url := tr["data-src"]
+		if def {
+			url = tr["src"]
+		}
+		if tr["label"] != want.label || tr["srclang"] != want.srclang || url != want.url {
+			t.Errorf("track %d = %v, want %+v", i, tr, want)
+		}
+		if def != (i == 0) {
+			t.Errorf("track %d (%s): default = %v", i, want.label, def)
+		}
+		r := serve(indexHandler, http.MethodGet, url)
+		if r.Code != http.StatusOK || !strings.HasPrefix(r.Header().Get("Content-Type"), "text/vtt") || !strings.HasPrefix(body(t, r), "WEBVTT") {
+			t.Errorf("GET %s = %d %q, want WebVTT", url, r.Code, r.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestPlayTracksForcedFirst(t *testing.T) {
+	setupRoot(t, map[string]string{
+		"Film.mkv":           "video",
+		"Film.en.forced.srt": testSRT,
+		"Film.ru.srt":        testSRT,
+		"Film.uk.forced.srt": testSRT,
+	})
+	tracks := pageTracks(body(t, serve(playHandler, http.MethodGet, "/play/Film.mkv")))
+	if len(tracks) != 3 {
+		t.Fatalf("page has %d tracks, want 3", len(tracks))
+	}
+	for _, tr := range tracks {
+		_, def := tr["default"]
+		if def != (tr["label"] == "Russian") {
+			t.Errorf("track %q: default = %v, want only the first non-forced track", tr["label"], def)
+		}
+	}
+
+	setupRoot(t, map[string]string{"Film.mkv": "video", "Film.en.forced.srt": testSRT})
+	for _, tr := range pageTracks(body(t, serve(playHandler, http.MethodGet, "/play/Film.mkv"))) {
+		if _, def := tr["default"]; def {
+			t.Errorf("forced-only track %q enabled by default", tr["label"])
+		}
+	}
+}
+
+func TestPlayTracksLazy(t *testing.T) {
+	files := map[string]string{"Film.mkv": "video"}
+	for i := range 30 {
+		files[fmt.Sprintf("Subs/Film/%d_English.srt", i+1)] = testSRT
+	}
+	setupRoot(t, files)
+	tracks := pageTracks(body(t, serve(playHandler, http.MethodGet, "/play/Film.mkv")))
+	if len(tracks) != 30 {
+		t.Fatalf("page has %d tracks, want 30", len(tracks))
+	}
+	loaded := 0
+	for _, tr := range tracks {
+		if _, ok := tr["src"]; ok {
+			loaded++
+		} else if tr["data-src"] == "" {
+			t.Errorf("track %q has neither src nor data-src", tr["label"])
+		}
+	}
+	if loaded != 1 {
+		t.Errorf("%d tracks load with the page, want only the default", loaded)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// playlistEntries lists the videos in the directory at upath, by relative
+// path in natural order; with recursive set, subdirectories too, each
+// directory's files ahead of its subdirectories, skipping those r may not
+// reach.
+func playlistEntries(r *http.Request, full, upath string, recursive bool) []string {
+	var out []string
+	if !recursive {
+		des, err := readShareDir(full)
+		if err != nil {
+			return nil
+		}
+		for _, de := range des {
+			rel := path.Join(upath, de.Name())
+			if de.Type().IsRegular() && fileKind(de.Name()) == "video" && visible(rel) {
+				out = append(out, rel)
+			}
+		}
+		sort.SliceStable(out, func(i, j int) bool { return naturalCompare(out[i], out[j]) < 0 })
+		return out
+	}
+	_ = walkShare(full, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel := relPath(p)
+		if !visible(rel) || !accessible(r, rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && fileKind(d.Name()) == "video" {
+			out = append(out, "/"+rel)
+		}
+		return nil
+	})
+	sort.SliceStable(out, func(i, j int) bool { return treeCompare(out[i], out[j]) < 0 })
+	return out
+}
+
+// treeCompare orders paths as a walk of the tree would list them, except
+// that a directory's files come before its subdirectories.
+func treeCompare(a, b string) int {
+	sa, sb := strings.Split(a, "/"), strings.Split(b, "/")
+	for k := 0; k < len(sa) && k < len(sb); k++ {
+		if sa[k] == sb[k] {
+			continue
+		}
+		fileA, fileB := k == len(sa)-1, k == len(sb)-1
+		if fileA != fileB {
+			if fileA {
+				return -1
+			}
+			return 1
+		}
+		return naturalCompare(sa[k], sb[k])
+	}
+	return len(sa) - len(sb)
+}
+
+// playlistHandler serves /playlist.m3u?path=Shows/Season: the videos of a
+// directory as an extended M3U8 playlist with absolute URLs, so VLC and
+// friends can play a season straight through.
+func playlistHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	upath := path.Clean("/" + q.Get("path"))
+	full, err := resolveFor(r, upath)
+	if err != nil {
+		writePathError(w, false, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || !fi.IsDir() {
+		http.Error(w, "not a directory", http.StatusNotFound)
+		return
+	}
+	base := baseURL(r)
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, rel := range playlistEntries(r, full, upath, q.Get("recursive") == "1") {
+		b.WriteString(extinf(rel) + "\n" + withToken(r, base+escapePath(rel)) + "\n")
+	}
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(b.String()))
+}
+
+// extinf describes a playlist entry from the media info cache. Files that
+// were never probed get -1 and their file name; building a playlist does
+// not wait for ffprobe.
+func extinf(rel string) string {
+	name := path.Base(rel)
+	dur, title := -1, name
+	if fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel))); err == nil {
+		if info, ok := cachedMediaInfo(filepath.Join(root, filepath.FromSlash(rel)), fi.Size(), fi.ModTime()); ok {
+			dur, title = int(math.Round(info.DurationS)), cleanTitle(name)
+		}
+	}
+	return fmt.Sprintf("#EXTINF:%d,%s", dur, strings.NewReplacer("\r", " ", "\n", " ").Replace(title))
+}
+
+// playlistURL links the playlist of the directory at upath.
+func playlistURL(upath string) string {
+	return "/playlist.m3u?path=" + url.QueryEscape(strings.TrimPrefix(upath, "/"))
+}
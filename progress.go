@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// progressRetention is how long a position is kept after it was last
+// reported.
+var progressRetention time.Duration
+
+type progressEntry struct {
+	PositionS float64   `json:"position_s"`
+	DurationS float64   `json:"duration_s"`
+	Updated   time.Time `json:"updated"`
+	// MissingSince is when the file was first found gone; see
+	// continueWatching.
+	MissingSince *time.Time `json:"missing_since,omitempty"`
+}
+
+type progressResponse struct {
+	Path string `json:"path"`
+	progressEntry
+}
+
+// pruneProgress drops positions past retention. state must be locked.
+func pruneProgress(now time.Time) {
+	for client, m := range state.data.Progress {
+		for p, e := range m {
+			if progressRetention > 0 && now.Sub(e.Updated) > progressRetention {
+				delete(m, p)
+			}
+		}
+		if len(m) == 0 {
+			delete(state.data.Progress, client)
+		}
+	}
+}
+
+func savedProgress(client, rel string) (progressEntry, bool) {
+	state.Lock()
+	defer state.Unlock()
+	e, ok := state.data.Progress[client][rel]
+	return e, ok
+}
+
+// resumeAt is where the player picks up a video: the saved position,
+// unless the video was barely started or watched to the end.
+func resumeAt(client, rel string) float64 {
+	e, ok := savedProgress(client, rel)
+	if !ok || e.PositionS < 10 || e.DurationS > 0 && e.PositionS > 0.95*e.DurationS {
+		return 0
+	}
+	return e.PositionS
+}
+
+// progressVideo resolves the share path of a progress request to a video.
+func progressVideo(w http.ResponseWriter, r *http.Request, p string) (string, os.FileInfo, bool) {
+	upath := path.Clean("/" + p)
+	full, err := resolveFor(r, upath)
+	if err != nil {
+		writePathError(w, true, err)
+		return "", nil, false
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() || fileKind(fi.Name()) != "video" {
+		jsonError(w, "not a video", http.StatusNotFound)
+		return "", nil, false
+	}
+	return strings.TrimPrefix(upath, "/"), fi, true
+}
+
+// progressHandler stores and returns watch positions per client:
+// PUT {path, position_s, duration_s}, GET ?path= and DELETE ?path=.
+// POST is taken as PUT since that is all navigator.sendBeacon can send.
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	client := clientID(w, r)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		rel, _, ok := progressVideo(w, r, r.URL.Query().Get("path"))
+		if !ok {
+			return
+		}
+		e, ok := savedProgress(client, rel)
+		if !ok {
+			jsonError(w, "no saved position", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, progressResponse{Path: rel, progressEntry: e})
+	case http.MethodPut, http.MethodPost:
+		var req struct {
+			Path      string  `json:"path"`
+			PositionS float64 `json:"position_s"`
+			DurationS float64 `json:"duration_s"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			jsonError(w, "body must be JSON {path, position_s, duration_s}", http.StatusBadRequest)
+			return
+		}
+		if req.PositionS < 0 || req.DurationS < 0 || math.IsInf(req.PositionS, 0) || math.IsInf(req.DurationS, 0) {
+			jsonError(w, "position_s and duration_s must be non-negative seconds", http.StatusBadRequest)
+			return
+		}
+		rel, fi, ok := progressVideo(w, r, req.Path)
+		if !ok {
+			return
+		}
+		// Players streaming a remux do not know the length; the media info
+		// cache may.
+		if req.DurationS == 0 {
+			if info, ok := cachedMediaInfo(filepath.Join(root, filepath.FromSlash(rel)), fi.Size(), fi.ModTime()); ok {
+				req.DurationS = info.DurationS
+			}
+		}
+		e := progressEntry{PositionS: req.PositionS, DurationS: req.DurationS, Updated: time.Now()}
+		state.Lock()
+		if state.data.Progress[client] == nil {
+			state.data.Progress[client] = map[string]progressEntry{}
+		}
+		state.data.Progress[client][rel] = e
+		state.Unlock()
+		saveState()
+		writeJSON(w, http.StatusOK, progressResponse{Path: rel, progressEntry: e})
+	case http.MethodDelete:
+		rel := strings.TrimPrefix(path.Clean("/"+r.URL.Query().Get("path")), "/")
+		state.Lock()
+		delete(state.data.Progress[client], rel)
+		state.Unlock()
+		saveState()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type continueItem struct {
+	Path      string    `json:"path"`
+	Title     string    `json:"title"`
+	ResumeURL string    `json:"resume_url"`
+	PositionS float64   `json:"position_s"`
+	DurationS float64   `json:"duration_s"`
+	Percent   int       `json:"percent"`
+	Updated   time.Time `json:"updated"`
+}
+
+const maxContinueItems = 20
+
+// missingGrace is how long a file has to stay gone before its position is
+// forgotten, so a share on an unplugged disk does not lose everything.
+const missingGrace = 7 * 24 * time.Hour
+
+// continueWatching lists the client's videos that are started but not
+// finished, most recently watched first. Files that are gone or that r may
+// no longer reach are left out, and positions dropped once their file has
+// been missing for a while.
+func continueWatching(r *http.Request, client string) []continueItem {
+	state.Lock()
+	saved := make(map[string]progressEntry, len(state.data.Progress[client]))
+	for p, e := range state.data.Progress[client] {
+		saved[p] = e
+	}
+	state.Unlock()
+	now := time.Now()
+	items := []continueItem{}
+	changed := map[string]*progressEntry{}
+	for p, e := range saved {
+		full, err := resolvePath("/" + p)
+		if err == nil {
+			_, err = os.Stat(full)
+		}
+		switch {
+		case err != nil && e.MissingSince == nil:
+			e.MissingSince = &now
+			changed[p] = &e
+		case err != nil && now.Sub(*e.MissingSince) > missingGrace:
+			changed[p] = nil
+		case err == nil && e.MissingSince != nil:
+			e.MissingSince = nil
+			changed[p] = &e
+		}
+		if err != nil || !accessible(r, p, false) {
+			continue
+		}
+		if e.DurationS <= 0 || e.PositionS < 0.02*e.DurationS || e.PositionS > 0.95*e.DurationS {
+			continue
+		}
+		items = append(items, continueItem{
+			Path:      p,
+			Title:     cleanTitle(path.Base(p)),
+			ResumeURL: playURL("/"+p) + "?t=" + strconv.Itoa(int(e.PositionS)),
+			PositionS: e.PositionS,
+			DurationS: e.DurationS,
+			Percent:   int(100 * e.PositionS / e.DurationS),
+			Updated:   e.Updated,
+		})
+	}
+	if len(changed) > 0 {
+		state.Lock()
+		for p, e := range changed {
+			// Leave positions alone that were reported meanwhile.
+			if cur, ok := state.data.Progress[client][p]; !ok || !cur.Updated.Equal(saved[p].Updated) {
+				continue
+			}
+			if e == nil {
+				delete(state.data.Progress[client], p)
+			} else {
+				state.data.Progress[client][p] = *e
+			}
+		}
+		state.Unlock()
+		saveState()
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Updated.After(items[j].Updated) })
+	if len(items) > maxContinueItems {
+		items = items[:maxContinueItems]
+	}
+	return items
+}
+
+func continueHandler(w http.ResponseWriter, r *http.Request) {
+	items := continueWatching(r, clientID(w, r))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"count": len(items), "items": items})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// lanURLs are the addresses other devices can open the server at, the
+// best guess first. They are worked out once the listener is up.
+var lanURLs []string
+
+// virtualIfacePrefixes name interfaces that are rarely what a phone on the
+// same Wi-Fi can reach: containers, bridges, VPN tunnels.
+var virtualIfacePrefixes = []string{"docker", "veth", "br-", "virbr", "vmnet", "vboxnet", "tun", "tap", "wg", "tailscale", "zt", "utun"}
+
+// shareIPs lists the addresses the listener is reachable at, ranked: the
+// one the default route leaves from, then private addresses on physical
+// interfaces, then everything else. A specific -addr is taken as is.
+func shareIPs(listenIP net.IP) []net.IP {
+	if listenIP != nil && !listenIP.IsUnspecified() {
+		return []net.IP{listenIP}
+	}
+	type ranked struct {
+		ip   net.IP
+		rank int
+	}
+	var out []ranked
+	defRoute, _ := routeTo(&net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53})
+	ifis, _ := net.Interfaces()
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		virtual := false
+		for _, p := range virtualIfacePrefixes {
+			if strings.HasPrefix(ifi.Name, p) {
+				virtual = true
+			}
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || ipn.IP.To4() == nil || ipn.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ip := ipn.IP.To4()
+			rank := 3
+			switch {
+			case ip.Equal(defRoute) && ip.IsPrivate():
+				rank = 0
+			case ip.IsPrivate() && !virtual:
+				rank = 1
+			case ip.IsPrivate():
+				rank = 2
+			}
+			i := len(out)
+			for i > 0 && out[i-1].rank > rank {
+				i--
+			}
+			out = append(out[:i], append([]ranked{{ip, rank}}, out[i:]...)...)
+		}
+	}
+	ips := make([]net.IP, len(out))
+	for i, r := range out {
+		ips[i] = r.ip
+	}
+	if len(ips) == 0 {
+		ips = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	return ips
+}
+
+func initLANURLs(listenIP net.IP, port int) {
+	for _, ip := range shareIPs(listenIP) {
+		lanURLs = append(lanURLs, scheme()+"://"+net.JoinHostPort(ip.String(), strconv.Itoa(port))+"/")
+	}
+}
+
+// printShareQR prints a QR code for the best LAN URL so a phone can open
+// the share straight from the terminal, then lists the other addresses.
+// The code is only drawn when stdout is a terminal.
+func printShareQR(port int) {
+	if len(lanURLs) == 0 {
+		return
+	}
+	fmt.Printf("Open on another device: %s\n", lanURLs[0])
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 && !strings.HasPrefix(lanURLs[0], scheme()+"://127.") {
+		if q, err := encodeQR(lanURLs[0]); err == nil {
+			fmt.Print(q.terminal())
+		}
+	}
+	others := lanURLs[1:]
+	if !noMDNS {
+		others = append(others, scheme()+"://"+net.JoinHostPort(mdnsHostLabel(mdnsName)+".local", strconv.Itoa(port))+"/")
+	}
+	if len(others) > 0 {
+		fmt.Println("Also reachable at:")
+		for _, u := range others {
+			fmt.Println("  " + u)
+		}
+	}
+}
+
+// qrQuiet is the blank margin around a code, in modules, that scanners
+// need to find it.
+const qrQuiet = 4
+
+func (q *qrCode) dark(x, y int) bool {
+	x, y = x-qrQuiet, y-qrQuiet
+	return x >= 0 && y >= 0 && x < q.size && y < q.size && q.modules[y][x]
+}
+
+// terminal draws the code with half-block characters, two rows of modules
+// per line. Light modules are drawn in the foreground colour, which suits
+// the usual light-on-dark terminal and needs nothing but UTF-8 over SSH.
+func (q *qrCode) terminal() string {
+	var b strings.Builder
+	n := q.size + 2*qrQuiet
+	for y := 0; y < n; y += 2 {
+		for x := 0; x < n; x++ {
+			top, bottom := !q.dark(x, y), y+1 < n && !q.dark(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func (q *qrCode) image(scale int) image.Image {
+	n := q.size + 2*qrQuiet
+	img := image.NewGray(image.Rect(0, 0, n*scale, n*scale))
+	for y := 0; y < n*scale; y++ {
+		for x := 0; x < n*scale; x++ {
+			c := color.Gray{Y: 255}
+			if q.dark(x/scale, y/scale) {
+				c.Y = 0
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+	return img
+}
+
+// shareURL is the address the root page's QR code points at: the one the
+// browser used, unless that only works on this machine.
+func shareURL(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if host == "localhost" || ip != nil && ip.IsLoopback() || r.Host == "" {
+		if len(lanURLs) > 0 {
+			return lanURLs[0]
+		}
+	}
+	return baseURL(r) + "/"
+}
+
+func qrHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := encodeQR(shareURL(r))
+	if err != nil {
+		http.Error(w, "cannot encode url", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	png.Encode(w, q.image(8))
+}
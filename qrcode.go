@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// A minimal QR code encoder: byte mode, error correction level M, versions
+// 1 to 10, which holds up to 213 bytes; plenty for a URL.
+
+// qrBlocks describes error correction level M for one version: EC codewords
+// per block, then count and data length of the short blocks, then of the
+// long ones.
+type qrBlocks struct{ ec, n1, d1, n2, d2 int }
+
+var qrVersions = []qrBlocks{
+	1:  {10, 1, 16, 0, 0},
+	2:  {16, 1, 28, 0, 0},
+	3:  {26, 1, 44, 0, 0},
+	4:  {18, 2, 32, 0, 0},
+	5:  {24, 2, 43, 0, 0},
+	6:  {16, 4, 27, 0, 0},
+	7:  {18, 4, 31, 0, 0},
+	8:  {22, 2, 38, 2, 39},
+	9:  {22, 3, 36, 2, 37},
+	10: {26, 4, 43, 1, 44},
+}
+
+var qrAlignment = [][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+var errQRTooLong = errors.New("text too long for a QR code")
+
+// qrCode is a square of modules, true for dark.
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+func (b qrBlocks) data() int { return b.n1*b.d1 + b.n2*b.d2 }
+
+// encodeQR returns the smallest QR code holding text.
+func encodeQR(text string) (*qrCode, error) {
+	version := 0
+	for v := 1; v < len(qrVersions); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(text) <= 8*qrVersions[v].data() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+	blocks := qrVersions[version]
+	var bits qrBits
+	bits.add(0b0100, 4)
+	if version >= 10 {
+		bits.add(len(text), 16)
+	} else {
+		bits.add(len(text), 8)
+	}
+	for i := 0; i < len(text); i++ {
+		bits.add(int(text[i]), 8)
+	}
+	capacity := 8 * blocks.data()
+	bits.add(0, min(4, capacity-len(bits)))
+	bits.add(0, (8-len(bits)%8)%8)
+	data := bits.bytes()
+	for pad := byte(0xec); len(data) < blocks.data(); pad ^= 0xec ^ 0x11 {
+		data = append(data, pad)
+	}
+
+	q := newQR(version)
+	q.place(interleave(data, blocks))
+	best, bestPenalty := -1, 0
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); best < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+type qrBits []bool
+
+func (b *qrBits) add(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, v>>i&1 == 1)
+	}
+}
+
+func (b qrBits) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// interleave splits data into blocks, appends each block's Reed-Solomon
+// codewords and interleaves the lot as the symbol expects.
+func interleave(data []byte, b qrBlocks) []byte {
+	var blocks [][]byte
+	divisor := rsDivisor(b.ec)
+	for i := 0; i < b.n1+b.n2; i++ {
+		n := b.d1
+		if i >= b.n1 {
+			n = b.d2
+		}
+		blocks = append(blocks, data[:n])
+		data = data[n:]
+	}
+	var out []byte
+	for i := 0; i < max(b.d1, b.d2); i++ {
+		for _, blk := range blocks {
+			if i < len(blk) {
+				out = append(out, blk[i])
+			}
+		}
+	}
+	ecs := make([][]byte, len(blocks))
+	for i, blk := range blocks {
+		ecs[i] = rsRemainder(blk, divisor)
+	}
+	for i := 0; i < b.ec; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+func gfMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		hi := z & 0x80
+		z <<= 1
+		if hi != 0 {
+			z ^= 0x1d
+		}
+		if y>>i&1 == 1 {
+			z ^= x
+		}
+	}
+	return z
+}
+
+func rsDivisor(degree int) []byte {
+	d := make([]byte, degree)
+	d[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range d {
+			d[j] = gfMul(d[j], root)
+			if j+1 < degree {
+				d[j] ^= d[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return d
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	r := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ r[0]
+		copy(r, r[1:])
+		r[len(r)-1] = 0
+		for i := range r {
+			r[i] ^= gfMul(divisor[i], factor)
+		}
+	}
+	return r
+}
+
+func newQR(version int) *qrCode {
+	size := 17 + 4*version
+	q := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					d := max(abs(dx), abs(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	if version >= 2 {
+		pos := qrAlignment[version]
+		last := len(pos) - 1
+		for i, y := range pos {
+			for j, x := range pos {
+				if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+					continue
+				}
+				for dy := -2; dy <= 2; dy++ {
+					for dx := -2; dx <= 2; dx++ {
+						q.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+					}
+				}
+			}
+		}
+	}
+	// Reserve the format areas; drawFormat fills them in per mask.
+	q.drawFormat(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			bit := bits>>i&1 == 1
+			a, b := size-11+i%3, i/3
+			q.set(a, b, bit)
+			q.set(b, a, bit)
+		}
+	}
+	return q
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// set draws a function module at column x, row y.
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFormat(mask int) {
+	data := 0<<3 | mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// place lays the codewords out in the two-column zigzag from the bottom
+// right corner, skipping function modules.
+func (q *qrCode) place(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i/8]>>(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips data modules by one of the eight patterns; applying it
+// twice undoes it.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the symbol is to scan, by the rules of the
+// standard: long runs, 2x2 blocks, finder look-alikes and dark balance.
+func (q *qrCode) penalty() int {
+	p, dark := 0, 0
+	lines := make([]string, 0, 2*q.size)
+	for y := 0; y < q.size; y++ {
+		var row, col strings.Builder
+		for x := 0; x < q.size; x++ {
+			row.WriteByte(qrChar(q.modules[y][x]))
+			col.WriteByte(qrChar(q.modules[x][y]))
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					p += 3
+				}
+			}
+		}
+		lines = append(lines, row.String(), col.String())
+	}
+	for _, l := range lines {
+		run := 1
+		for i := 1; i <= len(l); i++ {
+			if i < len(l) && l[i] == l[i-1] {
+				run++
+				continue
+			}
+			if run >= 5 {
+				p += run - 2
+			}
+			run = 1
+		}
+		// The quiet zone counts as light when looking for finder shapes.
+		l = "0000" + l + "0000"
+		p += 40 * (strings.Count(l, "10111010000") + strings.Count(l, "00001011101"))
+	}
+	total := q.size * q.size
+	p += 10 * ((abs(dark*20-total*10)+total-1)/total - 1)
+	return p
+}
+
+func qrChar(dark bool) byte {
+	if dark {
+		return '1'
+	}
+	return '0'
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestRate is how many listing, search, API and speedtest requests a
+// second one client may make, with bursts of up to requestBurst; 0 turns
+// the limit off. rateExemptSpecs are addresses it never applies to, on top
+// of loopback.
+var requestRate float64
+var requestBurst int
+var rateExemptSpecs stringList
+
+var rateExempt []netip.Prefix
+
+// clientBucket is one client's allowance. Unlike tokenBucket it never
+// waits: a request without a token is turned away.
+type clientBucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool
+}
+
+var clientBuckets = struct {
+	sync.Mutex
+	m map[netip.Addr]*clientBucket
+}{m: map[netip.Addr]*clientBucket{}}
+
+func checkRateLimit() (err error) {
+	if requestRate < 0 || requestBurst < 1 {
+		return fmt.Errorf("-rate must not be negative and -burst must be at least 1")
+	}
+	rateExempt, err = parsePrefixes("rate-exempt", rateExemptSpecs)
+	return err
+}
+
+// rateLimitedPath reports whether p is something cheap to ask for but
+// costly to answer. File bytes, archives, streams and uploads have
+// -limit-per-conn and -max-transfers instead, thumbnails come many to a
+// listing page, and /api/ping is a latency probe a 429 would only confuse.
+func rateLimitedPath(p string) bool {
+	for _, prefix := range []string{"/api/uploads/", "/api/ping", "/api/thumb", "/api/trickplay/", "/zip/", "/tar/", "/dlna/", "/files/"} {
+		if strings.HasPrefix(p, prefix) {
+			return false
+		}
+	}
+	switch {
+	case strings.HasPrefix(p, "/api/"), strings.HasPrefix(p, "/speedtest"):
+		return true
+	case p == "/recent", p == "/playlist.m3u":
+		return true
+	}
+	// Directories are the only paths under / that end in a slash.
+	return strings.HasSuffix(p, "/")
+}
+
+// takeToken spends one of ip's tokens. When there is none it returns how
+// long until there will be, and whether ip was let in the last time.
+func takeToken(ip netip.Addr, now time.Time) (ok bool, wait time.Duration, first bool) {
+	clientBuckets.Lock()
+	defer clientBuckets.Unlock()
+	b := clientBuckets.m[ip]
+	if b == nil {
+		b = &clientBucket{tokens: float64(requestBurst), last: now}
+		clientBuckets.m[ip] = b
+	}
+	b.tokens = math.Min(float64(requestBurst), b.tokens+now.Sub(b.last).Seconds()*requestRate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = false
+		return true, 0, false
+	}
+	first = !b.limited
+	b.limited = true
+	return false, time.Duration((1 - b.tokens) / requestRate * float64(time.Second)), first
+}
+
+// evictIdleClients forgets clients whose bucket has filled up again: they
+// would start from a full bucket anyway, so the map only holds clients
+// that were recently busy.
+func evictIdleClients(now time.Time) {
+	full := time.Duration(float64(requestBurst) / requestRate * float64(time.Second))
+	clientBuckets.Lock()
+	defer clientBuckets.Unlock()
+	for ip, b := range clientBuckets.m {
+		if now.Sub(b.last) > full {
+			delete(clientBuckets.m, ip)
+		}
+	}
+}
+
+// withRateLimit answers 429 to a client asking faster than -rate. It is
+// logged once when a client starts being turned away, not for every
+// request after that.
+func withRateLimit(next http.Handler) http.Handler {
+	go func() {
+		for now := range time.Tick(time.Minute) {
+			evictIdleClients(now)
+		}
+	}()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if !rateLimitedPath(r.URL.Path) || !ip.IsValid() || ip.IsLoopback() || inPrefixes(ip, rateExempt) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait, first := takeToken(ip, time.Now())
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if first {
+			fmt.Fprintf(os.Stdout, "rate limit: %s is over %g requests/s\n", ip, requestRate)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, strings.HasPrefix(r.URL.Path, "/api/") || wantsJSON(r), "too many requests", http.StatusTooManyRequests)
+	})
+}
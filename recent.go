@@ -0,0 +1,90 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const defaultRecentDays = 7
+const defaultRecentLimit = 100
+const maxRecentLimit = 1000
+
+//go:embed templates/recent.html
+var recentHTML string
+
+var recentTemplate = mustTemplate("recent", recentHTML)
+
+type recentItem struct {
+	Path    string    `json:"path"`
+	URL     string    `json:"url"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+	AgeS    int64     `json:"age_s"`
+}
+
+type recentResponse struct {
+	Days      int          `json:"days"`
+	Count     int          `json:"count"`
+	Truncated bool         `json:"truncated"`
+	Items     []recentItem `json:"items"`
+}
+
+// recentMedia returns media files modified within the last days, newest
+// first, taken from the cached library index.
+func recentMedia(r *http.Request) (recentResponse, error) {
+	q := r.URL.Query()
+	res := recentResponse{Days: defaultRecentDays, Items: []recentItem{}}
+	if v := q.Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return res, fmt.Errorf("days must be a positive integer")
+		}
+		res.Days = n
+	}
+	limit := defaultRecentLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRecentLimit {
+			return res, fmt.Errorf("limit must be between 1 and %d", maxRecentLimit)
+		}
+		limit = n
+	}
+	items, _ := library.get(false)
+	items = visibleTo(r, items)
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, -res.Days)
+	for _, it := range items {
+		if it.Kind != "video" || it.ModTime.Before(cutoff) {
+			continue
+		}
+		res.Items = append(res.Items, recentItem{Path: it.Path, URL: it.URL, Size: it.Size, ModTime: it.ModTime, AgeS: int64(now.Sub(it.ModTime).Seconds())})
+	}
+	sort.SliceStable(res.Items, func(i, j int) bool { return res.Items[i].ModTime.After(res.Items[j].ModTime) })
+	if len(res.Items) > limit {
+		res.Items, res.Truncated = res.Items[:limit], true
+	}
+	res.Count = len(res.Items)
+	return res, nil
+}
+
+func recentAPIHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := recentMedia(r)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func recentPageHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := recentMedia(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	renderTemplate(w, recentTemplate, recentTemplate, res)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// remuxArgs repackages the first video and audio stream into fragmented MP4
+// written to stdout, which a browser can play while it is still arriving.
+func remuxArgs(input string, start float64) []string {
+	args := ffmpegBaseArgs()
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start, 'f', 3, 64))
+	}
+	return append(args, "-i", input,
+		"-map", "0:v:0", "-map", "0:a:0?", "-c", "copy",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-f", "mp4", "pipe:1")
+}
+
+func remuxHandler(w http.ResponseWriter, r *http.Request) {
+	if ffmpegPath == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if allowCORS(w, r) {
+		return
+	}
+	upath, err := decodePath(strings.TrimPrefix(r.URL.EscapedPath(), "/remux"))
+	if err != nil {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+	full, err := resolveFor(r, upath)
+	if err != nil {
+		writePathError(w, false, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() || fileKind(fi.Name()) != "video" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	start := 0.0
+	if v := r.URL.Query().Get("t"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t < 0 {
+			http.Error(w, "t must be a non-negative number of seconds", http.StatusBadRequest)
+			return
+		}
+		start = t
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	t := &transcode{id: newTranscodeID(), kind: "remux", path: full, client: clientHost(r), owner: transcodeOwner(r), start: start, started: time.Now()}
+	streamFFmpeg(w, r, t, remuxArgs(full, start))
+}
+
+// streamFFmpeg runs ffmpeg as transcode t and copies its stdout to the
+// client, counting as a transfer like any other download. Headers must
+// already be set.
+func streamFFmpeg(w http.ResponseWriter, r *http.Request, t *transcode, args []string) {
+	base := filepath.Base(t.path)
+	release, ok := acquireTransfer(r, base)
+	if !ok {
+		writeBusy(w)
+		return
+	}
+	defer release()
+	w, done, err := throttle(w, r, base)
+	defer done()
+	if err != nil {
+		http.Error(w, "bad limit", http.StatusBadRequest)
+		return
+	}
+	w, served := countServed(w, relPath(t.path))
+	defer served()
+	// ffmpeg dies with the request context: when the client goes away, or
+	// when the session is stopped through the registry.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	var stopReason atomic.Value
+	t.stop = func(reason string) {
+		stopReason.Store(reason)
+		cancel()
+	}
+	if err := registerTranscode(t); err != nil {
+		writeTranscodeLimit(w)
+		return
+	}
+	defer unregisterTranscode(t)
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	log := &ffmpegLog{t: t}
+	cmd.Stderr = log
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		http.Error(w, "cannot start "+t.kind, http.StatusInternalServerError)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", t.kind, err)
+		http.Error(w, "cannot start "+t.kind, http.StatusInternalServerError)
+		return
+	}
+	name := base + " (" + t.kind + ")"
+	began := time.Now()
+	buf := getBuf()
+	n, copyErr := io.CopyBuffer(touchWriter{w, t}, struct{ io.Reader }{out}, *buf)
+	putBuf(buf)
+	waitErr := cmd.Wait()
+	switch {
+	case stopReason.Load() != nil:
+		elapsed, _ := throughput(n, began)
+		fmt.Fprintf(os.Stdout, "%s stopped after %s in %.2fs to %s: %s\n", name, human(n), elapsed, r.RemoteAddr, stopReason.Load())
+	case r.Context().Err() != nil || copyErr != nil:
+		elapsed, _ := throughput(n, began)
+		fmt.Fprintf(os.Stdout, "%s stopped after %s in %.2fs to %s: %s\n", name, human(n), elapsed, r.RemoteAddr, failureReason(r, copyErr))
+	case waitErr != nil:
+		fmt.Fprintf(os.Stderr, "%s: %s: %v: %s\n", t.kind, base, waitErr, log)
+		if n == 0 {
+			http.Error(w, t.kind+" failed", http.StatusInternalServerError)
+		}
+	default:
+		logTransfer(name, n, began, r.RemoteAddr)
+	}
+}
+
+// touchWriter marks the session active whenever the client accepts data, so
+// a stalled connection is reaped after -transcode-idle.
+type touchWriter struct {
+	w io.Writer
+	t *transcode
+}
+
+func (tw touchWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	if n > 0 {
+		tw.t.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadTTL is how long an unfinished resumable upload is kept after its
+// last byte arrived.
+var uploadTTL time.Duration
+
+// uploadSession is a resumable upload: bytes are appended to a hidden file
+// next to the target until the client commits it. Sessions live in the
+// state file, so they survive a restart of the server.
+type uploadSession struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	Part      string    `json:"part"`
+	Size      int64     `json:"size"`
+	Overwrite bool      `json:"overwrite,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	MD5       string    `json:"md5,omitempty"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	// HashState is the state of the digests over the first HashedTo bytes,
+	// so that commit does not have to read the whole file again.
+	HashState map[string][]byte `json:"hash_state,omitempty"`
+	HashedTo  int64             `json:"hashed_to,omitempty"`
+
+	// mu is held while bytes are written, so one session takes one PATCH
+	// at a time.
+	mu sync.Mutex
+	// limit is the rate the last PATCH was held to, reported by commit;
+	// 0 before the first PATCH since the server started.
+	limit int64
+}
+
+func (u *uploadSession) offset() (int64, error) {
+	fi, err := os.Stat(u.Part)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func getUpload(id string) *uploadSession {
+	state.Lock()
+	defer state.Unlock()
+	return state.data.Uploads[id]
+}
+
+func dropUpload(u *uploadSession) {
+	state.Lock()
+	delete(state.data.Uploads, u.ID)
+	state.Unlock()
+	saveState()
+}
+
+// pruneUploads removes sessions idle for longer than uploadTTL along with
+// their data and reports how many went. state must be locked.
+func pruneUploads(now time.Time) int {
+	n := 0
+	for id, u := range state.data.Uploads {
+		if uploadTTL <= 0 || now.Sub(u.Updated) <= uploadTTL || !u.mu.TryLock() {
+			continue
+		}
+		os.Remove(u.Part)
+		u.mu.Unlock()
+		delete(state.data.Uploads, id)
+		n++
+	}
+	return n
+}
+
+// startUploadGC drops stale sessions every few minutes.
+func startUploadGC() {
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			state.Lock()
+			n := pruneUploads(time.Now())
+			state.Unlock()
+			if n > 0 {
+				fmt.Fprintf(os.Stdout, "removed %d stale upload(s)\n", n)
+				saveState()
+			}
+		}
+	}()
+}
+
+func setUploadHeaders(w http.ResponseWriter, u *uploadSession, off int64) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(off, 10))
+	if u.Size >= 0 {
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.Size, 10))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+type uploadStatus struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	URL     string    `json:"url"`
+	Offset  int64     `json:"offset"`
+	Size    int64     `json:"size"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (u *uploadSession) status(off int64) uploadStatus {
+	st := uploadStatus{ID: u.ID, Path: u.Path, URL: "/api/uploads/" + u.ID, Offset: off, Size: u.Size}
+	if uploadTTL > 0 {
+		st.Expires = u.Updated.Add(uploadTTL)
+	}
+	return st
+}
+
+// uploadsHandler serves POST /api/uploads {path, size, overwrite, sha256,
+// md5} to start a resumable upload; size is -1 or left out when not known.
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+	req := struct {
+		Path      string `json:"path"`
+		Size      int64  `json:"size"`
+		Overwrite bool   `json:"overwrite"`
+		SHA256    string `json:"sha256"`
+		MD5       string `json:"md5"`
+	}{Size: -1}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		jsonError(w, "body must be JSON {path, size, overwrite, sha256, md5}", http.StatusBadRequest)
+		return
+	}
+	if req.Size < -1 {
+		jsonError(w, "size must not be negative", http.StatusBadRequest)
+		return
+	}
+	if maxUploadSize > 0 && req.Size > int64(maxUploadSize) {
+		jsonError(w, fmt.Sprintf("upload larger than -max-upload-size (%s)", human(int64(maxUploadSize))), http.StatusRequestEntityTooLarge)
+		return
+	}
+	want, err := commitChecksums(req.SHA256, req.MD5, nil)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	full, rel, err := resolveNewPath(r, req.Path)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	if fi, err := os.Lstat(full); err == nil {
+		switch {
+		case fi.IsDir():
+			writeUploadError(w, errIsDir)
+			return
+		case !req.Overwrite:
+			writeUploadError(w, errExists)
+			return
+		}
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	part := filepath.Join(filepath.Dir(full), ".upload-"+id+".part")
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		jsonError(w, "cannot create upload", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	now := time.Now()
+	u := &uploadSession{ID: id, Path: rel, Part: part, Size: req.Size, Overwrite: req.Overwrite, SHA256: want["sha256"], MD5: want["md5"], Created: now, Updated: now}
+	state.Lock()
+	state.data.Uploads[id] = u
+	state.Unlock()
+	saveState()
+	w.Header().Set("Location", "/api/uploads/"+id)
+	setUploadHeaders(w, u, 0)
+	writeJSON(w, http.StatusCreated, u.status(0))
+}
+
+// parseUploadOffset reads where a PATCH starts: Upload-Offset, as in tus,
+// or the first byte of Content-Range.
+func parseUploadOffset(r *http.Request) (int64, bool) {
+	if v := r.Header.Get("Upload-Offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil && n >= 0
+	}
+	if v, ok := strings.CutPrefix(r.Header.Get("Content-Range"), "bytes "); ok {
+		first, _, _ := strings.Cut(v, "-")
+		n, err := strconv.ParseInt(first, 10, 64)
+		return n, err == nil && n >= 0
+	}
+	return 0, false
+}
+
+// uploadSessionHandler serves /api/uploads/<id>: HEAD or GET for the offset to
+// resume from, PATCH to append, DELETE to give up, and POST
+// /api/uploads/<id>/commit {sha256, md5} to move the finished file into place.
+func uploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, commit := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/uploads/"), "/commit")
+	u := getUpload(id)
+	if u == nil {
+		jsonError(w, "no such upload", http.StatusNotFound)
+		return
+	}
+	if commit {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		commitUpload(w, r, u)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		off, err := u.offset()
+		if err != nil {
+			jsonError(w, "upload data is gone", http.StatusGone)
+			return
+		}
+		setUploadHeaders(w, u, off)
+		writeJSON(w, http.StatusOK, u.status(off))
+	case http.MethodPatch:
+		appendUpload(w, r, u)
+	case http.MethodDelete:
+		u.mu.Lock()
+		os.Remove(u.Part)
+		u.mu.Unlock()
+		dropUpload(u)
+		fmt.Fprintf(os.Stdout, "upload %s cancelled by %s\n", u.Path, r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PATCH, DELETE")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// appendUpload adds a PATCH body at the end of the data. Whatever arrived
+// before a disconnect is kept, so the client resumes from the new offset.
+func appendUpload(w http.ResponseWriter, r *http.Request, u *uploadSession) {
+	start, ok := parseUploadOffset(r)
+	if !ok {
+		jsonError(w, "Upload-Offset or Content-Range header required", http.StatusBadRequest)
+		return
+	}
+	if !u.mu.TryLock() {
+		jsonError(w, "upload is already receiving data", http.StatusConflict)
+		return
+	}
+	defer u.mu.Unlock()
+	off, err := u.offset()
+	if err != nil {
+		jsonError(w, "upload data is gone", http.StatusGone)
+		return
+	}
+	if start != off {
+		setUploadHeaders(w, u, off)
+		jsonError(w, fmt.Sprintf("offset mismatch: upload is at %d", off), http.StatusConflict)
+		return
+	}
+	limit := int64(-1)
+	if u.Size >= 0 {
+		limit = u.Size - off
+	}
+	if maxUploadSize > 0 && (limit < 0 || int64(maxUploadSize)-off < limit) {
+		limit = int64(maxUploadSize) - off
+	}
+	if limit >= 0 && r.ContentLength > limit {
+		jsonError(w, "body goes past the end of the upload", http.StatusRequestEntityTooLarge)
+		return
+	}
+	rate, done, err := throttleUpload(r, u.Path)
+	if err != nil {
+		jsonError(w, "bad limit", http.StatusBadRequest)
+		return
+	}
+	defer done()
+	body := io.Reader(r.Body)
+	if limit >= 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	f, err := os.OpenFile(u.Part, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		jsonError(w, "upload data is gone", http.StatusGone)
+		return
+	}
+	began := time.Now()
+	dst := io.Writer(f)
+	hs := u.resumeHashes(off)
+	if hs != nil {
+		dst = io.MultiWriter(f, hashWriter(hs))
+	}
+	bp := getBuf()
+	n, err := io.CopyBuffer(dst, body, *bp)
+	putBuf(bp)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	f.Close()
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		// A failed write to the part file may have left bytes the digests
+		// did not see; commit reads the file instead.
+		hs = nil
+	}
+	state.Lock()
+	u.Updated = time.Now()
+	u.HashState, u.HashedTo = marshalHashes(hs), off+n
+	u.limit = rate
+	state.Unlock()
+	saveState()
+	setUploadHeaders(w, u, off+n)
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooBig):
+		jsonError(w, "body goes past the end of the upload", http.StatusRequestEntityTooLarge)
+	case err != nil:
+		fmt.Fprintf(os.Stdout, "upload %s from %s paused at %s: %s\n", u.Path, r.RemoteAddr, human(off+n), failureReason(r, err))
+	default:
+		elapsed, mbps := throughput(n, began)
+		fmt.Fprintf(os.Stdout, "upload %s received %s in %.2fs (%.2f MB/s) from %s, at %s\n", u.Path, human(n), elapsed, mbps, r.RemoteAddr, human(off+n))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// commitChecksums merges the digests given at commit time over those
+// given when the upload was created.
+func commitChecksums(sha, md string, u *uploadSession) (map[string]string, error) {
+	want := map[string]string{}
+	if u != nil {
+		want["sha256"], want["md5"] = u.SHA256, u.MD5
+	}
+	for algo, v := range map[string]string{"sha256": sha, "md5": md} {
+		if v == "" {
+			continue
+		}
+		sum, err := parseChecksum(algo, v)
+		if err != nil {
+			return nil, err
+		}
+		want[algo] = sum
+	}
+	for algo, v := range want {
+		if v == "" {
+			delete(want, algo)
+		}
+	}
+	return want, nil
+}
+
+// resumeHashes picks up the digests where the last PATCH left them. It
+// returns nil when they do not cover the data up to off, for instance
+// after a PATCH was cut off before its state was saved; commit then reads
+// the file instead.
+func (u *uploadSession) resumeHashes(off int64) map[string]hash.Hash {
+	hs := uploadHashes(map[string]string{"md5": u.MD5})
+	if off == 0 {
+		return hs
+	}
+	if u.HashedTo != off || len(u.HashState) != len(hs) {
+		return nil
+	}
+	for algo, h := range hs {
+		if h.(encoding.BinaryUnmarshaler).UnmarshalBinary(u.HashState[algo]) != nil {
+			return nil
+		}
+	}
+	return hs
+}
+
+func marshalHashes(hs map[string]hash.Hash) map[string][]byte {
+	if hs == nil {
+		return nil
+	}
+	out := map[string][]byte{}
+	for algo, h := range hs {
+		b, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil
+		}
+		out[algo] = b
+	}
+	return out
+}
+
+// uploadDigests returns the digests of the data, from the saved state when
+// it covers everything and by reading the file otherwise.
+func (u *uploadSession) uploadDigests(off int64, want map[string]string) (map[string]string, error) {
+	if hs := u.resumeHashes(off); hs != nil && (want["md5"] == "" || hs["md5"] != nil) {
+		return sumHashes(hs), nil
+	}
+	f, err := os.Open(u.Part)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hs := uploadHashes(want)
+	bp := getBuf()
+	defer putBuf(bp)
+	if _, err := io.CopyBuffer(hashWriter(hs), struct{ io.Reader }{f}, *bp); err != nil {
+		return nil, err
+	}
+	return sumHashes(hs), nil
+}
+
+// commitUpload checks the size and, when one was given, the checksum of
+// the data and renames it to the target path. Data that does not match its
+// checksum is thrown away with the session.
+func commitUpload(w http.ResponseWriter, r *http.Request, u *uploadSession) {
+	var req struct {
+		SHA256 string `json:"sha256"`
+		MD5    string `json:"md5"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil && err != io.EOF {
+			jsonError(w, "body must be JSON {sha256, md5}", http.StatusBadRequest)
+			return
+		}
+	}
+	want, err := commitChecksums(req.SHA256, req.MD5, u)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !u.mu.TryLock() {
+		jsonError(w, "upload is still receiving data", http.StatusConflict)
+		return
+	}
+	defer u.mu.Unlock()
+	off, err := u.offset()
+	if err != nil {
+		jsonError(w, "upload data is gone", http.StatusGone)
+		return
+	}
+	if u.Size >= 0 && off != u.Size {
+		setUploadHeaders(w, u, off)
+		jsonError(w, fmt.Sprintf("upload incomplete: %d of %d bytes", off, u.Size), http.StatusConflict)
+		return
+	}
+	got, err := u.uploadDigests(off, want)
+	if err != nil {
+		jsonError(w, "cannot read upload", http.StatusInternalServerError)
+		return
+	}
+	if err := verifyChecksums(want, got); err != nil {
+		os.Remove(u.Part)
+		dropUpload(u)
+		logUpload(u.Path, off, u.Created, r, err)
+		writeUploadError(w, err)
+		return
+	}
+	full, rel, err := resolveNewPath(r, u.Path)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	if err := placeFile(u.Part, full, u.Overwrite); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	dropUpload(u)
+	rememberChecksums(full, got)
+	state.Lock()
+	rate := u.limit
+	state.Unlock()
+	if rate == 0 {
+		rate = uploadRate(int64(limitUpload))
+	}
+	library.invalidate()
+	fmt.Fprintf(os.Stdout, "upload %s completed, %s from %s\n", rel, human(off), r.RemoteAddr)
+	writeJSON(w, http.StatusCreated, uploadResult{Path: rel, URL: escapePath("/" + rel), Size: off, Limit: rate})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+)
+
+// crossOrigin tells a browser's cross-site requests apart by Sec-Fetch-Site
+// or, from older browsers, by an Origin that does not match the Host.
+// Players and scripts send neither and are let through.
+var crossOrigin = http.NewCrossOriginProtection()
+
+// withSameOrigin refuses cross-site requests that would change the share.
+// Without auth, or with Basic credentials the browser adds by itself, a form
+// on any page a LAN user opens could otherwise post to /api/move. The
+// archive form is included: it is cheap to send and costly to answer.
+func withSameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if writeRequest(r) || r.URL.Path == "/api/archive" {
+			if err := crossOrigin.Check(r); err != nil {
+				fmt.Fprintf(os.Stdout, "refused cross-site %s %s from %s (Origin %q)\n", r.Method, r.URL.Path, clientHost(r), r.Header.Get("Origin"))
+				jsonError(w, "cross-site request refused", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireJSON answers 415 unless r's body is declared as JSON. A form can
+// only send it as text/plain, so this keeps JSON endpoints out of reach of
+// cross-site forms even from browsers that send no Origin.
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && t == "application/json" {
+		return true
+	}
+	jsonError(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+	return false
+}
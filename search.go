@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const defaultSearchLimit = 100
+const maxSearchLimit = 1000
+
+type searchResult struct {
+	Path   string `json:"path"`
+	URL    string `json:"url"`
+	Dir    string `json:"dir"`
+	DirURL string `json:"dir_url"`
+	Size   int64  `json:"size"`
+}
+
+type searchResponse struct {
+	Query     string         `json:"query"`
+	Count     int            `json:"count"`
+	Truncated bool           `json:"truncated"`
+	Results   []searchResult `json:"results"`
+}
+
+// matchQuery reports whether the root-relative path p matches q. Queries
+// containing glob metacharacters are matched against the file name and the
+// whole path; anything else is a case-insensitive substring match.
+func matchQuery(q, p string) bool {
+	lp := strings.ToLower(p)
+	if strings.ContainsAny(q, "*?[") {
+		if ok, _ := path.Match(q, path.Base(lp)); ok {
+			return true
+		}
+		ok, _ := path.Match(q, lp)
+		return ok
+	}
+	return strings.Contains(lp, q)
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	q := strings.ToLower(strings.TrimSpace(qs.Get("q")))
+	if q == "" {
+		jsonError(w, "missing q", http.StatusBadRequest)
+		return
+	}
+	if _, err := path.Match(q, ""); err != nil {
+		jsonError(w, "bad pattern", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchLimit
+	if v := qs.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			jsonError(w, "limit must be between 1 and "+strconv.Itoa(maxSearchLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	items, _ := library.get(false)
+	items = visibleTo(r, items)
+	res := searchResponse{Query: qs.Get("q"), Results: []searchResult{}}
+	for _, it := range items {
+		if !matchQuery(q, it.Path) {
+			continue
+		}
+		if len(res.Results) == limit {
+			res.Truncated = true
+			break
+		}
+		d := path.Dir("/" + it.Path)
+		res.Results = append(res.Results, searchResult{Path: it.Path, URL: it.URL, Dir: d, DirURL: dirURL(d), Size: it.Size})
+	}
+	res.Count = len(res.Results)
+	writeJSON(w, http.StatusOK, res)
+}
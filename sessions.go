@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// usersFile switches on the /login form: a JSON list of users with bcrypt
+// hashes and a role. sessionIdle is how long a session lasts without being
+// used.
+var usersFile string
+var sessionIdle time.Duration
+
+const sessionCookie = "fileserver_session"
+
+// sessionRenew is how often an active session's cookie is re-issued with a
+// fresh timestamp; more often would send a cookie with every range request.
+const sessionRenew = time.Minute
+
+type user struct {
+	Name string `json:"username"`
+	Hash string `json:"hash"`
+	// Role is viewer or admin. Only admins upload, move and delete.
+	Role string `json:"role"`
+}
+
+var users map[string]user
+
+func loadUsers() error {
+	if usersFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(usersFile)
+	if err != nil {
+		return fmt.Errorf("-users: %v", err)
+	}
+	var list []user
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("-users: %s: %v", usersFile, err)
+	}
+	users = map[string]user{}
+	for _, u := range list {
+		if u.Name == "" || strings.ContainsAny(u.Name, "|:") {
+			return fmt.Errorf("-users: bad username %q", u.Name)
+		}
+		if _, err := bcrypt.Cost([]byte(u.Hash)); err != nil {
+			return fmt.Errorf("-users: %s: not a bcrypt hash (create hashes with htpasswd -nB)", u.Name)
+		}
+		if u.Role != "viewer" && u.Role != "admin" {
+			return fmt.Errorf("-users: %s: role must be viewer or admin", u.Name)
+		}
+		users[u.Name] = u
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("-users: %s has no users", usersFile)
+	}
+	return nil
+}
+
+// sessionKey signs session cookies. It is kept in the state file so that
+// sessions survive a restart; without -state every start logs everyone out.
+func sessionKey() []byte {
+	state.Lock()
+	key, err := base64.StdEncoding.DecodeString(state.data.SessionKey)
+	if err == nil && len(key) == 32 {
+		state.Unlock()
+		return key
+	}
+	key = make([]byte, 32)
+	rand.Read(key)
+	state.data.SessionKey = base64.StdEncoding.EncodeToString(key)
+	state.Unlock()
+	saveState()
+	return key
+}
+
+// sessionMAC covers the user's hash as well, so changing a password in
+// -users ends the sessions made with the old one.
+func sessionMAC(name string, seen int64, hash string) string {
+	m := hmac.New(sha256.New, sessionKey())
+	fmt.Fprintf(m, "%s|%d|%s", name, seen, hash)
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func setSession(w http.ResponseWriter, r *http.Request, u user, now time.Time) {
+	v := fmt.Sprintf("%s|%d", u.Name, now.Unix())
+	v = base64.RawURLEncoding.EncodeToString([]byte(v)) + "." + sessionMAC(u.Name, now.Unix(), u.Hash)
+	maxAge := int(sessionIdle.Seconds())
+	if sessionIdle <= 0 {
+		maxAge = 10 * 365 * 24 * 3600
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: v, Path: "/", MaxAge: maxAge, HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: r.TLS != nil})
+}
+
+// checkSession returns the user r's session cookie is for and when it was
+// last renewed, or false when there is none or it is forged or idle.
+func checkSession(r *http.Request, now time.Time) (user, time.Time, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || users == nil {
+		return user{}, time.Time{}, false
+	}
+	data, mac, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return user{}, time.Time{}, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return user{}, time.Time{}, false
+	}
+	name, ts, _ := strings.Cut(string(b), "|")
+	seen, err := strconv.ParseInt(ts, 10, 64)
+	u, known := users[name]
+	if err != nil || !known || !hmac.Equal([]byte(mac), []byte(sessionMAC(name, seen, u.Hash))) {
+		return user{}, time.Time{}, false
+	}
+	t := time.Unix(seen, 0)
+	if sessionIdle > 0 && now.Sub(t) > sessionIdle {
+		return user{}, time.Time{}, false
+	}
+	return u, t, true
+}
+
+// safeNext keeps the redirect after signing in on this server.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+type loginPage struct {
+	Tokens bool
+	Users  bool
+	Next   string
+	Error  string
+}
+
+// loginHandler serves the /login form and signs in with POST
+// username=&password=&next=.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	page := loginPage{Tokens: tokens != nil, Users: true, Next: safeNext(r.FormValue("next"))}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginTemplate.Execute(w, page)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, pass := r.PostFormValue("username"), r.PostFormValue("password")
+	u, ok := users[name]
+	if !ok {
+		// As slow as a wrong password, so the time taken does not tell
+		// which names exist.
+		for _, other := range users {
+			bcryptMatch(other.Hash, pass)
+			break
+		}
+	}
+	if !ok || !bcryptMatch(u.Hash, pass) {
+		fmt.Fprintf(os.Stdout, "auth: failed login as %s from %s\n", strconv.Quote(name), clientHost(r))
+		page.Error = "Wrong user name or password."
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		loginTemplate.Execute(w, page)
+		return
+	}
+	setSession(w, r, u, time.Now())
+	http.Redirect(w, r, page.Next, http.StatusSeeOther)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: r.TLS != nil})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed templates/share.html
+var shareHTML string
+
+var shareTemplate = mustTemplate("share", shareHTML)
+
+// shareLink is a /s/<id> link to one file or directory for someone without
+// an account. MaxDownloads counts clients, by address, rather than
+// requests: a player seeking through a movie makes many. The link reaches
+// what its creator could: Creator and CreatorWrite are what .access rules
+// are checked against each time it is used.
+type shareLink struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	Dir          bool      `json:"dir"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires,omitempty"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Clients      []string  `json:"clients,omitempty"`
+	By           string    `json:"by,omitempty"`
+	Creator      string    `json:"creator,omitempty"`
+	CreatorWrite bool      `json:"creator_write,omitempty"`
+}
+
+// shareKeep is how long an expired link is remembered, so that it says it
+// has expired instead of that it never existed.
+const shareKeep = 30 * 24 * time.Hour
+
+func (s *shareLink) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && now.After(s.Expires)
+}
+
+func (s *shareLink) exhausted() bool {
+	return s.MaxDownloads > 0 && len(s.Clients) >= s.MaxDownloads
+}
+
+// asCreator is r as the link's creator, for resolveFor.
+func (s *shareLink) asCreator(r *http.Request) *http.Request {
+	info := &authInfo{who: s.By, name: s.Creator, write: s.CreatorWrite}
+	return r.WithContext(context.WithValue(r.Context(), authInfoKey{}, info))
+}
+
+// pruneShares forgets links that expired long ago. The state lock is held.
+func pruneShares(now time.Time) {
+	for id, s := range state.data.Shares {
+		if s.expired(now) && now.Sub(s.Expires) > shareKeep {
+			delete(state.data.Shares, id)
+		}
+	}
+}
+
+type shareInfo struct {
+	shareLink
+	URL       string `json:"url"`
+	Downloads int    `json:"downloads"`
+	Active    bool   `json:"active"`
+}
+
+func shareJSON(r *http.Request, s *shareLink, now time.Time) shareInfo {
+	u := baseURL(r) + "/s/" + s.ID
+	if s.Dir {
+		u += "/"
+	}
+	return shareInfo{shareLink: *s, URL: u, Downloads: len(s.Clients), Active: !s.expired(now) && !s.exhausted()}
+}
+
+// parseExpiresIn takes seconds or a duration such as "48h"; nothing means
+// the link does not expire.
+func parseExpiresIn(raw json.RawMessage) (time.Duration, bool) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, true
+	}
+	var secs float64
+	if json.Unmarshal(raw, &secs) == nil {
+		return time.Duration(secs * float64(time.Second)), secs >= 0
+	}
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		return 0, false
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil && d >= 0
+}
+
+// shareAPIHandler serves GET /api/share, the links, and POST /api/share
+// {path, expires_in, max_downloads}, a new one.
+func shareAPIHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	switch r.Method {
+	case http.MethodGet:
+		state.Lock()
+		list := []shareInfo{}
+		for _, s := range state.data.Shares {
+			list = append(list, shareJSON(r, s, now))
+		}
+		state.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"shares": list})
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+	var req struct {
+		Path         string          `json:"path"`
+		ExpiresIn    json.RawMessage `json:"expires_in"`
+		MaxDownloads int             `json:"max_downloads"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		jsonError(w, "body must be JSON {path, expires_in, max_downloads}", http.StatusBadRequest)
+		return
+	}
+	ttl, ok := parseExpiresIn(req.ExpiresIn)
+	if !ok || req.MaxDownloads < 0 {
+		jsonError(w, "expires_in must be seconds or a duration such as 48h, max_downloads 0 or more", http.StatusBadRequest)
+		return
+	}
+	full, err := resolveFor(r, req.Path)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil {
+		jsonError(w, "not found", http.StatusNotFound)
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	s := &shareLink{
+		ID:           base64.RawURLEncoding.EncodeToString(b),
+		Path:         relPath(full),
+		Dir:          fi.IsDir(),
+		Created:      now,
+		MaxDownloads: req.MaxDownloads,
+	}
+	if s.Path == "." {
+		s.Path = ""
+	}
+	if ttl > 0 {
+		s.Expires = now.Add(ttl)
+	}
+	if info, _ := r.Context().Value(authInfoKey{}).(*authInfo); info != nil {
+		s.By, s.Creator, s.CreatorWrite = info.who, info.name, info.write
+	}
+	state.Lock()
+	state.data.Shares[s.ID] = s
+	res := shareJSON(r, s, now)
+	state.Unlock()
+	saveState()
+	writeJSON(w, http.StatusCreated, res)
+}
+
+// shareDeleteHandler serves DELETE /api/share/<id>.
+func shareDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/share/")
+	state.Lock()
+	_, ok := state.data.Shares[id]
+	delete(state.data.Shares, id)
+	state.Unlock()
+	if !ok {
+		jsonError(w, "no such share", http.StatusNotFound)
+		return
+	}
+	saveState()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type shareEntry struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	IsDir bool   `json:"is_dir"`
+	Size  int64  `json:"size"`
+}
+
+type sharePage struct {
+	Title   string       `json:"title"`
+	Gone    string       `json:"-"`
+	Parent  string       `json:"parent,omitempty"`
+	Entries []shareEntry `json:"entries"`
+	Expires time.Time    `json:"expires,omitempty"`
+}
+
+func shareGone(w http.ResponseWriter, r *http.Request, msg string) {
+	if wantsJSON(r) {
+		jsonError(w, msg, http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusGone)
+	shareTemplate.Execute(w, sharePage{Title: "Link no longer available", Gone: msg})
+}
+
+// countShareClient lets r in under s's download cap: a client that already
+// downloaded may go on, a new one takes one of the remaining downloads. A
+// HEAD request is only checked.
+func countShareClient(r *http.Request, id string) bool {
+	ip := clientIP(r).String()
+	state.Lock()
+	s, ok := state.data.Shares[id]
+	if !ok {
+		state.Unlock()
+		return false
+	}
+	if slices.Contains(s.Clients, ip) {
+		state.Unlock()
+		return true
+	}
+	if s.exhausted() || r.Method == http.MethodHead {
+		state.Unlock()
+		return !s.exhausted()
+	}
+	s.Clients = append(s.Clients, ip)
+	state.Unlock()
+	saveState()
+	return true
+}
+
+// shareHandler serves /s/<id>: the shared file, or for a directory
+// /s/<id>/ and everything below it, and nothing else in the share.
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/s/")
+	id, sub, _ := strings.Cut(rest, "/")
+	now := time.Now()
+	state.Lock()
+	s, ok := state.data.Shares[id]
+	var link shareLink
+	if ok {
+		link = *s
+	}
+	state.Unlock()
+	if !ok {
+		writeError(w, wantsJSON(r), "not found", http.StatusNotFound)
+		return
+	}
+	if link.expired(now) {
+		shareGone(w, r, "This link expired on "+link.Expires.Format("2 Jan 2006 15:04")+".")
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, wantsJSON(r), "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	creator := link.asCreator(r)
+	base, err := resolveFor(creator, "/"+link.Path)
+	if err != nil {
+		writeError(w, wantsJSON(r), "not found", http.StatusNotFound)
+		return
+	}
+	full := base
+	if link.Dir {
+		if !strings.Contains(rest, "/") {
+			localRedirect(w, r, id+"/")
+			return
+		}
+		upath, err := decodePath(sub)
+		if err != nil {
+			writeError(w, wantsJSON(r), "bad path", http.StatusBadRequest)
+			return
+		}
+		if full, err = resolveFor(creator, path.Join("/", link.Path, upath)); err != nil {
+			writePathError(w, wantsJSON(r), err)
+			return
+		}
+		// A symlink may lead elsewhere in the share, but not out of what
+		// was shared.
+		realBase, err1 := filepath.EvalSymlinks(base)
+		real, err2 := filepath.EvalSymlinks(full)
+		if rel, err := filepath.Rel(realBase, real); err1 != nil || err2 != nil || err != nil || (rel != "." && !filepath.IsLocal(rel)) {
+			writeError(w, wantsJSON(r), "not found", http.StatusNotFound)
+			return
+		}
+	} else if sub != "" || strings.HasSuffix(rest, "/") {
+		writeError(w, wantsJSON(r), "not found", http.StatusNotFound)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil {
+		writeError(w, wantsJSON(r), "not found", http.StatusNotFound)
+		return
+	}
+	if fi.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			localRedirect(w, r, path.Base(r.URL.EscapedPath())+"/")
+			return
+		}
+		upath, _ := decodePath(sub)
+		serveShareListing(w, creator, full, link, strings.TrimSuffix(upath, "/"))
+		return
+	}
+	if !countShareClient(r, id) {
+		shareGone(w, r, "This link has been used as many times as it allows.")
+		return
+	}
+	serveFileFast(w, r, full, fi)
+}
+
+func serveShareListing(w http.ResponseWriter, r *http.Request, full string, link shareLink, sub string) {
+	des, err := readShareDir(full)
+	if err != nil {
+		writeError(w, wantsJSON(r), "cannot read directory", http.StatusInternalServerError)
+		return
+	}
+	upath := path.Join("/", link.Path, sub)
+	page := sharePage{Title: path.Base("/" + link.Path), Expires: link.Expires}
+	if sub != "" && sub != "/" {
+		page.Title += sub
+		page.Parent = "../"
+	}
+	for _, de := range des {
+		if !visible(path.Join(upath, de.Name())) {
+			continue
+		}
+		if de.IsDir() {
+			if ok, hidden := accessFor(r, strings.TrimPrefix(path.Join(upath, de.Name()), "/"), true); !ok && hidden {
+				continue
+			}
+		}
+		e := shareEntry{Name: de.Name(), URL: escapePath(de.Name()), IsDir: de.IsDir()}
+		if e.IsDir {
+			e.URL += "/"
+		} else if info, err := de.Info(); err == nil {
+			e.Size = info.Size()
+		}
+		page.Entries = append(page.Entries, e)
+	}
+	sort.SliceStable(page.Entries, func(i, j int) bool {
+		a, b := page.Entries[i], page.Entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		return naturalCompare(a.Name, b.Name) < 0
+	})
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, page)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	shareTemplate.Execute(w, page)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var shutdownHooks struct {
+	sync.Mutex
+	fns []func()
+}
+
+var shutdownSignal sync.Once
+
+// onShutdown runs f when the server is interrupted, before it exits. Hooks
+// run in the order they were added.
+func onShutdown(f func()) {
+	shutdownHooks.Lock()
+	shutdownHooks.fns = append(shutdownHooks.fns, f)
+	shutdownHooks.Unlock()
+	shutdownSignal.Do(func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-c
+			fmt.Fprintf(os.Stdout, "%v: shutting down\n", sig)
+			shutdownHooks.Lock()
+			fns := shutdownHooks.fns
+			shutdownHooks.Unlock()
+			for _, f := range fns {
+				f()
+			}
+			os.Exit(0)
+		}()
+	})
+}
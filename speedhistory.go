@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// noSpeedHistory stops speedtest results from being kept.
+var noSpeedHistory bool
+
+// maxSpeedHistory is how many results are kept; older ones are dropped
+// from the file when the server starts.
+const maxSpeedHistory = 10000
+
+type speedResult struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Direction string    `json:"direction"`
+	Bytes     int64     `json:"bytes"`
+	MBPerS    float64   `json:"mb_per_s"`
+	DurationS float64   `json:"duration_s"`
+	Source    string    `json:"source,omitempty"`
+}
+
+var speedHistory struct {
+	sync.Mutex
+	items []speedResult
+}
+
+// speedHistoryFile is a JSON Lines file next to -state, so results are
+// only appended to and never rewritten while the server runs.
+func speedHistoryFile() string {
+	if stateFile == "" || noSpeedHistory {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(stateFile), "fileserver-speedtest.jsonl")
+}
+
+func loadSpeedHistory() {
+	name := speedHistoryFile()
+	if name == "" {
+		return
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	var items []speedResult
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var res speedResult
+		if json.Unmarshal(sc.Bytes(), &res) == nil {
+			items = append(items, res)
+		}
+	}
+	f.Close()
+	if len(items) > maxSpeedHistory {
+		items = items[len(items)-maxSpeedHistory:]
+		if err := rewriteSpeedHistory(name, items); err != nil {
+			fmt.Fprintln(os.Stderr, "cannot trim speedtest history:", err)
+		}
+	}
+	speedHistory.items = items
+}
+
+func rewriteSpeedHistory(name string, items []speedResult) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(bw)
+	for _, res := range items {
+		enc.Encode(res)
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// recordSpeed keeps a finished measurement. It is called once the transfer
+// is over and does its I/O in the background.
+func recordSpeed(res speedResult) {
+	if res.Bytes == 0 {
+		return
+	}
+	observeSpeed(res.Direction, res.MBPerS)
+	if noSpeedHistory {
+		return
+	}
+	go func() {
+		speedHistory.Lock()
+		defer speedHistory.Unlock()
+		speedHistory.items = append(speedHistory.items, res)
+		if len(speedHistory.items) > maxSpeedHistory {
+			speedHistory.items = speedHistory.items[len(speedHistory.items)-maxSpeedHistory:]
+		}
+		name := speedHistoryFile()
+		if name == "" {
+			return
+		}
+		b, _ := json.Marshal(res)
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err == nil {
+			_, err = f.Write(append(b, '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot save speedtest result:", err)
+		}
+	}()
+}
+
+type speedSummary struct {
+	Client    string  `json:"client"`
+	Direction string  `json:"direction"`
+	Count     int     `json:"count"`
+	Min       float64 `json:"min_mb_per_s"`
+	Avg       float64 `json:"avg_mb_per_s"`
+	Max       float64 `json:"max_mb_per_s"`
+}
+
+// speedHistoryHandler serves /api/speedtest/history?limit=100&client=: the
+// results newest first and min/avg/max per client and direction.
+func speedHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if noSpeedHistory {
+		jsonError(w, "speedtest history is disabled by -no-speedtest-history", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSpeedHistory {
+			jsonError(w, fmt.Sprintf("limit must be between 1 and %d", maxSpeedHistory), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	client := q.Get("client")
+	speedHistory.Lock()
+	var items []speedResult
+	for i := len(speedHistory.items) - 1; i >= 0; i-- {
+		if res := speedHistory.items[i]; client == "" || res.Client == client {
+			items = append(items, res)
+		}
+	}
+	speedHistory.Unlock()
+	byKey := map[[2]string]*speedSummary{}
+	summaries := []*speedSummary{}
+	for _, res := range items {
+		key := [2]string{res.Client, res.Direction}
+		s := byKey[key]
+		if s == nil {
+			s = &speedSummary{Client: res.Client, Direction: res.Direction, Min: res.MBPerS, Max: res.MBPerS}
+			byKey[key] = s
+			summaries = append(summaries, s)
+		}
+		s.Count++
+		s.Avg += res.MBPerS
+		s.Min = min(s.Min, res.MBPerS)
+		s.Max = max(s.Max, res.MBPerS)
+	}
+	for _, s := range summaries {
+		s.Avg /= float64(s.Count)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Client != summaries[j].Client {
+			return summaries[i].Client < summaries[j].Client
+		}
+		return summaries[i].Direction < summaries[j].Direction
+	})
+	total := len(items)
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	if items == nil {
+		items = []speedResult{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"total": total, "items": items, "clients": summaries})
+}
+
+// speedResultHandler serves POST /api/speedtest/result {direction, bytes,
+// duration_s}: a result measured by the browser, kept with source browser.
+func speedResultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if noSpeedHistory {
+		jsonError(w, "speedtest history is disabled by -no-speedtest-history", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Direction string  `json:"direction"`
+		Bytes     int64   `json:"bytes"`
+		DurationS float64 `json:"duration_s"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		jsonError(w, "body must be JSON {direction, bytes, duration_s}", http.StatusBadRequest)
+		return
+	}
+	if req.Direction != "download" && req.Direction != "upload" {
+		jsonError(w, "direction must be download or upload", http.StatusBadRequest)
+		return
+	}
+	if req.Bytes <= 0 || req.DurationS <= 0 || req.DurationS > 24*3600 {
+		jsonError(w, "bytes and duration_s must be positive", http.StatusBadRequest)
+		return
+	}
+	res := speedResult{Time: time.Now(), Client: clientHost(r), Direction: req.Direction, Bytes: req.Bytes,
+		MBPerS: float64(req.Bytes) / (1024 * 1024) / req.DurationS, DurationS: req.DurationS, Source: "browser"}
+	recordSpeed(res)
+	writeJSON(w, http.StatusCreated, res)
+}
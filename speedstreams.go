@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxSpeedStreams = 16
+const maxSpeedTests = 64
+
+// speedTestTimeout is how long a multi-stream test waits for its streams.
+// One that has not reported by then is left out, so a stream that never
+// connected cannot hold the report back.
+const speedTestTimeout = 2*time.Minute + maxSpeedSeconds*time.Second
+
+// speedTestKeep is how long a finished report stays available.
+const speedTestKeep = 10 * time.Minute
+
+// speedStream is the outcome of one connection of a multi-stream test.
+type speedStream struct {
+	Stream    int       `json:"stream"`
+	Bytes     int64     `json:"bytes"`
+	MBPerS    float64   `json:"mb_per_s"`
+	DurationS float64   `json:"duration_s"`
+	Complete  bool      `json:"complete"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+}
+
+// multiSpeedTest groups parallel /speedtest?test=<id>&stream=<n> requests,
+// the way iperf uses several connections to get past per-connection loss.
+type multiSpeedTest struct {
+	id      string
+	streams int
+	client  string
+	created time.Time
+	mu      sync.Mutex
+	results map[int]speedStream
+}
+
+var speedTests = struct {
+	sync.Mutex
+	m map[string]*multiSpeedTest
+}{m: map[string]*multiSpeedTest{}}
+
+func getSpeedTest(id string) *multiSpeedTest {
+	speedTests.Lock()
+	defer speedTests.Unlock()
+	return speedTests.m[id]
+}
+
+// speedTestStream finds the test a /speedtest request belongs to. It
+// returns nil without ?test=, and false when it has answered with an error.
+func speedTestStream(w http.ResponseWriter, r *http.Request) (*multiSpeedTest, int, bool) {
+	q := r.URL.Query()
+	if q.Get("test") == "" {
+		return nil, 0, true
+	}
+	t := getSpeedTest(q.Get("test"))
+	if t == nil {
+		http.Error(w, "no such speedtest", http.StatusNotFound)
+		return nil, 0, false
+	}
+	n, err := strconv.Atoi(q.Get("stream"))
+	if err != nil || n < 0 || n >= t.streams {
+		http.Error(w, fmt.Sprintf("stream must be between 0 and %d", t.streams-1), http.StatusBadRequest)
+		return nil, 0, false
+	}
+	t.mu.Lock()
+	_, seen := t.results[n]
+	t.mu.Unlock()
+	if seen {
+		http.Error(w, "stream already reported", http.StatusConflict)
+		return nil, 0, false
+	}
+	return t, n, true
+}
+
+// report stores one stream's result. The last one to come in puts the
+// combined figure into the history.
+func (t *multiSpeedTest) report(s speedStream, source string) {
+	t.mu.Lock()
+	t.results[s.Stream] = s
+	done := len(t.results) == t.streams
+	t.mu.Unlock()
+	if done {
+		sum := t.summary()
+		recordSpeed(speedResult{Time: t.created, Client: t.client, Direction: "download", Bytes: sum.Bytes,
+			MBPerS: sum.MBPerS, DurationS: sum.DurationS, Source: fmt.Sprintf("%s, %d streams", source, t.streams)})
+	}
+}
+
+type speedTestSummary struct {
+	ID        string        `json:"id"`
+	Streams   int           `json:"streams"`
+	Reported  int           `json:"reported"`
+	Done      bool          `json:"done"`
+	TimedOut  bool          `json:"timed_out,omitempty"`
+	Bytes     int64         `json:"bytes"`
+	MBPerS    float64       `json:"mb_per_s"`
+	SumMBPerS float64       `json:"sum_mb_per_s"`
+	DurationS float64       `json:"duration_s"`
+	PerStream []speedStream `json:"per_stream"`
+}
+
+// summary combines the streams reported so far. mb_per_s is every byte over
+// the time from the first stream starting to the last one ending;
+// sum_mb_per_s adds up the streams' own rates.
+func (t *multiSpeedTest) summary() speedTestSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := speedTestSummary{ID: t.id, Streams: t.streams, Reported: len(t.results), PerStream: []speedStream{}}
+	var first, last time.Time
+	for _, st := range t.results {
+		s.PerStream = append(s.PerStream, st)
+		s.Bytes += st.Bytes
+		s.SumMBPerS += st.MBPerS
+		if first.IsZero() || st.Start.Before(first) {
+			first = st.Start
+		}
+		if st.End.After(last) {
+			last = st.End
+		}
+	}
+	sort.Slice(s.PerStream, func(i, j int) bool { return s.PerStream[i].Stream < s.PerStream[j].Stream })
+	if s.Reported > 0 {
+		s.DurationS = last.Sub(first).Seconds()
+		if s.DurationS > 0 {
+			s.MBPerS = float64(s.Bytes) / (1024 * 1024) / s.DurationS
+		}
+	}
+	s.TimedOut = s.Reported < s.Streams && time.Since(t.created) > speedTestTimeout
+	s.Done = s.Reported == s.Streams || s.TimedOut
+	return s
+}
+
+// speedStartHandler serves POST /api/speedtest/start?streams=4: a new test
+// ID and the stream URLs to fetch in parallel. They take the usual
+// /speedtest parameters.
+func speedStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := 4
+	if v := r.URL.Query().Get("streams"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 || n > maxSpeedStreams {
+			jsonError(w, fmt.Sprintf("streams must be between 1 and %d", maxSpeedStreams), http.StatusBadRequest)
+			return
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	t := &multiSpeedTest{id: hex.EncodeToString(b), streams: n, client: clientHost(r), created: time.Now(), results: map[int]speedStream{}}
+	speedTests.Lock()
+	if len(speedTests.m) >= maxSpeedTests {
+		speedTests.Unlock()
+		jsonError(w, "too many speedtests running", http.StatusServiceUnavailable)
+		return
+	}
+	speedTests.m[t.id] = t
+	speedTests.Unlock()
+	time.AfterFunc(speedTestTimeout+speedTestKeep, func() {
+		speedTests.Lock()
+		delete(speedTests.m, t.id)
+		speedTests.Unlock()
+	})
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("%s/speedtest?test=%s&stream=%d", baseURL(r), t.id, i)
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": t.id, "streams": urls, "result": baseURL(r) + "/api/speedtest/result/" + t.id})
+}
+
+// speedTestResultHandler serves /api/speedtest/result/<id>, the per-stream
+// and combined figures of a multi-stream test.
+func speedTestResultHandler(w http.ResponseWriter, r *http.Request) {
+	t := getSpeedTest(strings.TrimPrefix(r.URL.Path, "/api/speedtest/result/"))
+	if t == nil {
+		jsonError(w, "no such speedtest", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.summary())
+}
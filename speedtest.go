@@ -0,0 +1,465 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed templates/speedtest.html
+var speedTestHTML string
+
+var speedTestTemplate = mustTemplate("speedtest", speedTestHTML)
+
+// maxSpeedSeconds bounds ?seconds= on /speedtest.
+const maxSpeedSeconds = 300
+
+// maxSpeedBytes bounds ?bytes= on /speedtest, about five minutes at
+// 10 Gbit/s; -speedbytes may set a larger default.
+const maxSpeedBytes = 256 << 30
+
+// syntheticBlock is the payload of ?source=synthetic: filled once and sent
+// over and over, so the test costs neither disk reads nor random numbers.
+var syntheticBlock = sync.OnceValue(func() []byte {
+	b := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+})
+
+// minSpeedChunk and maxSpeedChunk bound ?chunk=, the size of each write.
+const minSpeedChunk = 4 << 10
+const maxSpeedChunk = 8 << 20
+
+// zeroReader yields zeros, the payload of ?pattern=zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// syntheticReader yields syntheticBlock endlessly.
+type syntheticReader struct {
+	off int
+}
+
+func (s *syntheticReader) Read(p []byte) (int, error) {
+	block := syntheticBlock()
+	n := copy(p, block[s.off:])
+	s.off = (s.off + n) % len(block)
+	return n, nil
+}
+
+// loopReader reads a file over and over, so a speedtest can run longer
+// than the file is.
+type loopReader struct {
+	f *os.File
+}
+
+func (l *loopReader) Read(p []byte) (int, error) {
+	n, err := l.f.Read(p)
+	if err == io.EOF && n == 0 {
+		if _, err = l.f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return l.f.Read(p)
+	}
+	return n, err
+}
+
+// speedTestFile picks the file /speedtest streams: ?file= or else the
+// largest media file in the share. It returns "" when there is none.
+func speedTestFile(w http.ResponseWriter, r *http.Request, asJSON bool) (string, bool) {
+	if fileParam := r.URL.Query().Get("file"); fileParam != "" {
+		candidate, err := resolveFor(r, fileParam)
+		if err != nil {
+			writePathError(w, asJSON, err)
+			return "", false
+		}
+		if fi, err := os.Stat(candidate); err == nil && !fi.IsDir() {
+			if fi.Size() == 0 {
+				writeError(w, asJSON, "file is empty", http.StatusBadRequest)
+				return "", false
+			}
+			return candidate, true
+		}
+	}
+	items, _ := library.get(false)
+	items = visibleTo(r, items)
+	var best *libraryItem
+	for i, it := range items {
+		if it.Kind == "video" && it.Size > 0 && (best == nil || it.Size > best.Size) {
+			best = &items[i]
+		}
+	}
+	if best == nil {
+		return "", true
+	}
+	full, err := resolvePath("/" + best.Path)
+	if err != nil {
+		return "", true
+	}
+	return full, true
+}
+
+// parseSpeedRange reads a Range header against a stream of size bytes. A
+// single range is cut out; anything else that is well-formed, such as a
+// multi-range request, gets the whole stream, as RFC 9110 allows. ok is
+// false when the range cannot be satisfied.
+func parseSpeedRange(h string, size int64) (offset, length int64, ok bool) {
+	spec, found := strings.CutPrefix(h, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, size, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		n = min(n, size)
+		return size - n, n, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true
+}
+
+// speedTestHandler streams -speedbytes (or ?bytes=), or keeps streaming
+// for ?seconds=, to measure throughput. By default the data comes from a
+// media file, which measures the whole serving pipeline; ?source=synthetic,
+// also used when the share has no media, leaves the disk out and measures
+// the network alone.
+func speedTestHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	source := q.Get("source")
+	if source != "" && source != "file" && source != "synthetic" {
+		http.Error(w, "source must be file or synthetic", http.StatusBadRequest)
+		return
+	}
+	// ?pattern= names the payload by its content: zeros show whether a VPN
+	// or link compresses, random is the synthetic source.
+	if p := q.Get("pattern"); p != "" {
+		if source != "" {
+			http.Error(w, "give either source or pattern, not both", http.StatusBadRequest)
+			return
+		}
+		switch p {
+		case "zeros", "file":
+			source = p
+		case "random":
+			source = "synthetic"
+		default:
+			http.Error(w, "pattern must be zeros, random or file", http.StatusBadRequest)
+			return
+		}
+	}
+	chunk := int64(bufSize)
+	if v := q.Get("chunk"); v != "" {
+		n, err := parseBytes(v)
+		if err != nil || n < minSpeedChunk || n > maxSpeedChunk {
+			http.Error(w, "chunk must be a size between 4KB and 8MB, such as 64KB", http.StatusBadRequest)
+			return
+		}
+		chunk = n
+	}
+	size := speedBytes
+	if size <= 0 {
+		size = 50 << 20
+	}
+	if q.Get("seconds") != "" && q.Get("bytes") != "" {
+		http.Error(w, "give either seconds or bytes, not both", http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("bytes"); v != "" {
+		n, err := parseBytes(v)
+		if err != nil || n <= 0 || n > max(maxSpeedBytes, size) {
+			http.Error(w, fmt.Sprintf("bytes must be a positive size such as 100MB, at most %s", human(max(maxSpeedBytes, size))), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+	var duration time.Duration
+	if v := q.Get("seconds"); v != "" {
+		sec, err := strconv.ParseFloat(v, 64)
+		if err != nil || sec <= 0 || sec > maxSpeedSeconds {
+			http.Error(w, fmt.Sprintf("seconds must be a number above 0 and at most %d", maxSpeedSeconds), http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(sec * float64(time.Second))
+	}
+	test, stream, ok := speedTestStream(w, r)
+	if !ok {
+		return
+	}
+	// ?diag=1 reads the file into nothing first and then measures the
+	// network alone, unless ?source=file asks for both at once.
+	var disk *diskResult
+	if q.Get("diag") == "1" {
+		res, ok := runDiskBench(w, r, false, size)
+		if !ok {
+			return
+		}
+		disk = &res
+		if source == "" {
+			source = "synthetic"
+		}
+	}
+	// Without a length the response goes out chunked, with the result as a
+	// last line of its own.
+	chunked := duration > 0 || disk != nil
+	var src io.Reader
+	var target string
+	if source != "synthetic" && source != "zeros" {
+		var ok bool
+		if target, ok = speedTestFile(w, r, false); !ok {
+			return
+		}
+		if target == "" && source == "file" {
+			http.Error(w, "no media file found for speedtest", http.StatusNotFound)
+			return
+		}
+	}
+	// A byte count makes the stream a fixed-size virtual file that ranges
+	// can be cut from, which lets multi-connection downloaders split it.
+	offset, length, partial := int64(0), size, false
+	if h := r.Header.Get("Range"); h != "" && !chunked {
+		var ok bool
+		if offset, length, ok = parseSpeedRange(h, size); !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		partial = length != size
+	}
+	if target != "" {
+		f, err := os.Open(target)
+		if err != nil {
+			http.Error(w, "cannot open file", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err == nil && fi.Size() > 0 {
+			_, err = f.Seek(offset%fi.Size(), io.SeekStart)
+		}
+		if err != nil {
+			http.Error(w, "cannot read file", http.StatusInternalServerError)
+			return
+		}
+		src = &loopReader{f: f}
+	} else {
+		src = &syntheticReader{off: int(offset % int64(len(syntheticBlock())))}
+	}
+	if source == "zeros" {
+		src = zeroReader{}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if !chunked {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	bp := getBuf()
+	defer putBuf(bp)
+	buf := *bp
+	if chunk != int64(len(buf)) {
+		buf = make([]byte, chunk)
+	}
+	remaining := length
+	start := time.Now()
+	deadline := start.Add(duration)
+	total := int64(0)
+	for duration > 0 && time.Now().Before(deadline) || duration == 0 && remaining > 0 {
+		toRead := int64(len(buf))
+		if duration == 0 && remaining < toRead {
+			toRead = remaining
+		}
+		nr, err := src.Read(buf[:toRead])
+		if nr > 0 {
+			nw, errw := w.Write(buf[:nr])
+			if errw != nil || nw != nr {
+				break
+			}
+			total += int64(nw)
+			remaining -= int64(nw)
+		}
+		if err != nil {
+			break
+		}
+	}
+	elapsed := time.Since(start).Seconds()
+	if elapsed == 0 {
+		elapsed = 0.000001
+	}
+	res := map[string]interface{}{
+		"source":      "synthetic",
+		"pattern":     "random",
+		"bytes_sent":  total,
+		"mb_per_s":    float64(total) / (1024 * 1024) / elapsed,
+		"duration_s":  elapsed,
+		"buffer_size": int64(bufSize),
+		"chunk":       chunk,
+	}
+	if source == "zeros" {
+		res["source"], res["pattern"] = "zeros", "zeros"
+	}
+	if duration > 0 {
+		res["seconds"] = duration.Seconds()
+	}
+	if partial {
+		res["range"] = fmt.Sprintf("%d-%d", offset, offset+length-1)
+	}
+	if target != "" {
+		res["source"] = filepath.Base(target)
+		res["file"] = res["source"]
+		res["pattern"] = "file"
+	}
+	if disk != nil {
+		res["disk"] = disk
+	}
+	js, _ := json.Marshal(res)
+	fmt.Fprintln(os.Stdout, string(js))
+	w.Header().Set("Content-Type", "application/json")
+	if chunked {
+		w.Write([]byte("\n"))
+	}
+	w.Write(append(js, '\n'))
+	if test != nil {
+		complete := total == length
+		if duration > 0 {
+			complete = r.Context().Err() == nil
+		}
+		test.report(speedStream{Stream: stream, Bytes: total, MBPerS: res["mb_per_s"].(float64), DurationS: elapsed,
+			Complete: complete, Start: start, End: time.Now()}, res["source"].(string))
+		return
+	}
+	recordSpeed(speedResult{Time: start, Client: clientHost(r), Direction: "download", Bytes: total,
+		MBPerS: res["mb_per_s"].(float64), DurationS: elapsed, Source: res["source"].(string)})
+}
+
+// speedUploadHandler serves POST /speedtest/upload: the body, chunked or
+// not, is read and thrown away to measure how fast the client can send.
+// Bodies above -speedbytes, or ?bytes=, are cut off with 413.
+func speedUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := speedBytes
+	if limit <= 0 {
+		limit = 50 << 20
+	}
+	if v := r.URL.Query().Get("bytes"); v != "" {
+		n, err := parseBytes(v)
+		if err != nil || n <= 0 {
+			jsonError(w, "bytes must be a positive size such as 100MB", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if r.ContentLength > limit {
+		jsonError(w, fmt.Sprintf("upload larger than %d bytes", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, limit)
+	bp := getBuf()
+	defer putBuf(bp)
+	buf := *bp
+	start := time.Now()
+	total := int64(0)
+	var err error
+	for {
+		var n int
+		n, err = body.Read(buf)
+		total += int64(n)
+		if err != nil {
+			break
+		}
+	}
+	elapsed := time.Since(start).Seconds()
+	if elapsed == 0 {
+		elapsed = 0.000001
+	}
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		jsonError(w, fmt.Sprintf("upload larger than %d bytes", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != io.EOF {
+		fmt.Printf("speedtest upload from %s failed after %d bytes: %v\n", r.RemoteAddr, total, err)
+		return
+	}
+	res := map[string]interface{}{
+		"bytes_received": total,
+		"mb_per_s":       float64(total) / (1024 * 1024) / elapsed,
+		"duration_s":     elapsed,
+		"buffer_size":    int64(bufSize),
+	}
+	js, _ := json.Marshal(res)
+	fmt.Fprintln(os.Stdout, string(js))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+	recordSpeed(speedResult{Time: start, Client: clientHost(r), Direction: "upload", Bytes: total,
+		MBPerS: res["mb_per_s"].(float64), DurationS: elapsed})
+}
+
+// speedTestUIHandler serves /speedtest/ui, which runs the tests from the
+// browser for those without curl.
+func speedTestUIHandler(w http.ResponseWriter, r *http.Request) {
+	renderTemplate(w, speedTestTemplate, speedTestTemplate, struct{ History bool }{!noSpeedHistory})
+}
+
+type pingReply struct {
+	Seq          string `json:"seq,omitempty"`
+	ServerTimeMS int64  `json:"server_time_ms"`
+	ServerUS     int64  `json:"server_us"`
+}
+
+// pingHandler serves /api/ping?seq=N for latency and jitter measurements:
+// an uncached, uncompressed reply with the server's clock and its share of
+// the round trip in microseconds.
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	seq := r.URL.Query().Get("seq")
+	if len(seq) > 64 {
+		jsonError(w, "seq too long", http.StatusBadRequest)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Cache-Control", "no-store")
+	reply := pingReply{Seq: seq, ServerTimeMS: start.UnixMilli()}
+	reply.ServerUS = time.Since(start).Microseconds()
+	b, _ := json.Marshal(reply)
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// patternData returns n bytes that do not repeat with any small period, so
+// a stream that restarts the file in the wrong place is caught.
+func patternData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// speedGet fetches /speedtest from a real server, so the declared length is
+// enforced the way a client sees it.
+func speedGet(t *testing.T, query string, header ...string) (*http.Response, []byte) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(speedTestHandler))
+	defer srv.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/speedtest"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET /speedtest%s: read %d bytes of %d: %v", query, len(b), resp.ContentLength, err)
+	}
+	return resp, b
+}
+
+func setSpeedBytes(t *testing.T, n int64) {
+	old := speedBytes
+	t.Cleanup(func() { speedBytes = old })
+	speedBytes = n
+}
+
+func TestSpeedTestSmallFile(t *testing.T) {
+	data := patternData(1 << 20)
+	setupRoot(t, map[string]string{"small.mkv": string(data)})
+	setSpeedBytes(t, 50<<20)
+
+	resp, b := speedGet(t, "")
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 50<<20 {
+		t.Fatalf("status %d, Content-Length %d, want 200 and %d", resp.StatusCode, resp.ContentLength, 50<<20)
+	}
+	if len(b) != 50<<20 {
+		t.Fatalf("got %d bytes, want %d", len(b), 50<<20)
+	}
+	for off := 0; off < len(b); off += len(data) {
+		if !bytes.Equal(b[off:off+len(data)], data) {
+			t.Fatalf("bytes at %d are not the file again", off)
+		}
+	}
+
+	resp, b = speedGet(t, "?bytes=2500000")
+	if resp.ContentLength != 2500000 || len(b) != 2500000 {
+		t.Errorf("?bytes=2500000: Content-Length %d, got %d bytes", resp.ContentLength, len(b))
+	}
+	if !bytes.Equal(b[2<<20:], data[:2500000-2<<20]) {
+		t.Error("?bytes=2500000: third pass over the file differs")
+	}
+}
+
+func TestSpeedTestFileChoice(t *testing.T) {
+	setupRoot(t, map[string]string{
+		"a.mkv":          "aaaa",
+		"Shows/b.mp4":    "bbbbbbbbbbbbbbbb",
+		"notes.txt":      "larger than every video in the share",
+		"c.avi":          "cccccccc",
+		"empty.mkv":      "",
+		".hidden/big.ts": "hidden and larger than every other video",
+	})
+	for _, tt := range []struct{ query, want string }{
+		{"", "b.mp4"},
+		{"?file=a.mkv", "a.mkv"},
+		{"?file=notes.txt", "notes.txt"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/speedtest"+tt.query, nil)
+		full, ok := speedTestFile(httptest.NewRecorder(), r, false)
+		if !ok || filepath.Base(full) != tt.want {
+			t.Errorf("%q picked %q, want %s", tt.query, full, tt.want)
+		}
+	}
+	if w := serve(speedTestHandler, http.MethodGet, "/speedtest?file=empty.mkv"); w.Code != http.StatusBadRequest {
+		t.Errorf("?file=empty.mkv = %d, want 400", w.Code)
+	}
+	if w := serve(speedTestHandler, http.MethodGet, "/speedtest?file=missing.mkv"); w.Code != http.StatusNotFound {
+		t.Errorf("?file=missing.mkv = %d, want 404", w.Code)
+	}
+	if w := serve(speedTestHandler, http.MethodGet, "/speedtest?file=../x"); w.Code == http.StatusOK {
+		t.Error("?file=../x was served")
+	}
+}
+
+func TestParseSpeedRange(t *testing.T) {
+	tests := []struct {
+		header         string
+		offset, length int64
+		ok             bool
+	}{
+		{"bytes=0-99", 0, 100, true},
+		{"bytes=900-", 900, 100, true},
+		{"bytes=999-", 999, 1, true},
+		{"bytes=990-5000", 990, 10, true},
+		{"bytes=-100", 900, 100, true},
+		{"bytes=-5000", 0, 1000, true},
+		{"bytes= 10-19", 10, 10, true},
+		{"bytes=0-9,20-29", 0, 1000, true},
+		{"items=0-9", 0, 1000, true},
+		{"bytes=1000-", 0, 0, false},
+		{"bytes=20-10", 0, 0, false},
+		{"bytes=-0", 0, 0, false},
+		{"bytes=-", 0, 0, false},
+		{"bytes=10", 0, 0, false},
+		{"bytes=x-10", 0, 0, false},
+		{"bytes=10-y", 0, 0, false},
+		{"bytes=-5-10", 0, 0, false},
+	}
+	for _, tt := range tests {
+		offset, length, ok := parseSpeedRange(tt.header, 1000)
+		if ok != tt.ok || ok && (offset != tt.offset || length != tt.length) {
+			t.Errorf("parseSpeedRange(%q) = %d, %d, %v, want %d, %d, %v", tt.header, offset, length, ok, tt.offset, tt.length, tt.ok)
+		}
+	}
+}
+
+func TestSpeedTestRanges(t *testing.T) {
+	data := patternData(1 << 20)
+	setupRoot(t, map[string]string{"small.mkv": string(data)})
+	const size = 3 << 20
+	setSpeedBytes(t, size)
+	loop := bytes.Repeat(data, 3)
+
+	for _, tt := range []struct {
+		rng        string
+		start, end int
+	}{
+		{"bytes=0-99", 0, 99},
+		{"bytes=1048570-1048585", 1048570, 1048585},
+		{"bytes=3145000-", 3145000, size - 1},
+		{"bytes=-300", size - 300, size - 1},
+		{"bytes=3000000-9999999", 3000000, size - 1},
+	} {
+		resp, b := speedGet(t, "", "Range", tt.rng)
+		want := fmt.Sprintf("bytes %d-%d/%d", tt.start, tt.end, size)
+		if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != want {
+			t.Errorf("%s: %d %q, want 206 %q", tt.rng, resp.StatusCode, resp.Header.Get("Content-Range"), want)
+			continue
+		}
+		if !bytes.Equal(b, loop[tt.start:tt.end+1]) {
+			t.Errorf("%s: got %d bytes that differ from the looped file", tt.rng, len(b))
+		}
+	}
+
+	resp, b := speedGet(t, "?source=synthetic", "Range", "bytes=1048000-1049000")
+	if resp.StatusCode != http.StatusPartialContent || len(b) != 1001 {
+		t.Errorf("synthetic range: %d, %d bytes", resp.StatusCode, len(b))
+	} else if block := syntheticBlock(); !bytes.Equal(b[:576], block[1048000:]) || !bytes.Equal(b[576:], block[:425]) {
+		t.Error("synthetic range does not match the block at its offset")
+	}
+
+	resp, _ = speedGet(t, "", "Range", "bytes=0-0,10-20")
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != size || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("multi-range: %d, Content-Length %d, want the whole stream", resp.StatusCode, resp.ContentLength)
+	}
+	for _, rng := range []string{"bytes=" + strconv.Itoa(size) + "-", "bytes=5-1", "bytes=-0"} {
+		resp, _ := speedGet(t, "", "Range", rng)
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != fmt.Sprintf("bytes */%d", size) {
+			t.Errorf("%s: %d %q, want 416", rng, resp.StatusCode, resp.Header.Get("Content-Range"))
+		}
+	}
+}
+
+func TestSpeedTestBytesLimit(t *testing.T) {
+	setupRoot(t, nil)
+	setSpeedBytes(t, 50<<20)
+	for _, v := range []string{"0", "-1", "inf", "NaN", "1e18", "257GB"} {
+		if w := serve(speedTestHandler, http.MethodHead, "/speedtest?bytes="+v); w.Code != http.StatusBadRequest {
+			t.Errorf("?bytes=%s = %d, want 400", v, w.Code)
+		}
+	}
+	if w := serve(speedTestHandler, http.MethodHead, "/speedtest?bytes=256GB"); w.Code != http.StatusOK || w.Header().Get("Content-Length") != strconv.Itoa(256<<30) {
+		t.Errorf("?bytes=256GB = %d, Content-Length %s", w.Code, w.Header().Get("Content-Length"))
+	}
+	setSpeedBytes(t, 300<<30)
+	if w := serve(speedTestHandler, http.MethodHead, "/speedtest?bytes=300GB"); w.Code != http.StatusOK {
+		t.Errorf("?bytes= up to -speedbytes = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// stateFile holds what the server remembers for its users: watch progress,
+// favorites, how often each file was served and unfinished uploads. Unlike
+// the caches in -cache-dir it cannot be regenerated.
+var stateFile string
+
+// stateData is everything in stateFile, keyed by client first.
+type stateData struct {
+	Progress  map[string]map[string]progressEntry `json:"progress"`
+	Favorites map[string]map[string]time.Time     `json:"favorites"`
+	// Files is keyed by path alone.
+	Files map[string]*fileStats `json:"files,omitempty"`
+	// Uploads are the unfinished resumable uploads, keyed by ID.
+	Uploads map[string]*uploadSession `json:"uploads,omitempty"`
+	// Shares are the /s/ links, keyed by ID.
+	Shares map[string]*shareLink `json:"shares,omitempty"`
+	// SessionKey signs /login session cookies.
+	SessionKey string `json:"session_key,omitempty"`
+}
+
+var state = struct {
+	sync.Mutex
+	data  stateData
+	dirty bool
+}{data: stateData{Progress: map[string]map[string]progressEntry{}, Favorites: map[string]map[string]time.Time{}, Files: map[string]*fileStats{}, Uploads: map[string]*uploadSession{}, Shares: map[string]*shareLink{}}}
+
+// defaultStateFile puts the state next to the binary, where it survives
+// the share being swapped for another.
+func defaultStateFile() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return "fileserver-state.json"
+	}
+	return filepath.Join(filepath.Dir(exe), "fileserver-state.json")
+}
+
+// loadState reads stateFile and arranges for it to be written out on
+// shutdown. A missing file is a fresh start; a broken one is reported and
+// replaced on the next save.
+func loadState() {
+	if stateFile == "" {
+		return
+	}
+	onShutdown(flushState)
+	b, err := os.ReadFile(stateFile)
+	if err != nil {
+		return
+	}
+	var d stateData
+	if err := json.Unmarshal(b, &d); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: ignoring broken state file:", err)
+		return
+	}
+	state.Lock()
+	defer state.Unlock()
+	for client, m := range d.Progress {
+		state.data.Progress[client] = m
+	}
+	for client, m := range d.Favorites {
+		state.data.Favorites[client] = m
+	}
+	for p, s := range d.Files {
+		state.data.Files[p] = s
+	}
+	for id, u := range d.Uploads {
+		state.data.Uploads[id] = u
+	}
+	for id, s := range d.Shares {
+		state.data.Shares[id] = s
+	}
+	state.data.SessionKey = d.SessionKey
+	pruneProgress(time.Now())
+	pruneUploads(time.Now())
+	pruneShares(time.Now())
+}
+
+// saveState writes the state out a few seconds after it changed, so the
+// progress every player reports is saved in batches.
+func saveState() {
+	if stateFile == "" {
+		return
+	}
+	state.Lock()
+	if state.dirty {
+		state.Unlock()
+		return
+	}
+	state.dirty = true
+	state.Unlock()
+	time.AfterFunc(5*time.Second, flushState)
+}
+
+func flushState() {
+	state.Lock()
+	pruneProgress(time.Now())
+	b, err := json.Marshal(state.data)
+	state.dirty = false
+	state.Unlock()
+	if err == nil {
+		err = writeFileAtomic(stateFile, json.RawMessage(b))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot save state:", err)
+	}
+}
+
+const clientCookie = "fileserver_client"
+
+var clientName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// clientID tells apart the people using the server. A ?client= name wins
+// and sticks to the browser through the cookie; otherwise the cookie holds
+// a random id, created on first use.
+func clientID(w http.ResponseWriter, r *http.Request) string {
+	id := r.URL.Query().Get("client")
+	if id != "" && !clientName.MatchString(id) {
+		id = ""
+	}
+	if c, err := r.Cookie(clientCookie); err == nil && clientName.MatchString(c.Value) {
+		if id == "" || id == c.Value {
+			return c.Value
+		}
+	}
+	if id == "" {
+		b := make([]byte, 12)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	http.SetCookie(w, &http.Cookie{Name: clientCookie, Value: id, Path: "/", MaxAge: 10 * 365 * 24 * 3600, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	return id
+}
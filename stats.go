@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// noHistory turns off the per-file statistics.
+var noHistory bool
+
+type fileStats struct {
+	// Downloads are transfers of the whole file; Partial counts the ones
+	// broken off and players opening the file with a range from the start.
+	Downloads  int64           `json:"downloads"`
+	Partial    int64           `json:"partial"`
+	Bytes      int64           `json:"bytes"`
+	LastAccess time.Time       `json:"last_access"`
+	Clients    map[string]bool `json:"clients"`
+}
+
+// plays is what the listing shows: how often the file was opened.
+func (s *fileStats) plays() int64 {
+	return s.Downloads + s.Partial
+}
+
+type statEvent struct {
+	rel     string
+	client  string
+	n       int64
+	full    bool
+	partial bool
+	at      time.Time
+}
+
+// statEvents decouples streaming from bookkeeping: transfers only queue an
+// event, dropping it if the queue is full, and one goroutine applies them
+// in batches.
+var statEvents = make(chan statEvent, 1024)
+
+const maxStatsBatch = 256
+
+func startStats() {
+	if noHistory {
+		return
+	}
+	go func() {
+		for ev := range statEvents {
+			state.Lock()
+			applyStat(ev)
+		drain:
+			for i := 0; i < maxStatsBatch; i++ {
+				select {
+				case ev = <-statEvents:
+					applyStat(ev)
+				default:
+					break drain
+				}
+			}
+			state.Unlock()
+			saveState()
+		}
+	}()
+}
+
+// applyStat adds one transfer to the counters. state must be locked.
+func applyStat(ev statEvent) {
+	s := state.data.Files[ev.rel]
+	if s == nil {
+		s = &fileStats{Clients: map[string]bool{}}
+		state.data.Files[ev.rel] = s
+	}
+	if s.Clients == nil {
+		s.Clients = map[string]bool{}
+	}
+	switch {
+	case ev.full:
+		s.Downloads++
+	case ev.partial:
+		s.Partial++
+	}
+	s.Bytes += ev.n
+	s.LastAccess = ev.at
+	s.Clients[ev.client] = true
+}
+
+// recordTransfer notes n bytes of the file at full sent to r's client:
+// the whole file when complete is set, or the start of a play when opened
+// is.
+func recordTransfer(r *http.Request, full string, n int64, complete, opened bool) {
+	if noHistory || n == 0 {
+		return
+	}
+	select {
+	case statEvents <- statEvent{rel: relPath(full), client: clientHost(r), n: n, full: complete, partial: !complete && opened, at: time.Now()}:
+	default:
+	}
+}
+
+// markPlays annotates listing entries with how often they were opened.
+func markPlays(upath string, entries []dirEntry) {
+	if noHistory {
+		return
+	}
+	state.Lock()
+	defer state.Unlock()
+	if len(state.data.Files) == 0 {
+		return
+	}
+	for i, e := range entries {
+		if s := state.data.Files[strings.TrimPrefix(path.Join(upath, e.Name), "/")]; s != nil && !e.IsDir {
+			entries[i].Plays = s.plays()
+		}
+	}
+}
+
+type fileStatsItem struct {
+	Path       string    `json:"path"`
+	URL        string    `json:"url"`
+	Downloads  int64     `json:"downloads"`
+	Partial    int64     `json:"partial"`
+	Plays      int64     `json:"plays"`
+	Bytes      int64     `json:"bytes"`
+	LastAccess time.Time `json:"last_access"`
+	Clients    int       `json:"clients"`
+}
+
+const defaultStatsLimit = 50
+const maxStatsLimit = 1000
+
+// fileStatsHandler serves /api/stats/files?sort=bytes|count&limit=50, the
+// most served files first.
+func fileStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if noHistory {
+		jsonError(w, "statistics are disabled by -no-history", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	sortBy := q.Get("sort")
+	if sortBy == "" {
+		sortBy = "count"
+	}
+	if sortBy != "count" && sortBy != "bytes" {
+		jsonError(w, "sort must be bytes or count", http.StatusBadRequest)
+		return
+	}
+	limit := defaultStatsLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxStatsLimit {
+			jsonError(w, fmt.Sprintf("limit must be between 1 and %d", maxStatsLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	state.Lock()
+	items := make([]fileStatsItem, 0, len(state.data.Files))
+	for p, s := range state.data.Files {
+		items = append(items, fileStatsItem{Path: p, URL: escapePath("/" + p), Downloads: s.Downloads, Partial: s.Partial,
+			Plays: s.plays(), Bytes: s.Bytes, LastAccess: s.LastAccess, Clients: len(s.Clients)})
+	}
+	state.Unlock()
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if sortBy == "bytes" && a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if a.Plays != b.Plays {
+			return a.Plays > b.Plays
+		}
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Path < b.Path
+	})
+	total := len(items)
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sort": sortBy, "total": total, "items": items})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type subtitleTrack struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	URL    string `json:"url"`
+	VTTURL string `json:"vtt_url,omitempty"`
+	Format string `json:"format"`
+	Lang   string `json:"lang,omitempty"`
+	Forced bool   `json:"forced"`
+	SDH    bool   `json:"sdh"`
+}
+
+// subsDirs are the subdirectory names release groups put subtitles in.
+var subsDirs = map[string]bool{"subs": true, "subtitles": true}
+
+// languageNames maps language codes and spelled-out names found in
+// subtitle file names to a display label.
+var languageNames = map[string]string{
+	"en": "English", "eng": "English", "english": "English",
+	"ru": "Russian", "rus": "Russian", "russian": "Russian",
+	"uk": "Ukrainian", "ukr": "Ukrainian", "ukrainian": "Ukrainian",
+	"de": "German", "ger": "German", "deu": "German", "german": "German",
+	"fr": "French", "fre": "French", "fra": "French", "french": "French",
+	"es": "Spanish", "spa": "Spanish", "spanish": "Spanish",
+	"it": "Italian", "ita": "Italian", "italian": "Italian",
+	"pt": "Portuguese", "por": "Portuguese", "portuguese": "Portuguese",
+	"pl": "Polish", "pol": "Polish", "polish": "Polish",
+	"nl": "Dutch", "dut": "Dutch", "nld": "Dutch", "dutch": "Dutch",
+	"sv": "Swedish", "swe": "Swedish", "swedish": "Swedish",
+	"fi": "Finnish", "fin": "Finnish", "finnish": "Finnish",
+	"cs": "Czech", "cze": "Czech", "ces": "Czech", "czech": "Czech",
+	"tr": "Turkish", "tur": "Turkish", "turkish": "Turkish",
+	"ja": "Japanese", "jpn": "Japanese", "japanese": "Japanese",
+	"zh": "Chinese", "chi": "Chinese", "zho": "Chinese", "chinese": "Chinese",
+	"ko": "Korean", "kor": "Korean", "korean": "Korean",
+	"ar": "Arabic", "ara": "Arabic", "arabic": "Arabic",
+	"he": "Hebrew", "heb": "Hebrew", "hebrew": "Hebrew",
+}
+
+// isLangTag reports whether t looks like a language: a known name, a two or
+// three letter code, or a code with a region such as pt-br.
+func isLangTag(t string) bool {
+	if languageNames[t] != "" {
+		return true
+	}
+	code, region, hasRegion := strings.Cut(t, "-")
+	if hasRegion && (len(region) != 2 || !isAlpha(region)) {
+		return false
+	}
+	return (len(code) == 2 || len(code) == 3) && isAlpha(code)
+}
+
+func isAlpha(s string) bool {
+	for _, c := range s {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSubtitleTags reads the dot-separated suffixes between the video name
+// and the extension, e.g. "rus.forced". Any tag that is not a language or a
+// known flag means the file belongs to something else.
+func parseSubtitleTags(tags string, t *subtitleTrack) bool {
+	if tags == "" {
+		return true
+	}
+	for _, tag := range strings.Split(tags, ".") {
+		switch tag {
+		case "forced":
+			t.Forced = true
+		case "sdh", "cc":
+			t.SDH = true
+		case "default", "full":
+		default:
+			if !isLangTag(tag) || t.Lang != "" {
+				return false
+			}
+			t.Lang = tag
+		}
+	}
+	return true
+}
+
+// findSubtitles returns the sidecar subtitles for the video at full: files
+// next to it named after it, the same inside a Subs/ directory, and anything
+// in Subs/<video name>/, where the file name itself is usually the language
+// ("2_English.srt"). Matching ignores case.
+func findSubtitles(full string) []subtitleTrack {
+	dir, name := filepath.Split(full)
+	base := strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+	var out []subtitleTrack
+	scanSubtitles(dir, base, false, &out)
+	des, _ := readShareDir(dir)
+	for _, de := range des {
+		if !de.IsDir() || !subsDirs[strings.ToLower(de.Name())] {
+			continue
+		}
+		sub := filepath.Join(dir, de.Name())
+		scanSubtitles(sub, base, false, &out)
+		inner, _ := readShareDir(sub)
+		for _, ide := range inner {
+			if ide.IsDir() && strings.ToLower(ide.Name()) == base {
+				scanSubtitles(filepath.Join(sub, ide.Name()), base, true, &out)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return naturalCompare(out[i].Path, out[j].Path) < 0 })
+	return out
+}
+
+func scanSubtitles(dir, base string, inFolder bool, out *[]subtitleTrack) {
+	des, err := readShareDir(dir)
+	if err != nil {
+		return
+	}
+	for _, de := range des {
+		ext := strings.ToLower(filepath.Ext(de.Name()))
+		if de.IsDir() || !textSubtitleExts[ext] {
+			continue
+		}
+		rel := relPath(filepath.Join(dir, de.Name()))
+		if !visible(rel) {
+			continue
+		}
+		stem := strings.ToLower(strings.TrimSuffix(de.Name(), filepath.Ext(de.Name())))
+		t := subtitleTrack{Name: de.Name(), Path: rel, URL: escapePath("/" + rel), Format: ext[1:]}
+		switch {
+		case inFolder:
+			stem = strings.TrimLeft(stem, "0123456789_ -")
+			if !parseSubtitleTags(stem, &t) {
+				t.Lang = ""
+			}
+		case stem == base:
+		case strings.HasPrefix(stem, base+"."):
+			if !parseSubtitleTags(stem[len(base)+1:], &t) {
+				continue
+			}
+		default:
+			continue
+		}
+		switch ext {
+		case ".srt":
+			t.VTTURL = t.URL + "?as=vtt"
+		case ".vtt":
+			t.VTTURL = t.URL
+		}
+		*out = append(*out, t)
+	}
+}
+
+func subsHandler(w http.ResponseWriter, r *http.Request) {
+	full, err := resolveFor(r, r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() {
+		jsonError(w, "not a file", http.StatusNotFound)
+		return
+	}
+	subs := findSubtitles(full)
+	if subs == nil {
+		subs = []subtitleTrack{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"path": relPath(full), "subtitles": subs})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testSRT = "1\n00:00:01,000 --> 00:00:02,500\nHello\n"
+
+func subsFor(t *testing.T, p string) []subtitleTrack {
+	t.Helper()
+	w := serve(subsHandler, http.MethodGet, "/api/subs?path="+url.QueryEscape(p))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/api/subs?path=%s = %d: %s", p, w.Code, body(t, w))
+	}
+	var resp struct {
+		Path      string          `json:"path"`
+		Subtitles []subtitleTrack `json:"subtitles"`
+	}
+	if err := json.Unmarshal([]byte(body(t, w)), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Subtitles == nil {
+		t.Fatal("subtitles is null, want a list")
+	}
+	return resp.Subtitles
+}
+
+func TestSubsNaming(t *testing.T) {
+	setupRoot(t, map[string]string{
+		"Movies/Film.mkv":                     "video",
+		"Movies/Film.srt":                     testSRT,
+		"Movies/film.EN.srt":                  testSRT,
+		"Movies/Film.rus.forced.srt":          testSRT,
+		"Movies/Film.pt-br.sdh.vtt":           "WEBVTT\n",
+		"Movies/Film.ass":                     "[Script Info]\n",
+		"Movies/Film.sub":                     "{1}{2}x\n",
+		"Movies/Film.Director's Cut.srt":      testSRT,
+		"Movies/Film 2.srt":                   testSRT,
+		"Movies/Other.srt":                    testSRT,
+		"Movies/Subs/Film.de.srt":             testSRT,
+		"Movies/Subs/Film/2_English.srt":      testSRT,
+		"Movies/Subs/Film/3_Russian.srt":      testSRT,
+		"Movies/Subs/Other/4_English.srt":     testSRT,
+		"Movies/Film.mkv.txt":                 "not a subtitle",
+		"Movies/Subtitles/FILM.fr.forced.srt": testSRT,
+	})
+	type want struct {
+		lang        string
+		forced, sdh bool
+		format, vtt string
+	}
+	wants := map[string]want{
+		"Movies/Film.srt":                     {format: "srt", vtt: "/Movies/Film.srt?as=vtt"},
+		"Movies/film.EN.srt":                  {lang: "en", format: "srt", vtt: "/Movies/film.EN.srt?as=vtt"},
+		"Movies/Film.rus.forced.srt":          {lang: "rus", forced: true, format: "srt", vtt: "/Movies/Film.rus.forced.srt?as=vtt"},
+		"Movies/Film.pt-br.sdh.vtt":           {lang: "pt-br", sdh: true, format: "vtt", vtt: "/Movies/Film.pt-br.sdh.vtt"},
+		"Movies/Film.ass":                     {format: "ass"},
+		"Movies/Film.sub":                     {format: "sub"},
+		"Movies/Subs/Film.de.srt":             {lang: "de", format: "srt", vtt: "/Movies/Subs/Film.de.srt?as=vtt"},
+		"Movies/Subs/Film/2_English.srt":      {lang: "english", format: "srt", vtt: "/Movies/Subs/Film/2_English.srt?as=vtt"},
+		"Movies/Subs/Film/3_Russian.srt":      {lang: "russian", format: "srt", vtt: "/Movies/Subs/Film/3_Russian.srt?as=vtt"},
+		"Movies/Subtitles/FILM.fr.forced.srt": {lang: "fr", forced: true, format: "srt", vtt: "/Movies/Subtitles/FILM.fr.forced.srt?as=vtt"},
+	}
+	got := subsFor(t, "Movies/Film.mkv")
+	seen := map[string]bool{}
+	for _, s := range got {
+		seen[s.Path] = true
+		w, ok := wants[s.Path]
+		if !ok {
+			t.Errorf("unexpected subtitle %s", s.Path)
+			continue
+		}
+		if s.Lang != w.lang || s.Forced != w.forced || s.SDH != w.sdh || s.Format != w.format || s.VTTURL != w.vtt {
+			t.Errorf("%s = lang %q forced %v sdh %v format %q vtt %q, want %+v", s.Path, s.Lang, s.Forced, s.SDH, s.Format, s.VTTURL, w)
+		}
+		if s.URL != escapePath("/"+s.Path) {
+			t.Errorf("%s has url %q", s.Path, s.URL)
+		}
+		if r := serve(indexHandler, http.MethodGet, s.URL); r.Code != http.StatusOK {
+			t.Errorf("GET %s = %d", s.URL, r.Code)
+		}
+		if s.VTTURL == "" {
+			continue
+		}
+		r := serve(indexHandler, http.MethodGet, s.VTTURL)
+		if r.Code != http.StatusOK || !strings.HasPrefix(body(t, r), "WEBVTT") {
+			t.Errorf("GET %s = %d, not WebVTT", s.VTTURL, r.Code)
+		}
+	}
+	for p := range wants {
+		if !seen[p] {
+			t.Errorf("%s not found", p)
+		}
+	}
+
+	for _, p := range []string{"Movies/Missing.mkv", "Movies/Subs"} {
+		if w := serve(subsHandler, http.MethodGet, "/api/subs?path="+url.QueryEscape(p)); w.Code != http.StatusNotFound {
+			t.Errorf("/api/subs?path=%s = %d, want 404", p, w.Code)
+		}
+	}
+}
+
+func TestSubsExcluded(t *testing.T) {
+	setupRoot(t, map[string]string{
+		"Film.mkv":    "video",
+		"Film.en.srt": testSRT,
+		"Film.de.srt": testSRT,
+	})
+	excludes = stringList{"*.de.srt"}
+	got := subsFor(t, "Film.mkv")
+	if len(got) != 1 || got[0].Path != "Film.en.srt" {
+		t.Errorf("got %v, want only Film.en.srt", got)
+	}
+}
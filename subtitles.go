@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const vttCacheMax = 32 << 20
+
+// maxSubtitleSize bounds what serveSubtitle reads into memory; anything
+// larger is not a text subtitle and is served raw.
+const maxSubtitleSize = 16 << 20
+
+var noTranscodeSubs bool
+
+// textSubtitleExts are the subtitle formats served as UTF-8 text. .sub may
+// also be binary VobSub, which serveSubtitle recognizes and leaves alone.
+var textSubtitleExts = map[string]bool{".srt": true, ".ass": true, ".ssa": true, ".vtt": true, ".sub": true}
+
+var srtTiming = regexp.MustCompile(`^(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})\s*-->\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})`)
+var assAlign = regexp.MustCompile(`\{\\an([1-9])\}`)
+var assOverride = regexp.MustCompile(`\{\\[^}]*\}`)
+var fontTag = regexp.MustCompile(`(?i)</?font[^>]*>`)
+
+type vttEntry struct {
+	mtime time.Time
+	size  int64
+	data  []byte
+}
+
+// vttCache keeps converted subtitles keyed by path so that a player seeking
+// through a film does not trigger a conversion per request. It is simply
+// emptied when it outgrows vttCacheMax.
+var vttCache = struct {
+	sync.Mutex
+	entries map[string]vttEntry
+	bytes   int
+}{entries: map[string]vttEntry{}}
+
+// srtToVTT converts SubRip to WebVTT. Timestamps get a dot separator and
+// zero padding, {\anN} alignment tags become cue settings, and cues that do
+// not parse are skipped and reported through skipped.
+func srtToVTT(src []byte, skipped func(cue int, reason string)) []byte {
+	src = bytes.TrimPrefix(src, []byte("\xef\xbb\xbf"))
+	text := strings.ReplaceAll(strings.ReplaceAll(string(src), "\r\n", "\n"), "\r", "\n")
+	var out strings.Builder
+	out.WriteString("WEBVTT\n\n")
+	for i, block := range strings.Split(text, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		if len(lines) == 1 && strings.TrimSpace(lines[0]) == "" {
+			continue
+		}
+		if len(lines) > 0 && !strings.Contains(lines[0], "-->") {
+			lines = lines[1:]
+		}
+		if len(lines) == 0 {
+			skipped(i+1, "missing timing line")
+			continue
+		}
+		m := srtTiming.FindStringSubmatch(strings.TrimSpace(lines[0]))
+		if m == nil {
+			skipped(i+1, "bad timing line "+strconv.Quote(lines[0]))
+			continue
+		}
+		body := strings.Join(lines[1:], "\n")
+		settings := ""
+		if a := assAlign.FindStringSubmatch(body); a != nil {
+			n := a[1][0] - '0'
+			if n >= 7 {
+				settings += " line:0"
+			} else if n >= 4 {
+				settings += " line:50%"
+			}
+			switch n % 3 {
+			case 1:
+				settings += " align:start"
+			case 0:
+				settings += " align:end"
+			}
+		}
+		body = assOverride.ReplaceAllString(body, "")
+		body = fontTag.ReplaceAllString(body, "")
+		body = strings.ReplaceAll(body, "-->", "->")
+		fmt.Fprintf(&out, "%s --> %s%s\n%s\n\n", vttTime(m[1:5]), vttTime(m[5:9]), settings, body)
+	}
+	return []byte(out.String())
+}
+
+func vttTime(p []string) string {
+	h, _ := strconv.Atoi(p[0])
+	m, _ := strconv.Atoi(p[1])
+	s, _ := strconv.Atoi(p[2])
+	ms, _ := strconv.Atoi((p[3] + "00")[:3])
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", h, m, s, ms)
+}
+
+// requestCharset returns the source encoding forced with ?charset=, or ""
+// to detect it.
+func requestCharset(r *http.Request) (string, error) {
+	v := r.URL.Query().Get("charset")
+	if v == "" {
+		return "", nil
+	}
+	if cs := charsetName(v); cs != "" {
+		return cs, nil
+	}
+	return "", fmt.Errorf("unknown charset %q", v)
+}
+
+// subtitleText decodes subtitle bytes to UTF-8 using charset, or the
+// detected encoding when charset is empty.
+func subtitleText(src []byte, charset string) ([]byte, error) {
+	if charset == "" {
+		charset = detectCharset(src)
+	}
+	return decodeCharset(src, charset)
+}
+
+// serveSubtitle serves a text subtitle file as UTF-8. Files that already are
+// valid UTF-8 go out byte for byte; anything else is transcoded from the
+// detected or ?charset= encoding.
+func serveSubtitle(w http.ResponseWriter, r *http.Request, full string, fi os.FileInfo) {
+	charset, err := requestCharset(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if fi.Size() > maxSubtitleSize {
+		serveFileFast(w, r, full, fi)
+		return
+	}
+	src, err := os.ReadFile(full)
+	if err != nil {
+		http.Error(w, "cannot read subtitles", http.StatusInternalServerError)
+		return
+	}
+	typ := contentType(fi.Name())
+	if !strings.Contains(typ, "charset=") {
+		typ += "; charset=utf-8"
+	}
+	if charset == "" {
+		charset = detectCharset(src)
+		if charset == "utf-8" && utf8.Valid(src) {
+			w.Header().Set("Content-Type", typ)
+			serveFileFast(w, r, full, fi)
+			return
+		}
+		if !strings.HasPrefix(charset, "utf-16") && bytes.IndexByte(src, 0) >= 0 {
+			serveFileFast(w, r, full, fi)
+			return
+		}
+	}
+	etag := strings.TrimSuffix(fileETag(fi), `"`) + "-" + charset + `"`
+	w.Header().Set("ETag", etag)
+	if notModified(r, etag, fi.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, err := decodeCharset(src, charset)
+	if err != nil {
+		http.Error(w, "cannot decode subtitles", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", typ)
+	if r.URL.Query().Get("download") == "1" {
+		w.Header().Set("Content-Disposition", attachment(fi.Name()))
+	}
+	http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(data))
+}
+
+// convertedVTT returns the WebVTT rendition of the SRT file at full,
+// converting it only when the cached copy is stale. charset forces the
+// source encoding; empty detects it.
+func convertedVTT(full string, fi os.FileInfo, charset string) ([]byte, error) {
+	key := full + "\x00" + charset
+	vttCache.Lock()
+	e, ok := vttCache.entries[key]
+	vttCache.Unlock()
+	if ok && e.mtime.Equal(fi.ModTime()) && e.size == fi.Size() {
+		return e.data, nil
+	}
+	src, err := os.ReadFile(full)
+	if err != nil {
+		return nil, err
+	}
+	if !noTranscodeSubs {
+		if src, err = subtitleText(src, charset); err != nil {
+			return nil, err
+		}
+	}
+	data := srtToVTT(src, func(cue int, reason string) {
+		fmt.Fprintf(os.Stderr, "%s: skipping cue %d: %s\n", fi.Name(), cue, reason)
+	})
+	vttCache.Lock()
+	if vttCache.bytes+len(data) > vttCacheMax {
+		vttCache.entries, vttCache.bytes = map[string]vttEntry{}, 0
+	}
+	vttCache.bytes += len(data) - len(e.data)
+	vttCache.entries[key] = vttEntry{mtime: fi.ModTime(), size: fi.Size(), data: data}
+	vttCache.Unlock()
+	return data, nil
+}
+
+func serveVTT(w http.ResponseWriter, r *http.Request, full string, fi os.FileInfo) {
+	charset, err := requestCharset(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	etag := strings.TrimSuffix(fileETag(fi), `"`) + "-vtt"
+	if charset != "" {
+		etag += "-" + charset
+	}
+	etag += `"`
+	w.Header().Set("ETag", etag)
+	if notModified(r, etag, fi.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, err := convertedVTT(full, fi, charset)
+	if err != nil {
+		http.Error(w, "cannot read subtitles", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(data))
+}
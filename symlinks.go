@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// symlinkPolicy is -follow-symlinks: "off" treats links as missing, "root"
+// follows them while they resolve to somewhere under the share and "all"
+// follows them anywhere.
+type symlinkPolicy string
+
+func (p *symlinkPolicy) String() string { return string(*p) }
+
+func (p *symlinkPolicy) Set(v string) error {
+	switch v {
+	case "off", "root", "all":
+		*p = symlinkPolicy(v)
+		return nil
+	}
+	return fmt.Errorf("want off, root or all")
+}
+
+var followSymlinks = symlinkPolicy("root")
+
+// targetAllowed reports whether full, which resolves to real, may be
+// served under the symlink policy.
+func targetAllowed(full, real string) bool {
+	switch followSymlinks {
+	case "off":
+		return real == full
+	case "all":
+		return true
+	}
+	return insideRoot(real)
+}
+
+// targetVisible reports whether real, what a path resolves to, is not
+// hidden or excluded itself. Targets outside the share have no share path
+// to match against.
+func targetVisible(real string) bool {
+	return !insideRoot(real) || visible(relPath(real))
+}
+
+// followLink resolves the symlink p. It returns false when the policy
+// hides it, it dangles or it points at something hidden.
+func followLink(p string) (string, os.FileInfo, bool) {
+	if followSymlinks == "off" {
+		return "", nil, false
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil || !targetAllowed(p, real) || !targetVisible(real) {
+		return "", nil, false
+	}
+	fi, err := os.Stat(real)
+	if err != nil {
+		return "", nil, false
+	}
+	return real, fi, true
+}
+
+// readShareDir is os.ReadDir with the symlink policy applied: links are
+// replaced by what they point to, under their own name, and dropped when
+// they dangle or are not to be followed.
+func readShareDir(dir string) ([]fs.DirEntry, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Reached through a link, the entries are also matched where they
+	// really are.
+	realDir := realPath(dir)
+	out := des[:0]
+	for _, de := range des {
+		if realDir != dir && !targetVisible(filepath.Join(realDir, de.Name())) {
+			continue
+		}
+		if de.Type()&fs.ModeSymlink != 0 {
+			_, fi, ok := followLink(filepath.Join(dir, de.Name()))
+			if !ok {
+				continue
+			}
+			de = fs.FileInfoToDirEntry(renamedInfo{fi, de.Name()})
+		}
+		out = append(out, de)
+	}
+	return out, nil
+}
+
+// renamedInfo is a link target's FileInfo under the link's name.
+type renamedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i renamedInfo) Name() string { return i.name }
+
+// walkShare is filepath.WalkDir with the symlink policy applied. Followed
+// links to files are passed to fn as the file; links to directories are
+// descended into, with the paths fn sees kept under the link so that they
+// still map onto share paths. A link back to a directory already being
+// walked is skipped rather than looping.
+func walkShare(dir string, fn fs.WalkDirFunc) error {
+	start, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fn(dir, nil, err)
+	}
+	return walkFrom(dir, start, []string{start}, fn)
+}
+
+func walkFrom(dir, real string, open []string, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(real, func(p string, d fs.DirEntry, err error) error {
+		if dir != real && err == nil && !targetVisible(p) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		parent := filepath.Dir(p)
+		rel, _ := filepath.Rel(real, p)
+		p = filepath.Join(dir, rel)
+		if err != nil || d.Type()&fs.ModeSymlink == 0 {
+			return fn(p, d, err)
+		}
+		target, fi, ok := followLink(p)
+		if !ok {
+			return nil
+		}
+		d = fs.FileInfoToDirEntry(renamedInfo{fi, d.Name()})
+		if !fi.IsDir() {
+			return fn(p, d, nil)
+		}
+		for _, o := range append(open[:len(open):len(open)], parent) {
+			if rel, err := filepath.Rel(target, o); err == nil && (rel == "." || filepath.IsLocal(rel)) {
+				return nil
+			}
+		}
+		if err := fn(p, d, nil); err != nil {
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
+		}
+		err = walkFrom(p, target, append(open[:len(open):len(open)], target), func(q string, d fs.DirEntry, err error) error {
+			if q == p {
+				return nil
+			}
+			return fn(q, d, err)
+		})
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	})
+}
+
+// realDirs caches what directories resolve to, for realRel; access checks
+// ask for every file of a walk.
+var realDirs = struct {
+	sync.Mutex
+	m map[string]realDir
+}{m: map[string]realDir{}}
+
+type realDir struct {
+	real    string
+	checked time.Time
+}
+
+// realPath is filepath.EvalSymlinks for a directory, cached for
+// accessRecheck. A directory that cannot be resolved is returned as is.
+func realPath(dir string) string {
+	now := time.Now()
+	realDirs.Lock()
+	e, ok := realDirs.m[dir]
+	realDirs.Unlock()
+	if ok && now.Sub(e.checked) < accessRecheck {
+		return e.real
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		real = dir
+	}
+	realDirs.Lock()
+	realDirs.m[dir] = realDir{real: real, checked: now}
+	realDirs.Unlock()
+	return real
+}
+
+// realRel returns the root-relative path rel resolves to when reaching it
+// follows a symlink to elsewhere in the share, and "" when it does not.
+func realRel(rel string) string {
+	if followSymlinks == "off" || rel == "" || rel == "." {
+		return ""
+	}
+	full := filepath.Join(root, filepath.FromSlash(rel))
+	real := filepath.Join(realPath(filepath.Dir(full)), filepath.Base(full))
+	if fi, err := os.Lstat(real); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+		if real, err = filepath.EvalSymlinks(real); err != nil {
+			return ""
+		}
+	}
+	if real == full || !insideRoot(real) {
+		return ""
+	}
+	return relPath(real)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// setupLinks builds a share with a link escaping it, relative links that
+// stay inside and a dangling one.
+func setupLinks(t *testing.T) {
+	t.Helper()
+	outside, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.mkv"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := setupRoot(t, map[string]string{"Movies/film.mkv": "film"})
+	for link, target := range map[string]string{
+		"escape.mkv":       filepath.Join(outside, "secret.mkv"),
+		"escapedir":        outside,
+		"Movies/alias.mkv": "film.mkv",
+		"linkdir":          "Movies",
+		"dangling.mkv":     "missing.mkv",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func listNames(t *testing.T, dir string) []string {
+	t.Helper()
+	w := serve(indexHandler, http.MethodGet, dir+"?format=json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d", dir, w.Code)
+	}
+	var lst dirListing
+	if err := json.Unmarshal([]byte(body(t, w)), &lst); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range lst.Entries {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func archiveNames(t *testing.T, paths ...string) (int, []string) {
+	t.Helper()
+	form := url.Values{"path": paths}
+	r := httptest.NewRequest(http.MethodPost, "/api/archive", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	archiveHandler(w, r)
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, "/") {
+			names = append(names, f.Name)
+		}
+	}
+	slices.Sort(names)
+	return w.Code, names
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	tests := []struct {
+		policy  symlinkPolicy
+		top     []string
+		movies  []string
+		status  map[string]int
+		library []string
+		archive []string
+	}{
+		{
+			policy: "off",
+			top:    []string{"Movies"},
+			movies: []string{"film.mkv"},
+			status: map[string]int{
+				"/Movies/film.mkv": 200, "/Movies/alias.mkv": 404, "/linkdir/film.mkv": 404,
+				"/escape.mkv": 404, "/escapedir/secret.mkv": 404, "/dangling.mkv": 404,
+			},
+			library: []string{"Movies/film.mkv"},
+			archive: []string{"x/Movies/film.mkv"},
+		},
+		{
+			policy: "root",
+			top:    []string{"linkdir", "Movies"},
+			movies: []string{"alias.mkv", "film.mkv"},
+			status: map[string]int{
+				"/Movies/film.mkv": 200, "/Movies/alias.mkv": 200, "/linkdir/film.mkv": 200,
+				"/escape.mkv": 403, "/escapedir/secret.mkv": 403, "/dangling.mkv": 404,
+			},
+			library: []string{"Movies/alias.mkv", "Movies/film.mkv", "linkdir/alias.mkv", "linkdir/film.mkv"},
+			archive: []string{"x/Movies/alias.mkv", "x/Movies/film.mkv", "x/linkdir/alias.mkv", "x/linkdir/film.mkv"},
+		},
+		{
+			policy: "all",
+			top:    []string{"escapedir", "linkdir", "Movies", "escape.mkv"},
+			movies: []string{"alias.mkv", "film.mkv"},
+			status: map[string]int{
+				"/Movies/film.mkv": 200, "/Movies/alias.mkv": 200, "/linkdir/film.mkv": 200,
+				"/escape.mkv": 200, "/escapedir/secret.mkv": 200, "/dangling.mkv": 404,
+			},
+			library: []string{"Movies/alias.mkv", "Movies/film.mkv", "escape.mkv", "escapedir/secret.mkv", "linkdir/alias.mkv", "linkdir/film.mkv"},
+			archive: []string{"x/Movies/alias.mkv", "x/Movies/film.mkv", "x/escape.mkv", "x/escapedir/secret.mkv", "x/linkdir/alias.mkv", "x/linkdir/film.mkv"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			setupLinks(t)
+			followSymlinks = tt.policy
+			for i, n := range tt.archive {
+				tt.archive[i] = filepath.Base(root) + strings.TrimPrefix(n, "x")
+			}
+			if got := listNames(t, "/"); !slices.Equal(got, tt.top) {
+				t.Errorf("/ lists %q, want %q", got, tt.top)
+			}
+			if got := listNames(t, "/Movies/"); !slices.Equal(got, tt.movies) {
+				t.Errorf("/Movies/ lists %q, want %q", got, tt.movies)
+			}
+			for p, want := range tt.status {
+				if w := serve(indexHandler, http.MethodGet, p); w.Code != want {
+					t.Errorf("GET %s = %d, want %d", p, w.Code, want)
+				}
+			}
+			items, _ := library.get(false)
+			var got []string
+			for _, it := range items {
+				got = append(got, it.Path)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.library) {
+				t.Errorf("library has %q, want %q", got, tt.library)
+			}
+			if code, got := archiveNames(t, "/"); code != http.StatusOK || !slices.Equal(got, tt.archive) {
+				t.Errorf("archive of / = %d %q, want %q", code, got, tt.archive)
+			}
+		})
+	}
+}
+
+func TestArchiveRefusesHiddenLinks(t *testing.T) {
+	setupLinks(t)
+	for _, tt := range []struct {
+		policy symlinkPolicy
+		path   string
+		want   int
+	}{
+		{"root", "escape.mkv", http.StatusForbidden},
+		{"root", "escapedir", http.StatusForbidden},
+		{"root", "dangling.mkv", http.StatusNotFound},
+		{"off", "Movies/alias.mkv", http.StatusNotFound},
+		{"off", "linkdir", http.StatusNotFound},
+		{"all", "escape.mkv", http.StatusOK},
+	} {
+		followSymlinks = tt.policy
+		if code, _ := archiveNames(t, tt.path); code != tt.want {
+			t.Errorf("-follow-symlinks=%s: archive of %s = %d, want %d", tt.policy, tt.path, code, tt.want)
+		}
+	}
+}
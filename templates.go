@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"time"
+)
+
+//go:embed templates/listing.html
+var defaultListingHTML string
+
+var templatePath string
+
+var templateFuncs = template.FuncMap{
+	"human": human,
+	"date":  func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+	"icon":  kindIcon,
+	"age":   humanAge,
+	"days":  func() []int { return []int{1, 3, 7, 30} },
+}
+
+var kindIcons = map[string]string{
+	"dir":      "\U0001F4C1",
+	"video":    "\U0001F3AC",
+	"subtitle": "\U0001F4AC",
+	"image":    "\U0001F5BC",
+}
+
+func mustTemplate(name, src string) *template.Template {
+	return template.Must(template.New(name).Funcs(templateFuncs).Parse(src))
+}
+
+// humanAge renders a duration in seconds as its largest whole unit.
+func humanAge(s int64) string {
+	switch {
+	case s < 3600:
+		return fmt.Sprintf("%dm", s/60)
+	case s < 86400:
+		return fmt.Sprintf("%dh", s/3600)
+	}
+	return fmt.Sprintf("%dd", s/86400)
+}
+
+func kindIcon(kind string) string {
+	if icon, ok := kindIcons[kind]; ok {
+		return icon
+	}
+	return "\U0001F4C4"
+}
+
+var embeddedListing = mustTemplate("listing", defaultListingHTML)
+
+// listingTemplate is the template used for directory pages: the embedded
+// default or the one loaded from -template at startup.
+var listingTemplate = embeddedListing
+
+type sortLink struct {
+	Label string
+	URL   string
+	Mark  string
+}
+
+// listingPage is the data handed to the listing template. Its fields are
+// documented at the top of templates/listing.html.
+type listingPage struct {
+	Path           string
+	Breadcrumbs    []crumb
+	Parent         string
+	Filter         string
+	ClearFilterURL string
+	SortLinks      []sortLink
+	Entries        []dirEntry
+	Page           int
+	Pages          int
+	Total          int
+	PrevURL        string
+	NextURL        string
+	ShareURL       string
+	Continue       []continueItem
+	Favorites      []favoriteItem
+	PlaylistURL    string
+	ZipURL         string
+	CanDelete      bool
+	CanWrite       bool
+	User           string
+}
+
+// loadTemplates parses the -template override, if any. A broken template is
+// reported once here and the embedded default is used instead.
+func loadTemplates() {
+	if templatePath == "" {
+		return
+	}
+	b, err := os.ReadFile(templatePath)
+	if err == nil {
+		var t *template.Template
+		t, err = template.New("listing").Funcs(templateFuncs).Parse(string(b))
+		if err == nil {
+			listingTemplate = t
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, "warning: cannot use template, falling back to the built-in one:", err)
+}
+
+// renderTemplate executes t into a buffer so that a custom template failing
+// halfway through can still be replaced by the embedded one.
+func renderTemplate(w http.ResponseWriter, t, fallback *template.Template, data interface{}) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		fmt.Fprintln(os.Stderr, "template error:", err)
+		if t == fallback {
+			http.Error(w, "cannot render page", http.StatusInternalServerError)
+			return
+		}
+		buf.Reset()
+		if err := fallback.Execute(&buf, data); err != nil {
+			http.Error(w, "cannot render page", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
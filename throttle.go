@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var limitPerConn byteSize
+var limitTotal byteSize
+var limitUpload byteSize
+
+// globalBucket is shared by every throttled transfer when -limit-total is
+// set; it is nil otherwise.
+var globalBucket *sharedBucket
+
+type limiter interface {
+	wait(ctx context.Context, n int) error
+	chunk() int
+}
+
+// tokenBucket limits throughput to rate bytes per second. Its burst is kept
+// to a twentieth of a second of traffic so players see a steady stream
+// rather than one-second bursts.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	burst := float64(rate) / 20
+	if burst < 4096 {
+		burst = 4096
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// chunk is the largest write that should be made in one go against b.
+func (b *tokenBucket) chunk() int {
+	return int(b.burst)
+}
+
+// wait blocks until n bytes may be sent or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+		if b.tokens >= float64(n) {
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// sharedBucket is a token bucket drawn from by many transfers at once.
+// Callers queue on turn, and since blocked channel senders are woken in
+// FIFO order every transfer gets one chunk per round: a greedy client
+// re-queues behind everyone else instead of starving them.
+type sharedBucket struct {
+	*tokenBucket
+	turn   chan struct{}
+	mu     sync.Mutex
+	active int
+}
+
+func newSharedBucket(rate int64) *sharedBucket {
+	return &sharedBucket{tokenBucket: newTokenBucket(rate), turn: make(chan struct{}, 1)}
+}
+
+func (s *sharedBucket) wait(ctx context.Context, n int) error {
+	select {
+	case s.turn <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	err := s.tokenBucket.wait(ctx, n)
+	<-s.turn
+	return err
+}
+
+// join registers a transfer against the cap and returns the matching leave.
+func (s *sharedBucket) join(name string) func() {
+	s.mu.Lock()
+	s.active++
+	s.logActive(name, "started")
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		s.active--
+		s.logActive(name, "finished")
+		s.mu.Unlock()
+	}
+}
+
+func (s *sharedBucket) logActive(name, what string) {
+	fmt.Fprintf(os.Stdout, "limit-total: %s %s, %d active transfers sharing %s/s\n", name, what, s.active, human(int64(s.rate)))
+}
+
+// throttledWriter paces writes through one or more limiters. It deliberately
+// does not implement io.ReaderFrom, which forces copies through Write.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []limiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		for _, l := range t.limiters {
+			if c := l.chunk(); n > c {
+				n = c
+			}
+		}
+		for _, l := range t.limiters {
+			if err := l.wait(t.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := t.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// throttledBody paces reads of a request body the same way. Bytes are
+// paid for once they arrived, so a short read costs only what it returned.
+type throttledBody struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []limiter
+}
+
+func (t *throttledBody) Read(p []byte) (int, error) {
+	for _, l := range t.limiters {
+		if c := l.chunk(); len(p) > c {
+			p = p[:c]
+		}
+	}
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		for _, l := range t.limiters {
+			if werr := l.wait(t.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+// transferLimit returns the per-connection limit for r: -limit-per-conn,
+// lowered by a ?limit= override. A client can slow itself down but never
+// lift the configured cap. Zero means unlimited.
+func transferLimit(r *http.Request) (int64, error) {
+	return lowerLimit(r, int64(limitPerConn))
+}
+
+func lowerLimit(r *http.Request, limit int64) (int64, error) {
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := parseBytes(v)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 && (limit == 0 || n < limit) {
+			limit = n
+		}
+	}
+	return limit, nil
+}
+
+// limitersFor returns the limiters for a transfer at limit bytes per second
+// plus the global cap, and the func to call once the transfer is over.
+func limitersFor(limit int64, name string) ([]limiter, func()) {
+	var limiters []limiter
+	if limit > 0 {
+		limiters = append(limiters, newTokenBucket(limit))
+	}
+	done := func() {}
+	if globalBucket != nil {
+		limiters = append(limiters, globalBucket)
+		done = globalBucket.join(name)
+	}
+	return limiters, done
+}
+
+// throttle wraps w according to transferLimit and the global cap. The
+// returned func must be called once the transfer is over.
+func throttle(w http.ResponseWriter, r *http.Request, name string) (http.ResponseWriter, func(), error) {
+	limit, err := transferLimit(r)
+	if err != nil {
+		return w, func() {}, err
+	}
+	limiters, done := limitersFor(limit, name)
+	if len(limiters) == 0 {
+		return w, done, nil
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiters: limiters}, done, nil
+}
+
+// throttleUpload wraps r.Body according to -limit-upload, a ?limit=
+// override and the global cap. It returns the effective rate in bytes per
+// second, 0 for unlimited, and the func to call once the body is read.
+func throttleUpload(r *http.Request, name string) (int64, func(), error) {
+	limit, err := lowerLimit(r, int64(limitUpload))
+	if err != nil {
+		return 0, func() {}, err
+	}
+	limiters, done := limitersFor(limit, name)
+	if len(limiters) > 0 {
+		r.Body = &throttledBody{ReadCloser: r.Body, ctx: r.Context(), limiters: limiters}
+	}
+	return uploadRate(limit), done, nil
+}
+
+// uploadRate is the rate an upload limited to limit gets at most once the
+// global cap is taken into account.
+func uploadRate(limit int64) int64 {
+	if limitTotal > 0 && (limit == 0 || int64(limitTotal) < limit) {
+		return int64(limitTotal)
+	}
+	return limit
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultThumbWidth = 320
+const ffmpegWorkers = 2
+const ffmpegQueue = 256
+
+// thumbRetry is how long a file whose thumbnail could not be made is left
+// alone before another attempt.
+const thumbRetry = 10 * time.Minute
+
+// thumbPlaceholder is served with 202 while a thumbnail is being made.
+const thumbPlaceholder = `<svg xmlns="http://www.w3.org/2000/svg" width="16" height="9" viewBox="0 0 16 9"><rect width="16" height="9" fill="#333"/></svg>`
+
+type thumbJob struct {
+	full  string
+	fi    os.FileInfo
+	width int
+	dest  string
+}
+
+// ffmpegPool runs thumbnails and other still-image jobs on a small fixed
+// set of workers, so a folder full of episodes never runs more than
+// ffmpegWorkers ffmpegs.
+var ffmpegPool struct {
+	sync.Once
+	queue chan func()
+}
+
+// submitFFmpegJob queues job without blocking and reports whether there
+// was room for it.
+func submitFFmpegJob(job func()) bool {
+	ffmpegPool.Do(func() {
+		ffmpegPool.queue = make(chan func(), ffmpegQueue)
+		for i := 0; i < ffmpegWorkers; i++ {
+			go func() {
+				for job := range ffmpegPool.queue {
+					job()
+				}
+			}()
+		}
+	})
+	select {
+	case ffmpegPool.queue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+var thumbs = struct {
+	sync.Mutex
+	pending map[string]bool
+	failed  map[string]time.Time
+}{pending: map[string]bool{}, failed: map[string]time.Time{}}
+
+func thumbsEnabled() bool {
+	return ffmpegPath != ""
+}
+
+func thumbDir() string {
+	return generatedDir("thumbs")
+}
+
+// thumbFile names the cached JPEG for one size of one version of a file.
+func thumbFile(full string, fi os.FileInfo, width int) string {
+	h := sha1.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%d", full, fi.Size(), fi.ModTime().UnixNano(), width)))
+	return filepath.Join(thumbDir(), hex.EncodeToString(h[:])+".jpg")
+}
+
+// thumbURL is the listing's link to an entry's thumbnail.
+func thumbURL(rel string, width int) string {
+	return "/api/thumb?path=" + url.QueryEscape(rel) + "&w=" + strconv.Itoa(width)
+}
+
+// enqueueThumb schedules a thumbnail unless it is already queued. A full
+// queue drops the job; a later request for the image queues it again.
+func enqueueThumb(job thumbJob) {
+	thumbs.Lock()
+	defer thumbs.Unlock()
+	if thumbs.pending[job.dest] {
+		return
+	}
+	if submitFFmpegJob(func() { runThumb(job) }) {
+		thumbs.pending[job.dest] = true
+	}
+}
+
+func runThumb(job thumbJob) {
+	err := makeThumb(job)
+	thumbs.Lock()
+	delete(thumbs.pending, job.dest)
+	if err != nil {
+		thumbs.failed[job.dest] = time.Now()
+	}
+	thumbs.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "thumb: %s: %v\n", job.fi.Name(), err)
+	}
+}
+
+// thumbOffset picks a frame about 10% into the file, past opening logos.
+// Without a duration it guesses; makeThumb retries from the start if the
+// file turns out to be shorter.
+func thumbOffset(job thumbJob) float64 {
+	if ffprobePath != "" {
+		if info, err := probeMedia(job.full, job.fi); err == nil && info.DurationS > 0 {
+			return info.DurationS / 10
+		}
+	}
+	return 30
+}
+
+func makeThumb(job thumbJob) error {
+	if err := os.MkdirAll(filepath.Dir(job.dest), 0o755); err != nil {
+		return err
+	}
+	tmp := job.dest + ".tmp"
+	defer os.Remove(tmp)
+	var err error
+	for _, at := range []float64{thumbOffset(job), 0} {
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-loglevel", "error", "-nostdin",
+			"-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", job.full,
+			"-frames:v", "1", "-vf", fmt.Sprintf("scale=%d:-2", job.width), "-q:v", "4",
+			"-f", "image2", "-y", tmp)
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+		cancel()
+		if fi, serr := os.Stat(tmp); err == nil && serr == nil && fi.Size() > 0 {
+			return os.Rename(tmp, job.dest)
+		}
+		if err == nil {
+			err = fmt.Errorf("no frame at %.0fs", at)
+		} else if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+	}
+	return err
+}
+
+func thumbHandler(w http.ResponseWriter, r *http.Request) {
+	if !thumbsEnabled() {
+		jsonError(w, "thumbnails are disabled: start with -ffmpeg", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	width := defaultThumbWidth
+	if v := q.Get("w"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 32 || n > 1920 {
+			jsonError(w, "w must be between 32 and 1920", http.StatusBadRequest)
+			return
+		}
+		width = n
+	}
+	full, err := resolveFor(r, q.Get("path"))
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() || fileKind(fi.Name()) != "video" {
+		jsonError(w, "not a video", http.StatusNotFound)
+		return
+	}
+	dest := thumbFile(full, fi, width)
+	if f, err := os.Open(dest); err == nil {
+		defer f.Close()
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "public, max-age=604800")
+		w.Header().Set("ETag", `"`+strings.TrimSuffix(filepath.Base(dest), ".jpg")+`"`)
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+		return
+	}
+	thumbs.Lock()
+	failedAt, failed := thumbs.failed[dest]
+	thumbs.Unlock()
+	if failed && time.Since(failedAt) < thumbRetry {
+		jsonError(w, "no thumbnail", http.StatusNotFound)
+		return
+	}
+	enqueueThumb(thumbJob{full: full, fi: fi, width: width, dest: dest})
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "2")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(thumbPlaceholder))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+// readHeaderTimeout and idleTimeout bound clients that connect and send
+// nothing, or keep a connection open between requests; maxHeaderBytes
+// bounds the request header. stallTimeout is how long a single write to a
+// client may take before the transfer is given up on.
+var readHeaderTimeout time.Duration
+var idleTimeout time.Duration
+var stallTimeout time.Duration
+var maxHeaderBytes byteSize = 64 << 10
+
+// deadlineChunk is how much a sendfile call may send under one deadline.
+// At the default -stall-timeout a client has to take at least 17 KB/s,
+// well below what any video plays at.
+const deadlineChunk = 1 << 20
+
+// newServer is an http.Server with the timeouts in place. WriteTimeout
+// would cut off every movie longer than it, so it stays unset and
+// withWriteDeadline bounds each write instead.
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    int(maxHeaderBytes),
+	}
+}
+
+// deadlineWriter moves the connection's write deadline forward before each
+// write, so a client that stops reading is dropped after -stall-timeout
+// while one that keeps reading can stream for hours.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc    *http.ResponseController
+	armed time.Time
+}
+
+// arm pushes the deadline out; writes in quick succession, as templates
+// make, share one deadline rather than each paying for a timer update.
+func (d *deadlineWriter) arm(force bool) {
+	now := time.Now()
+	if !force && now.Sub(d.armed) < time.Second {
+		return
+	}
+	d.armed = now
+	d.rc.SetWriteDeadline(now.Add(stallTimeout))
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.arm(false)
+	return d.ResponseWriter.Write(p)
+}
+
+func (d *deadlineWriter) Flush() {
+	d.arm(false)
+	if f, ok := d.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ReadFrom keeps sendfile, but in deadlineChunk pieces with a fresh
+// deadline each: one call can otherwise send a whole movie.
+func (d *deadlineWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := d.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{d}, src)
+	}
+	d.arm(true)
+	return readFromChunks(rf, src, func(int64) { d.arm(true) })
+}
+
+// readFromChunks hands src to rf deadlineChunk bytes at a time, calling
+// sent after each chunk. net/http only finds a file for sendfile one
+// LimitedReader deep, as http.ServeContent passes a range, so that one is
+// unwrapped first.
+func readFromChunks(rf io.ReaderFrom, src io.Reader, sent func(n int64)) (int64, error) {
+	lr, ok := src.(*io.LimitedReader)
+	if !ok {
+		lr = &io.LimitedReader{R: src, N: math.MaxInt64}
+	}
+	var n int64
+	for lr.N > 0 {
+		want := min(lr.N, deadlineChunk)
+		m, err := rf.ReadFrom(&io.LimitedReader{R: lr.R, N: want})
+		n += m
+		lr.N -= m
+		sent(m)
+		if err != nil || m < want {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (d *deadlineWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
+
+// withWriteDeadline gives every response a rolling write deadline. After
+// the handler the deadline is pushed out once more for what net/http still
+// writes, and so that an idle keep-alive connection does not start its
+// next response already past it. WebSocket upgrades take over the
+// connection and clear the deadline themselves.
+func withWriteDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		d := &deadlineWriter{ResponseWriter: w, rc: http.NewResponseController(w)}
+		d.arm(true)
+		next.ServeHTTP(d, r)
+		d.arm(true)
+	})
+}
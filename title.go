@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var titleYear = regexp.MustCompile(`^[(\[]?((?:19|20)[0-9]{2})[)\]]?$`)
+
+// releaseTags start the technical tail of a release name; nothing after
+// the first of them belongs in a title.
+var releaseTags = regexp.MustCompile(`(?i)^(?:[0-9]{3,4}[pi]|4k|uhd|hdr10?\+?|dv|remux|bluray|blu-ray|bdrip|brrip|web-?dl|webrip|web|hdtv|dvdrip|hdrip|x26[45]|h\.?26[45]|hevc|avc|xvid|divx|aac|ac3|dts|truehd|atmos)$`)
+
+// cleanTitle turns a release file name into something to show a person:
+// "The.Thing.1982.2160p.REMUX.mkv" becomes "The Thing (1982)". Names it
+// cannot make sense of come back with just the extension dropped.
+func cleanTitle(name string) string {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	words := strings.Fields(strings.NewReplacer(".", " ", "_", " ").Replace(base))
+	end := len(words)
+	for i, w := range words {
+		if i > 0 && releaseTags.MatchString(w) {
+			end = i
+			break
+		}
+	}
+	words = words[:end]
+	// The last year-looking word is the release year, unless it is the
+	// whole title, as in "1917.2019.mkv".
+	for i := len(words) - 1; i > 0; i-- {
+		if m := titleYear.FindStringSubmatch(words[i]); m != nil {
+			words[i] = "(" + m[1] + ")"
+			break
+		}
+	}
+	if len(words) == 0 {
+		return base
+	}
+	return strings.Join(words, " ")
+}
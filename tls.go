@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certFile and keyFile switch the listener to HTTPS. httpRedirect is an
+// optional plain-HTTP address that sends every request on to it.
+var certFile, keyFile string
+var httpRedirect string
+
+// tlsSelfSigned serves HTTPS with a certificate the server makes itself.
+var tlsSelfSigned bool
+
+// scheme is what the server's own URLs start with.
+func scheme() string {
+	if tlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+func tlsEnabled() bool {
+	return certFile != "" || tlsSelfSigned || acmeEnabled()
+}
+
+func checkTLS() error {
+	if err := checkACME(); err != nil {
+		return err
+	}
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("-cert and -key go together")
+	}
+	if tlsSelfSigned && certFile != "" {
+		return fmt.Errorf("-tls-self-signed and -cert exclude each other")
+	}
+	if !tlsEnabled() {
+		if httpRedirect != "" {
+			return fmt.Errorf("-http-redirect needs -cert and -key or -tls-self-signed")
+		}
+		return checkMTLS()
+	}
+	if certFile != "" {
+		c, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("-cert/-key: %v", err)
+		}
+		fmt.Printf("TLS certificate SHA-256 fingerprint: %s\n", fingerprint(c.Certificate[0]))
+	}
+	if dlnaEnabled {
+		return fmt.Errorf("-dlna needs plain HTTP: TVs and renderers do not fetch media over HTTPS")
+	}
+	return checkMTLS()
+}
+
+// tlsConfig keeps to TLS 1.2 and later; Go's default cipher suites are
+// already limited to AEAD ones with forward secrecy.
+func tlsConfig() *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	requireClientCerts(cfg)
+	return cfg
+}
+
+// startHTTPRedirect answers plain HTTP on httpRedirect with a permanent
+// redirect to the same path on the TLS port. 308 keeps the method, so an
+// upload is not turned into a GET.
+func startHTTPRedirect(port int) {
+	if httpRedirect == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", httpRedirect)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "http-redirect:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Redirecting http://%s to https on port %d\n", ln.Addr(), port)
+	go newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := "https://" + net.JoinHostPort(host, strconv.Itoa(port)) + r.URL.RequestURI()
+		if port == 443 {
+			target = "https://" + host + r.URL.RequestURI()
+		}
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})).Serve(ln)
+}
+
+// fingerprint formats the SHA-256 of a DER certificate the way browsers
+// show it, for pinning.
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// selfSignedRenew is how long before expiry a self-signed certificate is
+// replaced, and selfSignedLifetime how long a new one is valid.
+const (
+	selfSignedRenew    = 30 * 24 * time.Hour
+	selfSignedLifetime = 365 * 24 * time.Hour
+)
+
+// selfSigned is the certificate -tls-self-signed serves. It is kept next
+// to -state so the fingerprint clients pinned survives restarts, and
+// replaced when it is about to expire or the machine's addresses changed.
+var selfSigned struct {
+	sync.Mutex
+	cert *tls.Certificate
+}
+
+func selfSignedFile() string {
+	if stateFile == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(stateFile), "fileserver-tls.pem")
+}
+
+// selfSignedNames are the SANs a certificate for this machine needs: its
+// host name, the mDNS name and every address it is shared on.
+func selfSignedNames(listenIP net.IP) ([]string, []net.IP) {
+	names := []string{"localhost"}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		names = append(names, h)
+	}
+	if !noMDNS {
+		names = append(names, mdnsHostLabel(mdnsName)+".local")
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1).To4(), net.IPv6loopback}
+	for _, ip := range shareIPs(listenIP) {
+		if !ip.IsLoopback() {
+			ips = append(ips, ip)
+		}
+	}
+	return names, ips
+}
+
+// certFits reports whether leaf still covers names and ips and is not
+// close to expiring.
+func certFits(leaf *x509.Certificate, names []string, ips []net.IP, now time.Time) bool {
+	if now.Add(selfSignedRenew).After(leaf.NotAfter) {
+		return false
+	}
+	key := func(ips []net.IP) []string {
+		out := make([]string, len(ips))
+		for i, ip := range ips {
+			out[i] = ip.String()
+		}
+		slices.Sort(out)
+		return out
+	}
+	return slices.Equal(key(leaf.IPAddresses), key(ips)) && slices.Equal(leaf.DNSNames, names)
+}
+
+func makeSelfSigned(names []string, ips []net.IP, now time.Time) ([]byte, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[len(names)-1], Organization: []string{"fileserver self-signed"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&b, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return b.Bytes(), nil
+}
+
+// loadSelfSigned returns the stored certificate if it still fits, or makes
+// and stores a new one. Without -state it lives in memory only.
+func loadSelfSigned(listenIP net.IP, now time.Time) (*tls.Certificate, bool, error) {
+	names, ips := selfSignedNames(listenIP)
+	name := selfSignedFile()
+	if name != "" {
+		if b, err := os.ReadFile(name); err == nil {
+			if c, err := tls.X509KeyPair(b, b); err == nil && certFits(c.Leaf, names, ips, now) {
+				return &c, false, nil
+			}
+		}
+	}
+	b, err := makeSelfSigned(names, ips, now)
+	if err != nil {
+		return nil, false, err
+	}
+	c, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return nil, false, err
+	}
+	if name != "" {
+		if err := writeBytesAtomic(name, b); err != nil {
+			fmt.Fprintln(os.Stderr, "cannot save self-signed certificate:", err)
+		}
+	}
+	return &c, true, nil
+}
+
+// startSelfSigned sets up the certificate and checks it again every hour,
+// so a server that runs for months renews it and follows a new DHCP lease.
+func startSelfSigned(cfg *tls.Config, listenIP net.IP) error {
+	c, _, err := loadSelfSigned(listenIP, time.Now())
+	if err != nil {
+		return fmt.Errorf("cannot create self-signed certificate: %v", err)
+	}
+	selfSigned.cert = c
+	note := ""
+	if selfSignedFile() == "" {
+		note = " (not saved without -state, it changes on every start)"
+	}
+	fmt.Printf("TLS self-signed certificate SHA-256 fingerprint: %s%s\n", fingerprint(c.Certificate[0]), note)
+	cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		selfSigned.Lock()
+		defer selfSigned.Unlock()
+		return selfSigned.cert, nil
+	}
+	go func() {
+		for now := range time.Tick(time.Hour) {
+			c, renewed, err := loadSelfSigned(listenIP, now)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "self-signed certificate:", err)
+				continue
+			}
+			if !renewed {
+				continue
+			}
+			selfSigned.Lock()
+			selfSigned.cert = c
+			selfSigned.Unlock()
+			fmt.Printf("TLS self-signed certificate renewed, SHA-256 fingerprint: %s\n", fingerprint(c.Certificate[0]))
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var maxTranscodes int
+
+// transcode is one running ffmpeg process, whichever endpoint started it.
+// The registry enforces -max-transcodes, reaps idle sessions and backs
+// /api/transcodes.
+type transcode struct {
+	id     string
+	kind   string
+	path   string
+	client string
+	// owner is who started it, from transcodeOwner; only they and write
+	// credentials may stop it.
+	owner   string
+	hwaccel string
+	start   float64
+	started time.Time
+	stop    func(reason string)
+
+	last  atomic.Int64
+	outUS atomic.Int64
+}
+
+type transcodeInfo struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Path     string    `json:"path"`
+	Client   string    `json:"client"`
+	HWAccel  string    `json:"hwaccel,omitempty"`
+	Started  time.Time `json:"started"`
+	ElapsedS float64   `json:"elapsed_s"`
+	StartS   float64   `json:"start_s"`
+	Position float64   `json:"position_s"`
+	IdleS    float64   `json:"idle_s"`
+}
+
+var transcodes = struct {
+	sync.Mutex
+	m map[string]*transcode
+}{m: map[string]*transcode{}}
+
+var transcodeReaper sync.Once
+
+// errTooManyTranscodes is returned by registerTranscode when -max-transcodes
+// processes are already running.
+var errTooManyTranscodes = fmt.Errorf("too many transcodes")
+
+func newTranscodeID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// registerTranscode reserves a slot for t before its ffmpeg is started.
+func registerTranscode(t *transcode) error {
+	transcodes.Lock()
+	defer transcodes.Unlock()
+	if maxTranscodes > 0 && len(transcodes.m) >= maxTranscodes {
+		return errTooManyTranscodes
+	}
+	t.touch()
+	transcodes.m[t.id] = t
+	transcodeReaper.Do(func() { go reapTranscodes() })
+	return nil
+}
+
+func unregisterTranscode(t *transcode) {
+	transcodes.Lock()
+	delete(transcodes.m, t.id)
+	transcodes.Unlock()
+}
+
+func (t *transcode) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+func (t *transcode) info(now time.Time) transcodeInfo {
+	return transcodeInfo{
+		ID:       t.id,
+		Kind:     t.kind,
+		Path:     relPath(t.path),
+		Client:   t.client,
+		HWAccel:  t.hwaccel,
+		Started:  t.started,
+		ElapsedS: now.Sub(t.started).Seconds(),
+		StartS:   t.start,
+		Position: t.start + float64(t.outUS.Load())/1e6,
+		IdleS:    now.Sub(time.Unix(0, t.last.Load())).Seconds(),
+	}
+}
+
+// reapTranscodes stops sessions whose client has fetched nothing for
+// -transcode-idle.
+func reapTranscodes() {
+	tick := transcodeIdle / 4
+	if tick < time.Second {
+		tick = time.Second
+	}
+	for range time.Tick(tick) {
+		cutoff := time.Now().Add(-transcodeIdle).UnixNano()
+		var idle []*transcode
+		transcodes.Lock()
+		for _, t := range transcodes.m {
+			if t.last.Load() < cutoff {
+				idle = append(idle, t)
+			}
+		}
+		transcodes.Unlock()
+		for _, t := range idle {
+			t.stop("idle")
+		}
+	}
+}
+
+func stopAllTranscodes(reason string) {
+	transcodes.Lock()
+	all := make([]*transcode, 0, len(transcodes.m))
+	for _, t := range transcodes.m {
+		all = append(all, t)
+	}
+	transcodes.Unlock()
+	for _, t := range all {
+		t.stop(reason)
+	}
+}
+
+// stopTranscodesOnSignal kills every ffmpeg and removes its temp files when
+// the server is interrupted, instead of leaving them running.
+func stopTranscodesOnSignal() {
+	onShutdown(func() { stopAllTranscodes("shutdown") })
+}
+
+// ffmpegProgress matches the key=value lines ffmpeg writes for -progress.
+var ffmpegProgress = regexp.MustCompile(`^[a-z0-9_]+=\S*$`)
+
+const ffmpegLogLines = 20
+
+// ffmpegLog is ffmpeg's stderr. Progress reports update the session's
+// output position; everything else is kept, up to ffmpegLogLines, for
+// error messages.
+type ffmpegLog struct {
+	t       *transcode
+	mu      sync.Mutex
+	partial []byte
+	lines   []string
+}
+
+func (l *ffmpegLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.partial = append(l.partial, p...)
+	for {
+		i := strings.IndexByte(string(l.partial), '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(l.partial[:i]))
+		l.partial = l.partial[i+1:]
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "out_time_us="):
+			if us, err := strconv.ParseInt(line[len("out_time_us="):], 10, 64); err == nil {
+				l.t.outUS.Store(us)
+			}
+		case ffmpegProgress.MatchString(line):
+		default:
+			if len(l.lines) == ffmpegLogLines {
+				l.lines = l.lines[1:]
+			}
+			l.lines = append(l.lines, line)
+		}
+	}
+	return len(p), nil
+}
+
+func (l *ffmpegLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.lines, "; ")
+}
+
+// ffmpegBaseArgs starts every ffmpeg command line: quiet apart from errors,
+// with machine-readable progress on stderr.
+func ffmpegBaseArgs() []string {
+	return []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-nostats", "-progress", "pipe:2", "-stats_period", "1"}
+}
+
+// writeTranscodeLimit is the 503 sent instead of starting another ffmpeg.
+func writeTranscodeLimit(w http.ResponseWriter) {
+	transcodes.Lock()
+	active := len(transcodes.m)
+	transcodes.Unlock()
+	w.Header().Set("Retry-After", "30")
+	writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+		"error":  fmt.Sprintf("transcode limit reached: %d of %d running, try again later or raise -max-transcodes", active, maxTranscodes),
+		"limit":  maxTranscodes,
+		"active": active,
+	})
+}
+
+// transcodeOwner names who r comes from: the signed-in user, token or
+// certificate, or on an open server the browser's client cookie. Addresses
+// are no use, as behind a proxy everyone has the same one. It is "" for a
+// client that cannot be told apart.
+func transcodeOwner(r *http.Request) string {
+	if info, _ := r.Context().Value(authInfoKey{}).(*authInfo); info != nil {
+		return "user:" + info.who
+	}
+	if c, err := r.Cookie(clientCookie); err == nil && clientName.MatchString(c.Value) {
+		return "client:" + c.Value
+	}
+	return ""
+}
+
+// canManageTranscode reports whether r may stop t: whoever started it can,
+// and so can write credentials, which administer the server.
+func canManageTranscode(r *http.Request, t *transcode) bool {
+	if info, _ := r.Context().Value(authInfoKey{}).(*authInfo); info != nil && info.write {
+		return true
+	}
+	owner := transcodeOwner(r)
+	return owner != "" && owner == t.owner
+}
+
+func transcodesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		now := time.Now()
+		transcodes.Lock()
+		list := make([]transcodeInfo, 0, len(transcodes.m))
+		for _, t := range transcodes.m {
+			list = append(list, t.info(now))
+		}
+		transcodes.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"limit": maxTranscodes, "count": len(list), "transcodes": list})
+	case http.MethodDelete:
+		transcodes.Lock()
+		t := transcodes.m[r.URL.Query().Get("id")]
+		transcodes.Unlock()
+		if t == nil {
+			jsonError(w, "no such transcode", http.StatusNotFound)
+			return
+		}
+		if !canManageTranscode(r, t) {
+			jsonError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		t.stop("stopped by " + clientHost(r))
+		writeJSON(w, http.StatusOK, map[string]string{"stopped": t.id})
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanManageTranscode(t *testing.T) {
+	as := func(info *authInfo, cookie string) *http.Request {
+		r := httptest.NewRequest(http.MethodDelete, "/api/transcodes?id=x", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: clientCookie, Value: cookie})
+		}
+		if info != nil {
+			r = r.WithContext(context.WithValue(r.Context(), authInfoKey{}, info))
+		}
+		return r
+	}
+	tc := &transcode{id: "x", client: "127.0.0.1", owner: transcodeOwner(as(alice, ""))}
+	open := &transcode{id: "y", client: "127.0.0.1", owner: transcodeOwner(as(nil, "aaaaaaaaaaaaaaaaaaaaaaaa"))}
+	anon := &transcode{id: "z", client: "127.0.0.1", owner: transcodeOwner(as(nil, ""))}
+	tests := []struct {
+		name string
+		r    *http.Request
+		t    *transcode
+		want bool
+	}{
+		{"owner", as(alice, ""), tc, true},
+		{"other user from the same address", as(bob, ""), tc, false},
+		{"write credentials", as(admin, ""), tc, true},
+		{"no credentials from loopback", as(nil, ""), tc, false},
+		{"same browser", as(nil, "aaaaaaaaaaaaaaaaaaaaaaaa"), open, true},
+		{"other browser behind the same proxy", as(nil, "bbbbbbbbbbbbbbbbbbbbbbbb"), open, false},
+		{"no cookie", as(nil, ""), open, false},
+		{"unknown owner", as(nil, ""), anon, false},
+	}
+	for _, tt := range tests {
+		if got := canManageTranscode(tt.r, tt.t); got != tt.want {
+			t.Errorf("%s: canManageTranscode = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTranscodeDeleteIsWrite(t *testing.T) {
+	for method, want := range map[string]bool{http.MethodGet: false, http.MethodHead: false, http.MethodDelete: true} {
+		if got := writeRequest(httptest.NewRequest(method, "/api/transcodes?id=x", nil)); got != want {
+			t.Errorf("%s /api/transcodes: writeRequest = %v, want %v", method, got, want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// bufSize is the size of every streaming copy buffer. It is fixed at startup
+// so the pool only ever holds buffers of one size.
+var bufSize byteSize = 1 << 20
+
+const minBufSize = 32 << 10
+const maxBufSize = 64 << 20
+
+var bufPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, int(bufSize))
+	return &b
+}}
+
+func checkBufSize() error {
+	if bufSize < minBufSize || bufSize > maxBufSize {
+		return fmt.Errorf("-bufsize must be between %s and %s", human(minBufSize), human(maxBufSize))
+	}
+	return nil
+}
+
+func getBuf() *[]byte { return bufPool.Get().(*[]byte) }
+
+func putBuf(b *[]byte) { bufPool.Put(b) }
+
+var maxTransfers int
+var transferWait time.Duration
+var smallFile byteSize = 8 << 20
+
+// transferSlots bounds concurrent large file transfers; nil means no limit.
+var transferSlots chan struct{}
+var inFlight atomic.Int64
+
+// acquireTransfer takes a transfer slot, waiting up to transferWait. It
+// returns ok=false when the server is saturated; otherwise release must be
+// called when the transfer ends.
+func acquireTransfer(r *http.Request, name string) (release func(), ok bool) {
+	if transferSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case transferSlots <- struct{}{}:
+	default:
+		if transferWait <= 0 {
+			return nil, false
+		}
+		t := time.NewTimer(transferWait)
+		defer t.Stop()
+		select {
+		case transferSlots <- struct{}{}:
+		case <-t.C:
+			return nil, false
+		case <-r.Context().Done():
+			return nil, false
+		}
+	}
+	fmt.Fprintf(os.Stdout, "transfers: %s started, %d/%d in flight\n", name, inFlight.Add(1), maxTransfers)
+	return func() {
+		<-transferSlots
+		fmt.Fprintf(os.Stdout, "transfers: %s finished, %d/%d in flight\n", name, inFlight.Add(-1), maxTransfers)
+	}, true
+}
+
+func writeBusy(w http.ResponseWriter) {
+	retry := int(transferWait.Seconds())
+	if retry < 5 {
+		retry = 5
+	}
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+	w.Header().Set("Retry-After", fmt.Sprint(retry))
+	http.Error(w, "too many transfers in progress, try again later", http.StatusServiceUnavailable)
+}
+
+// countingWriter records the status, the number of body bytes written
+// through it and the first write error, which http.ServeContent does not
+// pass on. It forwards ReadFrom so http.ServeContent can still use sendfile.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+	err    error
+}
+
+func (c *countingWriter) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *countingWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	c.fail(err)
+	return n, err
+}
+
+func (c *countingWriter) ReadFrom(r io.Reader) (int64, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if rf, ok := c.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(r)
+		c.n += n
+		c.fail(err)
+		return n, err
+	}
+	n, err := io.Copy(struct{ io.Writer }{c.ResponseWriter}, r)
+	c.n += n
+	c.fail(err)
+	return n, err
+}
+
+func (c *countingWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *countingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// copyFile streams f to w. On a plain connection it hands the file to the
+// ResponseWriter's ReadFrom so net/http can use sendfile; under TLS or when
+// w is a wrapper without ReadFrom (throttling) it falls back to a buffered
+// loop. Either way the returned count is the number of body bytes sent.
+func copyFile(w http.ResponseWriter, r *http.Request, f *os.File) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok && r.TLS == nil {
+		return rf.ReadFrom(f)
+	}
+	buf := getBuf()
+	defer putBuf(buf)
+	return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{f}, *buf)
+}
+
+func throughput(n int64, start time.Time) (float64, float64) {
+	elapsed := time.Since(start).Seconds()
+	if elapsed == 0 {
+		elapsed = 0.000001
+	}
+	return elapsed, float64(n) / (1024 * 1024) / elapsed
+}
+
+func logTransfer(name string, n int64, start time.Time, client string) {
+	elapsed, mbps := throughput(n, start)
+	fmt.Fprintf(os.Stdout, "%s transferred %s in %.2fs (%.2f MB/s) to %s\n", name, human(n), elapsed, mbps, client)
+}
+
+func logRangeTransfer(name, rng string, n int64, start time.Time, client string) {
+	elapsed, mbps := throughput(n, start)
+	fmt.Fprintf(os.Stdout, "%s range %s transferred %s in %.2fs (%.2f MB/s) to %s\n", name, rng, human(n), elapsed, mbps, client)
+}
+
+func logPartialTransfer(name string, n, total int64, start time.Time, client, reason string) {
+	elapsed, _ := throughput(n, start)
+	fmt.Fprintf(os.Stdout, "%s interrupted after %s of %s in %.2fs to %s: %s\n", name, human(n), human(total), elapsed, client, reason)
+}
+
+// failureReason tells a client that went away apart from a genuine I/O
+// problem on our side, so disconnects are not mistaken for disk trouble.
+func failureReason(r *http.Request, err error) string {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return "client stopped reading for " + stallTimeout.String()
+	}
+	if r.Context().Err() != nil || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed) {
+		return "client closed connection"
+	}
+	if err == nil {
+		return "incomplete"
+	}
+	return "I/O error: " + err.Error()
+}
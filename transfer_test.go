@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchFile makes a sparse file of size bytes; reading it costs no disk
+// time, so the copy itself is what is measured.
+func benchFile(b *testing.B, size int64) string {
+	p := filepath.Join(setupRoot(b, nil), "movie.mkv")
+	f, err := os.Create(p)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		b.Fatal(err)
+	}
+	return p
+}
+
+// BenchmarkCopyFile sends a 2 GB file over loopback through copyFile, once
+// with the ResponseWriter's ReadFrom (sendfile) and once with it hidden, as
+// a throttle or TLS hides it. cpu-ns/op is the CPU time of the whole test
+// process, the client reading the response included, which costs the same
+// in both.
+func BenchmarkCopyFile(b *testing.B) {
+	const size = 2 << 30
+	p := benchFile(b, size)
+	for _, bc := range []struct {
+		name string
+		wrap func(http.ResponseWriter) http.ResponseWriter
+	}{
+		{"sendfile", func(w http.ResponseWriter) http.ResponseWriter { return w }},
+		{"buffered", func(w http.ResponseWriter) http.ResponseWriter { return struct{ http.ResponseWriter }{w} }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				f, err := os.Open(p)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				defer f.Close()
+				copyFile(bc.wrap(w), r, f)
+			}))
+			defer srv.Close()
+			b.SetBytes(size)
+			cpu0, cpuOK := cpuTime()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res, err := http.Get(srv.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+				if err != nil || n != size {
+					b.Fatalf("read %d bytes: %v", n, err)
+				}
+			}
+			b.StopTimer()
+			if cpu1, ok := cpuTime(); ok && cpuOK {
+				b.ReportMetric(float64(cpu1-cpu0)/float64(b.N), "cpu-ns/op")
+			}
+		})
+	}
+}
+
+// discardWriter is a ResponseWriter that throws the body away and has no
+// ReadFrom, so copyFile takes its buffered loop.
+type discardWriter struct{ h http.Header }
+
+func (d *discardWriter) Header() http.Header         { return d.h }
+func (d *discardWriter) WriteHeader(int)             {}
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// BenchmarkCopyBuffers copies 256 KB, as for one of a player's range
+// requests, with a buffer from bufPool and with a fresh one each time as
+// before the pool. B/op shows what the pool saves.
+func BenchmarkCopyBuffers(b *testing.B) {
+	p := benchFile(b, 256<<10)
+	r := httptest.NewRequest(http.MethodGet, "/movie.mkv", nil)
+	w := &discardWriter{h: http.Header{}}
+	for _, bc := range []struct {
+		name string
+		copy func(f *os.File) (int64, error)
+	}{
+		{"pooled", func(f *os.File) (int64, error) { return copyFile(w, r, f) }},
+		{"fresh", func(f *os.File) (int64, error) {
+			buf := make([]byte, int(bufSize))
+			return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{f}, buf)
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			f, err := os.Open(p)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.Close()
+			b.SetBytes(256 << 10)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := bc.copy(f); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
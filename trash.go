@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// allowDelete routes DELETE /files/ and the trash API. Deleted files are
+// moved to trashDir rather than removed.
+var allowDelete bool
+
+// trashDir sits at the top of the share. Being a dotfile it is never listed
+// or served.
+const trashDir = ".trash"
+
+// trashIndexName records where each trashed item came from; without it a
+// timestamped name could not be traced back.
+const trashIndexName = ".index.json"
+
+type trashItem struct {
+	Path    string    `json:"path"`
+	Trash   string    `json:"trash"`
+	Deleted time.Time `json:"deleted"`
+	Client  string    `json:"client"`
+	Size    int64     `json:"size"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+// trashMu serialises moves in and out of the trash along with the index.
+var trashMu sync.Mutex
+
+func trashIndexFile() string {
+	return filepath.Join(root, trashDir, trashIndexName)
+}
+
+// loadTrashIndex reads the index, keyed by trash path. Items whose file has
+// been removed from the trash by hand are dropped.
+func loadTrashIndex() map[string]trashItem {
+	idx := map[string]trashItem{}
+	if b, err := os.ReadFile(trashIndexFile()); err == nil {
+		json.Unmarshal(b, &idx)
+	}
+	for p := range idx {
+		if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(p))); err != nil {
+			delete(idx, p)
+		}
+	}
+	return idx
+}
+
+// trashName picks a free name for rel inside the trash, adding the time of
+// deletion before the extension when the plain name is taken.
+func trashName(rel string, now time.Time) string {
+	name := path.Join(trashDir, rel)
+	if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+		return name
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext) + "." + now.Format("20060102-150405")
+	name = base + ext
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+// removeEmptyDirs deletes the directories left empty between dir and the
+// trash root after an item moved out.
+func removeEmptyDirs(dir string) {
+	top := filepath.Join(root, trashDir)
+	for dir != top && strings.HasPrefix(dir, top) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func itemSize(full string, fi os.FileInfo) int64 {
+	if !fi.IsDir() {
+		return fi.Size()
+	}
+	var n int64
+	filepath.Walk(full, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			n += fi.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// deleteFile serves DELETE /files/<path>, moving the target into the trash
+// under the same relative path.
+func deleteFile(w http.ResponseWriter, r *http.Request, upath string) {
+	rel := strings.TrimPrefix(path.Clean("/"+upath), "/")
+	if rel == "" {
+		jsonError(w, "cannot delete the share root", http.StatusForbidden)
+		return
+	}
+	full, err := resolveFor(r, upath)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	fi, err := os.Lstat(full)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	if fi.IsDir() && r.URL.Query().Get("recursive") != "1" {
+		jsonError(w, "path is a directory (add ?recursive=1 to delete it)", http.StatusConflict)
+		return
+	}
+	trashMu.Lock()
+	defer trashMu.Unlock()
+	now := time.Now()
+	name := trashName(rel, now)
+	dst := filepath.Join(root, filepath.FromSlash(name))
+	item := trashItem{Path: rel, Trash: name, Deleted: now, Client: clientHost(r), Size: itemSize(full, fi), IsDir: fi.IsDir()}
+	err = os.MkdirAll(filepath.Dir(dst), 0o755)
+	if err == nil {
+		err = os.Rename(full, dst)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "delete %s by %s failed: %v\n", rel, r.RemoteAddr, err)
+		jsonError(w, "cannot move to trash", http.StatusInternalServerError)
+		return
+	}
+	idx := loadTrashIndex()
+	idx[name] = item
+	if err := writeFileAtomic(trashIndexFile(), idx); err != nil {
+		fmt.Fprintln(os.Stderr, "cannot save trash index:", err)
+	}
+	library.invalidate()
+	fmt.Fprintf(os.Stdout, "delete %s by %s, moved to %s\n", rel, r.RemoteAddr, name)
+	writeJSON(w, http.StatusOK, item)
+}
+
+// trashHandler serves /api/trash, the trashed items newest first.
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	trashMu.Lock()
+	idx := loadTrashIndex()
+	trashMu.Unlock()
+	items := make([]trashItem, 0, len(idx))
+	for _, it := range idx {
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+// trashRestoreHandler serves POST /api/trash/restore {path}. The path is an
+// item's trash path, or its original path for the latest deletion of it.
+func trashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.Path == "" {
+		jsonError(w, "body must be JSON {path}", http.StatusBadRequest)
+		return
+	}
+	p := strings.TrimPrefix(path.Clean("/"+req.Path), "/")
+	trashMu.Lock()
+	defer trashMu.Unlock()
+	idx := loadTrashIndex()
+	item, ok := idx[p]
+	if !ok {
+		for _, it := range idx {
+			if it.Path == p && (!ok || it.Deleted.After(item.Deleted)) {
+				item, ok = it, true
+			}
+		}
+	}
+	if !ok {
+		jsonError(w, "not in trash", http.StatusNotFound)
+		return
+	}
+	// The directory it was in may have been deleted since.
+	if err := mkdirInRoot(r, filepath.Join(root, filepath.FromSlash(path.Dir(item.Path)))); err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	full, rel, err := resolveNewPath(r, item.Path)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	if _, err := os.Lstat(full); err == nil {
+		jsonError(w, "a file already exists at "+rel, http.StatusConflict)
+		return
+	}
+	src := filepath.Join(root, filepath.FromSlash(item.Trash))
+	if err := os.Rename(src, full); err != nil {
+		fmt.Fprintf(os.Stdout, "restore %s by %s failed: %v\n", rel, r.RemoteAddr, err)
+		if errors.Is(err, os.ErrNotExist) {
+			jsonError(w, "not in trash", http.StatusNotFound)
+		} else {
+			jsonError(w, "cannot restore", http.StatusInternalServerError)
+		}
+		return
+	}
+	removeEmptyDirs(filepath.Dir(src))
+	delete(idx, item.Trash)
+	if err := writeFileAtomic(trashIndexFile(), idx); err != nil {
+		fmt.Fprintln(os.Stderr, "cannot save trash index:", err)
+	}
+	library.invalidate()
+	fmt.Fprintf(os.Stdout, "restore %s by %s, from %s\n", rel, r.RemoteAddr, item.Trash)
+	writeJSON(w, http.StatusOK, item)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const trickWidth = 160
+const trickColumns = 10
+
+// trickMaxFrames caps the sprite sheet; long files get a wider interval
+// instead of a bigger image.
+const trickMaxFrames = 200
+const trickMinInterval = 10
+
+const trickTimeout = 30 * time.Minute
+
+type trickStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Sprite string `json:"sprite,omitempty"`
+	VTT    string `json:"vtt,omitempty"`
+}
+
+// trickJobs tracks generation in progress or failed by output directory.
+// Finished sheets are found on disk, so they survive restarts.
+var trickJobs = struct {
+	sync.Mutex
+	m map[string]*trickStatus
+}{m: map[string]*trickStatus{}}
+
+func trickplayEnabled() bool {
+	return ffmpegPath != "" && ffprobePath != ""
+}
+
+// generatedDir is where generated files of one kind are kept: under
+// -cache-dir when set, otherwise in the system temp dir.
+func generatedDir(kind string) string {
+	if cacheDir != "" {
+		return filepath.Join(cacheDir, kind)
+	}
+	return filepath.Join(os.TempDir(), "fileserver-"+kind)
+}
+
+// trickDir is the output directory for one version of a file.
+func trickDir(full string, fi os.FileInfo) string {
+	h := sha1.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d", full, fi.Size(), fi.ModTime().UnixNano())))
+	return filepath.Join(generatedDir("trickplay"), hex.EncodeToString(h[:]))
+}
+
+func trickReady(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "thumbs.vtt"))
+	return err == nil
+}
+
+func trickBaseURL(upath string) string {
+	return "/api/trickplay" + escapePath(upath)
+}
+
+func vttTimestamp(s float64) string {
+	ms := int64(math.Round(s * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// makeTrickplay renders one frame per interval into a single JPEG grid and
+// writes a WebVTT file pointing each time range at its tile.
+func makeTrickplay(full string, fi os.FileInfo, dir string) error {
+	info, err := probeMedia(full, fi)
+	if err != nil {
+		return err
+	}
+	if info.DurationS <= 0 || info.Video == nil || info.Video.Width == 0 {
+		return fmt.Errorf("no video duration or size")
+	}
+	interval := math.Max(trickMinInterval, math.Ceil(info.DurationS/trickMaxFrames))
+	frames := int(math.Ceil(info.DurationS / interval))
+	rows := (frames + trickColumns - 1) / trickColumns
+	height := int(math.Round(float64(trickWidth)*float64(info.Video.Height)/float64(info.Video.Width)/2)) * 2
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "sprite.jpg.tmp")
+	defer os.Remove(tmp)
+	ctx, cancel := context.WithTimeout(context.Background(), trickTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-loglevel", "error", "-nostdin",
+		"-skip_frame", "nokey", "-i", full, "-an", "-sn",
+		"-vf", fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d", interval, trickWidth, height, trickColumns, rows),
+		"-frames:v", "1", "-q:v", "5", "-f", "image2", "-y", tmp)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "sprite.jpg")); err != nil {
+		return err
+	}
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n\n")
+	for i := 0; i < frames; i++ {
+		start := float64(i) * interval
+		end := math.Min(start+interval, info.DurationS)
+		fmt.Fprintf(&vtt, "%s --> %s\nsprite.jpg#xywh=%d,%d,%d,%d\n\n", vttTimestamp(start), vttTimestamp(end),
+			i%trickColumns*trickWidth, i/trickColumns*height, trickWidth, height)
+	}
+	return os.WriteFile(filepath.Join(dir, "thumbs.vtt"), []byte(vtt.String()), 0o644)
+}
+
+// trickplayState reports on a file's sprite sheet, queueing generation
+// first when start is set.
+func trickplayState(full, upath string, fi os.FileInfo, start bool) trickStatus {
+	dir := trickDir(full, fi)
+	if trickReady(dir) {
+		base := trickBaseURL(upath)
+		return trickStatus{Status: "ready", Sprite: base + "/sprite.jpg", VTT: base + "/thumbs.vtt"}
+	}
+	trickJobs.Lock()
+	defer trickJobs.Unlock()
+	st := trickJobs.m[dir]
+	if !start || (st != nil && st.Status != "failed") {
+		if st == nil {
+			return trickStatus{Status: "none"}
+		}
+		return *st
+	}
+	st = &trickStatus{Status: "queued"}
+	ok := submitFFmpegJob(func() {
+		trickJobs.Lock()
+		st.Status = "running"
+		trickJobs.Unlock()
+		err := makeTrickplay(full, fi, dir)
+		trickJobs.Lock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "trickplay: %s: %v\n", fi.Name(), err)
+			st.Status, st.Error = "failed", err.Error()
+		} else {
+			delete(trickJobs.m, dir)
+		}
+		trickJobs.Unlock()
+	})
+	if !ok {
+		return trickStatus{Status: "failed", Error: "job queue is full, try again later"}
+	}
+	trickJobs.m[dir] = st
+	return *st
+}
+
+// trickplayHandler serves GET /api/trickplay?path= (status) and POST
+// (start generation).
+func trickplayHandler(w http.ResponseWriter, r *http.Request) {
+	if !trickplayEnabled() {
+		jsonError(w, "trickplay is disabled: needs -ffmpeg and ffprobe", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	upath := path.Clean("/" + r.URL.Query().Get("path"))
+	full, err := resolveFor(r, upath)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() || fileKind(fi.Name()) != "video" {
+		jsonError(w, "not a video", http.StatusNotFound)
+		return
+	}
+	st := trickplayState(full, upath, fi, r.Method == http.MethodPost)
+	code := http.StatusOK
+	if r.Method == http.MethodPost && st.Status == "queued" {
+		code = http.StatusAccepted
+	}
+	writeJSON(w, code, st)
+}
+
+// trickplayFileHandler serves /api/trickplay/<path>/sprite.jpg and
+// /api/trickplay/<path>/thumbs.vtt once generated.
+func trickplayFileHandler(w http.ResponseWriter, r *http.Request) {
+	if !trickplayEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	upath, err := decodePath(strings.TrimPrefix(r.URL.EscapedPath(), "/api/trickplay"))
+	if err != nil {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+	name := path.Base(upath)
+	if name != "sprite.jpg" && name != "thumbs.vtt" {
+		http.NotFound(w, r)
+		return
+	}
+	full, err := resolveFor(r, path.Dir(upath))
+	if err != nil {
+		writePathError(w, false, err)
+		return
+	}
+	fi, err := os.Stat(full)
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	dir := trickDir(full, fi)
+	if !trickReady(dir) {
+		http.Error(w, "not generated, POST /api/trickplay?path= first", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	if name == "thumbs.vtt" {
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "image/jpeg")
+	}
+	w.Header().Set("Cache-Control", "public, max-age=604800")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
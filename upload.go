@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// allowUpload routes /upload and PUT /files/; without it the share is
+// read-only.
+var allowUpload bool
+
+// maxUploadSize bounds one upload request; 0 means no limit.
+var maxUploadSize byteSize
+
+// tempMaxAge is how old a temporary upload file has to be before the sweep
+// removes it; 0 keeps them.
+var tempMaxAge time.Duration
+
+var errExists = errors.New("already exists")
+var errIsDir = errors.New("is a directory")
+
+// uploadResult describes a stored file. Limit is the rate the upload was
+// held to in bytes per second, 0 when it was not limited.
+type uploadResult struct {
+	Path  string `json:"path"`
+	URL   string `json:"url"`
+	Size  int64  `json:"size"`
+	Limit int64  `json:"limit"`
+}
+
+// resolveNewPath is resolvePath for something r is about to write: the
+// parent directory has to exist inside the root and be open to r, the name
+// has to be one the share would show, and an existing target must not be a
+// symlink -follow-symlinks does not follow.
+func resolveNewPath(r *http.Request, upath string) (string, string, error) {
+	rel := strings.TrimPrefix(path.Clean("/"+upath), "/")
+	if rel == "" || !visible(rel) {
+		return "", "", errForbidden
+	}
+	parent, err := resolveFor(r, "/"+path.Dir(rel))
+	if err != nil {
+		return "", "", err
+	}
+	if fi, err := os.Stat(parent); err != nil || !fi.IsDir() {
+		return "", "", os.ErrNotExist
+	}
+	full := filepath.Join(parent, path.Base(rel))
+	if real, err := filepath.EvalSymlinks(full); err == nil && !targetAllowed(full, real) {
+		return "", "", errForbidden
+	}
+	return full, rel, nil
+}
+
+// mkdirInRoot creates dir and any missing parents for r, refusing when the
+// part that already exists leads through a symlink that is not followed or
+// is closed to r by .access.
+func mkdirInRoot(r *http.Request, dir string) error {
+	existing := dir
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	if real, err := filepath.EvalSymlinks(existing); err != nil || !targetAllowed(existing, real) {
+		return errForbidden
+	}
+	if _, err := resolveFor(r, "/"+relPath(existing)); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0o755)
+}
+
+// storeUpload writes body next to full under a hidden temporary name and
+// moves it into place once complete, so a broken upload never leaves a
+// partial file behind. Without overwrite an existing target is an error.
+// The data is hashed on its way to disk and only placed when it matches
+// want.
+func storeUpload(full string, body io.Reader, overwrite bool, want map[string]string) (int64, error) {
+	if fi, err := os.Lstat(full); err == nil {
+		if fi.IsDir() {
+			return 0, errIsDir
+		}
+		if !overwrite {
+			return 0, errExists
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(full), ".upload-*.part")
+	if err != nil {
+		return 0, err
+	}
+	hs := uploadHashes(want)
+	bp := getBuf()
+	n, err := io.CopyBuffer(io.MultiWriter(tmp, hashWriter(hs)), body, *bp)
+	putBuf(bp)
+	got := sumHashes(hs)
+	if err == nil {
+		err = verifyChecksums(want, got)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		// CreateTemp makes the file private; uploads are for sharing.
+		err = tmp.Chmod(0o644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = placeFile(tmp.Name(), full, overwrite)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return n, err
+	}
+	rememberChecksums(full, got)
+	library.invalidate()
+	return n, nil
+}
+
+// sweepTemps removes temporary files that interrupted uploads and moves
+// left behind, once they are older than tempMaxAge. Parts of resumable
+// uploads that are still open are left to -upload-ttl.
+func sweepTemps(now time.Time) int {
+	live := map[string]bool{}
+	state.Lock()
+	for _, u := range state.data.Uploads {
+		live[u.Part] = true
+	}
+	state.Unlock()
+	n := 0
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && p == filepath.Join(root, trashDir) {
+			return filepath.SkipDir
+		}
+		if !tempName(d.Name()) || live[p] {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil && now.Sub(fi.ModTime()) > tempMaxAge {
+			if os.RemoveAll(p) == nil {
+				n++
+			}
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return n
+}
+
+// startTempSweep sweeps at startup and then every hour.
+func startTempSweep() {
+	if tempMaxAge <= 0 {
+		return
+	}
+	sweep := func(now time.Time) {
+		if n := sweepTemps(now); n > 0 {
+			fmt.Fprintf(os.Stdout, "removed %d stale temporary upload file(s)\n", n)
+		}
+	}
+	go func() {
+		sweep(time.Now())
+		for now := range time.Tick(time.Hour) {
+			sweep(now)
+		}
+	}()
+}
+
+// placeFile renames tmp to full. Without overwrite it links instead, which
+// fails rather than replacing a file that appeared meanwhile; filesystems
+// without hard links, such as FAT on USB disks, fall back to a check and a
+// rename.
+func placeFile(tmp, full string, overwrite bool) error {
+	if overwrite {
+		return os.Rename(tmp, full)
+	}
+	err := os.Link(tmp, full)
+	if errors.Is(err, os.ErrExist) {
+		return errExists
+	}
+	if err == nil {
+		return os.Remove(tmp)
+	}
+	if _, err := os.Lstat(full); err == nil {
+		return errExists
+	}
+	return os.Rename(tmp, full)
+}
+
+// uploadBody applies -max-upload-size to r. It returns nil when it has
+// already answered 413.
+func uploadBody(w http.ResponseWriter, r *http.Request) io.Reader {
+	if maxUploadSize <= 0 {
+		return r.Body
+	}
+	if r.ContentLength > int64(maxUploadSize) {
+		jsonError(w, fmt.Sprintf("upload larger than -max-upload-size (%s)", human(int64(maxUploadSize))), http.StatusRequestEntityTooLarge)
+		return nil
+	}
+	return http.MaxBytesReader(w, r.Body, int64(maxUploadSize))
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	var tooBig *http.MaxBytesError
+	var mismatch *checksumMismatch
+	switch {
+	case errors.As(err, &mismatch):
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error(), "algo": mismatch.algo, "expected": mismatch.expected, "actual": mismatch.actual})
+	case errors.As(err, &tooBig):
+		jsonError(w, fmt.Sprintf("upload larger than -max-upload-size (%s)", human(int64(maxUploadSize))), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errExists):
+		jsonError(w, "file exists (add ?overwrite=1 to replace it)", http.StatusConflict)
+	case errors.Is(err, errIsDir):
+		jsonError(w, "path is a directory", http.StatusConflict)
+	default:
+		jsonError(w, "upload failed", http.StatusInternalServerError)
+	}
+}
+
+func logUpload(rel string, n int64, start time.Time, r *http.Request, err error) {
+	elapsed, mbps := throughput(n, start)
+	if errors.Is(err, errExists) || errors.Is(err, errIsDir) {
+		return
+	}
+	var mismatch *checksumMismatch
+	if errors.As(err, &mismatch) {
+		fmt.Fprintf(os.Stdout, "upload %s from %s rejected: %s is %s, expected %s\n", rel, r.RemoteAddr, mismatch.algo, mismatch.actual, mismatch.expected)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "upload %s from %s failed after %s: %s\n", rel, r.RemoteAddr, human(n), failureReason(r, err))
+		return
+	}
+	fmt.Fprintf(os.Stdout, "upload %s received %s in %.2fs (%.2f MB/s) from %s\n", rel, human(n), elapsed, mbps, r.RemoteAddr)
+}
+
+// uploadHandler serves POST /upload?dir=relative/path with a multipart
+// body; every file part is stored in that directory under its own name.
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dir := strings.TrimPrefix(path.Clean("/"+r.URL.Query().Get("dir")), "/")
+	limit, done, err := throttleUpload(r, "upload to /"+dir)
+	if err != nil {
+		jsonError(w, "bad limit", http.StatusBadRequest)
+		return
+	}
+	defer done()
+	body := uploadBody(w, r)
+	if body == nil {
+		return
+	}
+	r.Body = io.NopCloser(body)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		jsonError(w, "body must be multipart/form-data", http.StatusBadRequest)
+		return
+	}
+	overwrite := r.URL.Query().Get("overwrite") == "1"
+	files := []uploadResult{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		name := part.FileName()
+		if name == "" {
+			continue
+		}
+		// Browsers send a bare name; a path from anything else is cut to
+		// its last element.
+		name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+		if name == "." || name == ".." || name == "/" {
+			jsonError(w, "bad file name", http.StatusBadRequest)
+			return
+		}
+		full, rel, err := resolveNewPath(r, path.Join("/", dir, name))
+		if err != nil {
+			writePathError(w, true, err)
+			return
+		}
+		want, err := wantedChecksums(http.Header(part.Header))
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		start := time.Now()
+		n, err := storeUpload(full, part, overwrite, want)
+		logUpload(rel, n, start, r, err)
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		files = append(files, uploadResult{Path: rel, URL: escapePath("/" + rel), Size: n, Limit: limit})
+	}
+	if len(files) == 0 {
+		jsonError(w, "no files in upload", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"files": files})
+}
+
+// filesHandler serves PUT /files/<path>, storing the raw body as that
+// file, with -allow-upload and DELETE /files/<path> with -allow-delete.
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	upath := strings.TrimPrefix(r.URL.Path, "/files")
+	switch {
+	case r.Method == http.MethodPut && allowUpload:
+		putFile(w, r, upath)
+	case r.Method == http.MethodDelete && allowDelete:
+		deleteFile(w, r, upath)
+	default:
+		var allow []string
+		if allowUpload {
+			allow = append(allow, "PUT")
+		}
+		if allowDelete {
+			allow = append(allow, "DELETE")
+		}
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func putFile(w http.ResponseWriter, r *http.Request, upath string) {
+	full, rel, err := resolveNewPath(r, upath)
+	if err != nil {
+		writePathError(w, true, err)
+		return
+	}
+	want, err := wantedChecksums(r.Header)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, done, err := throttleUpload(r, rel)
+	if err != nil {
+		jsonError(w, "bad limit", http.StatusBadRequest)
+		return
+	}
+	defer done()
+	body := uploadBody(w, r)
+	if body == nil {
+		return
+	}
+	start := time.Now()
+	n, err := storeUpload(full, body, r.URL.Query().Get("overwrite") == "1", want)
+	logUpload(rel, n, start, r, err)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, uploadResult{Path: rel, URL: escapePath("/" + rel), Size: n, Limit: limit})
+}
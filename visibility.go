@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var showHidden bool
+var excludes stringList
+
+// excludeFold makes -exclude matching case-insensitive on platforms whose
+// filesystems are case-insensitive by default.
+var excludeFold = runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+
+const excludeUsage = `glob of root-relative paths to keep out of the share (repeatable).
+A pattern without "/" matches any single path element at any depth ("*.partial", "private").
+A pattern with "/" is anchored at the share root and matched element by element;
+"**" matches any number of directories ("incomplete/**/*.tmp").
+Matching a directory excludes everything below it.
+Case-insensitive on Windows and macOS, case-sensitive elsewhere.`
+
+// junkNames are OS and sync-tool droppings that are hidden along with
+// dotfiles. Keys are lower case.
+var junkNames = map[string]bool{
+	"thumbs.db":                 true,
+	"desktop.ini":               true,
+	"$recycle.bin":              true,
+	"system volume information": true,
+	"@eadir":                    true,
+	"lost+found":                true,
+}
+
+// tempName reports whether name is one of the files uploads and moves are
+// written to before they are renamed into place. Those stay hidden even
+// with -show-hidden, so nothing is served before it is complete.
+func tempName(name string) bool {
+	return (strings.HasPrefix(name, ".upload-") || strings.HasPrefix(name, ".move-")) && strings.HasSuffix(name, ".part")
+}
+
+// hiddenName reports whether a single path element is kept out of listings,
+// recursive scans and direct requests. .access files are hidden even with
+// -show-hidden.
+func hiddenName(name string) bool {
+	if tempName(name) || strings.EqualFold(name, accessFile) {
+		return true
+	}
+	if showHidden {
+		return false
+	}
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	return junkNames[strings.ToLower(name)]
+}
+
+// visible reports whether a root-relative slash-separated path may be
+// exposed. Every endpoint that lists, walks or serves files goes through it.
+func visible(rel string) bool {
+	var segs []string
+	for _, seg := range strings.Split(strings.Trim(rel, "/"), "/") {
+		if seg == "" || seg == "." {
+			continue
+		}
+		if hiddenName(seg) {
+			return false
+		}
+		segs = append(segs, seg)
+	}
+	return !excluded(segs)
+}
+
+func checkExcludes() error {
+	for _, pat := range excludes {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("bad -exclude pattern %q: %v", pat, err)
+		}
+	}
+	return nil
+}
+
+func excluded(segs []string) bool {
+	if len(excludes) == 0 || len(segs) == 0 {
+		return false
+	}
+	if excludeFold {
+		lower := make([]string, len(segs))
+		for i, seg := range segs {
+			lower[i] = strings.ToLower(seg)
+		}
+		segs = lower
+	}
+	for _, pat := range excludes {
+		if excludeFold {
+			pat = strings.ToLower(pat)
+		}
+		pat = strings.Trim(pat, "/")
+		if !strings.Contains(pat, "/") {
+			for _, seg := range segs {
+				if ok, _ := path.Match(pat, seg); ok {
+					return true
+				}
+			}
+			continue
+		}
+		if matchPrefix(strings.Split(pat, "/"), segs) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPrefix reports whether pat matches segs or one of its ancestors, so
+// that an excluded directory takes its subtree with it.
+func matchPrefix(pat, segs []string) bool {
+	if len(pat) == 0 {
+		return true
+	}
+	if pat[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if matchPrefix(pat[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pat[0], segs[0]); !ok {
+		return false
+	}
+	return matchPrefix(pat[1:], segs[1:])
+}
+
+// relPath converts a filesystem path under root into the slash-separated
+// form visible expects.
+func relPath(p string) string {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestExcluded(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"*.partial", "movie.partial", true},
+		{"*.partial", "Shows/S01/ep.partial", true},
+		{"*.partial", "movie.partial.mkv", false},
+		{"private", "private", true},
+		{"private", "private/a.mkv", true},
+		{"private", "Shows/private/a.mkv", true},
+		{"private", "privateer.mkv", false},
+		{"private/", "private/a.mkv", true},
+		{"incomplete-torrents/*", "incomplete-torrents/x.mkv", true},
+		{"incomplete-torrents/*", "incomplete-torrents", false},
+		{"incomplete-torrents/*", "Shows/incomplete-torrents/x.mkv", false},
+		{"Shows/*/extras", "Shows/Lost/extras/a.mkv", true},
+		{"Shows/*/extras", "Shows/Lost/S01/extras", false},
+		{"incomplete/**/*.tmp", "incomplete/a.tmp", true},
+		{"incomplete/**/*.tmp", "incomplete/x/y/a.tmp", true},
+		{"incomplete/**/*.tmp", "incomplete/x/y/a.mkv", false},
+		{"incomplete/**/*.tmp", "other/a.tmp", false},
+		{"**/samples", "a/b/samples/c.mkv", true},
+		{"**/samples", "samples", true},
+	}
+	old := excludes
+	defer func() { excludes = old }()
+	for _, tt := range tests {
+		excludes = stringList{tt.pattern}
+		if got := !visible(tt.path); got != tt.want {
+			t.Errorf("-exclude %q: excluded(%q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestExcludedCase(t *testing.T) {
+	old, oldFold := excludes, excludeFold
+	defer func() { excludes, excludeFold = old, oldFold }()
+	excludes = stringList{"Private/*.MKV"}
+	for _, fold := range []bool{false, true} {
+		excludeFold = fold
+		if visible("Private/a.MKV") {
+			t.Errorf("fold=%v: exact case not excluded", fold)
+		}
+	}
+	excludeFold = false
+	if !visible("private/a.mkv") {
+		t.Error("case-sensitive matching excluded private/a.mkv")
+	}
+	excludeFold = true
+	if visible("private/a.mkv") {
+		t.Error("case-insensitive matching did not exclude private/a.mkv")
+	}
+}
+
+func TestHiddenNames(t *testing.T) {
+	tests := []struct {
+		path       string
+		showHidden bool
+		want       bool
+	}{
+		{"Movies/film.mkv", false, true},
+		{".hidden", false, false},
+		{"Movies/.cache/x.mkv", false, false},
+		{"Thumbs.db", false, false},
+		{"Movies/@eaDir/a.jpg", false, false},
+		{"$RECYCLE.BIN/a", false, false},
+		{".hidden", true, true},
+		{"Thumbs.db", true, true},
+		{".access", true, false},
+		{"Movies/.ACCESS", true, false},
+		{"Movies/.upload-1234.part", true, false},
+	}
+	old := showHidden
+	defer func() { showHidden = old }()
+	for _, tt := range tests {
+		showHidden = tt.showHidden
+		if got := visible(tt.path); got != tt.want {
+			t.Errorf("show-hidden=%v: visible(%q) = %v, want %v", tt.showHidden, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCheckExcludes(t *testing.T) {
+	old := excludes
+	defer func() { excludes = old }()
+	excludes = stringList{"ok/*", "[bad"}
+	if err := checkExcludes(); err == nil {
+		t.Error("checkExcludes accepted [bad")
+	}
+}
+
+func TestExcludedPathsDisappear(t *testing.T) {
+	setupRoot(t, map[string]string{
+		"film.mkv":                   "film",
+		"film.partial":               "partial",
+		"private/secret.mkv":         "secret, and larger than the rest",
+		"incomplete-torrents/x.mkv":  "x",
+		"Shows/private/episode.mkv":  "episode",
+		"Shows/S01/episode 1.mkv":    "episode 1",
+		"Shows/S01/.episode.mkv.tmp": "temp",
+	})
+	excludes = stringList{"*.partial", "private", "incomplete-torrents/**"}
+
+	for dir, want := range map[string][]string{"/": {"Shows", "film.mkv"}, "/Shows/": {"S01"}, "/Shows/S01/": {"episode 1.mkv"}} {
+		w := serve(indexHandler, http.MethodGet, dir+"?format=json")
+		var lst dirListing
+		if err := json.Unmarshal([]byte(body(t, w)), &lst); err != nil {
+			t.Fatalf("%s: %v", dir, err)
+		}
+		var got []string
+		for _, e := range lst.Entries {
+			got = append(got, e.Name)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s lists %q, want %q", dir, got, want)
+		}
+	}
+	for _, p := range []string{"/film.partial", "/private/secret.mkv", "/private/", "/incomplete-torrents/x.mkv", "/Shows/private/episode.mkv", "/Shows/S01/.episode.mkv.tmp"} {
+		if w := serve(indexHandler, http.MethodGet, escapePath(p)); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", p, w.Code)
+		}
+	}
+	full, ok := speedTestFile(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/speedtest", nil), false)
+	if !ok || filepath.Base(full) != "episode 1.mkv" {
+		t.Errorf("speedtest picked %q, want the largest file not excluded", full)
+	}
+}